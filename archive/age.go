@@ -0,0 +1,100 @@
+package archive
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// 使用age加密的分片在格式扩展名后追加该后缀
+const EncryptedExt = ".age"
+
+// LoadRecipients 解析age公钥，keys为配置中直接填写的公钥，file为每行一个公钥的文件
+func LoadRecipients(keys []string, file string) ([]age.Recipient, error) {
+	recipients := make([]age.Recipient, 0, len(keys))
+	for _, key := range keys {
+		r, err := age.ParseX25519Recipient(strings.TrimSpace(key))
+		if err != nil {
+			return nil, fmt.Errorf("解析age公钥失败: %v", err)
+		}
+		recipients = append(recipients, r)
+	}
+
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, fmt.Errorf("打开age公钥文件失败: %v", err)
+		}
+		defer f.Close()
+
+		rs, err := age.ParseRecipients(f)
+		if err != nil {
+			return nil, fmt.Errorf("解析age公钥文件失败: %v", err)
+		}
+		recipients = append(recipients, rs...)
+	}
+
+	return recipients, nil
+}
+
+// LoadIdentities 从私钥文件中加载age私钥，用于还原和校验
+func LoadIdentities(file string) ([]age.Identity, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("打开age私钥文件失败: %v", err)
+	}
+	defer f.Close()
+
+	identities, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("解析age私钥文件失败: %v", err)
+	}
+	return identities, nil
+}
+
+// 读取时可用的全部身份，包括口令对应的scrypt身份
+func (o Options) identities() []age.Identity {
+	identities := o.Identities
+	if o.Passphrase != "" {
+		if id, err := age.NewScryptIdentity(o.Passphrase); err == nil {
+			identities = append(identities[:len(identities):len(identities)], id)
+		}
+	}
+	return identities
+}
+
+// 先关闭压缩包再关闭age加密流
+type encryptedWriter struct {
+	Writer
+	enc io.WriteCloser
+}
+
+func (w *encryptedWriter) Close() error {
+	if err := w.Writer.Close(); err != nil {
+		w.enc.Close()
+		return err
+	}
+	return w.enc.Close()
+}
+
+// 打开age加密的分片，返回解密后的数据流
+func openDecrypted(path string, identities []age.Identity) (io.Reader, *os.File, error) {
+	if len(identities) == 0 {
+		return nil, nil, fmt.Errorf("分片已使用age加密，需要提供私钥文件或口令: %s", path)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r, err := age.Decrypt(file, identities...)
+	if err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("解密分片失败: %v", err)
+	}
+	return r, file, nil
+}
@@ -0,0 +1,231 @@
+package archive
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+)
+
+// Format 压缩包格式
+type Format string
+
+const (
+	FormatZip    Format = "zip"     // 带AES密码的zip，兼容常见解压工具
+	FormatTarZst Format = "tar.zst" // tar+zstd，压缩率更高并保留Unix元数据
+)
+
+// 所有支持的格式，按扩展名匹配时依次尝试
+var formats = []Format{FormatZip, FormatTarZst}
+
+// Method 单个文件的压缩方式。zip格式使用的压缩库固定了deflate的级别，
+// 只区分Store和Deflate，配置固定级别时用SupportsMethod检查；tar.zst格式会切换对应的zstd级别
+type Method int
+
+const (
+	Deflate Method = iota // 压缩，使用默认级别
+	Store                 // 不压缩，直接存储
+	Fast                  // 快速压缩
+	Best                  // 最高压缩率
+)
+
+// ParseMethod 解析配置中的压缩级别名称
+func ParseMethod(s string) (Method, error) {
+	switch s {
+	case "default":
+		return Deflate, nil
+	case "store":
+		return Store, nil
+	case "fast":
+		return Fast, nil
+	case "best":
+		return Best, nil
+	}
+	return 0, fmt.Errorf("不支持的压缩级别: %s", s)
+}
+
+// Options 创建或读取压缩包的参数
+type Options struct {
+	Format        Format // 压缩包格式，默认zip
+	Password      string // zip格式的文件密码
+	ZstdLevel     int    // zstd压缩级别(1-22)，0使用默认级别
+	ZstdLongRange bool   // zstd长距离模式，使用更大的匹配窗口
+
+	Recipients []age.Recipient // 写入时使用age公钥加密整个分片
+	Identities []age.Identity  // 读取age加密的分片时使用的私钥
+
+	// 使用口令以age scrypt方式加密整个分片，文件名和目录结构也会被加密，
+	// 读取时也用于解密口令加密的分片。配置了Recipients时写入不使用口令
+	Passphrase string
+}
+
+// 写入时是否对整个分片加密
+func (o Options) encrypted() bool {
+	return len(o.Recipients) > 0 || o.Passphrase != ""
+}
+
+// Ext 返回分片文件的扩展名，使用age加密时追加.age
+func (o Options) Ext() string {
+	format := o.Format
+	if format == "" {
+		format = FormatZip
+	}
+	if o.encrypted() {
+		return format.Ext() + EncryptedExt
+	}
+	return format.Ext()
+}
+
+// Header 压缩包中单个文件的元数据
+type Header struct {
+	Name    string      // 压缩包内的路径，使用/分隔
+	Size    int64       // 原始大小
+	Mode    os.FileMode // 文件权限
+	ModTime time.Time   // 修改时间
+	Method  Method      // 压缩方式
+	Uid     int         // 属主，仅tar格式保留
+	Gid     int         // 属组，仅tar格式保留
+	Owner   bool        // Uid/Gid是否有效
+
+	// 可选，写入tar格式时用于保留完整的Unix元数据
+	Info os.FileInfo
+}
+
+// Writer 压缩包写入接口
+type Writer interface {
+	// Create 添加一个文件，返回的Writer需要在下一次Create或Close之前写完
+	Create(h *Header) (io.Writer, error)
+	Close() error
+}
+
+// Reader 压缩包读取接口
+type Reader interface {
+	// Walk 按写入顺序遍历所有文件，读取r到结束时会校验文件完整性
+	Walk(fn func(h *Header, r io.Reader) error) error
+	Close() error
+}
+
+// ParseFormat 解析配置中的格式名称，空字符串使用zip
+func ParseFormat(s string) (Format, error) {
+	if s == "" {
+		return FormatZip, nil
+	}
+	for _, f := range formats {
+		if string(f) == s {
+			return f, nil
+		}
+	}
+	return "", fmt.Errorf("不支持的压缩格式: %s", s)
+}
+
+// SupportsMethod 返回格式是否能区分该压缩方式，zip中Fast和Best会按Deflate写入
+func (f Format) SupportsMethod(m Method) bool {
+	if f == FormatZip {
+		return m == Deflate || m == Store
+	}
+	return true
+}
+
+// FixedSize 返回格式是否在文件内容之前写入大小，写入的内容必须与Header.Size一致
+func (f Format) FixedSize() bool {
+	return f == FormatTarZst
+}
+
+// Ext 返回分片文件的扩展名
+func (f Format) Ext() string {
+	return "." + string(f)
+}
+
+// FormatFromName 根据文件名的扩展名识别格式，忽略age加密后缀
+func FormatFromName(name string) (Format, bool) {
+	name = strings.TrimSuffix(name, EncryptedExt)
+	for _, f := range formats {
+		if strings.HasSuffix(name, f.Ext()) {
+			return f, true
+		}
+	}
+	return "", false
+}
+
+// TrimExt 去掉分片文件名中的格式扩展名和加密后缀
+func TrimExt(name string) string {
+	format, ok := FormatFromName(name)
+	if !ok {
+		return name
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(name, EncryptedExt), format.Ext())
+}
+
+// NewWriter 按格式创建压缩包写入器，配置了age公钥或口令时整个分片会被加密
+func NewWriter(w io.Writer, opts Options) (Writer, error) {
+	var enc io.WriteCloser
+	if opts.encrypted() {
+		recipients := opts.Recipients
+		if len(recipients) == 0 {
+			r, err := age.NewScryptRecipient(opts.Passphrase)
+			if err != nil {
+				return nil, fmt.Errorf("创建口令加密失败: %v", err)
+			}
+			recipients = []age.Recipient{r}
+		}
+
+		var err error
+		enc, err = age.Encrypt(w, recipients...)
+		if err != nil {
+			return nil, fmt.Errorf("创建age加密流失败: %v", err)
+		}
+		w = enc
+	}
+
+	var aw Writer
+	var err error
+	switch opts.Format {
+	case FormatZip, "":
+		aw = newZipWriter(w, opts)
+	case FormatTarZst:
+		aw, err = newTarZstWriter(w, opts)
+	default:
+		err = fmt.Errorf("不支持的压缩格式: %s", opts.Format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if enc != nil {
+		return &encryptedWriter{Writer: aw, enc: enc}, nil
+	}
+	return aw, nil
+}
+
+// OpenReader 打开压缩包，格式根据文件扩展名识别，.age后缀的分片使用opts中的私钥或口令解密
+func OpenReader(path string, opts Options) (Reader, error) {
+	format, ok := FormatFromName(path)
+	if !ok {
+		return nil, fmt.Errorf("无法识别的压缩包格式: %s", path)
+	}
+	encrypted := strings.HasSuffix(path, EncryptedExt)
+
+	switch format {
+	case FormatZip:
+		if encrypted {
+			return openEncryptedZipReader(path, opts)
+		}
+		return openZipReader(path, opts)
+	default:
+		if encrypted {
+			r, file, err := openDecrypted(path, opts.identities())
+			if err != nil {
+				return nil, err
+			}
+			return newTarZstReader(r, file)
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		return newTarZstReader(file, file)
+	}
+}
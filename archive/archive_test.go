@@ -0,0 +1,189 @@
+package archive
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+)
+
+func TestArchive_RoundTrip(t *testing.T) {
+	files := map[string][]byte{
+		"a.txt":     []byte("hello world"),
+		"dir/b.bin": bytes.Repeat([]byte{1, 2, 3}, 100000),
+	}
+	modTime := time.Date(2024, 1, 2, 3, 4, 6, 0, time.UTC) // zip的时间精度为2秒
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encryptions := map[string]func(o *Options){
+		"plain": func(o *Options) {},
+		"recipients": func(o *Options) {
+			o.Recipients = []age.Recipient{identity.Recipient()}
+			o.Identities = []age.Identity{identity}
+		},
+		"passphrase": func(o *Options) {
+			o.Passphrase = o.Password
+			o.Password = ""
+		},
+	}
+
+	for _, format := range formats {
+		for name, encrypt := range encryptions {
+			opts := Options{Format: format, Password: "secret", ZstdLevel: 3, ZstdLongRange: true}
+			encrypt(&opts)
+			t.Run(string(format)+"/"+name, func(t *testing.T) {
+				testRoundTrip(t, opts, files, modTime)
+			})
+		}
+	}
+}
+
+func testRoundTrip(t *testing.T, opts Options, files map[string][]byte, modTime time.Time) {
+	path := filepath.Join(t.TempDir(), "test"+opts.Ext())
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewWriter(f, opts)
+	if err != nil {
+		t.Fatalf("NewWriter() error = %v", err)
+	}
+	for name, data := range files {
+		fw, err := w.Create(&Header{Name: name, Size: int64(len(data)), Mode: 0640, ModTime: modTime})
+		if err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+		if _, err := fw.Write(data); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	f.Close()
+
+	// 整个分片加密时，文件名不能以明文出现
+	if opts.encrypted() {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(raw, []byte("dir/b.bin")) {
+			t.Errorf("加密后的分片中包含明文文件名")
+		}
+	}
+
+	r, err := OpenReader(path, opts)
+	if err != nil {
+		t.Fatalf("OpenReader() error = %v", err)
+	}
+	defer r.Close()
+
+	seen := 0
+	err = r.Walk(func(h *Header, rd io.Reader) error {
+		data, err := io.ReadAll(rd)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(data, files[h.Name]) {
+			t.Errorf("%s 内容不一致", h.Name)
+		}
+		if !h.ModTime.Equal(modTime) {
+			t.Errorf("%s 修改时间不一致: %v", h.Name, h.ModTime)
+		}
+		seen++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk() error = %v", err)
+	}
+	if seen != len(files) {
+		t.Fatalf("读取到%d个文件, 期望%d个", seen, len(files))
+	}
+}
+
+// 不同压缩方式的文件会切换zstd级别写入新的帧，读取时应当能连续解压
+func TestTarZst_MixedMethods(t *testing.T) {
+	random := make([]byte, 200*1024)
+	rand.New(rand.NewSource(1)).Read(random)
+	text := bytes.Repeat([]byte("log line 12345\n"), 20000)
+
+	entries := []struct {
+		name   string
+		method Method
+		data   []byte
+	}{
+		{"a.log", Best, text},
+		{"b.bin", Store, random},
+		{"small.txt", Fast, []byte("small")},
+		{"c.log", Deflate, text},
+		{"d.log", Best, text},
+	}
+
+	var buf bytes.Buffer
+	w, err := newTarZstWriter(&buf, Options{Format: FormatTarZst, ZstdLevel: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		fw, err := w.Create(&Header{Name: e.name, Size: int64(len(e.data)), Mode: 0644, Method: e.method})
+		if err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+		if _, err := fw.Write(e.data); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	r, err := newTarZstReader(&buf, io.NopCloser(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	i := 0
+	err = r.Walk(func(h *Header, rd io.Reader) error {
+		data, err := io.ReadAll(rd)
+		if err != nil {
+			return err
+		}
+		if h.Name != entries[i].name || !bytes.Equal(data, entries[i].data) {
+			t.Errorf("第%d个文件不一致: %s", i, h.Name)
+		}
+		i++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk() error = %v", err)
+	}
+	if i != len(entries) {
+		t.Fatalf("读取到%d个文件, 期望%d个", i, len(entries))
+	}
+}
+
+func TestFormat_SupportsMethod(t *testing.T) {
+	for _, m := range []Method{Deflate, Store, Fast, Best} {
+		if !FormatTarZst.SupportsMethod(m) {
+			t.Errorf("tar.zst should support method %d", m)
+		}
+	}
+	if !FormatZip.SupportsMethod(Store) || !FormatZip.SupportsMethod(Deflate) {
+		t.Error("zip should support Store and Deflate")
+	}
+	if FormatZip.SupportsMethod(Fast) || FormatZip.SupportsMethod(Best) {
+		t.Error("zip cannot distinguish Fast and Best from Deflate")
+	}
+}
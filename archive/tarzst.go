@@ -0,0 +1,200 @@
+package archive
+
+import (
+	"archive/tar"
+	"bufio"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// 长距离模式使用的匹配窗口大小
+	zstdLongWindowSize = 128 * 1024 * 1024
+	// 读取时允许的最大窗口，需要覆盖长距离模式
+	zstdMaxDecoderWindow = 1 << 30
+)
+
+// 达到该大小的文件才单独切换压缩级别，小文件沿用当前级别，避免频繁结束zstd帧影响压缩率
+const zstdSwitchMinSize = 64 * 1024
+
+type tarZstWriter struct {
+	out      io.Writer
+	opts     []zstd.EOption
+	level    zstd.EncoderLevel // 默认压缩级别
+	encoders map[zstd.EncoderLevel]*zstd.Encoder
+	zw       *zstd.Encoder // 当前使用的编码器
+	zwLevel  zstd.EncoderLevel
+	tw       *tar.Writer
+}
+
+func newTarZstWriter(w io.Writer, opts Options) (*tarZstWriter, error) {
+	level := zstd.SpeedDefault
+	if opts.ZstdLevel > 0 {
+		level = zstd.EncoderLevelFromZstd(opts.ZstdLevel)
+	}
+	encOpts := []zstd.EOption{}
+	if opts.ZstdLongRange {
+		encOpts = append(encOpts, zstd.WithWindowSize(zstdLongWindowSize))
+	}
+
+	tw := &tarZstWriter{
+		out:      w,
+		opts:     encOpts,
+		level:    level,
+		encoders: make(map[zstd.EncoderLevel]*zstd.Encoder),
+	}
+	zw, err := tw.encoder(level)
+	if err != nil {
+		return nil, err
+	}
+	tw.zw, tw.zwLevel = zw, level
+	tw.tw = tar.NewWriter(writerFunc(func(p []byte) (int, error) {
+		return tw.zw.Write(p)
+	}))
+	return tw, nil
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+// 返回指定级别的编码器，同一级别的编码器会被复用
+func (w *tarZstWriter) encoder(level zstd.EncoderLevel) (*zstd.Encoder, error) {
+	if zw, ok := w.encoders[level]; ok {
+		zw.Reset(w.out)
+		return zw, nil
+	}
+	zw, err := zstd.NewWriter(w.out, append(w.opts, zstd.WithEncoderLevel(level))...)
+	if err != nil {
+		return nil, err
+	}
+	w.encoders[level] = zw
+	return zw, nil
+}
+
+// 文件压缩方式对应的zstd级别
+func (w *tarZstWriter) levelFor(m Method) zstd.EncoderLevel {
+	switch m {
+	case Store, Fast:
+		// zstd遇到无法压缩的块会直接存储，最快的级别开销很小
+		return zstd.SpeedFastest
+	case Best:
+		return max(w.level, zstd.SpeedBestCompression)
+	}
+	return w.level
+}
+
+// 切换压缩级别：结束当前的zstd帧，之后的数据写入新的帧，多个帧连接后仍是合法的zstd流
+func (w *tarZstWriter) switchLevel(level zstd.EncoderLevel) error {
+	if level == w.zwLevel {
+		return nil
+	}
+	// 先写入上一个文件的tar填充
+	if err := w.tw.Flush(); err != nil {
+		return err
+	}
+	if err := w.zw.Close(); err != nil {
+		return err
+	}
+	zw, err := w.encoder(level)
+	if err != nil {
+		return err
+	}
+	w.zw, w.zwLevel = zw, level
+	return nil
+}
+
+func (w *tarZstWriter) Create(h *Header) (io.Writer, error) {
+	var header *tar.Header
+	if h.Info != nil {
+		th, err := tar.FileInfoHeader(h.Info, "")
+		if err != nil {
+			return nil, err
+		}
+		header = th
+	} else {
+		header = &tar.Header{
+			Typeflag: tar.TypeReg,
+			Mode:     int64(h.Mode.Perm()),
+		}
+		if h.Mode.IsDir() {
+			header.Typeflag = tar.TypeDir
+		}
+		if h.Owner {
+			header.Uid = h.Uid
+			header.Gid = h.Gid
+		}
+	}
+
+	header.Name = h.Name
+	header.Size = h.Size
+	header.ModTime = h.ModTime
+	header.Format = tar.FormatPAX
+
+	if h.Size >= zstdSwitchMinSize {
+		if err := w.switchLevel(w.levelFor(h.Method)); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.tw.WriteHeader(header); err != nil {
+		return nil, err
+	}
+	return w.tw, nil
+}
+
+func (w *tarZstWriter) Close() error {
+	if err := w.tw.Close(); err != nil {
+		w.zw.Close()
+		return err
+	}
+	return w.zw.Close()
+}
+
+type tarZstReader struct {
+	closer io.Closer
+	zr     *zstd.Decoder
+}
+
+func newTarZstReader(r io.Reader, closer io.Closer) (*tarZstReader, error) {
+	zr, err := zstd.NewReader(bufio.NewReader(r), zstd.WithDecoderMaxWindow(zstdMaxDecoderWindow))
+	if err != nil {
+		closer.Close()
+		return nil, err
+	}
+
+	return &tarZstReader{closer: closer, zr: zr}, nil
+}
+
+func (r *tarZstReader) Walk(fn func(h *Header, rd io.Reader) error) error {
+	tr := tar.NewReader(r.zr)
+	for {
+		th, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		h := &Header{
+			Name:    th.Name,
+			Size:    th.Size,
+			Mode:    th.FileInfo().Mode(),
+			ModTime: th.ModTime,
+			Uid:     th.Uid,
+			Gid:     th.Gid,
+			Owner:   true,
+		}
+		if err := fn(h, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func (r *tarZstReader) Close() error {
+	r.zr.Close()
+	return r.closer.Close()
+}
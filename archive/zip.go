@@ -0,0 +1,142 @@
+package archive
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/alexmullins/zip"
+)
+
+type zipWriter struct {
+	zw       *zip.Writer
+	password string
+}
+
+func newZipWriter(w io.Writer, opts Options) *zipWriter {
+	return &zipWriter{
+		zw:       zip.NewWriter(w),
+		password: opts.Password,
+	}
+}
+
+func (w *zipWriter) Create(h *Header) (io.Writer, error) {
+	var header *zip.FileHeader
+	if h.Info != nil {
+		fh, err := zip.FileInfoHeader(h.Info)
+		if err != nil {
+			return nil, err
+		}
+		header = fh
+	} else {
+		header = &zip.FileHeader{}
+		header.SetMode(h.Mode)
+	}
+
+	header.Name = h.Name
+	header.SetModTime(h.ModTime)
+
+	header.Method = zip.Deflate
+	if h.Method == Store {
+		header.Method = zip.Store
+	}
+	if w.password != "" {
+		header.SetPassword(w.password)
+	}
+
+	return w.zw.CreateHeader(header)
+}
+
+func (w *zipWriter) Close() error {
+	return w.zw.Close()
+}
+
+type zipReader struct {
+	zr       *zip.ReadCloser
+	password string
+	tmpPath  string // 解密后的临时文件，关闭时删除
+}
+
+func openZipReader(path string, opts Options) (*zipReader, error) {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	return &zipReader{zr: zr, password: opts.Password}, nil
+}
+
+// zip需要随机读取，先把age加密的分片解密到同目录的临时文件
+func openEncryptedZipReader(path string, opts Options) (*zipReader, error) {
+	r, file, err := openDecrypted(path, opts.identities())
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".decrypt-*.zip")
+	if err != nil {
+		return nil, fmt.Errorf("创建临时文件失败: %v", err)
+	}
+	_, err = io.Copy(tmp, r)
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("解密分片失败: %v", err)
+	}
+
+	zr, err := openZipReader(tmp.Name(), opts)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	zr.tmpPath = tmp.Name()
+	return zr, nil
+}
+
+func (r *zipReader) Walk(fn func(h *Header, rd io.Reader) error) error {
+	for _, file := range r.zr.File {
+		if file.IsEncrypted() {
+			file.SetPassword(r.password)
+		}
+
+		h := &Header{
+			Name:    file.Name,
+			Size:    int64(file.UncompressedSize64),
+			Mode:    file.Mode(),
+			ModTime: file.ModTime(),
+		}
+
+		if file.FileInfo().IsDir() {
+			if err := fn(h, eofReader{}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		rc, err := file.Open()
+		if err != nil {
+			return err
+		}
+		err = fn(h, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *zipReader) Close() error {
+	err := r.zr.Close()
+	if r.tmpPath != "" {
+		os.Remove(r.tmpPath)
+	}
+	return err
+}
+
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
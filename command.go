@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"golang.org/x/crypto/bcrypt"
+
+	"auto-backup/archive"
+	"auto-backup/config"
+	"auto-backup/db"
+	"auto-backup/service"
+	"auto-backup/uploader"
+)
+
+// 执行命令行子命令
+func runCommand(cfg *config.Config, store uploader.Uploader, args []string) error {
+	switch args[0] {
+	case "verify":
+		return runVerify(cfg, store, args[1:])
+	case "restore":
+		return runRestore(cfg, store, args[1:])
+	case "pause":
+		return runJobControl(cfg, args[0], service.PauseJob, args[1:])
+	case "resume":
+		return runJobControl(cfg, args[0], service.ResumeJob, args[1:])
+	case "cancel":
+		return runJobControl(cfg, args[0], service.CancelJob, args[1:])
+	case "hash-password":
+		return runHashPassword()
+	default:
+		return fmt.Errorf("未知命令: %s", args[0])
+	}
+}
+
+// verify 校验备份是否可以完整还原
+func runVerify(cfg *config.Config, store uploader.Uploader, args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	backupID := fs.String("id", filepath.Base(cfg.Backup.RootDir), "备份ID")
+	timestamp := fs.String("timestamp", "", "要校验的备份时间，默认最近一次成功的备份")
+	identity := fs.String("identity", "", "age私钥文件，校验age加密的分片时需要")
+	fs.Parse(args)
+
+	identities, err := loadIdentities(*identity)
+	if err != nil {
+		return err
+	}
+
+	mode, err := service.ParseMode(cfg.Backup.Mode)
+	if err != nil {
+		return err
+	}
+
+	verifyInfo := service.VerifyInfo{
+		ZipDir:    cfg.Backup.OutputDir,
+		Password:  cfg.Backup.Password,
+		BackupID:  *backupID,
+		Timestamp: *timestamp,
+		BasePath:  cfg.OneDrive.BasePath,
+		Uploader:  store,
+		Mode:      mode,
+
+		Identities: identities,
+	}
+
+	report, err := verifyInfo.Verify()
+	if err != nil {
+		return err
+	}
+
+	if report.Status != db.VerifyStatusPass {
+		return fmt.Errorf("备份校验未通过, 失败%d个", report.Failed)
+	}
+
+	return nil
+}
+
+// restore 从本地分片或仓库还原备份
+func runRestore(cfg *config.Config, store uploader.Uploader, args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	backupID := fs.String("id", filepath.Base(cfg.Backup.RootDir), "备份ID")
+	timestamp := fs.String("timestamp", "", "要还原的备份时间，为空时列出所有可用的备份")
+	zipDir := fs.String("dir", cfg.Backup.OutputDir, "分片所在目录")
+	outputDir := fs.String("output", "", "还原的目标目录")
+	identity := fs.String("identity", "", "age私钥文件，还原age加密的分片时需要")
+	chain := fs.Bool("chain", false, "依次还原指定时间及之前的所有备份，还原增量备份和文件差异时使用")
+	fs.Parse(args)
+
+	if *outputDir == "" && *timestamp != "" {
+		return fmt.Errorf("请使用 -output 指定还原的目标目录")
+	}
+
+	identities, err := loadIdentities(*identity)
+	if err != nil {
+		return err
+	}
+
+	mode, err := service.ParseMode(cfg.Backup.Mode)
+	if err != nil {
+		return err
+	}
+
+	restoreInfo := service.RestoreInfo{
+		ZipDir:     *zipDir,
+		OutputDir:  *outputDir,
+		Password:   cfg.Backup.Password,
+		BackupID:   *backupID,
+		Timestamp:  *timestamp,
+		Chain:      *chain,
+		Identities: identities,
+		Mode:       mode,
+		BasePath:   cfg.OneDrive.BasePath,
+		Uploader:   store,
+	}
+
+	return restoreInfo.Restore()
+}
+
+// pause/resume/cancel 修改任务的控制状态，由运行备份的进程在几秒内执行
+func runJobControl(cfg *config.Config, name string, action func(string) error, args []string) error {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	backupID := fs.String("id", filepath.Base(cfg.Backup.RootDir), "备份ID")
+	fs.Parse(args)
+
+	if *backupID != filepath.Base(cfg.Backup.RootDir) {
+		return fmt.Errorf("任务不存在: %s", *backupID)
+	}
+	return action(*backupID)
+}
+
+// hash-password 从标准输入读取一行密码，输出用于server.users的bcrypt哈希
+func runHashPassword() error {
+	fmt.Fprint(os.Stderr, "请输入密码: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return fmt.Errorf("读取密码失败: %v", err)
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return fmt.Errorf("密码不能为空")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("生成密码哈希失败: %v", err)
+	}
+	fmt.Println(string(hash))
+	return nil
+}
+
+// 加载age私钥文件，未指定时返回空
+func loadIdentities(path string) ([]age.Identity, error) {
+	if path == "" {
+		return nil, nil
+	}
+	return archive.LoadIdentities(path)
+}
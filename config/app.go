@@ -15,6 +15,8 @@ type OneDrive struct {
 	Scope        string `yaml:"scope"`
 	RedirectURI  string `yaml:"redirect_uri"`
 	BasePath     string `yaml:"base_path"`
+	// 认证方式: code(浏览器跳转到redirect_uri回调) 或 device(输入设备代码，不需要回调)
+	AuthFlow string `yaml:"auth_flow"`
 }
 
 type Log struct {
@@ -31,12 +33,75 @@ type Backup struct {
 	Password        string `yaml:"password"`
 	ForceFullBackup bool   `yaml:"force_full_backup"`
 	Cron            string `yaml:"cron"`
+	StartupRun      string `yaml:"startup_run"`     // 启动时的备份策略: missed(只补错过的备份)、always 或 never
+	Format          string `yaml:"format"`          // 压缩格式: zip 或 tar.zst
+	ZstdLevel       int    `yaml:"zstd_level"`      // tar.zst压缩级别(1-22)
+	ZstdLongRange   bool   `yaml:"zstd_long_range"` // tar.zst是否开启长距离模式
+	// 压缩级别: auto(按文件内容自动选择) 或 store/fast/default/best
+	CompressionLevel string `yaml:"compression_level"`
+
+	AgeRecipients     []string `yaml:"age_recipients"`      // age公钥，配置后使用age加密分片
+	AgeRecipientsFile string   `yaml:"age_recipients_file"` // age公钥文件，每行一个公钥
+	EncryptNames      bool     `yaml:"encrypt_names"`       // 使用密码加密整个分片，包括文件名和目录结构
+
+	Mode        string `yaml:"mode"`         // 存储模式: archive(压缩包分片) 或 repository(分块去重仓库)
+	DeltaBackup bool   `yaml:"delta_backup"` // 大文件变化时只备份二进制差异
+	PartSize    int64  `yaml:"part_size"`    // 每个分片的最大大小(MB)，超过的文件会被拆分，默认1024
+	// 分片边压缩边分块上传到OneDrive，本地不保存分片文件，适合磁盘较小的主机。
+	// 每块是一个单独的远端文件，需要拼接后才是完整的分片
+	StreamUpload bool `yaml:"stream_upload"`
+	// 为每个分片生成的Reed-Solomon恢复数据比例(%)，0不生成
+	ParityRedundancy int `yaml:"parity_redundancy"`
+
+	Watch         bool `yaml:"watch"`           // 监听源目录，文件变化后自动备份变化的文件
+	WatchDebounce int  `yaml:"watch_debounce"`  // 最后一次变化后等待的秒数，默认30
+	WatchMaxDelay int  `yaml:"watch_max_delay"` // 持续变化时第一次变化后最长等待的秒数，默认600
+
+	// SQLite数据库的读取方式: auto(按文件头识别)、paths(只处理sqlite_paths中的文件) 或 off
+	SQLiteCapture string   `yaml:"sqlite_capture"`
+	SQLitePaths   []string `yaml:"sqlite_paths"` // 需要在线备份的SQLite文件，相对于root_dir的匹配规则
+
+	Hooks Hooks `yaml:"hooks"` // 备份前后执行的命令
+
+	CommandSources []CommandSource `yaml:"command_sources"` // 内容来自命令标准输出的虚拟文件
+	// 文件在读取过程中被修改时重新压缩的次数，默认3，小于0不重新压缩
+	ModifiedRetries int `yaml:"modified_retries"`
+}
+
+// 命令源，命令的标准输出作为一个文件写入压缩包
+type CommandSource struct {
+	Name    string `yaml:"name"`    // 在压缩包中的相对路径
+	Command string `yaml:"command"` // 使用sh -c执行的命令
+	Timeout int    `yaml:"timeout"` // 超时秒数，0不限制
+}
+
+// 备份前后执行的命令，使用sh -c执行
+type Hooks struct {
+	PreBackup         string `yaml:"pre_backup"`           // 读取源目录之前执行
+	PostBackup        string `yaml:"post_backup"`          // 备份结束后执行，无论成功或失败
+	OnSuccess         string `yaml:"on_success"`           // 备份成功后执行
+	OnFailure         string `yaml:"on_failure"`           // 备份失败后执行
+	Timeout           int    `yaml:"timeout"`              // 每个命令的超时秒数，默认300
+	AbortOnPreFailure bool   `yaml:"abort_on_pre_failure"` // 前置命令失败时中止备份
+	SkipOnWatch       bool   `yaml:"skip_on_watch"`        // watch触发的备份不执行命令，默认执行
+}
+
+// 内置HTTP服务，提供授权回调、管理接口和管理页面
+type Server struct {
+	Listen  string `yaml:"listen"`   // 监听地址，例如 ":8080" 或 "127.0.0.1:8080"，默认"127.0.0.1:8080"
+	TLSCert string `yaml:"tls_cert"` // TLS证书文件，和tls_key同时配置时使用HTTPS
+	TLSKey  string `yaml:"tls_key"`  // TLS私钥文件
+	// 管理接口的访问令牌，请求头 Authorization: Bearer <令牌>
+	Tokens []string `yaml:"tokens"`
+	// Basic认证的用户名和bcrypt密码哈希，可以使用 ./auto-backup hash-password 生成
+	Users map[string]string `yaml:"users"`
 }
 
 type Config struct {
 	OneDrive OneDrive `yaml:"onedrive"`
 	Log      Log      `yaml:"log"`
 	Backup   Backup   `yaml:"backup"`
+	Server   Server   `yaml:"server"`
 }
 
 // 加载完整配置
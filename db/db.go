@@ -3,6 +3,7 @@ package db
 import (
 	"database/sql"
 	"log"
+	"path/filepath"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -10,11 +11,19 @@ import (
 var db *sql.DB
 
 // 当前数据库架构版本
-const CurrentSchemaVersion = 2
+const CurrentSchemaVersion = 8
+
+// 数据库所在目录，任务锁文件也放在该目录下
+const dataDir = "./config"
+
+// LockPath 返回锁文件的路径，使用同一个数据库的进程通过该文件协调对同一任务的写入
+func LockPath(name string) string {
+	return filepath.Join(dataDir, name+".lock")
+}
 
 func InitDB() {
 	var err error
-	db, err = sql.Open("sqlite3", "./config/backup.db")
+	db, err = sql.Open("sqlite3", filepath.Join(dataDir, "backup.db"))
 
 	if err != nil {
 		panic(err)
@@ -42,6 +51,36 @@ func InitDB() {
 	if err != nil {
 		panic(err)
 	}
+
+	err = createAuthAttemptTable()
+	if err != nil {
+		panic(err)
+	}
+
+	err = createBackupRunTables()
+	if err != nil {
+		panic(err)
+	}
+
+	err = createRepositoryTables()
+	if err != nil {
+		panic(err)
+	}
+
+	err = createFileSignatureTable()
+	if err != nil {
+		panic(err)
+	}
+
+	err = createJobStateTable()
+	if err != nil {
+		panic(err)
+	}
+
+	err = createStreamChunkTable()
+	if err != nil {
+		panic(err)
+	}
 }
 
 // CloseDB 关闭数据库连接
@@ -163,8 +202,52 @@ func applyUpgradeScript(tx *sql.Tx, version int) error {
 		return nil
 	// 添加更多版本升级脚本
 	case 3:
-		// 版本3的升级脚本
-		// ...
+		// 版本3：添加uploaded字段到backup_parts表
+		_, err := tx.Exec(`ALTER TABLE backup_parts ADD COLUMN uploaded INTEGER DEFAULT 0`)
+		if err != nil {
+			log.Printf("添加uploaded列时出现错误(可能列已存在): %v", err)
+			return nil
+		}
+		return nil
+	case 4:
+		// 版本4：添加chunks字段到backup_parts表，记录流式上传的分块数量
+		_, err := tx.Exec(`ALTER TABLE backup_parts ADD COLUMN chunks INTEGER DEFAULT 0`)
+		if err != nil {
+			log.Printf("添加chunks列时出现错误(可能列已存在): %v", err)
+			return nil
+		}
+		return nil
+	case 5:
+		// 版本5：记录备份过程中仍在变化的文件，backup_runs记录数量，backup_entries标记具体的目录项
+		_, err := tx.Exec(`ALTER TABLE backup_runs ADD COLUMN inconsistent INTEGER DEFAULT 0`)
+		if err != nil {
+			log.Printf("添加inconsistent列时出现错误(可能列已存在): %v", err)
+		}
+		_, err = tx.Exec(`ALTER TABLE backup_entries ADD COLUMN inconsistent INTEGER DEFAULT 0`)
+		if err != nil {
+			log.Printf("添加inconsistent列时出现错误(可能列已存在): %v", err)
+		}
+		return nil
+	case 6:
+		// 版本6：job_state记录任务的控制状态(暂停、取消)，重启后仍然有效
+		_, err := tx.Exec(`ALTER TABLE job_state ADD COLUMN control TEXT DEFAULT ''`)
+		if err != nil {
+			log.Printf("添加control列时出现错误(可能列已存在): %v", err)
+		}
+		return nil
+	case 7:
+		// 版本7：backup_runs保存每次运行期间输出的日志，供管理接口查看
+		_, err := tx.Exec(`ALTER TABLE backup_runs ADD COLUMN log TEXT DEFAULT ''`)
+		if err != nil {
+			log.Printf("添加log列时出现错误(可能列已存在): %v", err)
+		}
+		return nil
+	case 8:
+		// 版本8：backup_entries标记执行失败的命令源已经写入的片段
+		_, err := tx.Exec(`ALTER TABLE backup_entries ADD COLUMN invalid INTEGER DEFAULT 0`)
+		if err != nil {
+			log.Printf("添加invalid列时出现错误(可能列已存在): %v", err)
+		}
 		return nil
 	default:
 		log.Printf("没有找到版本 %d 的升级脚本", version)
@@ -194,3 +277,163 @@ func createAuthInfoTable() error {
     )`)
 	return err
 }
+
+// 创建OneDrive授权请求表，保存每次授权的state和PKCE校验码
+func createAuthAttemptTable() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS auth_attempts (
+        state TEXT PRIMARY KEY,
+        verifier TEXT,
+        created_at DATETIME
+    )`)
+	return err
+}
+
+// 创建备份运行、分片、目录项以及校验报告表
+func createBackupRunTables() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS backup_runs (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        backup_id TEXT,
+        timestamp TEXT,
+        full INTEGER,
+        status TEXT,
+        file_count INTEGER DEFAULT 0,
+        total_size INTEGER DEFAULT 0,
+        error TEXT,
+        started_at DATETIME,
+        finished_at DATETIME,
+        inconsistent INTEGER DEFAULT 0,
+        log TEXT DEFAULT ''
+    )`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS backup_parts (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        run_id INTEGER,
+        part_num INTEGER,
+        name TEXT,
+        size INTEGER,
+        uploaded INTEGER DEFAULT 0,
+        chunks INTEGER DEFAULT 0
+    )`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS backup_entries (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        run_id INTEGER,
+        part_num INTEGER,
+        path TEXT,
+        size INTEGER,
+        hash TEXT,
+        mod_time DATETIME,
+        inconsistent INTEGER DEFAULT 0,
+        invalid INTEGER DEFAULT 0
+    )`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_backup_entries_run ON backup_entries (run_id)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS verify_reports (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        run_id INTEGER,
+        status TEXT,
+        checked INTEGER,
+        failed INTEGER,
+        detail TEXT,
+        started_at DATETIME,
+        finished_at DATETIME
+    )`)
+	return err
+}
+
+// 创建去重仓库的配置、数据包、数据块索引和快照表
+func createRepositoryTables() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS repo_config (
+        remote TEXT PRIMARY KEY,
+        config TEXT
+    )`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS repo_packs (
+        id TEXT PRIMARY KEY,
+        size INTEGER,
+        uploaded INTEGER DEFAULT 0,
+        created_at DATETIME
+    )`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS repo_chunks (
+        id TEXT PRIMARY KEY,
+        pack_id TEXT,
+        offset INTEGER,
+        length INTEGER,
+        raw_size INTEGER
+    )`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS repo_snapshots (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        backup_id TEXT,
+        timestamp TEXT,
+        run_id INTEGER,
+        file_count INTEGER DEFAULT 0,
+        total_size INTEGER DEFAULT 0,
+        new_size INTEGER DEFAULT 0,
+        created_at DATETIME
+    )`)
+	return err
+}
+
+// 创建大文件分块签名表
+func createFileSignatureTable() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS file_signatures (
+        backup_id TEXT,
+        path TEXT,
+        block_size INTEGER,
+        size INTEGER,
+        hash TEXT,
+        blocks BLOB,
+        updated_at DATETIME,
+        PRIMARY KEY (backup_id, path)
+    )`)
+	return err
+}
+
+// 创建备份任务调度状态表
+func createJobStateTable() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS job_state (
+        backup_id TEXT PRIMARY KEY,
+        last_run_at DATETIME,
+        last_status TEXT,
+        last_error TEXT,
+        last_success_at DATETIME,
+        control TEXT DEFAULT ''
+    )`)
+	return err
+}
+
+// 创建流式上传分块表，记录还没有归属到已完成分片的远端分块
+func createStreamChunkTable() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS stream_chunks (
+        backup_id TEXT,
+        folder TEXT,
+        name TEXT,
+        created_at DATETIME,
+        PRIMARY KEY (folder, name)
+    )`)
+	return err
+}
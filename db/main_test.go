@@ -0,0 +1,27 @@
+package db
+
+import (
+	"os"
+	"testing"
+)
+
+// 数据库位于工作目录下的config目录，测试在临时目录中运行
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "auto-backup-db-")
+	if err != nil {
+		panic(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		panic(err)
+	}
+	if err := os.Mkdir(dataDir, 0755); err != nil {
+		panic(err)
+	}
+	InitDB()
+
+	code := m.Run()
+
+	CloseDB()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
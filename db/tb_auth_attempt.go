@@ -0,0 +1,57 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// 一次OneDrive授权请求，回调时按state找到对应的PKCE校验码
+type AuthAttempt struct {
+	State     string    `db:"state"`      // 授权地址中的state，回调时原样返回
+	Verifier  string    `db:"verifier"`   // PKCE校验码，换取令牌时使用
+	CreatedAt time.Time `db:"created_at"` // 创建时间，过期的请求不再接受
+}
+
+// 保存授权请求
+func SaveAuthAttempt(a *AuthAttempt) error {
+	query := `INSERT INTO auth_attempts (state, verifier, created_at) VALUES (?, ?, ?)`
+	_, err := db.Exec(query, a.State, a.Verifier, a.CreatedAt)
+	return err
+}
+
+// 取出并删除授权请求，每个state只能使用一次，不存在或在since之前创建时返回nil
+func TakeAuthAttempt(state string, since time.Time) (*AuthAttempt, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	a := &AuthAttempt{}
+	err = tx.QueryRow(`SELECT state, verifier, created_at FROM auth_attempts WHERE state = ?`, state).
+		Scan(&a.State, &a.Verifier, &a.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM auth_attempts WHERE state = ?`, state); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	if a.CreatedAt.Before(since) {
+		return nil, nil
+	}
+	return a, nil
+}
+
+// 删除before之前创建的授权请求
+func DeleteExpiredAuthAttempts(before time.Time) error {
+	_, err := db.Exec(`DELETE FROM auth_attempts WHERE created_at < ?`, before)
+	return err
+}
@@ -0,0 +1,74 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTakeAuthAttempt_OneTimeUse(t *testing.T) {
+	now := time.Now()
+	if err := SaveAuthAttempt(&AuthAttempt{State: "state-once", Verifier: "verifier", CreatedAt: now}); err != nil {
+		t.Fatalf("SaveAuthAttempt() error = %v", err)
+	}
+
+	a, err := TakeAuthAttempt("state-once", now.Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("TakeAuthAttempt() error = %v", err)
+	}
+	if a == nil || a.Verifier != "verifier" {
+		t.Fatalf("TakeAuthAttempt() = %+v, want saved attempt", a)
+	}
+
+	// 同一个state不能再次使用
+	a, err = TakeAuthAttempt("state-once", now.Add(-time.Hour))
+	if err != nil || a != nil {
+		t.Fatalf("second TakeAuthAttempt() = %+v, %v, want nil", a, err)
+	}
+}
+
+func TestTakeAuthAttempt_Unknown(t *testing.T) {
+	a, err := TakeAuthAttempt("state-unknown", time.Now().Add(-time.Hour))
+	if err != nil || a != nil {
+		t.Fatalf("TakeAuthAttempt() = %+v, %v, want nil", a, err)
+	}
+}
+
+func TestTakeAuthAttempt_Expired(t *testing.T) {
+	created := time.Now().Add(-2 * time.Hour)
+	if err := SaveAuthAttempt(&AuthAttempt{State: "state-expired", Verifier: "verifier", CreatedAt: created}); err != nil {
+		t.Fatalf("SaveAuthAttempt() error = %v", err)
+	}
+
+	a, err := TakeAuthAttempt("state-expired", time.Now().Add(-time.Hour))
+	if err != nil || a != nil {
+		t.Fatalf("TakeAuthAttempt() = %+v, %v, want nil for expired attempt", a, err)
+	}
+	// 过期的请求取出时也会被删除
+	a, err = TakeAuthAttempt("state-expired", created.Add(-time.Hour))
+	if err != nil || a != nil {
+		t.Fatalf("TakeAuthAttempt() after expiry = %+v, %v, want nil", a, err)
+	}
+}
+
+func TestDeleteExpiredAuthAttempts(t *testing.T) {
+	now := time.Now()
+	for state, created := range map[string]time.Time{
+		"state-old": now.Add(-2 * time.Hour),
+		"state-new": now,
+	} {
+		if err := SaveAuthAttempt(&AuthAttempt{State: state, Verifier: "verifier", CreatedAt: created}); err != nil {
+			t.Fatalf("SaveAuthAttempt() error = %v", err)
+		}
+	}
+
+	if err := DeleteExpiredAuthAttempts(now.Add(-time.Hour)); err != nil {
+		t.Fatalf("DeleteExpiredAuthAttempts() error = %v", err)
+	}
+	since := now.Add(-3 * time.Hour)
+	if a, _ := TakeAuthAttempt("state-old", since); a != nil {
+		t.Error("expired attempt was not deleted")
+	}
+	if a, _ := TakeAuthAttempt("state-new", since); a == nil {
+		t.Error("recent attempt was deleted")
+	}
+}
@@ -0,0 +1,86 @@
+package db
+
+import "time"
+
+// 备份目录项结构，记录每次备份中每个文件所在的分片和内容哈希
+type BackupEntry struct {
+	ID      int64     `db:"id"`       // 自增ID
+	RunID   int64     `db:"run_id"`   // 所属备份运行ID
+	PartNum int       `db:"part_num"` // 所在分片序号
+	Path    string    `db:"path"`     // 压缩包内的路径
+	Size    int64     `db:"size"`     // 原始文件大小
+	Hash    string    `db:"hash"`     // 原始内容的SHA256
+	ModTime time.Time `db:"mod_time"` // 文件修改时间
+	// 读取过程中文件的大小或修改时间发生了变化，内容可能不完整
+	Inconsistent bool `db:"inconsistent"`
+	// 命令源执行失败，已经写入压缩包的片段无效，还原时只会留下临时文件
+	Invalid bool `db:"invalid"`
+}
+
+// 批量保存目录项（使用事务和预处理语句）
+func BatchSaveBackupEntries(entries []*BackupEntry) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`INSERT INTO backup_entries (run_id, part_num, path, size, hash, mod_time, inconsistent, invalid) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, e := range entries {
+		_, err = stmt.Exec(e.RunID, e.PartNum, e.Path, e.Size, e.Hash, e.ModTime, e.Inconsistent, e.Invalid)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// 加载备份运行的所有目录项，按写入顺序排列
+func LoadBackupEntries(runID int64) ([]*BackupEntry, error) {
+	query := `SELECT id, run_id, part_num, path, size, hash, mod_time, inconsistent, invalid FROM backup_entries
+              WHERE run_id = ? ORDER BY id`
+	rows, err := db.Query(query, runID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]*BackupEntry, 0)
+	for rows.Next() {
+		e := &BackupEntry{}
+		if err := rows.Scan(&e.ID, &e.RunID, &e.PartNum, &e.Path, &e.Size, &e.Hash, &e.ModTime, &e.Inconsistent, &e.Invalid); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// 把备份运行中指定路径的目录项标记为无效
+func InvalidateBackupEntries(runID int64, paths []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`UPDATE backup_entries SET invalid = 1 WHERE run_id = ? AND path = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, p := range paths {
+		if _, err := stmt.Exec(runID, p); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,63 @@
+package db
+
+// 备份分片记录结构
+type BackupPart struct {
+	ID       int64  `db:"id" json:"id"`             // 自增ID
+	RunID    int64  `db:"run_id" json:"run_id"`     // 所属备份运行ID
+	PartNum  int    `db:"part_num" json:"part_num"` // 分片序号
+	Name     string `db:"name" json:"name"`         // 分片文件名
+	Size     int64  `db:"size" json:"size"`         // 分片文件大小
+	Uploaded bool   `db:"uploaded" json:"uploaded"` // 是否已上传并通过远端哈希校验
+	Chunks   int    `db:"chunks" json:"chunks"`     // 流式上传时远端的分块数量，0表示整个分片是一个文件
+}
+
+// 保存分片记录
+func SaveBackupPart(p *BackupPart) error {
+	query := `INSERT INTO backup_parts (run_id, part_num, name, size, uploaded, chunks) VALUES (?, ?, ?, ?, ?, ?)`
+	result, err := db.Exec(query, p.RunID, p.PartNum, p.Name, p.Size, p.Uploaded, p.Chunks)
+	if err != nil {
+		return err
+	}
+
+	p.ID, err = result.LastInsertId()
+	return err
+}
+
+// 标记分片已上传
+func MarkBackupPartUploaded(id int64) error {
+	query := `UPDATE backup_parts SET uploaded = 1 WHERE id = ?`
+	_, err := db.Exec(query, id)
+	return err
+}
+
+// 加载备份运行的所有分片，按分片序号排序
+func LoadBackupParts(runID int64) ([]*BackupPart, error) {
+	query := `SELECT id, run_id, part_num, name, size, uploaded, chunks FROM backup_parts WHERE run_id = ? ORDER BY part_num`
+	return queryBackupParts(query, runID)
+}
+
+// 加载指定备份ID下所有尚未上传成功的分片
+func LoadPendingBackupParts(backupID string) ([]*BackupPart, error) {
+	query := `SELECT p.id, p.run_id, p.part_num, p.name, p.size, p.uploaded, p.chunks
+              FROM backup_parts p JOIN backup_runs r ON p.run_id = r.id
+              WHERE r.backup_id = ? AND p.uploaded = 0 ORDER BY p.run_id, p.part_num`
+	return queryBackupParts(query, backupID)
+}
+
+func queryBackupParts(query string, args ...any) ([]*BackupPart, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	parts := make([]*BackupPart, 0)
+	for rows.Next() {
+		p := &BackupPart{}
+		if err := rows.Scan(&p.ID, &p.RunID, &p.PartNum, &p.Name, &p.Size, &p.Uploaded, &p.Chunks); err != nil {
+			return nil, err
+		}
+		parts = append(parts, p)
+	}
+	return parts, rows.Err()
+}
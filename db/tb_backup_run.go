@@ -0,0 +1,119 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+// 备份运行状态
+const (
+	RunStatusRunning     = "running"
+	RunStatusSuccess     = "success"
+	RunStatusFailed      = "failed"
+	RunStatusInterrupted = "interrupted" // 程序退出时在安全的位置停止
+	RunStatusCancelled   = "cancelled"   // 通过命令行或HTTP接口取消
+)
+
+// 备份运行记录结构
+type BackupRun struct {
+	ID         int64     `db:"id" json:"id"`                   // 自增ID
+	BackupID   string    `db:"backup_id" json:"backup_id"`     // 备份ID
+	Timestamp  string    `db:"timestamp" json:"timestamp"`     // 备份时间戳，与分片文件名一致
+	Full       bool      `db:"full" json:"full"`               // 是否全量备份
+	Status     string    `db:"status" json:"status"`           // 运行状态
+	FileCount  int64     `db:"file_count" json:"file_count"`   // 备份文件数量
+	TotalSize  int64     `db:"total_size" json:"total_size"`   // 备份文件总大小
+	Error      string    `db:"error" json:"error"`             // 错误信息
+	StartedAt  time.Time `db:"started_at" json:"started_at"`   // 开始时间
+	FinishedAt time.Time `db:"finished_at" json:"finished_at"` // 结束时间
+	// 备份过程中仍在变化、内容可能不完整的文件数量
+	Inconsistent int64 `db:"inconsistent" json:"inconsistent"`
+}
+
+// 创建备份运行记录，返回自增ID
+func CreateBackupRun(r *BackupRun) (int64, error) {
+	query := `INSERT INTO backup_runs (backup_id, timestamp, full, status, started_at)
+              VALUES (?, ?, ?, ?, ?)`
+	result, err := db.Exec(query, r.BackupID, r.Timestamp, r.Full, r.Status, r.StartedAt)
+	if err != nil {
+		return 0, err
+	}
+
+	r.ID, err = result.LastInsertId()
+	return r.ID, err
+}
+
+// 更新备份运行记录的结束状态
+func FinishBackupRun(r *BackupRun) error {
+	query := `UPDATE backup_runs SET status = ?, file_count = ?, total_size = ?, error = ?, finished_at = ?, inconsistent = ?
+              WHERE id = ?`
+	_, err := db.Exec(query, r.Status, r.FileCount, r.TotalSize, r.Error, r.FinishedAt, r.Inconsistent, r.ID)
+	return err
+}
+
+// 根据备份ID和时间戳加载备份运行记录，时间戳为空时返回最近一次成功的记录
+func LoadBackupRun(backupID, timestamp string) (*BackupRun, error) {
+	query := `SELECT id, backup_id, timestamp, full, status, file_count, total_size, error, started_at, finished_at, inconsistent
+              FROM backup_runs WHERE backup_id = ? AND timestamp = ?`
+	args := []any{backupID, timestamp}
+	if timestamp == "" {
+		query = `SELECT id, backup_id, timestamp, full, status, file_count, total_size, error, started_at, finished_at, inconsistent
+                 FROM backup_runs WHERE backup_id = ? AND status = ? ORDER BY id DESC LIMIT 1`
+		args = []any{backupID, RunStatusSuccess}
+	}
+
+	return scanBackupRun(db.QueryRow(query, args...))
+}
+
+// 加载备份任务最近的运行记录，按开始时间从新到旧排列，limit不大于0时返回全部
+func ListBackupRuns(backupID string, limit int) ([]*BackupRun, error) {
+	query := `SELECT id, backup_id, timestamp, full, status, file_count, total_size, error, started_at, finished_at, inconsistent
+              FROM backup_runs WHERE backup_id = ? ORDER BY id DESC LIMIT ?`
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := db.Query(query, backupID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := make([]*BackupRun, 0)
+	for rows.Next() {
+		r, err := scanBackupRun(rows)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
+
+// 保存运行期间输出的日志，没有对应的运行记录时不保存
+func SaveBackupRunLog(backupID, timestamp, text string) error {
+	query := `UPDATE backup_runs SET log = ? WHERE backup_id = ? AND timestamp = ?`
+	_, err := db.Exec(query, text, backupID, timestamp)
+	return err
+}
+
+// 加载运行期间输出的日志
+func LoadBackupRunLog(backupID, timestamp string) (string, error) {
+	query := `SELECT log FROM backup_runs WHERE backup_id = ? AND timestamp = ?`
+	var text sql.NullString
+	err := db.QueryRow(query, backupID, timestamp).Scan(&text)
+	return text.String, err
+}
+
+func scanBackupRun(row interface{ Scan(...any) error }) (*BackupRun, error) {
+	r := &BackupRun{}
+	var errMsg sql.NullString
+	var finishedAt sql.NullTime
+	err := row.Scan(&r.ID, &r.BackupID, &r.Timestamp, &r.Full, &r.Status, &r.FileCount, &r.TotalSize,
+		&errMsg, &r.StartedAt, &finishedAt, &r.Inconsistent)
+	if err != nil {
+		return nil, err
+	}
+	r.Error = errMsg.String
+	r.FinishedAt = finishedAt.Time
+	return r, nil
+}
@@ -72,6 +72,38 @@ func BatchSaveFileRecordsOptimized(records []*FileRecord) error {
 	return tx.Commit()
 }
 
+// 替换指定路径的文件记录，其他路径的记录保持不变
+func ReplaceFileRecords(records []*FileRecord) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	del, err := tx.Prepare(`DELETE FROM file_records WHERE backup_id = ? AND path = ?`)
+	if err != nil {
+		return err
+	}
+	defer del.Close()
+
+	ins, err := tx.Prepare(`INSERT INTO file_records (path, mod_time, backup_id, hash) VALUES (?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer ins.Close()
+
+	for _, record := range records {
+		if _, err := del.Exec(record.BackupID, record.Path); err != nil {
+			return err
+		}
+		if _, err := ins.Exec(record.Path, record.ModTime, record.BackupID, record.Hash); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
 // 删除文件记录
 func DeleteFileRecord(backupId string) error {
 	query := `DELETE FROM file_records WHERE backup_id = ?`
@@ -0,0 +1,65 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// 大文件的分块签名结构，用于下一次备份时计算二进制差异
+type FileSignature struct {
+	BackupID  string    `db:"backup_id"`  // 备份ID
+	Path      string    `db:"path"`       // 压缩包内的路径
+	BlockSize int       `db:"block_size"` // 分块大小
+	Size      int64     `db:"size"`       // 文件大小
+	Hash      string    `db:"hash"`       // 整个文件的SHA256
+	Blocks    []byte    `db:"blocks"`     // 每块的弱校验和与强哈希
+	UpdatedAt time.Time `db:"updated_at"` // 更新时间
+}
+
+// 加载文件的分块签名，不存在时返回nil
+func LoadFileSignature(backupID, path string) (*FileSignature, error) {
+	query := `SELECT backup_id, path, block_size, size, hash, blocks, updated_at
+              FROM file_signatures WHERE backup_id = ? AND path = ?`
+	s := &FileSignature{}
+	err := db.QueryRow(query, backupID, path).
+		Scan(&s.BackupID, &s.Path, &s.BlockSize, &s.Size, &s.Hash, &s.Blocks, &s.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// 批量保存分块签名，已存在的签名会被替换
+func BatchSaveFileSignatures(sigs []*FileSignature) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`INSERT OR REPLACE INTO file_signatures (backup_id, path, block_size, size, hash, blocks, updated_at)
+                             VALUES (?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, s := range sigs {
+		_, err = stmt.Exec(s.BackupID, s.Path, s.BlockSize, s.Size, s.Hash, s.Blocks, s.UpdatedAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// 删除备份ID下的所有分块签名
+func DeleteFileSignatures(backupID string) error {
+	_, err := db.Exec(`DELETE FROM file_signatures WHERE backup_id = ?`, backupID)
+	return err
+}
@@ -0,0 +1,68 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// 备份任务的调度状态，用于启动时判断是否错过了计划的备份
+type JobState struct {
+	BackupID      string    `db:"backup_id" json:"backup_id"`             // 备份ID
+	LastRunAt     time.Time `db:"last_run_at" json:"last_run_at"`         // 最近一次运行的开始时间
+	LastStatus    string    `db:"last_status" json:"last_status"`         // 最近一次运行的结果
+	LastError     string    `db:"last_error" json:"last_error"`           // 最近一次运行的错误信息
+	LastSuccessAt time.Time `db:"last_success_at" json:"last_success_at"` // 最近一次成功运行的开始时间，从未成功时为零值
+	Control       string    `db:"control" json:"control"`                 // 控制状态，由SetJobControl修改
+}
+
+// 任务的控制状态，命令行和HTTP接口写入，运行备份的进程读取后执行
+const (
+	JobControlNone   = ""       // 正常运行
+	JobControlPaused = "paused" // 已暂停，正在运行的备份在下一块数据前等待，计划的备份不再开始
+	JobControlCancel = "cancel" // 请求取消正在运行的备份，执行后恢复为正常
+)
+
+// 加载备份任务的调度状态，不存在时返回nil
+func LoadJobState(backupID string) (*JobState, error) {
+	query := `SELECT backup_id, last_run_at, last_status, last_error, last_success_at, control FROM job_state WHERE backup_id = ?`
+	s := &JobState{}
+	var lastRunAt, lastSuccessAt sql.NullTime
+	var lastStatus, lastError, control sql.NullString
+	err := db.QueryRow(query, backupID).Scan(&s.BackupID, &lastRunAt, &lastStatus, &lastError, &lastSuccessAt, &control)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// 只设置过控制状态的任务没有运行记录
+	s.LastRunAt = lastRunAt.Time
+	s.LastStatus = lastStatus.String
+	s.LastError = lastError.String
+	s.LastSuccessAt = lastSuccessAt.Time
+	s.Control = control.String
+	return s, nil
+}
+
+// 保存备份任务的调度状态，不修改控制状态
+func SaveJobState(s *JobState) error {
+	var lastSuccessAt sql.NullTime
+	if !s.LastSuccessAt.IsZero() {
+		lastSuccessAt = sql.NullTime{Time: s.LastSuccessAt, Valid: true}
+	}
+	query := `INSERT INTO job_state (backup_id, last_run_at, last_status, last_error, last_success_at)
+              VALUES (?, ?, ?, ?, ?)
+              ON CONFLICT(backup_id) DO UPDATE SET last_run_at = excluded.last_run_at, last_status = excluded.last_status,
+              last_error = excluded.last_error, last_success_at = excluded.last_success_at`
+	_, err := db.Exec(query, s.BackupID, s.LastRunAt, s.LastStatus, s.LastError, lastSuccessAt)
+	return err
+}
+
+// 设置任务的控制状态，其他进程可能同时修改调度状态，只更新control列
+func SetJobControl(backupID, control string) error {
+	query := `INSERT INTO job_state (backup_id, control) VALUES (?, ?)
+              ON CONFLICT(backup_id) DO UPDATE SET control = excluded.control`
+	_, err := db.Exec(query, backupID, control)
+	return err
+}
@@ -0,0 +1,33 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// 仓库数据块索引结构，数据块按内容的HMAC寻址
+type RepoChunk struct {
+	ID      string `db:"id"`       // 数据块ID
+	PackID  string `db:"pack_id"`  // 所在数据包ID
+	Offset  int64  `db:"offset"`   // 在数据包中的偏移
+	Length  int64  `db:"length"`   // 压缩加密后的长度
+	RawSize int64  `db:"raw_size"` // 原始大小
+	// 所在数据包是否已上传，查询时从repo_packs读取
+	Uploaded bool `db:"uploaded"`
+}
+
+// 根据ID查找数据块，不存在时返回nil
+func LoadRepoChunk(id string) (*RepoChunk, error) {
+	c := &RepoChunk{}
+	query := `SELECT c.id, c.pack_id, c.offset, c.length, c.raw_size, COALESCE(p.uploaded, 0)
+              FROM repo_chunks c LEFT JOIN repo_packs p ON p.id = c.pack_id WHERE c.id = ?`
+	err := db.QueryRow(query, id).
+		Scan(&c.ID, &c.PackID, &c.Offset, &c.Length, &c.RawSize, &c.Uploaded)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
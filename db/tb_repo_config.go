@@ -0,0 +1,23 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// 加载仓库配置，不存在时返回空字符串
+func LoadRepoConfig(remote string) (string, error) {
+	var config string
+	err := db.QueryRow(`SELECT config FROM repo_config WHERE remote = ?`, remote).Scan(&config)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return config, err
+}
+
+// 保存仓库配置
+func SaveRepoConfig(remote, config string) error {
+	query := `INSERT OR REPLACE INTO repo_config (remote, config) VALUES (?, ?)`
+	_, err := db.Exec(query, remote, config)
+	return err
+}
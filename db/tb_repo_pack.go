@@ -0,0 +1,83 @@
+package db
+
+import "time"
+
+// 仓库数据包记录结构，一个数据包包含多个加密后的数据块
+type RepoPack struct {
+	ID        string    `db:"id"`         // 数据包ID，同时也是文件名
+	Size      int64     `db:"size"`       // 数据包大小
+	Uploaded  bool      `db:"uploaded"`   // 是否已上传
+	CreatedAt time.Time `db:"created_at"` // 创建时间
+}
+
+// 保存数据包以及其中的数据块索引，数据块只有在数据包写完后才会进入索引
+func SaveRepoPack(p *RepoPack, chunks []*RepoChunk) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO repo_packs (id, size, uploaded, created_at) VALUES (?, ?, ?, ?)`,
+		p.ID, p.Size, p.Uploaded, p.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(`INSERT OR IGNORE INTO repo_chunks (id, pack_id, offset, length, raw_size) VALUES (?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, c := range chunks {
+		_, err = stmt.Exec(c.ID, c.PackID, c.Offset, c.Length, c.RawSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// 标记数据包已上传
+func MarkRepoPackUploaded(id string) error {
+	_, err := db.Exec(`UPDATE repo_packs SET uploaded = 1 WHERE id = ?`, id)
+	return err
+}
+
+// 删除数据包及其中的数据块索引，之后的备份重新写入这些数据块
+func DeleteRepoPack(id string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM repo_chunks WHERE pack_id = ?`, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM repo_packs WHERE id = ?`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// 加载所有尚未上传的数据包
+func LoadPendingRepoPacks() ([]*RepoPack, error) {
+	rows, err := db.Query(`SELECT id, size, uploaded, created_at FROM repo_packs WHERE uploaded = 0 ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	packs := make([]*RepoPack, 0)
+	for rows.Next() {
+		p := &RepoPack{}
+		if err := rows.Scan(&p.ID, &p.Size, &p.Uploaded, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		packs = append(packs, p)
+	}
+	return packs, rows.Err()
+}
@@ -0,0 +1,50 @@
+package db
+
+import "time"
+
+// 仓库快照记录结构，快照内容保存在加密的快照文件中
+type RepoSnapshot struct {
+	ID        int64     `db:"id"`         // 自增ID
+	BackupID  string    `db:"backup_id"`  // 备份ID
+	Timestamp string    `db:"timestamp"`  // 备份时间戳
+	RunID     int64     `db:"run_id"`     // 对应的备份运行ID
+	FileCount int64     `db:"file_count"` // 文件数量
+	TotalSize int64     `db:"total_size"` // 文件总大小
+	NewSize   int64     `db:"new_size"`   // 本次新写入的数据块原始大小
+	CreatedAt time.Time `db:"created_at"` // 创建时间
+}
+
+// 保存快照记录
+func SaveRepoSnapshot(s *RepoSnapshot) error {
+	query := `INSERT INTO repo_snapshots (backup_id, timestamp, run_id, file_count, total_size, new_size, created_at)
+              VALUES (?, ?, ?, ?, ?, ?, ?)`
+	result, err := db.Exec(query, s.BackupID, s.Timestamp, s.RunID, s.FileCount, s.TotalSize, s.NewSize, s.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	s.ID, err = result.LastInsertId()
+	return err
+}
+
+// 加载指定备份ID的所有快照，最新的在前面
+func LoadRepoSnapshots(backupID string) ([]*RepoSnapshot, error) {
+	query := `SELECT id, backup_id, timestamp, run_id, file_count, total_size, new_size, created_at
+              FROM repo_snapshots WHERE backup_id = ? ORDER BY id DESC`
+	rows, err := db.Query(query, backupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	snapshots := make([]*RepoSnapshot, 0)
+	for rows.Next() {
+		s := &RepoSnapshot{}
+		if err := rows.Scan(&s.ID, &s.BackupID, &s.Timestamp, &s.RunID, &s.FileCount, &s.TotalSize,
+			&s.NewSize, &s.CreatedAt); err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, s)
+	}
+	return snapshots, rows.Err()
+}
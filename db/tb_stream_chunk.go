@@ -0,0 +1,43 @@
+package db
+
+import "time"
+
+// 流式上传到远端的分块，所在分片完成前一直保留记录，中止后按记录删除远端文件
+type StreamChunk struct {
+	BackupID  string    `db:"backup_id"`
+	Folder    string    `db:"folder"`     // 远端目录
+	Name      string    `db:"name"`       // 远端文件名
+	CreatedAt time.Time `db:"created_at"` // 开始上传的时间
+}
+
+// 保存分块记录，上传开始前调用，进程中途退出时也能找到远端的残留分块
+func SaveStreamChunk(c *StreamChunk) error {
+	query := `INSERT OR REPLACE INTO stream_chunks (backup_id, folder, name, created_at) VALUES (?, ?, ?, ?)`
+	_, err := db.Exec(query, c.BackupID, c.Folder, c.Name, c.CreatedAt)
+	return err
+}
+
+// 删除分块记录
+func DeleteStreamChunk(folder, name string) error {
+	_, err := db.Exec(`DELETE FROM stream_chunks WHERE folder = ? AND name = ?`, folder, name)
+	return err
+}
+
+// 加载备份任务的所有分块记录
+func LoadStreamChunks(backupID string) ([]*StreamChunk, error) {
+	rows, err := db.Query(`SELECT backup_id, folder, name, created_at FROM stream_chunks WHERE backup_id = ? ORDER BY name`, backupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var chunks []*StreamChunk
+	for rows.Next() {
+		c := &StreamChunk{}
+		if err := rows.Scan(&c.BackupID, &c.Folder, &c.Name, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, c)
+	}
+	return chunks, rows.Err()
+}
@@ -0,0 +1,34 @@
+package db
+
+import "time"
+
+// 校验结果
+const (
+	VerifyStatusPass = "pass"
+	VerifyStatusFail = "fail"
+)
+
+// 备份校验报告结构
+type VerifyReport struct {
+	ID         int64     `db:"id"`          // 自增ID
+	RunID      int64     `db:"run_id"`      // 被校验的备份运行ID
+	Status     string    `db:"status"`      // 校验结果 pass/fail
+	Checked    int64     `db:"checked"`     // 已校验的文件数量
+	Failed     int64     `db:"failed"`      // 校验失败的数量
+	Detail     string    `db:"detail"`      // 失败详情，每行一条
+	StartedAt  time.Time `db:"started_at"`  // 开始时间
+	FinishedAt time.Time `db:"finished_at"` // 结束时间
+}
+
+// 保存校验报告
+func SaveVerifyReport(r *VerifyReport) error {
+	query := `INSERT INTO verify_reports (run_id, status, checked, failed, detail, started_at, finished_at)
+              VALUES (?, ?, ?, ?, ?, ?, ?)`
+	result, err := db.Exec(query, r.RunID, r.Status, r.Checked, r.Failed, r.Detail, r.StartedAt, r.FinishedAt)
+	if err != nil {
+		return err
+	}
+
+	r.ID, err = result.LastInsertId()
+	return err
+}
@@ -0,0 +1,380 @@
+// Package delta 实现rsync风格的二进制差异。
+//
+// 备份时为大文件保存分块签名(弱校验和+强哈希)，下次文件变化时用滚动校验和在新文件中
+// 查找与旧版本相同的块，只输出引用旧块的COPY指令和变化部分的DATA指令，
+// 还原时在旧版本文件的基础上应用差异得到新文件。
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+const (
+	// DefaultBlockSize 默认分块大小
+	DefaultBlockSize = 64 * 1024
+
+	strongSize = 16 // 每块强哈希的长度，取SHA256的前16字节
+	entrySize  = 4 + strongSize
+
+	magic = "ABDELTA1"
+
+	opCopy = 'C'
+	opData = 'D'
+	opEnd  = 'E'
+)
+
+var ErrBaseMismatch = errors.New("基础文件与差异不匹配")
+
+// Signature 文件的分块签名
+type Signature struct {
+	BlockSize int    // 分块大小
+	Size      int64  // 文件大小
+	Hash      string // 整个文件的SHA256
+	Blocks    []byte // 每块的弱校验和(4字节)与强哈希，最后一块可能不足BlockSize
+
+	index map[uint32][]int // 弱校验和到块序号的索引，只包含完整的块
+}
+
+// BlockCount 返回签名中的块数
+func (s *Signature) BlockCount() int {
+	return len(s.Blocks) / entrySize
+}
+
+func (s *Signature) weak(i int) uint32 {
+	return binary.BigEndian.Uint32(s.Blocks[i*entrySize:])
+}
+
+func (s *Signature) strong(i int) []byte {
+	off := i*entrySize + 4
+	return s.Blocks[off : off+strongSize]
+}
+
+func (s *Signature) buildIndex() {
+	s.index = make(map[uint32][]int)
+	full := int(s.Size / int64(s.BlockSize))
+	for i := 0; i < full; i++ {
+		w := s.weak(i)
+		s.index[w] = append(s.index[w], i)
+	}
+}
+
+// 在签名中查找与数据块相同的完整块
+func (s *Signature) find(weak uint32, block []byte) (int, bool) {
+	candidates, ok := s.index[weak]
+	if !ok {
+		return 0, false
+	}
+	strong := strongSum(block)
+	for _, i := range candidates {
+		if bytes.Equal(s.strong(i), strong) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func strongSum(block []byte) []byte {
+	sum := sha256.Sum256(block)
+	return sum[:strongSize]
+}
+
+// rsync的弱校验和，a为字节和，b为加权和，都取低16位
+func weakSum(block []byte) (a, b uint32) {
+	n := uint32(len(block))
+	for i, c := range block {
+		a += uint32(c)
+		b += (n - uint32(i)) * uint32(c)
+	}
+	return a & 0xffff, b & 0xffff
+}
+
+// SignatureBuilder 顺序写入文件内容，计算分块签名和整个文件的哈希
+type SignatureBuilder struct {
+	sig    *Signature
+	block  []byte
+	hasher hash.Hash
+}
+
+// NewSignatureBuilder 创建签名计算器，blockSize为0时使用默认分块大小
+func NewSignatureBuilder(blockSize int) *SignatureBuilder {
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	}
+	return &SignatureBuilder{
+		sig:    &Signature{BlockSize: blockSize},
+		block:  make([]byte, 0, blockSize),
+		hasher: sha256.New(),
+	}
+}
+
+func (b *SignatureBuilder) Write(p []byte) (int, error) {
+	n := len(p)
+	b.hasher.Write(p)
+	b.sig.Size += int64(n)
+
+	for len(p) > 0 {
+		m := copy(b.block[len(b.block):cap(b.block)], p)
+		b.block = b.block[:len(b.block)+m]
+		p = p[m:]
+		if len(b.block) == cap(b.block) {
+			b.addBlock()
+		}
+	}
+	return n, nil
+}
+
+func (b *SignatureBuilder) addBlock() {
+	x, y := weakSum(b.block)
+	var entry [entrySize]byte
+	binary.BigEndian.PutUint32(entry[:], x|y<<16)
+	copy(entry[4:], strongSum(b.block))
+	b.sig.Blocks = append(b.sig.Blocks, entry[:]...)
+	b.block = b.block[:0]
+}
+
+// Signature 返回计算完成的签名，调用后不能再写入
+func (b *SignatureBuilder) Signature() *Signature {
+	if len(b.block) > 0 {
+		b.addBlock()
+	}
+	b.sig.Hash = hex.EncodeToString(b.hasher.Sum(nil))
+	return b.sig
+}
+
+// Write 比较新文件r与旧版本的签名base，将差异写入w，同时把新文件的内容写入newSig，
+// 用于计算下一次备份使用的签名
+func Write(w io.Writer, base *Signature, r io.Reader, newSig *SignatureBuilder) error {
+	if base.index == nil {
+		base.buildIndex()
+	}
+
+	bw := bufio.NewWriter(w)
+	enc := &encoder{w: bw}
+
+	// 先写入头部，新文件的大小和哈希在结尾指令中写入
+	header := make([]byte, 0, len(magic)+4+8+32)
+	header = append(header, magic...)
+	header = binary.BigEndian.AppendUint32(header, uint32(base.BlockSize))
+	header = binary.BigEndian.AppendUint64(header, uint64(base.Size))
+	baseHash, err := hex.DecodeString(base.Hash)
+	if err != nil || len(baseHash) != sha256.Size {
+		return fmt.Errorf("无效的签名哈希: %s", base.Hash)
+	}
+	header = append(header, baseHash...)
+	if _, err := bw.Write(header); err != nil {
+		return err
+	}
+
+	bs := base.BlockSize
+	src := io.TeeReader(r, newSig)
+	buf := make([]byte, 0, 4*bs)
+	var start, lit int // 当前窗口起点，尚未输出的字面数据起点
+	eof := false
+
+	// 保证窗口后至少还有一个字节可以滚动，或者已读到结尾
+	fill := func() error {
+		if eof || len(buf)-start > bs {
+			return nil
+		}
+		if start > 2*bs {
+			if err := enc.data(buf[lit:start]); err != nil {
+				return err
+			}
+			n := copy(buf, buf[start:])
+			buf = buf[:n]
+			start, lit = 0, 0
+		}
+		for !eof && len(buf)-start <= bs {
+			n, err := src.Read(buf[len(buf):cap(buf)])
+			buf = buf[:len(buf)+n]
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var a, b uint32
+	rolling := false
+	for {
+		if err := fill(); err != nil {
+			return err
+		}
+		n := len(buf) - start
+		if n < bs {
+			break
+		}
+
+		if !rolling {
+			a, b = weakSum(buf[start : start+bs])
+			rolling = true
+		}
+
+		if i, ok := base.find(a|b<<16, buf[start:start+bs]); ok {
+			if err := enc.data(buf[lit:start]); err != nil {
+				return err
+			}
+			if err := enc.copy(i); err != nil {
+				return err
+			}
+			start += bs
+			lit = start
+			rolling = false
+			continue
+		}
+
+		if n == bs {
+			// 已经到结尾，剩余数据作为字面数据输出
+			break
+		}
+
+		// 窗口向后滚动一个字节
+		out, in := uint32(buf[start]), uint32(buf[start+bs])
+		a = (a - out + in) & 0xffff
+		b = (b - uint32(bs)*out + a) & 0xffff
+		start++
+	}
+
+	if err := enc.data(buf[lit:]); err != nil {
+		return err
+	}
+	if err := enc.flushCopy(); err != nil {
+		return err
+	}
+
+	target := newSig.Signature()
+	targetHash, _ := hex.DecodeString(target.Hash)
+	end := make([]byte, 0, 1+8+32)
+	end = append(end, opEnd)
+	end = binary.BigEndian.AppendUint64(end, uint64(target.Size))
+	end = append(end, targetHash...)
+	if _, err := bw.Write(end); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// 编码差异指令，连续的COPY合并为一条
+type encoder struct {
+	w         *bufio.Writer
+	copyStart int
+	copyCount int
+	scratch   [13]byte
+}
+
+func (e *encoder) copy(block int) error {
+	if e.copyCount > 0 && e.copyStart+e.copyCount == block {
+		e.copyCount++
+		return nil
+	}
+	if err := e.flushCopy(); err != nil {
+		return err
+	}
+	e.copyStart, e.copyCount = block, 1
+	return nil
+}
+
+func (e *encoder) flushCopy() error {
+	if e.copyCount == 0 {
+		return nil
+	}
+	e.scratch[0] = opCopy
+	binary.BigEndian.PutUint64(e.scratch[1:], uint64(e.copyStart))
+	binary.BigEndian.PutUint32(e.scratch[9:], uint32(e.copyCount))
+	e.copyCount = 0
+	_, err := e.w.Write(e.scratch[:13])
+	return err
+}
+
+func (e *encoder) data(p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	if err := e.flushCopy(); err != nil {
+		return err
+	}
+	e.scratch[0] = opData
+	binary.BigEndian.PutUint32(e.scratch[1:], uint32(len(p)))
+	if _, err := e.w.Write(e.scratch[:5]); err != nil {
+		return err
+	}
+	_, err := e.w.Write(p)
+	return err
+}
+
+// Apply 在旧版本文件base上应用差异d，将新文件写入w。
+// 会校验base的大小，并在结尾校验新文件的大小和哈希
+func Apply(w io.Writer, base io.ReaderAt, baseSize int64, d io.Reader) error {
+	r := bufio.NewReader(d)
+
+	header := make([]byte, len(magic)+4+8+32)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return fmt.Errorf("读取差异头部失败: %v", err)
+	}
+	if string(header[:len(magic)]) != magic {
+		return fmt.Errorf("无效的差异格式")
+	}
+	blockSize := int64(binary.BigEndian.Uint32(header[len(magic):]))
+	expectedBaseSize := int64(binary.BigEndian.Uint64(header[len(magic)+4:]))
+	if baseSize != expectedBaseSize {
+		return fmt.Errorf("%w: 大小为%d, 期望%d", ErrBaseMismatch, baseSize, expectedBaseSize)
+	}
+
+	hasher := sha256.New()
+	out := io.MultiWriter(w, hasher)
+	var size int64
+	op := make([]byte, 12)
+	for {
+		t, err := r.ReadByte()
+		if err != nil {
+			return fmt.Errorf("读取差异指令失败: %v", err)
+		}
+
+		switch t {
+		case opCopy:
+			if _, err := io.ReadFull(r, op[:12]); err != nil {
+				return fmt.Errorf("读取差异指令失败: %v", err)
+			}
+			offset := int64(binary.BigEndian.Uint64(op)) * blockSize
+			length := int64(binary.BigEndian.Uint32(op[8:])) * blockSize
+			if offset+length > baseSize {
+				return fmt.Errorf("%w: 引用的块超出基础文件", ErrBaseMismatch)
+			}
+			n, err := io.Copy(out, io.NewSectionReader(base, offset, length))
+			size += n
+			if err != nil {
+				return fmt.Errorf("读取基础文件失败: %v", err)
+			}
+		case opData:
+			if _, err := io.ReadFull(r, op[:4]); err != nil {
+				return fmt.Errorf("读取差异指令失败: %v", err)
+			}
+			n, err := io.CopyN(out, r, int64(binary.BigEndian.Uint32(op)))
+			size += n
+			if err != nil {
+				return fmt.Errorf("读取差异数据失败: %v", err)
+			}
+		case opEnd:
+			end := make([]byte, 8+32)
+			if _, err := io.ReadFull(r, end); err != nil {
+				return fmt.Errorf("读取差异结尾失败: %v", err)
+			}
+			if int64(binary.BigEndian.Uint64(end)) != size || !bytes.Equal(end[8:], hasher.Sum(nil)) {
+				return fmt.Errorf("%w: 还原后的文件哈希不一致", ErrBaseMismatch)
+			}
+			return nil
+		default:
+			return fmt.Errorf("未知的差异指令: %d", t)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package delta
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func signatureOf(data []byte, blockSize int) *Signature {
+	b := NewSignatureBuilder(blockSize)
+	b.Write(data)
+	return b.Signature()
+}
+
+func TestDelta_RoundTrip(t *testing.T) {
+	const blockSize = 4096
+	base := make([]byte, 1000*blockSize+123)
+	rand.New(rand.NewSource(1)).Read(base)
+
+	patch := func(data []byte, off int, p []byte) []byte {
+		out := append([]byte(nil), data...)
+		copy(out[off:], p)
+		return out
+	}
+	insert := func(data []byte, off int, p []byte) []byte {
+		out := append([]byte(nil), data[:off]...)
+		out = append(out, p...)
+		return append(out, data[off:]...)
+	}
+
+	cases := map[string]struct {
+		target   []byte
+		maxDelta int // 差异的最大大小
+	}{
+		"identical": {base, 20 * 1024},
+		"modified":  {patch(base, 500*blockSize+17, []byte("changed")), 3 * blockSize},
+		"inserted":  {insert(base, 300*blockSize+5, []byte("inserted bytes")), 3 * blockSize},
+		"deleted":   {append(append([]byte(nil), base[:200*blockSize]...), base[201*blockSize+9:]...), 3 * blockSize},
+		"appended":  {append(append([]byte(nil), base...), bytes.Repeat([]byte("x"), 10000)...), 4 * blockSize},
+		"truncated": {base[:400*blockSize+10], 2 * blockSize},
+		"empty":     {nil, 1024},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			sig := signatureOf(base, blockSize)
+
+			var d bytes.Buffer
+			newSig := NewSignatureBuilder(blockSize)
+			if err := Write(&d, sig, bytes.NewReader(tc.target), newSig); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+			if d.Len() > tc.maxDelta {
+				t.Errorf("差异大小%d超过预期%d", d.Len(), tc.maxDelta)
+			}
+
+			var out bytes.Buffer
+			if err := Apply(&out, bytes.NewReader(base), int64(len(base)), bytes.NewReader(d.Bytes())); err != nil {
+				t.Fatalf("Apply() error = %v", err)
+			}
+			if !bytes.Equal(out.Bytes(), tc.target) {
+				t.Fatal("应用差异后的内容不一致")
+			}
+
+			expected := signatureOf(tc.target, blockSize)
+			got := newSig.Signature()
+			if got.Hash != expected.Hash || !bytes.Equal(got.Blocks, expected.Blocks) {
+				t.Error("新文件的签名不一致")
+			}
+		})
+	}
+}
+
+func TestDelta_WrongBase(t *testing.T) {
+	base := make([]byte, 100*1024)
+	rand.New(rand.NewSource(2)).Read(base)
+	target := append([]byte("prefix"), base...)
+
+	var d bytes.Buffer
+	if err := Write(&d, signatureOf(base, 1024), bytes.NewReader(target), NewSignatureBuilder(1024)); err != nil {
+		t.Fatal(err)
+	}
+
+	other := append([]byte(nil), base...)
+	other[5000] ^= 0xff
+	var out bytes.Buffer
+	if err := Apply(&out, bytes.NewReader(other), int64(len(other)), bytes.NewReader(d.Bytes())); err == nil {
+		t.Fatal("基础文件不同时应用差异应当失败")
+	}
+}
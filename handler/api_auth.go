@@ -0,0 +1,88 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// 管理接口的认证方式，令牌和用户都为空时不认证
+type apiAuth struct {
+	tokens [][sha256.Size]byte // 访问令牌的哈希，比较时不泄露长度
+	users  map[string][]byte   // 用户名和bcrypt密码哈希
+}
+
+func newAPIAuth(tokens []string, users map[string]string) (*apiAuth, error) {
+	a := &apiAuth{users: make(map[string][]byte, len(users))}
+	for _, token := range tokens {
+		if token == "" {
+			return nil, fmt.Errorf("访问令牌不能为空")
+		}
+		a.tokens = append(a.tokens, sha256.Sum256([]byte(token)))
+	}
+	for user, hash := range users {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("用户%s的密码不是有效的bcrypt哈希: %v", user, err)
+		}
+		a.users[user] = []byte(hash)
+	}
+	return a, nil
+}
+
+func (a *apiAuth) enabled() bool {
+	return len(a.tokens) > 0 || len(a.users) > 0
+}
+
+// 检查请求头中的令牌或用户名密码
+func (a *apiAuth) check(r *http.Request) bool {
+	header := r.Header.Get("Authorization")
+	if token, ok := strings.CutPrefix(header, "Bearer "); ok {
+		sum := sha256.Sum256([]byte(token))
+		matched := 0
+		for _, t := range a.tokens {
+			matched |= subtle.ConstantTimeCompare(sum[:], t[:])
+		}
+		return matched == 1
+	}
+
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	hash, exists := a.users[user]
+	if !exists {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
+
+// 认证中间件，未通过时返回401，配置了用户时浏览器会弹出登录框
+func (a *apiAuth) middleware(c *gin.Context) {
+	if !a.enabled() || a.check(c.Request) {
+		c.Next()
+		return
+	}
+	if len(a.users) > 0 {
+		c.Header("WWW-Authenticate", `Basic realm="auto-backup", charset="UTF-8"`)
+	}
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "未认证"})
+}
+
+// 监听地址是否只接受本机的连接，主机为空时监听所有网卡
+func loopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
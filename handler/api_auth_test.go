@@ -0,0 +1,91 @@
+package handler
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAPIAuthCheck(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := newAPIAuth([]string{"token1"}, map[string]string{"admin": string(hash)})
+	if err != nil {
+		t.Fatalf("newAPIAuth() error = %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		user   string
+		pass   string
+		want   bool
+	}{
+		{name: "令牌正确", header: "Bearer token1", want: true},
+		{name: "令牌错误", header: "Bearer token2"},
+		{name: "令牌为空", header: "Bearer "},
+		{name: "密码正确", user: "admin", pass: "secret", want: true},
+		{name: "密码错误", user: "admin", pass: "wrong"},
+		{name: "用户不存在", user: "guest", pass: "secret"},
+		{name: "没有认证信息"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/jobs", nil)
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+		if tt.user != "" {
+			req.SetBasicAuth(tt.user, tt.pass)
+		}
+		if got := auth.check(req); got != tt.want {
+			t.Errorf("%s: check() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNewAPIAuthInvalidHash(t *testing.T) {
+	if _, err := newAPIAuth(nil, map[string]string{"admin": "plain-password"}); err == nil {
+		t.Fatal("newAPIAuth() 期望明文密码返回错误")
+	}
+	if _, err := newAPIAuth([]string{""}, nil); err == nil {
+		t.Fatal("newAPIAuth() 期望空令牌返回错误")
+	}
+}
+
+func TestLoopbackAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"127.0.0.1:8080", true},
+		{"127.0.0.2:8080", true},
+		{"[::1]:8080", true},
+		{"localhost:8080", true},
+		{":8080", false},
+		{"0.0.0.0:8080", false},
+		{"[::]:8080", false},
+		{"192.168.1.10:8080", false},
+		{"backup.example.com:8080", false},
+		{"8080", false},
+	}
+	for _, tt := range tests {
+		if got := loopbackAddr(tt.addr); got != tt.want {
+			t.Errorf("loopbackAddr(%q) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestNewAuthHandlerServerRequiresAuth(t *testing.T) {
+	if _, err := NewAuthHandlerServer(ServerOptions{Addr: ":8080"}, nil); err == nil {
+		t.Fatal("NewAuthHandlerServer() 期望没有认证时拒绝监听所有网卡")
+	}
+	if _, err := NewAuthHandlerServer(ServerOptions{Addr: "127.0.0.1:8080"}, nil); err != nil {
+		t.Fatalf("NewAuthHandlerServer() error = %v", err)
+	}
+	if _, err := NewAuthHandlerServer(ServerOptions{Addr: ":8080", Tokens: []string{"token1"}}, nil); err != nil {
+		t.Fatalf("NewAuthHandlerServer() error = %v", err)
+	}
+}
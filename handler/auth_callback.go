@@ -3,6 +3,7 @@ package handler
 import (
 	"context"
 	"fmt"
+	"html/template"
 	"net/http"
 	"time"
 
@@ -12,33 +13,70 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
+// ServerOptions HTTP服务的监听地址、TLS和管理接口的认证方式
+type ServerOptions struct {
+	Addr     string            // 监听地址，例如 "127.0.0.1:8080"，没有配置认证时必须是本机地址
+	CertFile string            // TLS证书文件，和KeyFile同时配置时使用HTTPS
+	KeyFile  string            // TLS私钥文件
+	Tokens   []string          // 管理接口的访问令牌
+	Users    map[string]string // Basic认证的用户名和bcrypt密码哈希
+}
+
 type AuthHandlerServer struct {
-	port   int
+	opts   ServerOptions
+	auth   *apiAuth
 	router *gin.Engine
 	srv    *http.Server
 	notify chan model.TokenAction
+	jobs   JobController
 }
 
-func NewAuthHandlerServer(port int, notify chan model.TokenAction) *AuthHandlerServer {
+func NewAuthHandlerServer(opts ServerOptions, notify chan model.TokenAction) (*AuthHandlerServer, error) {
+	if (opts.CertFile == "") != (opts.KeyFile == "") {
+		return nil, fmt.Errorf("tls_cert和tls_key需要同时配置")
+	}
+	auth, err := newAPIAuth(opts.Tokens, opts.Users)
+	if err != nil {
+		return nil, err
+	}
+	// 管理接口可以还原到任意目录、取消备份，没有认证时只允许本机访问
+	if !auth.enabled() && !loopbackAddr(opts.Addr) {
+		return nil, fmt.Errorf("监听地址%s允许其他主机访问，需要配置server.tokens或server.users", opts.Addr)
+	}
+
 	router := gin.Default()
 	return &AuthHandlerServer{
-		port:   port,
+		opts:   opts,
+		auth:   auth,
 		router: router,
 		notify: notify,
-	}
+	}, nil
 }
 
 func (s *AuthHandlerServer) Start(ctx context.Context) {
+	// 授权回调由浏览器跳转访问，不需要认证
 	s.router.GET("/token", s.getToken)
+	s.registerJobRoutes()
+	s.registerDashboard()
+
+	if !s.auth.enabled() {
+		log.Info("管理接口没有配置认证，只接受本机访问: %s", s.opts.Addr)
+	}
 
 	s.srv = &http.Server{
-		Addr:    fmt.Sprintf(":%d", s.port),
+		Addr:    s.opts.Addr,
 		Handler: s.router,
 	}
 
 	// 在goroutine中启动服务器
 	go func() {
-		if err := s.srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if s.opts.CertFile != "" {
+			err = s.srv.ListenAndServeTLS(s.opts.CertFile, s.opts.KeyFile)
+		} else {
+			err = s.srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Error("监听失败: %v", err)
 		}
 
@@ -61,18 +99,91 @@ func (s *AuthHandlerServer) Start(ctx context.Context) {
 	}()
 }
 
+// 等待上传器处理授权回调的时间，包括用授权码换取令牌的请求
+const tokenExchangeTimeout = 30 * time.Second
+
+// 授权回调的结果页面
+var callbackPage = template.Must(template.New("callback").Parse(`<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+<meta charset="utf-8">
+<title>auto-backup OneDrive认证</title>
+</head>
+<body style="font-family: sans-serif; max-width: 640px; margin: 48px auto;">
+{{if .OK}}<h2>OneDrive认证成功</h2>
+<p>可以关闭此页面。</p>
+{{else}}<h2>OneDrive认证失败</h2>
+<p>{{.Message}}</p>
+<p>请回到管理页面或命令行重新发起认证。</p>
+{{end}}</body>
+</html>
+`))
+
+// 渲染授权回调的结果页面
+func renderCallback(c *gin.Context, status int, err error) {
+	data := struct {
+		OK      bool
+		Message string
+	}{OK: err == nil}
+	if err != nil {
+		data.Message = err.Error()
+	}
+
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(status)
+	if err := callbackPage.Execute(c.Writer, data); err != nil {
+		log.Error("渲染授权结果页面失败: %v", err)
+	}
+}
+
 func (s *AuthHandlerServer) getToken(c *gin.Context) {
-	// 获取code
-	code := c.Query("code")
+	// 用户拒绝授权或授权服务出错时回调中带有error参数
+	if e := c.Query("error"); e != "" {
+		log.Warn("OneDrive授权失败: %s %s", e, c.Query("error_description"))
+		renderCallback(c, http.StatusBadRequest, fmt.Errorf("%s: %s", e, c.Query("error_description")))
+		return
+	}
 
-	// 返回响应
-	c.JSON(http.StatusOK, gin.H{
-		"status": "ok",
-	})
+	code := c.Query("code")
+	state := c.Query("state")
+	if code == "" || state == "" {
+		renderCallback(c, http.StatusBadRequest, fmt.Errorf("回调缺少code或state参数"))
+		return
+	}
+	if s.notify == nil {
+		log.Warn("没有等待授权的OneDrive上传器，忽略授权回调")
+		renderCallback(c, http.StatusServiceUnavailable, fmt.Errorf("没有配置使用授权回调的OneDrive上传"))
+		return
+	}
 
-	// 发送code到channel中
-	s.notify <- model.TokenAction{
+	// 发送code到channel中，由上传器校验state并换取令牌
+	result := make(chan error, 1)
+	timeout := time.NewTimer(tokenExchangeTimeout)
+	defer timeout.Stop()
+	select {
+	case s.notify <- model.TokenAction{
 		Action: "getToken",
 		Code:   code,
+		State:  state,
+		Result: result,
+	}:
+	case <-timeout.C:
+		renderCallback(c, http.StatusServiceUnavailable, fmt.Errorf("上传器没有响应，请稍后重试"))
+		return
+	case <-c.Request.Context().Done():
+		return
+	}
+
+	select {
+	case err := <-result:
+		if err != nil {
+			log.Warn("OneDrive授权回调处理失败: %v", err)
+			renderCallback(c, http.StatusBadRequest, err)
+			return
+		}
+		renderCallback(c, http.StatusOK, nil)
+	case <-timeout.C:
+		renderCallback(c, http.StatusGatewayTimeout, fmt.Errorf("获取令牌超时，请查看日志"))
+	case <-c.Request.Context().Done():
 	}
 }
@@ -0,0 +1,26 @@
+package handler
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 管理页面的静态文件，编译时嵌入程序
+//
+//go:embed web
+var webFiles embed.FS
+
+// 注册管理页面，页面通过管理接口读取数据
+func (s *AuthHandlerServer) registerDashboard() {
+	sub, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		panic(err)
+	}
+	s.router.StaticFS("/ui", http.FS(sub))
+	s.router.GET("/", func(c *gin.Context) {
+		c.Redirect(http.StatusFound, "/ui/")
+	})
+}
@@ -0,0 +1,218 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"auto-backup/db"
+	"auto-backup/model"
+	"auto-backup/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 运行记录列表默认返回的条数
+const defaultRunLimit = 50
+
+// JobController 管理接口查询和控制备份任务
+type JobController interface {
+	HasJob(id string) bool
+	Jobs() ([]*service.JobStatus, error)
+	Job(id string) (*service.JobStatus, error)
+	RunBackup(id string) error
+	Pause(id string) error
+	Resume(id string) error
+	Cancel(id string) error
+	Runs(id string, limit int) ([]*db.BackupRun, error)
+	Run(id, timestamp string) (*service.RunDetail, error)
+	RunLog(id, timestamp string) (string, error)
+	Restore(id string, req service.RestoreRequest) (*service.RestoreTask, error)
+	Restores() []*service.RestoreTask
+	AuthStatus() *service.AuthStatus
+	AuthURL() (string, error)
+	DeviceAuth() (*model.DeviceAuth, error)
+}
+
+// SetJobController 设置任务控制器，需要在Start之前调用，未设置时管理接口返回503
+func (s *AuthHandlerServer) SetJobController(jobs JobController) {
+	s.jobs = jobs
+}
+
+func (s *AuthHandlerServer) registerJobRoutes() {
+	api := s.router.Group("/", s.auth.middleware, s.requireJobs)
+	api.GET("/jobs", s.listJobs)
+	api.GET("/jobs/:id", s.getJob)
+	api.POST("/jobs/:id/backup", s.runBackup)
+	api.POST("/jobs/:id/pause", s.jobAction("paused", JobController.Pause))
+	api.POST("/jobs/:id/resume", s.jobAction("resumed", JobController.Resume))
+	api.POST("/jobs/:id/cancel", s.jobAction("cancelling", JobController.Cancel))
+	api.GET("/jobs/:id/runs", s.listRuns)
+	api.GET("/jobs/:id/runs/:timestamp", s.getRun)
+	api.GET("/jobs/:id/runs/:timestamp/log", s.getRunLog)
+	api.POST("/jobs/:id/restore", s.startRestore)
+	api.GET("/restores", s.listRestores)
+	api.GET("/auth/status", s.authStatus)
+	api.POST("/auth/url", s.authURL)
+	api.POST("/auth/device", s.deviceAuth)
+}
+
+// 没有设置任务控制器时管理接口不可用
+func (s *AuthHandlerServer) requireJobs(c *gin.Context) {
+	if s.jobs == nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "管理接口不可用"})
+		return
+	}
+	c.Next()
+}
+
+// 按错误类型返回对应的状态码
+func writeError(c *gin.Context, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, service.ErrJobNotFound), errors.Is(err, service.ErrRunNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, service.ErrJobRunning), errors.Is(err, service.ErrJobPaused), errors.Is(err, service.ErrAuthFlow):
+		status = http.StatusConflict
+	case errors.Is(err, service.ErrAuthDisabled):
+		status = http.StatusNotFound
+	}
+	c.JSON(status, gin.H{"error": err.Error()})
+}
+
+func (s *AuthHandlerServer) listJobs(c *gin.Context) {
+	jobs, err := s.jobs.Jobs()
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, jobs)
+}
+
+func (s *AuthHandlerServer) getJob(c *gin.Context) {
+	job, err := s.jobs.Job(c.Param("id"))
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+func (s *AuthHandlerServer) runBackup(c *gin.Context) {
+	id := c.Param("id")
+	if err := s.jobs.RunBackup(id); err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{
+		"id":     id,
+		"status": "started",
+	})
+}
+
+// 返回执行指定操作的处理函数，status为成功时返回的任务状态
+func (s *AuthHandlerServer) jobAction(status string, action func(JobController, string) error) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		if !s.jobs.HasJob(id) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "任务不存在: " + id})
+			return
+		}
+		if err := action(s.jobs, id); err != nil {
+			writeError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"id":     id,
+			"status": status,
+		})
+	}
+}
+
+func (s *AuthHandlerServer) listRuns(c *gin.Context) {
+	limit := defaultRunLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit必须是整数"})
+			return
+		}
+		limit = n
+	}
+
+	runs, err := s.jobs.Runs(c.Param("id"), limit)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, runs)
+}
+
+func (s *AuthHandlerServer) getRun(c *gin.Context) {
+	run, err := s.jobs.Run(c.Param("id"), c.Param("timestamp"))
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, run)
+}
+
+func (s *AuthHandlerServer) getRunLog(c *gin.Context) {
+	text, err := s.jobs.RunLog(c.Param("id"), c.Param("timestamp"))
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"timestamp": c.Param("timestamp"),
+		"log":       text,
+	})
+}
+
+func (s *AuthHandlerServer) startRestore(c *gin.Context) {
+	var req service.RestoreRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求格式错误: " + err.Error()})
+		return
+	}
+	if req.Timestamp == "" || req.OutputDir == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "需要指定timestamp和output"})
+		return
+	}
+
+	task, err := s.jobs.Restore(c.Param("id"), req)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusAccepted, task)
+}
+
+func (s *AuthHandlerServer) listRestores(c *gin.Context) {
+	c.JSON(http.StatusOK, s.jobs.Restores())
+}
+
+func (s *AuthHandlerServer) authStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, s.jobs.AuthStatus())
+}
+
+// 每次请求生成新的认证地址，避免多个页面共用同一个state
+func (s *AuthHandlerServer) authURL(c *gin.Context) {
+	url, err := s.jobs.AuthURL()
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"auth_url": url})
+}
+
+// 开始设备代码认证，返回用户需要在验证页面输入的代码
+func (s *AuthHandlerServer) deviceAuth(c *gin.Context) {
+	auth, err := s.jobs.DeviceAuth()
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, auth)
+}
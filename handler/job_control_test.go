@@ -0,0 +1,165 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"auto-backup/db"
+	"auto-backup/model"
+	"auto-backup/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 只有任务job，所有操作返回err
+type fakeJobs struct {
+	err error
+}
+
+func (f *fakeJobs) HasJob(id string) bool { return id == "job" }
+
+func (f *fakeJobs) Jobs() ([]*service.JobStatus, error) { return nil, f.err }
+
+func (f *fakeJobs) Job(id string) (*service.JobStatus, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &service.JobStatus{}, nil
+}
+
+func (f *fakeJobs) RunBackup(id string) error { return f.err }
+func (f *fakeJobs) Pause(id string) error     { return f.err }
+func (f *fakeJobs) Resume(id string) error    { return f.err }
+func (f *fakeJobs) Cancel(id string) error    { return f.err }
+
+func (f *fakeJobs) Runs(id string, limit int) ([]*db.BackupRun, error) { return nil, f.err }
+
+func (f *fakeJobs) Run(id, timestamp string) (*service.RunDetail, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &service.RunDetail{}, nil
+}
+
+func (f *fakeJobs) RunLog(id, timestamp string) (string, error) { return "", f.err }
+
+func (f *fakeJobs) Restore(id string, req service.RestoreRequest) (*service.RestoreTask, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &service.RestoreTask{BackupID: id, Timestamp: req.Timestamp}, nil
+}
+
+func (f *fakeJobs) Restores() []*service.RestoreTask { return nil }
+
+func (f *fakeJobs) AuthStatus() *service.AuthStatus { return &service.AuthStatus{} }
+
+func (f *fakeJobs) AuthURL() (string, error) { return "https://login.example.com", f.err }
+
+func (f *fakeJobs) DeviceAuth() (*model.DeviceAuth, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &model.DeviceAuth{UserCode: "CODE"}, nil
+}
+
+func newJobTestServer(t *testing.T, jobs JobController) *AuthHandlerServer {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	s, err := NewAuthHandlerServer(ServerOptions{Addr: "127.0.0.1:0"}, nil)
+	if err != nil {
+		t.Fatalf("NewAuthHandlerServer() error = %v", err)
+	}
+	if jobs != nil {
+		s.SetJobController(jobs)
+	}
+	s.registerJobRoutes()
+	return s
+}
+
+func serve(s *AuthHandlerServer, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	return w
+}
+
+func TestWriteError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "任务不存在", err: fmt.Errorf("%w: %s", service.ErrJobNotFound, "job"), want: http.StatusNotFound},
+		{name: "运行记录不存在", err: fmt.Errorf("%w: %s", service.ErrRunNotFound, "20260101_000000"), want: http.StatusNotFound},
+		{name: "任务正在运行", err: service.ErrJobRunning, want: http.StatusConflict},
+		{name: "任务已暂停", err: service.ErrJobPaused, want: http.StatusConflict},
+		{name: "认证方式不同", err: service.ErrAuthFlow, want: http.StatusConflict},
+		{name: "没有配置上传", err: service.ErrAuthDisabled, want: http.StatusNotFound},
+		{name: "其他错误", err: errors.New("数据库错误"), want: http.StatusInternalServerError},
+	}
+	gin.SetMode(gin.TestMode)
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		writeError(c, tt.err)
+		if w.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.want)
+		}
+		if !strings.Contains(w.Body.String(), tt.err.Error()) {
+			t.Errorf("%s: body = %s, want error message", tt.name, w.Body.String())
+		}
+	}
+}
+
+func TestJobRoutesStatus(t *testing.T) {
+	restore := `{"timestamp":"20260101_000000","output":"/tmp/restore"}`
+	tests := []struct {
+		name   string
+		err    error
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{name: "任务列表", method: "GET", path: "/jobs", want: http.StatusOK},
+		{name: "任务不存在", err: fmt.Errorf("%w: %s", service.ErrJobNotFound, "other"), method: "GET", path: "/jobs/other", want: http.StatusNotFound},
+		{name: "开始备份", method: "POST", path: "/jobs/job/backup", want: http.StatusAccepted},
+		{name: "备份正在运行", err: service.ErrJobRunning, method: "POST", path: "/jobs/job/backup", want: http.StatusConflict},
+		{name: "备份已暂停", err: service.ErrJobPaused, method: "POST", path: "/jobs/job/backup", want: http.StatusConflict},
+		{name: "暂停", method: "POST", path: "/jobs/job/pause", want: http.StatusOK},
+		{name: "暂停不存在的任务", method: "POST", path: "/jobs/other/pause", want: http.StatusNotFound},
+		{name: "恢复失败", err: errors.New("数据库错误"), method: "POST", path: "/jobs/job/resume", want: http.StatusInternalServerError},
+		{name: "取消不存在的任务", method: "POST", path: "/jobs/other/cancel", want: http.StatusNotFound},
+		{name: "运行记录limit错误", method: "GET", path: "/jobs/job/runs?limit=abc", want: http.StatusBadRequest},
+		{name: "运行记录不存在", err: fmt.Errorf("%w: %s", service.ErrRunNotFound, "x"), method: "GET", path: "/jobs/job/runs/x", want: http.StatusNotFound},
+		{name: "运行日志不存在", err: fmt.Errorf("%w: %s", service.ErrRunNotFound, "x"), method: "GET", path: "/jobs/job/runs/x/log", want: http.StatusNotFound},
+		{name: "开始还原", method: "POST", path: "/jobs/job/restore", body: restore, want: http.StatusAccepted},
+		{name: "还原缺少参数", method: "POST", path: "/jobs/job/restore", body: `{"timestamp":"20260101_000000"}`, want: http.StatusBadRequest},
+		{name: "还原请求格式错误", method: "POST", path: "/jobs/job/restore", body: `{`, want: http.StatusBadRequest},
+		{name: "认证地址", method: "POST", path: "/auth/url", want: http.StatusOK},
+		{name: "没有配置上传", err: service.ErrAuthDisabled, method: "POST", path: "/auth/url", want: http.StatusNotFound},
+		{name: "设备代码认证方式不同", err: service.ErrAuthFlow, method: "POST", path: "/auth/device", want: http.StatusConflict},
+	}
+	for _, tt := range tests {
+		s := newJobTestServer(t, &fakeJobs{err: tt.err})
+		w := serve(s, tt.method, tt.path, tt.body)
+		if w.Code != tt.want {
+			t.Errorf("%s: %s %s status = %d, want %d, body = %s", tt.name, tt.method, tt.path, w.Code, tt.want, w.Body.String())
+		}
+	}
+}
+
+func TestJobRoutesWithoutController(t *testing.T) {
+	s := newJobTestServer(t, nil)
+	if w := serve(s, "GET", "/jobs", ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,319 @@
+// 管理页面：定时读取管理接口并显示任务、运行历史和认证状态
+"use strict";
+
+const HISTORY_RUNS = 30; // 图表和表格中显示的运行次数
+const REFRESH_IDLE = 10000; // 没有正在运行的备份时的刷新间隔(毫秒)
+const REFRESH_RUNNING = 2000; // 有正在运行的备份时的刷新间隔(毫秒)
+
+const STATUS_TEXT = {
+  success: "成功",
+  failed: "失败",
+  running: "运行中",
+  interrupted: "中断",
+  cancelled: "已取消",
+  paused: "已暂停",
+};
+
+const TOKEN_KEY = "auto-backup-token"; // 访问令牌在sessionStorage中的键
+
+let timer = null;
+let device = null; // 正在进行的设备代码认证及开始时令牌的过期时间
+
+class UnauthorizedError extends Error {}
+
+async function api(method, path, body) {
+  const opts = { method, headers: {} };
+  const token = sessionStorage.getItem(TOKEN_KEY);
+  if (token) {
+    opts.headers["Authorization"] = "Bearer " + token;
+  }
+  if (body !== undefined) {
+    opts.headers["Content-Type"] = "application/json";
+    opts.body = JSON.stringify(body);
+  }
+  const resp = await fetch(path, opts);
+  const data = await resp.json().catch(() => ({}));
+  if (resp.status === 401) {
+    throw new UnauthorizedError(data.error || "未认证");
+  }
+  if (!resp.ok) {
+    throw new Error(data.error || resp.status + " " + resp.statusText);
+  }
+  return data;
+}
+
+// 管理接口使用访问令牌认证时显示输入框，Basic认证由浏览器弹出登录框
+function showLogin() {
+  const input = el("input", { type: "password", placeholder: "访问令牌", autocomplete: "current-password" });
+  const form = el("form", {
+    class: "login",
+    onsubmit: (e) => {
+      e.preventDefault();
+      sessionStorage.setItem(TOKEN_KEY, input.value);
+      showError(null);
+      refresh();
+    },
+  }, "需要认证，请输入管理接口的访问令牌: ", input, el("button", { type: "submit" }, "登录"));
+  const box = document.getElementById("error");
+  box.hidden = false;
+  box.replaceChildren(form);
+  input.focus();
+}
+
+function el(tag, attrs, ...children) {
+  const node = document.createElement(tag);
+  for (const [k, v] of Object.entries(attrs || {})) {
+    if (k.startsWith("on")) {
+      node.addEventListener(k.slice(2), v);
+    } else if (v !== false && v !== null && v !== undefined) {
+      node.setAttribute(k, v === true ? "" : v);
+    }
+  }
+  for (const child of children.flat()) {
+    if (child !== null && child !== undefined) {
+      node.append(child instanceof Node ? child : String(child));
+    }
+  }
+  return node;
+}
+
+function svg(tag, attrs, ...children) {
+  const node = document.createElementNS("http://www.w3.org/2000/svg", tag);
+  for (const [k, v] of Object.entries(attrs || {})) {
+    node.setAttribute(k, v);
+  }
+  node.append(...children);
+  return node;
+}
+
+function isZeroTime(t) {
+  return !t || t.startsWith("0001-");
+}
+
+function formatTime(t) {
+  return isZeroTime(t) ? "-" : new Date(t).toLocaleString();
+}
+
+function formatBytes(n) {
+  const units = ["B", "KB", "MB", "GB", "TB"];
+  let i = 0;
+  while (n >= 1024 && i < units.length - 1) {
+    n /= 1024;
+    i++;
+  }
+  return (i === 0 ? n : n.toFixed(1)) + " " + units[i];
+}
+
+function formatDuration(run) {
+  if (isZeroTime(run.finished_at)) {
+    return "-";
+  }
+  const s = Math.round((new Date(run.finished_at) - new Date(run.started_at)) / 1000);
+  return s < 60 ? s + "秒" : Math.floor(s / 60) + "分" + (s % 60) + "秒";
+}
+
+function statusBadge(status) {
+  return el("span", { class: "status status-" + status }, STATUS_TEXT[status] || status || "-");
+}
+
+function showError(err) {
+  if (err instanceof UnauthorizedError) {
+    sessionStorage.removeItem(TOKEN_KEY);
+    showLogin();
+    return;
+  }
+  const box = document.getElementById("error");
+  box.hidden = !err;
+  box.textContent = err ? err.message : "";
+}
+
+// 柱状图，从旧到新排列，颜色表示运行状态
+function barChart(title, runs, value, format) {
+  const width = 600;
+  const height = 120;
+  const max = Math.max(1, ...runs.map(value));
+  const step = width / Math.max(runs.length, 1);
+  const bars = runs.map((run, i) => {
+    const h = Math.max(1, (value(run) / max) * (height - 10));
+    return svg("rect", {
+      x: i * step + 1,
+      y: height - h,
+      width: Math.max(1, step - 2),
+      height: h,
+      class: "bar-" + run.status,
+    }, svg("title", {}, run.timestamp + ": " + format(value(run))));
+  });
+  return el("div", { class: "chart" },
+    el("h3", {}, title + "（最大 " + format(max) + "）"),
+    svg("svg", { viewBox: `0 0 ${width} ${height}`, preserveAspectRatio: "none" }, ...bars));
+}
+
+async function action(method, path, body) {
+  try {
+    await api(method, path, body);
+    showError(null);
+  } catch (err) {
+    showError(err);
+  }
+  refresh();
+}
+
+async function showLog(jobId, timestamp) {
+  const dialog = document.getElementById("log-dialog");
+  document.getElementById("log-title").textContent = jobId + " " + timestamp;
+  document.getElementById("log-text").textContent = "加载中...";
+  dialog.showModal();
+  try {
+    const data = await api("GET", `/jobs/${encodeURIComponent(jobId)}/runs/${timestamp}/log`);
+    document.getElementById("log-text").textContent = data.log || "(没有日志)";
+  } catch (err) {
+    document.getElementById("log-text").textContent = err.message;
+  }
+}
+
+function renderJob(job, runs) {
+  const id = encodeURIComponent(job.id);
+  const state = job.state || {};
+  const status = job.running ? "running" : job.paused ? "paused" : state.last_status;
+
+  const children = [
+    el("h2", {}, job.id, " ", statusBadge(status)),
+    el("div", { class: "meta" },
+      el("span", {}, "源目录: ", el("b", {}, job.src_dir)),
+      el("span", {}, "存储模式: ", el("b", {}, job.mode || "archive")),
+      el("span", {}, "计划: ", el("b", {}, job.cron || "-")),
+      el("span", {}, "下一次计划备份: ", el("b", {}, formatTime(job.next_run))),
+      el("span", {}, "最近一次运行: ", el("b", {}, formatTime(state.last_run_at))),
+      el("span", {}, "最近一次成功: ", el("b", {}, formatTime(state.last_success_at)))),
+  ];
+  if (state.last_error) {
+    children.push(el("p", { class: "error" }, state.last_error));
+  }
+
+  if (job.running && job.progress) {
+    const p = job.progress;
+    const percent = p.files_total > 0 ? Math.floor((p.files_done / p.files_total) * 100) : 0;
+    children.push(
+      el("div", { class: "progress" }, el("div", { style: `width: ${percent}%` })),
+      el("div", { class: "meta" },
+        el("span", {}, "开始时间: ", el("b", {}, formatTime(job.started_at))),
+        el("span", {}, "文件: ", el("b", {}, `${p.files_done} / ${p.files_total}`)),
+        el("span", {}, "已写入: ", el("b", {}, formatBytes(p.bytes_done)))));
+  }
+
+  children.push(el("div", { class: "actions" },
+    el("button", {
+      class: "primary",
+      disabled: job.running || job.paused,
+      onclick: () => action("POST", `/jobs/${id}/backup`),
+    }, "立即备份"),
+    job.paused
+      ? el("button", { onclick: () => action("POST", `/jobs/${id}/resume`) }, "恢复")
+      : el("button", { onclick: () => action("POST", `/jobs/${id}/pause`) }, "暂停"),
+    el("button", {
+      class: "danger",
+      disabled: !job.running,
+      onclick: () => confirm("确定取消正在运行的备份？") && action("POST", `/jobs/${id}/cancel`),
+    }, "取消")));
+
+  const history = runs.slice().reverse();
+  children.push(el("div", { class: "charts" },
+    barChart("备份大小", history, (r) => r.total_size, formatBytes),
+    barChart("文件数量", history, (r) => r.file_count, String)));
+
+  children.push(el("table", {},
+    el("thead", {}, el("tr", {},
+      ["时间", "状态", "文件", "大小", "耗时", "错误", ""].map((h) => el("th", {}, h)))),
+    el("tbody", {}, runs.map((run) => el("tr", {},
+      el("td", {}, formatTime(run.started_at)),
+      el("td", {}, statusBadge(run.status)),
+      el("td", {}, run.file_count),
+      el("td", {}, formatBytes(run.total_size)),
+      el("td", {}, formatDuration(run)),
+      el("td", { class: "error-text" }, run.error),
+      el("td", {}, el("button", { onclick: () => showLog(job.id, run.timestamp) }, "日志")))))));
+
+  return el("section", { class: "card" }, children);
+}
+
+function renderAuth(auth) {
+  const box = document.getElementById("auth");
+  box.replaceChildren();
+  if (!auth.enabled) {
+    box.append("未配置OneDrive上传");
+    return;
+  }
+  box.append(auth.authenticated
+    ? "OneDrive已认证，令牌有效期至 " + formatTime(auth.expires_at)
+    : "OneDrive未认证");
+
+  // 令牌更新或代码过期后不再显示设备代码
+  if (device && (device.expiresAt !== auth.expires_at || new Date(device.code.expires_at) < new Date())) {
+    device = null;
+  }
+  if (device) {
+    box.append(el("span", {}, "在 ",
+      el("a", { href: device.code.verification_uri, target: "_blank", rel: "noopener" }, device.code.verification_uri),
+      " 输入代码 ", el("b", {}, device.code.user_code)));
+    return;
+  }
+  const start = auth.flow === "device" ? () => startDeviceAuth(auth) : startAuth;
+  box.append(el("button", { onclick: start }, auth.authenticated ? "重新认证" : "认证"));
+}
+
+// 设备代码认证不需要回调，在任意设备上打开验证页面输入代码即可，程序在后台等待授权完成
+async function startDeviceAuth(auth) {
+  try {
+    const code = await api("POST", "/auth/device");
+    device = { code, expiresAt: auth.expires_at };
+    showError(null);
+  } catch (err) {
+    showError(err);
+  }
+  refresh();
+}
+
+// 每次认证都向服务端申请新的认证地址，地址中的state和PKCE校验码只能使用一次。
+// 窗口需要在点击事件中同步打开，否则会被浏览器拦截
+async function startAuth() {
+  const win = window.open("", "_blank");
+  try {
+    const data = await api("POST", "/auth/url");
+    if (win) {
+      win.location = data.auth_url;
+    } else {
+      window.location = data.auth_url;
+    }
+  } catch (err) {
+    if (win) {
+      win.close();
+    }
+    showError(err);
+  }
+}
+
+async function refresh() {
+  clearTimeout(timer);
+  let running = false;
+  try {
+    const [jobs, auth] = await Promise.all([api("GET", "/jobs"), api("GET", "/auth/status")]);
+    const runs = await Promise.all(jobs.map((job) =>
+      api("GET", `/jobs/${encodeURIComponent(job.id)}/runs?limit=${HISTORY_RUNS}`)));
+
+    renderAuth(auth);
+    document.getElementById("jobs").replaceChildren(...jobs.map((job, i) => renderJob(job, runs[i])));
+    running = jobs.some((job) => job.running);
+  } catch (err) {
+    showError(err);
+    if (err instanceof UnauthorizedError) {
+      return;
+    }
+  }
+  timer = setTimeout(refresh, running ? REFRESH_RUNNING : REFRESH_IDLE);
+}
+
+document.getElementById("log-close").addEventListener("click", () => {
+  document.getElementById("log-dialog").close();
+});
+
+refresh();
@@ -168,6 +168,7 @@ func print(level LogLevel, data string) {
 	case DEBUG:
 		logger.Debug(data, "source", source)
 	}
+	record(level, data)
 }
 
 // 将自定义日志级别转换为 slog 级别
@@ -0,0 +1,80 @@
+package log
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Recorder 收集从创建到Stop之间输出的日志，用于保存单次备份运行的日志。
+// 只保留最后max行，之前的行只记录数量
+type Recorder struct {
+	mu      sync.Mutex
+	lines   []string
+	max     int
+	dropped int
+}
+
+var (
+	recordersMu sync.Mutex
+	recorders   = make(map[*Recorder]bool)
+)
+
+// NewRecorder 创建并开始记录日志，最多保留max行
+func NewRecorder(max int) *Recorder {
+	r := &Recorder{max: max}
+	recordersMu.Lock()
+	recorders[r] = true
+	recordersMu.Unlock()
+	return r
+}
+
+// Stop 停止记录，之前记录的内容仍然可以读取
+func (r *Recorder) Stop() {
+	recordersMu.Lock()
+	delete(recorders, r)
+	recordersMu.Unlock()
+}
+
+// String 返回记录的日志，每行一条
+func (r *Recorder) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var sb strings.Builder
+	if r.dropped > 0 {
+		fmt.Fprintf(&sb, "... 省略了之前的%d行\n", r.dropped)
+	}
+	for _, line := range r.lines {
+		sb.WriteString(line)
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+func (r *Recorder) add(line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.lines) >= r.max {
+		n := len(r.lines) - r.max + 1
+		r.lines = append(r.lines[:0], r.lines[n:]...)
+		r.dropped += n
+	}
+	r.lines = append(r.lines, line)
+}
+
+// 把一条日志追加到所有正在记录的Recorder
+func record(level LogLevel, data string) {
+	recordersMu.Lock()
+	defer recordersMu.Unlock()
+	if len(recorders) == 0 {
+		return
+	}
+
+	line := fmt.Sprintf("%s %s %s", time.Now().Format(time.DateTime), strings.ToUpper(level.String()), data)
+	for r := range recorders {
+		r.add(line)
+	}
+}
@@ -6,7 +6,9 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"auto-backup/archive"
 	"auto-backup/config"
 	"auto-backup/db"
 	"auto-backup/handler"
@@ -27,6 +29,16 @@ func initConfig() (*config.Config, bool, error) {
 
 	needUpload := true
 
+	if os.Getenv("AUTH_FLOW") != "" {
+		cfg.OneDrive.AuthFlow = os.Getenv("AUTH_FLOW")
+	}
+	if cfg.OneDrive.AuthFlow, err = uploader.ParseAuthFlow(cfg.OneDrive.AuthFlow); err != nil {
+		log.Error("解析认证方式失败: %v", err)
+		return nil, false, err
+	}
+	// 设备代码认证不需要client_secret和回调地址
+	needCallback := cfg.OneDrive.AuthFlow == uploader.AuthFlowCode
+
 	// 配置信息中client_id和client_secret从环境变量中获取，如果没有设置，则使用配置文件中的值
 	if os.Getenv("CLIENT_ID") != "" {
 		cfg.OneDrive.ClientID = os.Getenv("CLIENT_ID")
@@ -35,12 +47,12 @@ func initConfig() (*config.Config, bool, error) {
 	}
 	if os.Getenv("CLIENT_SECRET") != "" {
 		cfg.OneDrive.ClientSecret = os.Getenv("CLIENT_SECRET")
-	} else {
+	} else if needCallback {
 		needUpload = false
 	}
 	if os.Getenv("REDIRECT_URI") != "" {
 		cfg.OneDrive.RedirectURI = os.Getenv("REDIRECT_URI")
-	} else {
+	} else if needCallback {
 		needUpload = false
 	}
 	if os.Getenv("BACKUP_PASSWORD") != "" {
@@ -52,6 +64,17 @@ func initConfig() (*config.Config, bool, error) {
 		cfg.OneDrive.BasePath = "backup"
 	}
 
+	// 容器中需要监听所有地址才能通过映射的端口访问，此时必须配置访问令牌
+	if os.Getenv("SERVER_LISTEN") != "" {
+		cfg.Server.Listen = os.Getenv("SERVER_LISTEN")
+	}
+	if os.Getenv("SERVER_TOKEN") != "" {
+		cfg.Server.Tokens = append(cfg.Server.Tokens, os.Getenv("SERVER_TOKEN"))
+	}
+	if cfg.Server.Listen == "" {
+		cfg.Server.Listen = "127.0.0.1:8080"
+	}
+
 	if os.Getenv("FORCE_FULL_BACKUP") != "" {
 		cfg.Backup.ForceFullBackup = os.Getenv("FORCE_FULL_BACKUP") == "true"
 	}
@@ -87,45 +110,228 @@ func main() {
 
 	var store *uploader.OneDriveUploader = nil
 
-	if needUpload {
-		// 启动http服务
-		server := handler.NewAuthHandlerServer(8080, actionChan)
+	// 启动http服务，提供授权回调和管理接口，只在后台运行的进程中启动，
+	// 命令行子命令不监听端口，可以和后台程序同时运行。
+	// 任务在配置解析完成后加入，之前访问任务的接口返回404。
+	// 不上传或使用设备代码认证时没有接收授权回调的上传器，回调直接返回失败页面
+	daemon := len(os.Args) == 1
+	var notify chan model.TokenAction
+	if daemon && needUpload && config.OneDrive.AuthFlow == uploader.AuthFlowCode {
+		notify = actionChan
+	}
+	jobs := service.NewJobController(ctx)
+	server, err := handler.NewAuthHandlerServer(handler.ServerOptions{
+		Addr:     config.Server.Listen,
+		CertFile: config.Server.TLSCert,
+		KeyFile:  config.Server.TLSKey,
+		Tokens:   config.Server.Tokens,
+		Users:    config.Server.Users,
+	}, notify)
+	if err != nil {
+		log.Error("HTTP服务配置错误: %v", err)
+		return
+	}
+	server.SetJobController(jobs)
+	if daemon {
 		server.Start(ctx)
+	}
+
+	if needUpload {
 
 		onedriveConfig := &uploader.OneDriveConfig{
 			ClientID:     config.OneDrive.ClientID,
 			ClientSecret: config.OneDrive.ClientSecret,
 			Scope:        config.OneDrive.Scope,
 			RedirectURI:  config.OneDrive.RedirectURI,
+			AuthFlow:     config.OneDrive.AuthFlow,
 		}
 
-		store, err = uploader.NewOneDriveUploader(onedriveConfig, actionChan, doneChan, ctx)
+		store, err = uploader.NewOneDriveUploader(onedriveConfig, notify, doneChan, ctx)
 		if err != nil {
 			log.Error("初始化OneDrive上传器失败: %v", err)
 			return
 		}
+		if config.OneDrive.AuthFlow == uploader.AuthFlowDevice {
+			jobs.SetDeviceAuthFunc(store.StartDeviceAuth)
+		} else {
+			jobs.SetAuthURLFunc(store.GetAuthUrl)
+		}
 
-		store.DoAuthInit()
+		if err := store.DoAuthInit(); err != nil {
+			log.Error("OneDrive认证失败: %v", err)
+			// 子命令不能等待认证，不使用OneDrive继续执行，后台程序可以通过管理页面重新认证
+			if !daemon {
+				store = nil
+			}
+		}
 	}
 
-	backupInfo := service.BackupInfo{
-		SrcDir:    config.Backup.RootDir,
-		OutputDir: config.Backup.OutputDir,
-		Password:  config.Backup.Password,
-		ForceFull: config.Backup.ForceFullBackup,
-		Cron:      config.Backup.Cron,
-		BasePath:  config.OneDrive.BasePath,
-		Uploader:  store,
+	// 未配置上传时保持接口为nil，避免持有空指针的接口
+	var up uploader.Uploader
+	if store != nil {
+		up = store
+	}
+
+	// 带参数运行时执行子命令后退出
+	if len(os.Args) > 1 {
+		if err := runCommand(config, up, os.Args[1:]); err != nil {
+			log.Error("执行命令失败: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	format, err := archive.ParseFormat(config.Backup.Format)
+	if err != nil {
+		log.Error("解析压缩格式失败: %v", err)
+		return
+	}
+
+	startupRun, err := service.ParseStartupRun(config.Backup.StartupRun)
+	if err != nil {
+		log.Error("解析启动备份策略失败: %v", err)
+		return
+	}
+
+	compression, err := service.ParseCompression(config.Backup.CompressionLevel, format)
+	if err != nil {
+		log.Error("解析压缩级别失败: %v", err)
+		return
+	}
+
+	sqliteCapture, err := service.ParseSQLiteCapture(config.Backup.SQLiteCapture)
+	if err != nil {
+		log.Error("解析SQLite读取方式失败: %v", err)
+		return
+	}
+
+	sources := make([]service.CommandSource, 0, len(config.Backup.CommandSources))
+	for _, src := range config.Backup.CommandSources {
+		sources = append(sources, service.CommandSource{
+			Name:    src.Name,
+			Command: src.Command,
+			Timeout: time.Duration(src.Timeout) * time.Second,
+		})
+	}
+	if err := service.ValidateSources(sources); err != nil {
+		log.Error("命令源配置错误: %v", err)
+		return
+	}
+
+	mode, err := service.ParseMode(config.Backup.Mode)
+	if err != nil {
+		log.Error("解析存储模式失败: %v", err)
+		return
+	}
+	if mode == service.ModeRepository && config.Backup.Password == "" {
+		log.Error("repository模式需要配置备份密码")
+		return
+	}
+	if mode == service.ModeRepository && len(sources) > 0 {
+		log.Error("repository模式不支持命令源，请删除command_sources或使用archive模式")
+		return
+	}
+
+	if config.Backup.StreamUpload && up == nil {
+		log.Error("stream_upload需要配置OneDrive上传")
+		return
+	}
+
+	if config.Backup.ParityRedundancy < 0 || config.Backup.ParityRedundancy > 100 {
+		log.Error("parity_redundancy必须在0-100之间: %d", config.Backup.ParityRedundancy)
+		return
+	}
+	if config.Backup.ParityRedundancy > 0 && config.Backup.StreamUpload {
+		log.Error("stream_upload模式不在本地保存分片，无法生成恢复数据，请将parity_redundancy设为0或关闭stream_upload")
+		return
 	}
 
-	backupInfo.StartScheduledBackup()
+	recipients, err := archive.LoadRecipients(config.Backup.AgeRecipients, config.Backup.AgeRecipientsFile)
+	if err != nil {
+		log.Error("加载age公钥失败: %v", err)
+		return
+	}
+	if len(recipients) > 0 {
+		log.Info("使用age公钥加密分片, 共%d个公钥", len(recipients))
+	} else if config.Backup.EncryptNames {
+		if config.Backup.Password == "" {
+			log.Error("encrypt_names需要配置备份密码")
+			return
+		}
+		log.Info("使用密码加密整个分片, 文件名和目录结构不可见")
+	} else if format == archive.FormatTarZst && config.Backup.Password != "" {
+		log.Warn("tar.zst格式不支持文件密码，分片内容不会加密，可以开启encrypt_names")
+	}
 
-	// 启动时执行一次备份
-	backupInfo.Backup()
+	backupInfo := service.BackupInfo{
+		SrcDir:        config.Backup.RootDir,
+		OutputDir:     config.Backup.OutputDir,
+		Password:      config.Backup.Password,
+		ForceFull:     config.Backup.ForceFullBackup,
+		Cron:          config.Backup.Cron,
+		BasePath:      config.OneDrive.BasePath,
+		Uploader:      up,
+		Format:        format,
+		ZstdLevel:     config.Backup.ZstdLevel,
+		ZstdLongRange: config.Backup.ZstdLongRange,
+		Recipients:    recipients,
+		EncryptNames:  config.Backup.EncryptNames,
+		Mode:          mode,
+		Delta:         config.Backup.DeltaBackup,
+		PartSize:      config.Backup.PartSize * 1024 * 1024,
+		Compression:   compression,
+		Stream:        config.Backup.StreamUpload,
+		Parity:        config.Backup.ParityRedundancy,
+		WatchDebounce: time.Duration(config.Backup.WatchDebounce) * time.Second,
+		WatchMaxDelay: time.Duration(config.Backup.WatchMaxDelay) * time.Second,
+		Sources:       sources,
+		SQLiteCapture: sqliteCapture,
+		SQLitePaths:   config.Backup.SQLitePaths,
+		Hooks: service.Hooks{
+			PreBackup:         config.Backup.Hooks.PreBackup,
+			PostBackup:        config.Backup.Hooks.PostBackup,
+			OnSuccess:         config.Backup.Hooks.OnSuccess,
+			OnFailure:         config.Backup.Hooks.OnFailure,
+			Timeout:           time.Duration(config.Backup.Hooks.Timeout) * time.Second,
+			AbortOnPreFailure: config.Backup.Hooks.AbortOnPreFailure,
+			SkipOnWatch:       config.Backup.Hooks.SkipOnWatch,
+		},
+		ModifiedRetries: config.Backup.ModifiedRetries,
+	}
 
-	// 等待退出信号
+	// 收到退出信号时取消ctx，正在运行的备份在安全的位置停止，再次收到信号时立即退出
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
-	log.Info("收到退出信号,程序退出")
+	go func() {
+		<-quit
+		log.Info("收到退出信号,停止正在运行的备份")
+		cancel()
+		<-quit
+		log.Warn("再次收到退出信号,立即退出")
+		os.Exit(1)
+	}()
+
+	jobs.AddJob(&backupInfo)
+
+	// 执行命令行和HTTP接口的暂停、恢复和取消
+	go backupInfo.WatchControl(ctx)
+
+	backupInfo.StartScheduledBackup(ctx)
+
+	// 监听模式下文件变化后自动备份，计划的备份仍然会遍历整个目录
+	if config.Backup.Watch {
+		go func() {
+			if err := backupInfo.Watch(ctx); err != nil {
+				log.Error("监听目录失败: %v", err)
+			}
+		}()
+	}
+
+	// 按启动策略补做错过的备份
+	backupInfo.RunAtStartup(ctx, startupRun)
+
+	// 等待退出信号，正在运行的备份记录为中断后再退出
+	<-ctx.Done()
+	service.WaitIdle()
+	log.Info("程序退出")
 }
@@ -0,0 +1,11 @@
+package model
+
+import "time"
+
+// DeviceAuth 设备代码认证中需要用户在浏览器中输入的代码
+type DeviceAuth struct {
+	UserCode        string    `json:"user_code"`
+	VerificationURI string    `json:"verification_uri"`
+	ExpiresAt       time.Time `json:"expires_at"`
+	Message         string    `json:"message"` // 授权服务返回的完整提示
+}
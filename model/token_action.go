@@ -3,4 +3,6 @@ package model
 type TokenAction struct {
 	Action string
 	Code   string
+	State  string     // 授权回调中的state，用于找到对应的授权请求
+	Result chan error // 不为nil时返回处理结果，需要有缓冲
 }
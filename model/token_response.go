@@ -11,6 +11,9 @@ type TokenResponse struct {
 	AccessToken  string `json:"access_token,omitempty"`
 	RefreshToken string `json:"refresh_token,omitempty"`
 	UserID       string `json:"user_id,omitempty"`
+	// 请求失败时的错误码和说明，例如invalid_grant
+	Error            string `json:"error,omitempty"`
+	ErrorDescription string `json:"error_description,omitempty"`
 }
 
 func (t *TokenResponse) UnmarshalJSON(data []byte) error {
@@ -0,0 +1,398 @@
+// Package parity 为分片生成Reed-Solomon恢复数据，分片损坏时用于修复。
+//
+// 分片按固定大小分块，所有块交错分配到多个条带中(第i块属于第i%条带数个条带)，
+// 每个条带单独计算校验块，连续的损坏会分散到不同条带，提高可修复的连续损坏长度。
+// 恢复文件中保存每个数据块和校验块的哈希，用于定位损坏的块。
+//
+// 恢复文件格式:
+//
+//	头部: magic | 块大小 | 分片大小 | 每条带数据块数 | 每条带校验块数 | 条带数 | 分片SHA256
+//	数据块哈希表 | 校验块哈希表 | 以上内容的SHA256
+//	校验块，按条带顺序排列
+package parity
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+const (
+	// Ext 恢复文件的扩展名，追加在分片文件名之后
+	Ext = ".par"
+
+	// BlockSize 分块大小
+	BlockSize = 64 * 1024
+
+	// 每个条带最多的数据块数，数据块和校验块合计不能超过256
+	maxDataShards = 128
+
+	hashSize   = 16 // 每块哈希的长度，取SHA256的前16字节
+	magic      = "ABPAR001"
+	headerSize = len(magic) + 4 + 8 + 4 + 4 + 4 + sha256.Size
+)
+
+var (
+	ErrInvalid       = errors.New("恢复文件已损坏")
+	ErrUnrecoverable = errors.New("损坏的数据超过恢复数据的修复能力")
+)
+
+// 恢复文件的布局
+type layout struct {
+	blockSize int
+	size      int64 // 分片大小
+	data      int   // 每个条带的数据块数
+	parity    int   // 每个条带的校验块数
+	stripes   int
+	hash      [sha256.Size]byte // 整个分片的SHA256
+}
+
+func newLayout(size int64, redundancy int) layout {
+	blocks := int((size + BlockSize - 1) / BlockSize)
+	if blocks == 0 {
+		blocks = 1
+	}
+	stripes := (blocks + maxDataShards - 1) / maxDataShards
+	data := (blocks + stripes - 1) / stripes
+	parity := max((data*redundancy+99)/100, 1)
+	return layout{blockSize: BlockSize, size: size, data: data, parity: parity, stripes: stripes}
+}
+
+// 分片中的数据块数
+func (l layout) blocks() int {
+	return int((l.size + int64(l.blockSize) - 1) / int64(l.blockSize))
+}
+
+// 条带s中第j个数据块在分片中的序号，超出分片的块视为全0
+func (l layout) block(s, j int) int {
+	return s + j*l.stripes
+}
+
+// 数据块的实际长度，最后一块可能不足blockSize
+func (l layout) blockLen(i int) int {
+	off := int64(i) * int64(l.blockSize)
+	if off >= l.size {
+		return 0
+	}
+	return int(min(int64(l.blockSize), l.size-off))
+}
+
+func (l layout) metaSize() int64 {
+	return int64(headerSize + (l.blocks()+l.stripes*l.parity)*hashSize + sha256.Size)
+}
+
+// 第s个条带第j个校验块在恢复文件中的偏移
+func (l layout) parityOffset(s, j int) int64 {
+	return l.metaSize() + int64(s*l.parity+j)*int64(l.blockSize)
+}
+
+func (l layout) encodeHeader() []byte {
+	h := make([]byte, 0, headerSize)
+	h = append(h, magic...)
+	h = binary.BigEndian.AppendUint32(h, uint32(l.blockSize))
+	h = binary.BigEndian.AppendUint64(h, uint64(l.size))
+	h = binary.BigEndian.AppendUint32(h, uint32(l.data))
+	h = binary.BigEndian.AppendUint32(h, uint32(l.parity))
+	h = binary.BigEndian.AppendUint32(h, uint32(l.stripes))
+	return append(h, l.hash[:]...)
+}
+
+func blockHash(b []byte) []byte {
+	sum := sha256.Sum256(b)
+	return sum[:hashSize]
+}
+
+// 读取条带的数据块，长度不足的块补0
+func (l layout) readStripe(r io.ReaderAt, s int, shards [][]byte) error {
+	for j := 0; j < l.data; j++ {
+		shard := shards[j][:l.blockSize]
+		n := l.blockLen(l.block(s, j))
+		if n > 0 {
+			if _, err := r.ReadAt(shard[:n], int64(l.block(s, j))*int64(l.blockSize)); err != nil {
+				return err
+			}
+		}
+		clear(shard[n:])
+		shards[j] = shard
+	}
+	return nil
+}
+
+// Create 为大小为size的分片r生成恢复数据写入w，redundancy为每个条带中校验块占数据块的百分比(1-100)
+func Create(w io.WriterAt, r io.ReaderAt, size int64, redundancy int) error {
+	if redundancy < 1 || redundancy > 100 {
+		return fmt.Errorf("恢复数据比例必须在1-100之间: %d", redundancy)
+	}
+	l := newLayout(size, redundancy)
+
+	enc, err := reedsolomon.New(l.data, l.parity)
+	if err != nil {
+		return fmt.Errorf("创建Reed-Solomon编码器失败: %v", err)
+	}
+
+	// 顺序计算每个数据块和整个分片的哈希
+	hasher := sha256.New()
+	dataHashes := make([]byte, 0, l.blocks()*hashSize)
+	buf := make([]byte, l.blockSize)
+	for i := 0; i < l.blocks(); i++ {
+		b := buf[:l.blockLen(i)]
+		if _, err := r.ReadAt(b, int64(i)*int64(l.blockSize)); err != nil {
+			return fmt.Errorf("读取分片失败: %v", err)
+		}
+		hasher.Write(b)
+		dataHashes = append(dataHashes, blockHash(b)...)
+	}
+	copy(l.hash[:], hasher.Sum(nil))
+
+	// 逐个条带计算校验块
+	shards := make([][]byte, l.data+l.parity)
+	for i := range shards {
+		shards[i] = make([]byte, l.blockSize)
+	}
+	parityHashes := make([]byte, 0, l.stripes*l.parity*hashSize)
+	for s := 0; s < l.stripes; s++ {
+		if err := l.readStripe(r, s, shards); err != nil {
+			return fmt.Errorf("读取分片失败: %v", err)
+		}
+		if err := enc.Encode(shards); err != nil {
+			return fmt.Errorf("计算校验块失败: %v", err)
+		}
+		for j := 0; j < l.parity; j++ {
+			p := shards[l.data+j]
+			if _, err := w.WriteAt(p, l.parityOffset(s, j)); err != nil {
+				return fmt.Errorf("写入恢复文件失败: %v", err)
+			}
+			parityHashes = append(parityHashes, blockHash(p)...)
+		}
+	}
+
+	meta := l.encodeHeader()
+	meta = append(meta, dataHashes...)
+	meta = append(meta, parityHashes...)
+	sum := sha256.Sum256(meta)
+	meta = append(meta, sum[:]...)
+	if _, err := w.WriteAt(meta, 0); err != nil {
+		return fmt.Errorf("写入恢复文件失败: %v", err)
+	}
+	return nil
+}
+
+// CreateFile 为分片文件生成恢复文件，返回恢复文件的路径
+func CreateFile(partPath string, redundancy int) (string, error) {
+	part, err := os.Open(partPath)
+	if err != nil {
+		return "", err
+	}
+	defer part.Close()
+
+	info, err := part.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	parPath := partPath + Ext
+	out, err := os.Create(parPath)
+	if err != nil {
+		return "", err
+	}
+	err = Create(out, part, info.Size(), redundancy)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(parPath)
+		return "", err
+	}
+	return parPath, nil
+}
+
+// 读取并校验恢复文件的头部和哈希表
+func readMeta(par io.ReaderAt) (layout, []byte, []byte, error) {
+	var l layout
+	header := make([]byte, headerSize)
+	if _, err := par.ReadAt(header, 0); err != nil {
+		return l, nil, nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	if string(header[:len(magic)]) != magic {
+		return l, nil, nil, fmt.Errorf("%w: 无效的文件头", ErrInvalid)
+	}
+	p := header[len(magic):]
+	l.blockSize = int(binary.BigEndian.Uint32(p))
+	l.size = int64(binary.BigEndian.Uint64(p[4:]))
+	l.data = int(binary.BigEndian.Uint32(p[12:]))
+	l.parity = int(binary.BigEndian.Uint32(p[16:]))
+	l.stripes = int(binary.BigEndian.Uint32(p[20:]))
+	copy(l.hash[:], p[24:])
+	if l.blockSize <= 0 || l.data <= 0 || l.parity <= 0 || l.stripes <= 0 || l.data+l.parity > 256 ||
+		l.data*l.stripes < l.blocks() {
+		return l, nil, nil, fmt.Errorf("%w: 无效的文件头", ErrInvalid)
+	}
+
+	meta := make([]byte, l.metaSize())
+	if _, err := par.ReadAt(meta, 0); err != nil {
+		return l, nil, nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	body, sum := meta[:len(meta)-sha256.Size], meta[len(meta)-sha256.Size:]
+	if expected := sha256.Sum256(body); !bytes.Equal(expected[:], sum) {
+		return l, nil, nil, fmt.Errorf("%w: 哈希表校验失败", ErrInvalid)
+	}
+
+	hashes := body[headerSize:]
+	n := l.blocks() * hashSize
+	return l, hashes[:n], hashes[n:], nil
+}
+
+// Result 修复结果
+type Result struct {
+	Blocks   int // 分片的数据块数
+	Damaged  int // 损坏的数据块数
+	Repaired bool
+}
+
+// File 可以原地修复的分片文件
+type File interface {
+	io.ReaderAt
+	io.WriterAt
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+}
+
+// Repair 使用恢复文件par检查分片part，有损坏的块时原地修复。
+// 损坏超过恢复能力时返回ErrUnrecoverable，分片不会被修改
+func Repair(part File, par io.ReaderAt) (Result, error) {
+	l, dataHashes, parityHashes, err := readMeta(par)
+	if err != nil {
+		return Result{}, err
+	}
+
+	info, err := part.Stat()
+	if err != nil {
+		return Result{}, err
+	}
+	actualSize := info.Size()
+
+	// 定位损坏的数据块，长度不足时缺失的块也视为损坏
+	result := Result{Blocks: l.blocks()}
+	damaged := make(map[int]bool)
+	buf := make([]byte, l.blockSize)
+	for i := 0; i < l.blocks(); i++ {
+		n := l.blockLen(i)
+		off := int64(i) * int64(l.blockSize)
+		if off+int64(n) > actualSize {
+			damaged[i] = true
+			continue
+		}
+		if _, err := part.ReadAt(buf[:n], off); err != nil {
+			return result, fmt.Errorf("读取分片失败: %v", err)
+		}
+		if !bytes.Equal(blockHash(buf[:n]), dataHashes[i*hashSize:(i+1)*hashSize]) {
+			damaged[i] = true
+		}
+	}
+	result.Damaged = len(damaged)
+	if len(damaged) == 0 && actualSize == l.size {
+		return result, nil
+	}
+
+	enc, err := reedsolomon.New(l.data, l.parity)
+	if err != nil {
+		return result, fmt.Errorf("创建Reed-Solomon编码器失败: %v", err)
+	}
+
+	// 先在内存中重建所有损坏的块，全部成功后再写回分片
+	repaired := make(map[int][]byte)
+	shards := make([][]byte, l.data+l.parity)
+	for s := 0; s < l.stripes; s++ {
+		missing := 0
+		for j := 0; j < l.data; j++ {
+			if damaged[l.block(s, j)] {
+				missing++
+			}
+		}
+		if missing == 0 {
+			continue
+		}
+
+		for j := range shards {
+			shards[j] = make([]byte, l.blockSize)
+		}
+		for j := 0; j < l.data; j++ {
+			i := l.block(s, j)
+			if damaged[i] {
+				shards[j] = shards[j][:0]
+				continue
+			}
+			n := l.blockLen(i)
+			if n > 0 {
+				if _, err := part.ReadAt(shards[j][:n], int64(i)*int64(l.blockSize)); err != nil {
+					return result, fmt.Errorf("读取分片失败: %v", err)
+				}
+			}
+		}
+		for j := 0; j < l.parity; j++ {
+			p := shards[l.data+j]
+			k := s*l.parity + j
+			if _, err := par.ReadAt(p, l.parityOffset(s, j)); err != nil ||
+				!bytes.Equal(blockHash(p), parityHashes[k*hashSize:(k+1)*hashSize]) {
+				shards[l.data+j] = p[:0]
+				missing++
+			}
+		}
+		if missing > l.parity {
+			return result, fmt.Errorf("%w: 第%d个条带损坏%d块, 最多可修复%d块", ErrUnrecoverable, s+1, missing, l.parity)
+		}
+
+		if err := enc.ReconstructData(shards); err != nil {
+			return result, fmt.Errorf("%w: %v", ErrUnrecoverable, err)
+		}
+		for j := 0; j < l.data; j++ {
+			i := l.block(s, j)
+			if damaged[i] {
+				repaired[i] = shards[j][:l.blockLen(i)]
+			}
+		}
+	}
+
+	for i, b := range repaired {
+		if _, err := part.WriteAt(b, int64(i)*int64(l.blockSize)); err != nil {
+			return result, fmt.Errorf("写入修复的数据失败: %v", err)
+		}
+	}
+	if err := part.Truncate(l.size); err != nil {
+		return result, fmt.Errorf("修正分片大小失败: %v", err)
+	}
+
+	// 修复后整体校验一次
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, io.NewSectionReader(part, 0, l.size)); err != nil {
+		return result, fmt.Errorf("读取分片失败: %v", err)
+	}
+	if !bytes.Equal(hasher.Sum(nil), l.hash[:]) {
+		return result, fmt.Errorf("%w: 修复后的分片哈希不一致", ErrUnrecoverable)
+	}
+	result.Repaired = true
+	return result, nil
+}
+
+// RepairFile 使用恢复文件parPath检查并修复分片文件partPath
+func RepairFile(partPath, parPath string) (Result, error) {
+	par, err := os.Open(parPath)
+	if err != nil {
+		return Result{}, err
+	}
+	defer par.Close()
+
+	part, err := os.OpenFile(partPath, os.O_RDWR, 0)
+	if err != nil {
+		return Result{}, err
+	}
+	defer part.Close()
+
+	return Repair(part, par)
+}
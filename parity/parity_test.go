@@ -0,0 +1,128 @@
+package parity
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestPart(t *testing.T, size int) (string, []byte) {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+	path := filepath.Join(t.TempDir(), "part.zip")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, data
+}
+
+func TestParity_Repair(t *testing.T) {
+	const size = 300*BlockSize + 1234
+
+	cases := map[string]func(data []byte) []byte{
+		"intact": func(data []byte) []byte { return data },
+		"bitflip": func(data []byte) []byte {
+			data[12345] ^= 0x01
+			return data
+		},
+		"burst": func(data []byte) []byte {
+			// 连续损坏会分散到不同条带
+			for i := 100 * BlockSize; i < 105*BlockSize; i++ {
+				data[i] = 0
+			}
+			return data
+		},
+		"lastblock": func(data []byte) []byte {
+			data[len(data)-1] ^= 0xff
+			return data
+		},
+		"truncated": func(data []byte) []byte { return data[:len(data)-3*BlockSize] },
+		"appended":  func(data []byte) []byte { return append(data, "garbage"...) },
+	}
+
+	for name, damage := range cases {
+		t.Run(name, func(t *testing.T) {
+			path, data := writeTestPart(t, size)
+			parPath, err := CreateFile(path, 10)
+			if err != nil {
+				t.Fatalf("CreateFile() error = %v", err)
+			}
+
+			damaged := damage(append([]byte(nil), data...))
+			if err := os.WriteFile(path, damaged, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := RepairFile(path, parPath)
+			if err != nil {
+				t.Fatalf("RepairFile() error = %v", err)
+			}
+			if name != "intact" && !result.Repaired {
+				t.Error("损坏的分片没有被修复")
+			}
+
+			got, _ := os.ReadFile(path)
+			if !bytes.Equal(got, data) {
+				t.Fatal("修复后的内容不一致")
+			}
+		})
+	}
+}
+
+func TestParity_Unrecoverable(t *testing.T) {
+	path, data := writeTestPart(t, 50*BlockSize)
+	parPath, err := CreateFile(path, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 只有一个条带和3个校验块，损坏10个块无法修复
+	damaged := append([]byte(nil), data...)
+	for i := 0; i < 10; i++ {
+		damaged[i*BlockSize] ^= 0xff
+	}
+	os.WriteFile(path, damaged, 0644)
+
+	if _, err := RepairFile(path, parPath); !errors.Is(err, ErrUnrecoverable) {
+		t.Fatalf("RepairFile() error = %v, 期望ErrUnrecoverable", err)
+	}
+	got, _ := os.ReadFile(path)
+	if !bytes.Equal(got, damaged) {
+		t.Fatal("无法修复时不应修改分片")
+	}
+}
+
+func TestParity_DamagedParityFile(t *testing.T) {
+	path, data := writeTestPart(t, 20*BlockSize)
+	parPath, err := CreateFile(path, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 损坏一个校验块，仍然可以用其余校验块修复
+	par, _ := os.ReadFile(parPath)
+	par[len(par)-10] ^= 0xff
+	os.WriteFile(parPath, par, 0644)
+
+	damaged := append([]byte(nil), data...)
+	damaged[5*BlockSize+7] ^= 0xff
+	os.WriteFile(path, damaged, 0644)
+
+	if _, err := RepairFile(path, parPath); err != nil {
+		t.Fatalf("RepairFile() error = %v", err)
+	}
+	got, _ := os.ReadFile(path)
+	if !bytes.Equal(got, data) {
+		t.Fatal("修复后的内容不一致")
+	}
+
+	// 哈希表损坏时无法使用恢复文件
+	par[20] ^= 0xff
+	os.WriteFile(parPath, par, 0644)
+	if _, err := RepairFile(path, parPath); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("RepairFile() error = %v, 期望ErrInvalid", err)
+	}
+}
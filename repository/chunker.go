@@ -0,0 +1,128 @@
+package repository
+
+import (
+	"io"
+	"math/bits"
+)
+
+// FastCDC 内容定义分块参数，修改这些值会导致已有数据无法去重
+const (
+	minChunkSize = 512 * 1024      // 最小块大小
+	avgChunkSize = 1024 * 1024     // 平均块大小
+	maxChunkSize = 8 * 1024 * 1024 // 最大块大小
+)
+
+var (
+	// 归一化分块：达到平均大小前使用更严格的掩码，之后使用更宽松的掩码，使块大小集中在平均值附近
+	maskS = topBits(bits.Len(avgChunkSize) + 1)
+	maskL = topBits(bits.Len(avgChunkSize) - 3)
+
+	gearTable = newGearTable(0x6175746f2d626163) // 固定种子，保证分块边界在不同版本间稳定
+)
+
+// 高位置1的掩码，gear哈希左移时高位综合了最近64个字节的信息
+func topBits(n int) uint64 {
+	return ^uint64(0) << (64 - n)
+}
+
+// 使用splitmix64生成gear表
+func newGearTable(seed uint64) [256]uint64 {
+	var table [256]uint64
+	for i := range table {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}
+
+// Chunker 将数据流按内容切分为大小不等的块，插入或删除数据只影响附近的块
+type Chunker struct {
+	r   io.Reader
+	buf []byte
+	// buf[start:end] 为尚未切分的数据
+	start, end int
+	eof        bool
+}
+
+// NewChunker 创建分块器
+func NewChunker(r io.Reader) *Chunker {
+	return &Chunker{
+		r:   r,
+		buf: make([]byte, 2*maxChunkSize),
+	}
+}
+
+// Next 返回下一个块，返回的切片在下一次调用前有效，数据结束时返回io.EOF
+func (c *Chunker) Next() ([]byte, error) {
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	n := cutPoint(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
+
+// 保证缓冲区中至少有maxChunkSize字节，或者已读到结尾
+func (c *Chunker) fill() error {
+	if c.eof || c.end-c.start >= maxChunkSize {
+		return nil
+	}
+
+	// 把剩余数据移动到缓冲区开头
+	copy(c.buf, c.buf[c.start:c.end])
+	c.end -= c.start
+	c.start = 0
+
+	for c.end < maxChunkSize {
+		n, err := c.r.Read(c.buf[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 计算数据中第一个切分点
+func cutPoint(data []byte) int {
+	n := len(data)
+	if n <= minChunkSize {
+		return n
+	}
+	if n > maxChunkSize {
+		n = maxChunkSize
+	}
+
+	normal := avgChunkSize
+	if n < normal {
+		normal = n
+	}
+
+	var fp uint64
+	i := minChunkSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
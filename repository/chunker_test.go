@@ -0,0 +1,96 @@
+package repository
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func chunkAll(t *testing.T, data []byte) [][]byte {
+	t.Helper()
+
+	var chunks [][]byte
+	c := NewChunker(bytes.NewReader(data))
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		chunks = append(chunks, append([]byte(nil), chunk...))
+	}
+}
+
+func TestChunker_Boundaries(t *testing.T) {
+	data := make([]byte, 40*1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	chunks := chunkAll(t, data)
+	if !bytes.Equal(bytes.Join(chunks, nil), data) {
+		t.Fatal("拼接后的数据与原始数据不一致")
+	}
+	for i, chunk := range chunks[:len(chunks)-1] {
+		if len(chunk) < minChunkSize || len(chunk) > maxChunkSize {
+			t.Errorf("第%d块大小%d超出范围", i, len(chunk))
+		}
+	}
+	if avg := len(data) / len(chunks); avg < minChunkSize || avg > 2*avgChunkSize {
+		t.Errorf("平均块大小%d偏离预期", avg)
+	}
+}
+
+func TestChunker_ShiftResistant(t *testing.T) {
+	data := make([]byte, 20*1024*1024)
+	rand.New(rand.NewSource(2)).Read(data)
+
+	// 在开头插入数据后，只有开头附近的块会变化
+	shifted := append([]byte("inserted bytes"), data...)
+
+	seen := make(map[string]bool)
+	for _, chunk := range chunkAll(t, data) {
+		seen[string(chunk)] = true
+	}
+
+	chunks := chunkAll(t, shifted)
+	changed := 0
+	for _, chunk := range chunks {
+		if !seen[string(chunk)] {
+			changed++
+		}
+	}
+	if changed > 2 {
+		t.Errorf("插入数据后%d/%d个块发生变化", changed, len(chunks))
+	}
+}
+
+func TestKeys_SealOpen(t *testing.T) {
+	salt, err := newSalt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := deriveKeys("secret", salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain := bytes.Repeat([]byte("auto-backup"), 1000)
+	blob, err := k.seal(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := k.open(blob)
+	if err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("open() = %v, 内容不一致", err)
+	}
+
+	other, _ := deriveKeys("wrong", salt)
+	if _, err := other.open(blob); err == nil {
+		t.Error("错误的密码也能解密")
+	}
+	if other.chunkID(plain) == k.chunkID(plain) {
+		t.Error("不同密码的数据块ID相同")
+	}
+}
@@ -0,0 +1,103 @@
+package repository
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/crypto/scrypt"
+)
+
+// scrypt参数，修改后已有仓库无法打开
+const (
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	saltSize     = 32
+	checkMessage = "auto-backup repository"
+)
+
+var errDecrypt = errors.New("解密失败，密码错误或数据已损坏")
+
+// 共享的zstd编解码器，EncodeAll/DecodeAll可以并发使用
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// 由仓库密码派生的密钥
+type keys struct {
+	aead cipher.AEAD // 数据块、快照的加密密钥
+	mac  []byte      // 计算数据块ID的HMAC密钥，避免通过ID推测明文
+}
+
+func newSalt() ([]byte, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// 使用scrypt从密码派生加密密钥和HMAC密钥
+func deriveKeys(password string, salt []byte) (*keys, error) {
+	key, err := scrypt.Key([]byte(password), salt, scryptN, scryptR, scryptP, 64)
+	if err != nil {
+		return nil, fmt.Errorf("派生仓库密钥失败: %v", err)
+	}
+
+	block, err := aes.NewCipher(key[:32])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &keys{aead: aead, mac: key[32:]}, nil
+}
+
+// 计算数据块ID
+func (k *keys) chunkID(data []byte) string {
+	h := hmac.New(sha256.New, k.mac)
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// 压缩并加密，输出格式为 nonce || 密文
+func (k *keys) seal(plain []byte) ([]byte, error) {
+	compressed := zstdEncoder.EncodeAll(plain, nil)
+
+	nonceSize := k.aead.NonceSize()
+	out := make([]byte, nonceSize, nonceSize+len(compressed)+k.aead.Overhead())
+	if _, err := rand.Read(out); err != nil {
+		return nil, err
+	}
+	return k.aead.Seal(out, out, compressed, nil), nil
+}
+
+// 解密并解压seal的输出
+func (k *keys) open(blob []byte) ([]byte, error) {
+	nonceSize := k.aead.NonceSize()
+	if len(blob) < nonceSize {
+		return nil, errDecrypt
+	}
+
+	compressed, err := k.aead.Open(nil, blob[:nonceSize], blob[nonceSize:], nil)
+	if err != nil {
+		return nil, errDecrypt
+	}
+
+	plain, err := zstdDecoder.DecodeAll(compressed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("解压数据失败: %v", err)
+	}
+	return plain, nil
+}
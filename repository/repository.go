@@ -0,0 +1,630 @@
+// Package repository 实现按内容分块去重的备份仓库。
+//
+// 文件使用FastCDC切分为数据块，数据块按内容的HMAC寻址，压缩加密后写入数据包并上传，
+// 数据块索引保存在SQLite中。每次备份生成一个加密的快照文件，记录所有文件引用的数据块，
+// 还原时只依赖远端的配置、快照和数据包，不依赖本地数据库。
+package repository
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"auto-backup/db"
+	"auto-backup/log"
+	"auto-backup/uploader"
+	"auto-backup/utils"
+)
+
+// 仓库的目录结构，本地和远端相同
+const (
+	packDir     = "packs"
+	snapshotDir = "snapshots"
+	cacheDir    = "cache"
+	configName  = "config"
+	packExt     = ".pack"
+	snapshotExt = ".snap"
+)
+
+const (
+	repoVersion       = 1
+	packSize          = 16 * 1024 * 1024 // 数据包达到该大小后写完并上传
+	maxUploadAttempts = 3                // 远端哈希不一致时的最大上传次数
+)
+
+// Options 打开仓库的参数
+type Options struct {
+	Dir      string            // 本地目录，存放待上传的数据包和快照文件
+	Remote   string            // 远端目录，多个备份任务可以共用同一个仓库
+	Password string            // 仓库密码，用于派生加密密钥
+	Uploader uploader.Uploader // 为空时数据包只保存在本地目录
+	Context  context.Context   // 取消后中止正在进行的上传和下载，为空时不会取消
+}
+
+// 仓库配置，保存密钥派生参数，本身不包含密钥
+type repoConfig struct {
+	Version int    `json:"version"`
+	Salt    []byte `json:"salt"`
+	Check   []byte `json:"check"` // 用派生密钥加密的固定内容，用于校验密码
+}
+
+// ChunkRef 快照中对数据块的引用
+type ChunkRef struct {
+	ID     string `json:"id"`
+	Pack   string `json:"pack"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+}
+
+// SnapshotFile 快照中的单个文件或目录
+type SnapshotFile struct {
+	Path    string      `json:"path"` // 相对路径，使用/分隔
+	Size    int64       `json:"size"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mod_time"`
+	Hash    string      `json:"hash,omitempty"` // 原始内容的SHA256
+	Chunks  []ChunkRef  `json:"chunks,omitempty"`
+}
+
+// Snapshot 一次备份的完整文件列表
+type Snapshot struct {
+	BackupID  string          `json:"backup_id"`
+	Timestamp string          `json:"timestamp"`
+	Time      time.Time       `json:"time"`
+	Files     []*SnapshotFile `json:"files"`
+}
+
+// 正在写入的数据包
+type packWriter struct {
+	id     string
+	file   *os.File
+	size   int64
+	chunks []*db.RepoChunk
+}
+
+// Repository 去重仓库
+type Repository struct {
+	opts    Options
+	keys    *keys
+	pack    *packWriter
+	pending map[string]ChunkRef // 当前数据包中尚未写入索引的数据块
+	newSize int64               // 本次新写入的数据块原始大小
+}
+
+// Open 打开仓库，本地和远端都没有配置时初始化新仓库
+func Open(opts Options) (*Repository, error) {
+	if opts.Password == "" {
+		return nil, fmt.Errorf("仓库模式需要配置备份密码")
+	}
+
+	for _, dir := range []string{packDir, snapshotDir} {
+		if err := os.MkdirAll(filepath.Join(opts.Dir, dir), 0755); err != nil {
+			log.Error("创建仓库目录失败: %v", err)
+			return nil, fmt.Errorf("创建仓库目录失败: %v", err)
+		}
+	}
+
+	r := &Repository{
+		opts:    opts,
+		pending: make(map[string]ChunkRef),
+	}
+
+	cfg, err := r.loadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	r.keys, err = deriveKeys(opts.Password, cfg.Salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.keys.open(cfg.Check); err != nil {
+		return nil, fmt.Errorf("仓库密码错误: %v", err)
+	}
+
+	return r, nil
+}
+
+// 依次从数据库、本地目录、远端加载仓库配置，都不存在时创建
+func (r *Repository) loadConfig() (*repoConfig, error) {
+	data, err := db.LoadRepoConfig(r.opts.Remote)
+	if err != nil {
+		log.Error("加载仓库配置失败: %v", err)
+		return nil, fmt.Errorf("加载仓库配置失败: %v", err)
+	}
+	if data != "" {
+		return parseConfig([]byte(data))
+	}
+
+	localPath := filepath.Join(r.opts.Dir, configName)
+	raw, err := os.ReadFile(localPath)
+	if os.IsNotExist(err) && r.opts.Uploader != nil {
+		err = r.opts.Uploader.DownloadFile(r.context(), r.opts.Remote, configName, localPath)
+		if err == nil {
+			raw, err = os.ReadFile(localPath)
+		} else if !errors.Is(err, utils.ErrNotFound) {
+			// 无法确认远端是否已有仓库，不能创建新的配置覆盖远端
+			return nil, fmt.Errorf("下载仓库配置失败: %v", err)
+		} else {
+			err = os.ErrNotExist
+		}
+	}
+
+	var cfg *repoConfig
+	switch {
+	case err == nil:
+		if cfg, err = parseConfig(raw); err != nil {
+			return nil, err
+		}
+	case os.IsNotExist(err):
+		if cfg, err = r.initConfig(localPath); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("读取仓库配置失败: %v", err)
+	}
+
+	raw, _ = json.Marshal(cfg)
+	if err := db.SaveRepoConfig(r.opts.Remote, string(raw)); err != nil {
+		log.Error("保存仓库配置失败: %v", err)
+		return nil, fmt.Errorf("保存仓库配置失败: %v", err)
+	}
+	return cfg, nil
+}
+
+func parseConfig(data []byte) (*repoConfig, error) {
+	cfg := &repoConfig{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("解析仓库配置失败: %v", err)
+	}
+	if cfg.Version != repoVersion {
+		return nil, fmt.Errorf("不支持的仓库版本: %d", cfg.Version)
+	}
+	return cfg, nil
+}
+
+// 初始化新仓库的配置并上传
+func (r *Repository) initConfig(localPath string) (*repoConfig, error) {
+	log.Info("初始化新仓库: %s", r.opts.Remote)
+
+	salt, err := newSalt()
+	if err != nil {
+		return nil, fmt.Errorf("生成仓库盐值失败: %v", err)
+	}
+	k, err := deriveKeys(r.opts.Password, salt)
+	if err != nil {
+		return nil, err
+	}
+	check, err := k.seal([]byte(checkMessage))
+	if err != nil {
+		return nil, fmt.Errorf("生成仓库配置失败: %v", err)
+	}
+
+	cfg := &repoConfig{Version: repoVersion, Salt: salt, Check: check}
+	raw, _ := json.Marshal(cfg)
+	if err := os.WriteFile(localPath, raw, 0600); err != nil {
+		log.Error("写入仓库配置失败: %v", err)
+		return nil, fmt.Errorf("写入仓库配置失败: %v", err)
+	}
+
+	if r.opts.Uploader != nil {
+		if err := r.upload(r.opts.Remote, localPath); err != nil {
+			return nil, fmt.Errorf("上传仓库配置失败: %v", err)
+		}
+	}
+	return cfg, nil
+}
+
+// 上传和下载使用的context，没有配置时不会取消
+func (r *Repository) context() context.Context {
+	if r.opts.Context == nil {
+		return context.Background()
+	}
+	return r.opts.Context
+}
+
+// 上传文件，远端哈希不一致时重试
+func (r *Repository) upload(folder, localPath string) error {
+	var err error
+	for attempt := 1; attempt <= maxUploadAttempts; attempt++ {
+		err = r.opts.Uploader.UploadBigFile(r.context(), folder, localPath)
+		if err == nil || !errors.Is(err, utils.ErrHashMismatch) {
+			break
+		}
+		log.Warn("远端文件哈希不一致，重新上传(%d/%d): %s", attempt, maxUploadAttempts, filepath.Base(localPath))
+	}
+	return err
+}
+
+// NewSize 返回本次新写入仓库的数据块原始大小
+func (r *Repository) NewSize() int64 {
+	return r.newSize
+}
+
+// AddFile 将文件切分为数据块写入仓库，填充f的大小、哈希和数据块列表
+func (r *Repository) AddFile(localPath string, f *SnapshotFile) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		log.Error("打开文件失败: %v", err)
+		return fmt.Errorf("打开文件失败: %v", err)
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	chunker := NewChunker(file)
+	f.Size = 0
+	f.Chunks = nil
+	for {
+		data, err := chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Error("读取文件失败: %v", err)
+			return fmt.Errorf("读取文件失败: %v", err)
+		}
+
+		hasher.Write(data)
+		ref, err := r.storeChunk(data)
+		if err != nil {
+			return err
+		}
+		f.Chunks = append(f.Chunks, ref)
+		f.Size += int64(len(data))
+	}
+
+	f.Hash = hex.EncodeToString(hasher.Sum(nil))
+	return nil
+}
+
+// HasChunks 检查数据块是否都已在仓库中，用于复用上一次快照中未变化的文件
+func (r *Repository) HasChunks(refs []ChunkRef) (bool, error) {
+	for _, ref := range refs {
+		if _, ok := r.pending[ref.ID]; ok {
+			continue
+		}
+		c, err := r.loadChunk(ref.ID)
+		if err != nil {
+			return false, err
+		}
+		if c == nil {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// 查询可以复用的数据块，不存在时返回nil。
+// 只复用已上传的数据包或本地文件仍在、等待上传的数据包中的数据块，
+// 本地文件丢失的未上传数据包在这里删除索引，让数据块重新写入
+func (r *Repository) loadChunk(id string) (*db.RepoChunk, error) {
+	c, err := db.LoadRepoChunk(id)
+	if err != nil || c == nil || c.Uploaded {
+		return c, err
+	}
+	if _, err := os.Stat(r.packPath(c.PackID)); err == nil {
+		return c, nil
+	}
+	if err := r.dropPack(c.PackID); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// 删除本地文件丢失且没有上传的数据包的索引
+func (r *Repository) dropPack(id string) error {
+	log.Error("数据包没有上传且本地文件已丢失，引用它的快照无法还原，删除其数据块索引后重新写入: %s", id)
+	if err := db.DeleteRepoPack(id); err != nil {
+		log.Error("删除数据包索引失败: %v", err)
+		return fmt.Errorf("删除数据包索引失败: %v", err)
+	}
+	return nil
+}
+
+// 写入单个数据块，仓库中已存在时直接返回已有的引用
+func (r *Repository) storeChunk(data []byte) (ChunkRef, error) {
+	id := r.keys.chunkID(data)
+	if ref, ok := r.pending[id]; ok {
+		return ref, nil
+	}
+
+	c, err := r.loadChunk(id)
+	if err != nil {
+		log.Error("查询数据块索引失败: %v", err)
+		return ChunkRef{}, fmt.Errorf("查询数据块索引失败: %v", err)
+	}
+	if c != nil {
+		return ChunkRef{ID: c.ID, Pack: c.PackID, Offset: c.Offset, Length: c.Length}, nil
+	}
+
+	blob, err := r.keys.seal(data)
+	if err != nil {
+		return ChunkRef{}, fmt.Errorf("加密数据块失败: %v", err)
+	}
+
+	if r.pack == nil {
+		if err := r.newPack(); err != nil {
+			return ChunkRef{}, err
+		}
+	}
+
+	p := r.pack
+	if _, err := p.file.Write(blob); err != nil {
+		log.Error("写入数据包失败: %v", err)
+		return ChunkRef{}, fmt.Errorf("写入数据包失败: %v", err)
+	}
+	ref := ChunkRef{ID: id, Pack: p.id, Offset: p.size, Length: int64(len(blob))}
+	p.chunks = append(p.chunks, &db.RepoChunk{
+		ID:      id,
+		PackID:  p.id,
+		Offset:  p.size,
+		Length:  int64(len(blob)),
+		RawSize: int64(len(data)),
+	})
+	p.size += int64(len(blob))
+	r.pending[id] = ref
+	r.newSize += int64(len(data))
+
+	if p.size >= packSize {
+		if err := r.flushPack(); err != nil {
+			return ChunkRef{}, err
+		}
+	}
+	return ref, nil
+}
+
+func (r *Repository) packPath(id string) string {
+	return filepath.Join(r.opts.Dir, packDir, id+packExt)
+}
+
+// 创建新的数据包，数据包ID随机生成，写入过程中使用临时文件
+func (r *Repository) newPack() error {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Errorf("生成数据包ID失败: %v", err)
+	}
+	id := hex.EncodeToString(buf)
+
+	file, err := os.Create(r.packPath(id) + ".tmp")
+	if err != nil {
+		log.Error("创建数据包失败: %v", err)
+		return fmt.Errorf("创建数据包失败: %v", err)
+	}
+
+	r.pack = &packWriter{id: id, file: file}
+	return nil
+}
+
+// 写完当前数据包，保存数据块索引后上传
+func (r *Repository) flushPack() error {
+	p := r.pack
+	r.pack = nil
+
+	tmpPath := p.file.Name()
+	err := p.file.Close()
+	if err == nil {
+		err = os.Rename(tmpPath, r.packPath(p.id))
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		log.Error("关闭数据包失败: %v", err)
+		return fmt.Errorf("关闭数据包失败: %v", err)
+	}
+
+	pack := &db.RepoPack{ID: p.id, Size: p.size, CreatedAt: time.Now()}
+	if err := db.SaveRepoPack(pack, p.chunks); err != nil {
+		log.Error("保存数据块索引失败: %v", err)
+		return fmt.Errorf("保存数据块索引失败: %v", err)
+	}
+	for _, c := range p.chunks {
+		delete(r.pending, c.ID)
+	}
+
+	log.Info("数据包写入完成: %s, 数据块%d个, %d 字节", p.id, len(p.chunks), p.size)
+
+	if r.opts.Uploader != nil {
+		return r.uploadPack(pack)
+	}
+	return nil
+}
+
+// 上传数据包，成功后删除本地文件
+func (r *Repository) uploadPack(pack *db.RepoPack) error {
+	localPath := r.packPath(pack.ID)
+	if err := r.upload(path.Join(r.opts.Remote, packDir), localPath); err != nil {
+		// 本地数据包保留，下次备份时重新上传
+		return fmt.Errorf("上传数据包失败: %v", err)
+	}
+
+	if err := db.MarkRepoPackUploaded(pack.ID); err != nil {
+		log.Error("更新数据包上传状态失败: %v", err)
+		return fmt.Errorf("更新数据包上传状态失败: %v", err)
+	}
+	pack.Uploaded = true
+
+	os.Remove(localPath)
+	return nil
+}
+
+// UploadPending 重新上传之前上传失败的数据包，本地文件已丢失的数据包删除索引并记录错误
+func (r *Repository) UploadPending() {
+	if r.opts.Uploader == nil {
+		return
+	}
+
+	packs, err := db.LoadPendingRepoPacks()
+	if err != nil {
+		log.Error("加载待上传数据包失败: %v", err)
+		return
+	}
+
+	for _, pack := range packs {
+		if r.context().Err() != nil {
+			return
+		}
+		if _, err := os.Stat(r.packPath(pack.ID)); err != nil {
+			r.dropPack(pack.ID)
+			continue
+		}
+		log.Info("重新上传之前失败的数据包: %s", pack.ID)
+		if err := r.uploadPack(pack); err != nil {
+			log.Error("重新上传数据包失败: %v", err)
+		}
+	}
+}
+
+func snapshotName(backupID, timestamp string) string {
+	return fmt.Sprintf("%s_%s%s", backupID, timestamp, snapshotExt)
+}
+
+// SaveSnapshot 写完剩余的数据包，加密保存快照文件并上传，本地保留快照供下次备份复用
+func (r *Repository) SaveSnapshot(s *Snapshot) error {
+	if r.pack != nil {
+		if err := r.flushPack(); err != nil {
+			return err
+		}
+	}
+
+	raw, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("序列化快照失败: %v", err)
+	}
+	blob, err := r.keys.seal(raw)
+	if err != nil {
+		return fmt.Errorf("加密快照失败: %v", err)
+	}
+
+	localPath := filepath.Join(r.opts.Dir, snapshotDir, snapshotName(s.BackupID, s.Timestamp))
+	if err := os.WriteFile(localPath, blob, 0600); err != nil {
+		log.Error("写入快照文件失败: %v", err)
+		return fmt.Errorf("写入快照文件失败: %v", err)
+	}
+
+	if r.opts.Uploader != nil {
+		if err := r.upload(path.Join(r.opts.Remote, snapshotDir), localPath); err != nil {
+			return fmt.Errorf("上传快照文件失败: %v", err)
+		}
+	}
+	return nil
+}
+
+// LoadSnapshot 加载快照，本地不存在时从远端下载
+func (r *Repository) LoadSnapshot(backupID, timestamp string) (*Snapshot, error) {
+	name := snapshotName(backupID, timestamp)
+	localPath := filepath.Join(r.opts.Dir, snapshotDir, name)
+
+	if _, err := os.Stat(localPath); err != nil {
+		if r.opts.Uploader == nil {
+			return nil, fmt.Errorf("快照不存在: %s", name)
+		}
+		if err := r.opts.Uploader.DownloadFile(r.context(), path.Join(r.opts.Remote, snapshotDir), name, localPath); err != nil {
+			return nil, fmt.Errorf("下载快照失败: %v", err)
+		}
+	}
+
+	blob, err := os.ReadFile(localPath)
+	if err != nil {
+		return nil, fmt.Errorf("读取快照失败: %v", err)
+	}
+	raw, err := r.keys.open(blob)
+	if err != nil {
+		return nil, fmt.Errorf("解密快照失败: %v", err)
+	}
+
+	s := &Snapshot{}
+	if err := json.Unmarshal(raw, s); err != nil {
+		return nil, fmt.Errorf("解析快照失败: %v", err)
+	}
+	return s, nil
+}
+
+// ReadFile 读取快照中的文件内容写入w，逐块校验数据块ID并在最后校验整个文件的哈希
+func (r *Repository) ReadFile(f *SnapshotFile, w io.Writer) error {
+	hasher := sha256.New()
+	for _, ref := range f.Chunks {
+		data, err := r.readChunk(ref)
+		if err != nil {
+			return err
+		}
+		hasher.Write(data)
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+
+	if f.Hash != "" && hex.EncodeToString(hasher.Sum(nil)) != f.Hash {
+		return fmt.Errorf("%w: %s", utils.ErrHashMismatch, f.Path)
+	}
+	return nil
+}
+
+// 读取并解密单个数据块
+func (r *Repository) readChunk(ref ChunkRef) ([]byte, error) {
+	packPath, err := r.locatePack(ref.Pack)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(packPath)
+	if err != nil {
+		return nil, fmt.Errorf("打开数据包失败: %v", err)
+	}
+	defer file.Close()
+
+	blob := make([]byte, ref.Length)
+	if _, err := file.ReadAt(blob, ref.Offset); err != nil {
+		return nil, fmt.Errorf("读取数据块失败: %s, %v", ref.ID, err)
+	}
+
+	data, err := r.keys.open(blob)
+	if err != nil {
+		return nil, fmt.Errorf("数据块 %s: %v", ref.ID, err)
+	}
+	if r.keys.chunkID(data) != ref.ID {
+		return nil, fmt.Errorf("%w: 数据块 %s", utils.ErrHashMismatch, ref.ID)
+	}
+	return data, nil
+}
+
+// 查找数据包的本地路径，本地不存在时下载到缓存目录
+func (r *Repository) locatePack(id string) (string, error) {
+	localPath := r.packPath(id)
+	if _, err := os.Stat(localPath); err == nil {
+		return localPath, nil
+	}
+
+	cachePath := filepath.Join(r.opts.Dir, cacheDir, id+packExt)
+	if _, err := os.Stat(cachePath); err == nil {
+		return cachePath, nil
+	}
+
+	if r.opts.Uploader == nil {
+		return "", fmt.Errorf("数据包不存在: %s", id)
+	}
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err != nil {
+		return "", fmt.Errorf("创建缓存目录失败: %v", err)
+	}
+	if err := r.opts.Uploader.DownloadFile(r.context(), path.Join(r.opts.Remote, packDir), id+packExt, cachePath); err != nil {
+		return "", fmt.Errorf("下载数据包失败: %v", err)
+	}
+	return cachePath, nil
+}
+
+// Close 放弃尚未写完的数据包并清理下载缓存
+func (r *Repository) Close() {
+	if r.pack != nil {
+		r.pack.file.Close()
+		os.Remove(r.pack.file.Name())
+		r.pack = nil
+	}
+	os.RemoveAll(filepath.Join(r.opts.Dir, cacheDir))
+}
@@ -0,0 +1,269 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"auto-backup/db"
+	"auto-backup/utils"
+)
+
+// 数据块索引保存在工作目录下的config/backup.db，测试在临时目录中运行
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "auto-backup-repository-")
+	if err != nil {
+		panic(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		panic(err)
+	}
+	if err := os.Mkdir("config", 0755); err != nil {
+		panic(err)
+	}
+	db.InitDB()
+
+	code := m.Run()
+
+	db.CloseDB()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// 保存在内存中的远端
+type memUploader struct {
+	mu        sync.Mutex
+	files     map[string][]byte
+	failPacks bool // 上传数据包时返回错误
+}
+
+func newMemUploader() *memUploader {
+	return &memUploader{files: make(map[string][]byte)}
+}
+
+func (u *memUploader) UploadBigFile(ctx context.Context, folderPath, localFilePath string) error {
+	if u.failPacks && strings.HasSuffix(localFilePath, packExt) {
+		return errors.New("上传失败")
+	}
+	data, err := os.ReadFile(localFilePath)
+	if err != nil {
+		return err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.files[folderPath+"/"+filepath.Base(localFilePath)] = data
+	return nil
+}
+
+func (u *memUploader) UploadReader(ctx context.Context, folderPath, fileName string, r io.ReaderAt, size int64) error {
+	return errors.New("不支持")
+}
+
+func (u *memUploader) DownloadFile(ctx context.Context, folderPath, fileName, localFilePath string) error {
+	u.mu.Lock()
+	data, ok := u.files[folderPath+"/"+fileName]
+	u.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", utils.ErrNotFound, fileName)
+	}
+	return os.WriteFile(localFilePath, data, 0644)
+}
+
+func (u *memUploader) DeleteFile(ctx context.Context, folderPath, fileName string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.files, folderPath+"/"+fileName)
+	return nil
+}
+
+// 远端数据包的数量
+func (u *memUploader) packCount() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	n := 0
+	for key := range u.files {
+		if strings.HasSuffix(key, packExt) {
+			n++
+		}
+	}
+	return n
+}
+
+func openTestRepo(t *testing.T, dir, remote string, up *memUploader) *Repository {
+	t.Helper()
+	r, err := Open(Options{Dir: dir, Remote: remote, Password: "secret", Uploader: up})
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	t.Cleanup(r.Close)
+	return r
+}
+
+func writeRandomFile(t *testing.T, path string, seed int64, size int) []byte {
+	t.Helper()
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// 把文件写入仓库并保存只包含该文件的快照
+func backupFile(t *testing.T, r *Repository, path, timestamp string) *SnapshotFile {
+	t.Helper()
+	f := &SnapshotFile{Path: filepath.Base(path)}
+	if err := r.AddFile(path, f); err != nil {
+		t.Fatalf("AddFile() error = %v", err)
+	}
+	s := &Snapshot{BackupID: "job", Timestamp: timestamp, Time: time.Now(), Files: []*SnapshotFile{f}}
+	if err := r.SaveSnapshot(s); err != nil {
+		t.Fatalf("SaveSnapshot() error = %v", err)
+	}
+	return f
+}
+
+func TestRepository_BackupRestoreDedupe(t *testing.T) {
+	up := newMemUploader()
+	src := t.TempDir()
+	path := filepath.Join(src, "data.bin")
+	data := writeRandomFile(t, path, 1, 6*1024*1024)
+
+	first := openTestRepo(t, t.TempDir(), "dedupe", up)
+	f1 := backupFile(t, first, path, "20260101_000000")
+	if first.NewSize() != int64(len(data)) {
+		t.Errorf("first NewSize() = %d, want %d", first.NewSize(), len(data))
+	}
+	if len(f1.Chunks) < 2 {
+		t.Fatalf("chunks = %d, want several", len(f1.Chunks))
+	}
+	packs := up.packCount()
+
+	// 第二次备份相同内容只引用已上传的数据块
+	second := openTestRepo(t, t.TempDir(), "dedupe", up)
+	f2 := backupFile(t, second, path, "20260102_000000")
+	if second.NewSize() != 0 {
+		t.Errorf("second NewSize() = %d, want 0", second.NewSize())
+	}
+	if up.packCount() != packs {
+		t.Errorf("packs = %d, want %d", up.packCount(), packs)
+	}
+	for i := range f1.Chunks {
+		if f1.Chunks[i] != f2.Chunks[i] {
+			t.Fatalf("chunk %d = %+v, want %+v", i, f2.Chunks[i], f1.Chunks[i])
+		}
+	}
+
+	// 使用新的本地目录还原，快照和数据包都从远端下载
+	restore := openTestRepo(t, t.TempDir(), "dedupe", up)
+	for _, timestamp := range []string{"20260101_000000", "20260102_000000"} {
+		s, err := restore.LoadSnapshot("job", timestamp)
+		if err != nil {
+			t.Fatalf("LoadSnapshot() error = %v", err)
+		}
+		var buf bytes.Buffer
+		if err := restore.ReadFile(s.Files[0], &buf); err != nil {
+			t.Fatalf("ReadFile() error = %v", err)
+		}
+		if !bytes.Equal(buf.Bytes(), data) {
+			t.Errorf("%s: restored content differs", timestamp)
+		}
+	}
+}
+
+func TestRepository_LostPendingPack(t *testing.T) {
+	up := newMemUploader()
+	up.failPacks = true
+	src := t.TempDir()
+	path := filepath.Join(src, "data.bin")
+	data := writeRandomFile(t, path, 2, 1024*1024)
+
+	dir := t.TempDir()
+	first := openTestRepo(t, dir, "lost", up)
+	f := &SnapshotFile{Path: "data.bin"}
+	if err := first.AddFile(path, f); err != nil {
+		t.Fatalf("AddFile() error = %v", err)
+	}
+	if err := first.SaveSnapshot(&Snapshot{BackupID: "job", Timestamp: "20260101_000000", Files: []*SnapshotFile{f}}); err == nil {
+		t.Fatal("SaveSnapshot() succeeded with failing pack upload")
+	}
+
+	// 等待上传的数据包本地文件丢失
+	lost := f.Chunks[0].Pack
+	if err := os.Remove(filepath.Join(dir, packDir, lost+packExt)); err != nil {
+		t.Fatal(err)
+	}
+
+	up.failPacks = false
+	second := openTestRepo(t, dir, "lost", up)
+	f2 := backupFile(t, second, path, "20260102_000000")
+	if second.NewSize() != int64(len(data)) {
+		t.Errorf("NewSize() = %d, want %d rewritten", second.NewSize(), len(data))
+	}
+	for _, ref := range f2.Chunks {
+		if ref.Pack == lost {
+			t.Fatalf("chunk %s still references lost pack", ref.ID)
+		}
+	}
+
+	restore := openTestRepo(t, t.TempDir(), "lost", up)
+	s, err := restore.LoadSnapshot("job", "20260102_000000")
+	if err != nil {
+		t.Fatalf("LoadSnapshot() error = %v", err)
+	}
+	var buf bytes.Buffer
+	if err := restore.ReadFile(s.Files[0], &buf); err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Error("restored content differs")
+	}
+}
+
+func TestRepository_UploadPendingDropsLostPack(t *testing.T) {
+	up := newMemUploader()
+	up.failPacks = true
+	src := t.TempDir()
+	path := filepath.Join(src, "data.bin")
+	writeRandomFile(t, path, 3, 512*1024)
+
+	dir := t.TempDir()
+	r := openTestRepo(t, dir, "pending", up)
+	f := &SnapshotFile{Path: "data.bin"}
+	if err := r.AddFile(path, f); err != nil {
+		t.Fatalf("AddFile() error = %v", err)
+	}
+	r.SaveSnapshot(&Snapshot{BackupID: "job", Timestamp: "20260101_000000", Files: []*SnapshotFile{f}})
+	lost := f.Chunks[0].Pack
+	if err := os.Remove(filepath.Join(dir, packDir, lost+packExt)); err != nil {
+		t.Fatal(err)
+	}
+
+	up.failPacks = false
+	r.UploadPending()
+
+	pending, err := db.LoadPendingRepoPacks()
+	if err != nil {
+		t.Fatalf("LoadPendingRepoPacks() error = %v", err)
+	}
+	for _, p := range pending {
+		if p.ID == lost {
+			t.Errorf("lost pack %s is still pending", lost)
+		}
+	}
+	if c, err := db.LoadRepoChunk(f.Chunks[0].ID); err != nil || c != nil {
+		t.Errorf("LoadRepoChunk() = %+v, %v, want nil", c, err)
+	}
+	if ok, err := r.HasChunks(f.Chunks); err != nil || ok {
+		t.Errorf("HasChunks() = %v, %v, want false", ok, err)
+	}
+}
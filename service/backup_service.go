@@ -2,6 +2,10 @@ package service
 
 import (
 	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -10,11 +14,14 @@ import (
 	"sync"
 	"time"
 
-	"github.com/alexmullins/zip"
+	"filippo.io/age"
 	"github.com/robfig/cron/v3"
 
+	"auto-backup/archive"
 	"auto-backup/db"
+	"auto-backup/delta"
 	"auto-backup/log"
+	"auto-backup/parity"
 	"auto-backup/uploader"
 	"auto-backup/utils"
 )
@@ -28,19 +35,78 @@ type FileInfo struct {
 }
 
 type BackupInfo struct {
-	SrcDir    string
-	OutputDir string
-	Password  string
-	Cron      string
-	ForceFull bool
-	BasePath  string
-	Uploader  uploader.Uploader
+	SrcDir        string
+	OutputDir     string
+	Password      string
+	Cron          string
+	ForceFull     bool
+	BasePath      string
+	Uploader      uploader.Uploader
+	Format        archive.Format  // 压缩包格式
+	ZstdLevel     int             // tar.zst格式的压缩级别
+	ZstdLongRange bool            // tar.zst格式是否开启长距离模式
+	Recipients    []age.Recipient // age公钥，配置后整个分片使用age加密
+	EncryptNames  bool            // 使用密码加密整个分片，隐藏文件名和目录结构
+	Mode          string          // 存储模式: archive 或 repository
+	Delta         bool            // 大文件变化时只备份与上一次备份的二进制差异
+	PartSize      int64           // 每个分片的最大大小，0使用默认值
+	Compression   string          // 压缩级别: auto 按内容自动选择，或 store/fast/default/best
+	Stream        bool            // 分片边压缩边分块上传，不在本地保存分片文件
+	Parity        int             // 为每个分片生成的恢复数据比例(%)，0不生成
+	WatchDebounce time.Duration   // 监听模式下最后一次变化后等待的时间
+	WatchMaxDelay time.Duration   // 监听模式下第一次变化后最长等待的时间
+	Sources       []CommandSource // 内容来自命令输出的虚拟文件，每次完整备份时执行
+	SQLiteCapture string          // SQLite数据库的读取方式: auto、paths 或 off
+	SQLitePaths   []string        // 需要在线备份的SQLite文件，相对于源目录的匹配规则
+	Hooks         Hooks           // 备份前后执行的命令
+	// 文件在读取过程中被修改时重新读取的次数，0使用默认值，小于0不重新读取
+	ModifiedRetries int
+}
+
+// 每个分片的最大大小
+func (b *BackupInfo) partSize() int64 {
+	if b.PartSize > 0 {
+		return b.PartSize
+	}
+	return maxZipSize
+}
+
+// 文件在读取过程中被修改时重新压缩的次数，小于0不重新压缩
+func (b *BackupInfo) modifiedRetries() int {
+	if b.ModifiedRetries == 0 {
+		return defaultModifiedRetries
+	}
+	return max(b.ModifiedRetries, 0)
+}
+
+// 创建分片时使用的压缩包参数
+func (b *BackupInfo) archiveOptions() archive.Options {
+	opts := archive.Options{
+		Format:        b.Format,
+		Password:      b.Password,
+		ZstdLevel:     b.ZstdLevel,
+		ZstdLongRange: b.ZstdLongRange,
+		Recipients:    b.Recipients,
+	}
+	// 使用age加密时主机上不需要保存密码，还原只依赖私钥
+	if len(b.Recipients) > 0 {
+		opts.Password = ""
+	} else if b.EncryptNames {
+		// 整个分片已经用密码加密，不再重复加密每个文件
+		opts.Passphrase = b.Password
+		opts.Password = ""
+	}
+	return opts
 }
 
 // 添加缓冲区大小常量
 const (
 	defaultBufferSize = 4 * 1024 * 1024        // 4MB 缓冲区
-	maxZipSize        = 1 * 1024 * 1024 * 1024 // 1GB 每个压缩包最大大小
+	maxZipSize        = 1 * 1024 * 1024 * 1024 // 1GB 默认每个压缩包最大大小
+	maxUploadAttempts = 3                      // 远端哈希不一致时的最大上传次数
+
+	defaultModifiedRetries = 3           // 文件在读取过程中被修改时默认的重新读取次数
+	modifiedRetryDelay     = time.Second // 重新读取前等待的时间
 )
 
 // 包级别的缓冲池
@@ -51,20 +117,45 @@ var bufPool = sync.Pool{
 	},
 }
 
-// 添加一个变量和互斥锁来跟踪备份状态
-var (
-	isRunning bool
-	mu        sync.Mutex
-)
+// 按备份结果返回运行状态，ctx取消导致的失败记为取消或中断
+func runStatus(ctx context.Context, err error) string {
+	switch {
+	case err == nil:
+		return db.RunStatusSuccess
+	case errors.Is(context.Cause(ctx), errBackupCancelled):
+		return db.RunStatusCancelled
+	case ctx.Err() != nil:
+		return db.RunStatusInterrupted
+	default:
+		return db.RunStatusFailed
+	}
+}
+
+// 读取前检查ctx，取消或暂停后长时间的复制在下一次读取时停止
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	// 暂停时在读取下一块之前等待
+	if err := utils.WaitIfPaused(r.ctx); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
 
-// 获取目录下所有文件的信息
-func getFilesList(srcDir string) (map[string]FileInfo, error) {
+// 获取目录下所有文件的信息，ctx取消时停止遍历
+func getFilesList(ctx context.Context, srcDir string) (map[string]FileInfo, error) {
 	files := make(map[string]FileInfo)
 
 	err := filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
 		// 过滤隐藏文件和系统文件
 		filename := info.Name()
@@ -216,71 +307,70 @@ func updateFileRecords(files map[string]FileInfo, backupID string) error {
 	return tx.Commit()
 }
 
-// 根据文件类型选择最佳压缩方式
-func selectCompressionMethod(filename string) uint16 {
-	ext := strings.ToLower(filepath.Ext(filename))
-
-	// 已压缩的文件类型使用 STORE 方法（不压缩）
-	noCompressionExts := map[string]bool{
-		".jpg": true, ".jpeg": true, ".png": true,
-		".mp3": true, ".mp4": true, ".zip": true,
-		".rar": true, ".7z": true, ".gz": true,
-	}
-
-	if noCompressionExts[ext] {
-		return zip.Store
-	}
-
-	// 其他文件使用 DEFLATE 方法
-	return zip.Deflate
-}
-
-// 将文件压缩逻辑抽取为独立函数
-func (b *BackupInfo) compressFile(archive *zip.Writer, srcDir, filePath, password string) error {
-	fullPath := filepath.Join(srcDir, filePath)
+// 将文件压缩逻辑抽取为独立函数，返回写入压缩包的目录项，目录返回nil。
+// fullPath为读取内容的路径，filePath为写入压缩包的相对路径。
+// sig不为空时文件内容会同时写入sig，用于计算分块签名
+func (b *BackupInfo) compressFile(ctx context.Context, aw archive.Writer, fullPath, filePath string, sig io.Writer) (*db.BackupEntry, error) {
 	info, err := os.Stat(fullPath)
 	if err != nil {
 		log.Error("获取文件信息失败: %v", err)
-		return fmt.Errorf("获取文件信息失败: %v", err)
+		return nil, fmt.Errorf("获取文件信息失败: %v", err)
 	}
 
 	if info.IsDir() {
-		return nil
+		return nil, nil
+	}
+
+	// 读取过程中被修改时需要重新读取，先暂存文件内容，压缩包中只写入最后一次读取的副本
+	if retries := b.modifiedRetries(); retries > 0 {
+		staged, err := b.stageFile(ctx, fullPath, filePath, retries)
+		if err != nil {
+			return nil, err
+		}
+		defer staged.Close()
+
+		entry, err := b.writeFile(ctx, aw, staged.reader(), filePath, staged.info, staged.size, sig)
+		if entry != nil {
+			entry.Inconsistent = entry.Inconsistent || staged.changed
+		}
+		return entry, err
 	}
 
-	// 创建带缓冲的读取器
 	file, err := os.Open(fullPath)
 	if err != nil {
 		log.Error("打开文件失败: %v", err)
-		return fmt.Errorf("打开文件失败: %v", err)
+		return nil, fmt.Errorf("打开文件失败: %v", err)
 	}
 	defer file.Close()
 
-	bufferedReader := bufio.NewReaderSize(file, defaultBufferSize)
-
-	header, err := zip.FileInfoHeader(info)
-	if err != nil {
-		log.Error("创建文件头失败: %v", err)
-		return fmt.Errorf("创建文件头失败: %v", err)
+	entry, err := b.writeFile(ctx, aw, file, filePath, info, info.Size(), sig)
+	if entry != nil {
+		entry.Inconsistent = entry.Inconsistent || fileChanged(fullPath, info)
 	}
+	return entry, err
+}
 
-	relPath, err := filepath.Rel(srcDir, fullPath)
-	if err != nil {
-		log.Error("获取相对路径失败: %v", err)
-		return fmt.Errorf("获取相对路径失败: %v", err)
+// 从r中读取size字节作为文件写入压缩包，r提前结束时目录项标记为不一致
+func (b *BackupInfo) writeFile(ctx context.Context, aw archive.Writer, r io.Reader, filePath string, info os.FileInfo, size int64, sig io.Writer) (*db.BackupEntry, error) {
+	// 创建带缓冲的读取器
+	bufferedReader := bufio.NewReaderSize(contextReader{ctx, r}, defaultBufferSize)
+	// 读取文件开头用于选择压缩方式，不足sniffSize时返回全部内容
+	head, _ := bufferedReader.Peek(sniffSize)
+
+	header := &archive.Header{
+		Name:    filepath.ToSlash(filePath),
+		Size:    size,
+		Mode:    info.Mode(),
+		ModTime: info.ModTime(),
+		// 根据文件内容选择压缩方法
+		Method: b.selectCompression(filePath, head),
+		Info:   info,
 	}
 
-	header.Name = filepath.ToSlash(relPath)
-	header.SetModTime(info.ModTime())
-
-	// 根据文件类型选择压缩方法
-	header.Method = selectCompressionMethod(filePath)
-	header.SetPassword(password)
-
-	writer, err := archive.CreateHeader(header)
+	writer, err := aw.Create(header)
 	if err != nil {
 		log.Error("创建文件头失败: %v", err)
-		return fmt.Errorf("创建文件头失败: %v", err)
+		return nil, fmt.Errorf("创建文件头失败: %v", err)
 	}
 
 	// 从池中获取缓冲区
@@ -289,34 +379,101 @@ func (b *BackupInfo) compressFile(archive *zip.Writer, srcDir, filePath, passwor
 		bufPool.Put(&buf)
 	}()
 
-	_, err = io.CopyBuffer(writer, bufferedReader, buf)
+	// 写入压缩包的同时计算原始内容的哈希，供校验使用
+	hasher := sha256.New()
+	dst := io.MultiWriter(writer, hasher)
+	if sig != nil {
+		dst = io.MultiWriter(writer, hasher, sig)
+	}
+	// 只复制文件头中的大小，文件在读取过程中变大或变小时tar格式的文件头仍然有效
+	written, err := io.CopyBuffer(dst, io.LimitReader(bufferedReader, size), buf)
 	if err != nil {
 		log.Error("复制文件内容失败: %v", err)
-		return fmt.Errorf("复制文件内容失败: %v", err)
+		return nil, fmt.Errorf("复制文件内容失败: %v", err)
+	}
+	inconsistent := written < size
+	if inconsistent && b.Format.FixedSize() {
+		// 文件变小了，tar格式用0补足文件头中的大小，zip格式只保存读取到的内容
+		if _, err := io.CopyN(dst, zeroReader{}, size-written); err != nil {
+			log.Error("复制文件内容失败: %v", err)
+			return nil, fmt.Errorf("复制文件内容失败: %v", err)
+		}
+		written = size
 	}
 
-	return nil
+	return &db.BackupEntry{
+		Path:         header.Name,
+		Size:         written,
+		Hash:         hex.EncodeToString(hasher.Sum(nil)),
+		ModTime:      info.ModTime(),
+		Inconsistent: inconsistent,
+	}, nil
+}
+
+// 读取前后文件的大小或修改时间不一致时，认为文件在读取过程中被修改
+func fileChanged(path string, before os.FileInfo) bool {
+	after, err := os.Stat(path)
+	return err != nil || after.Size() != before.Size() || !after.ModTime().Equal(before.ModTime())
 }
 
-// 增量压缩文件夹
-func (b *BackupInfo) Backup() error {
-	// 检查是否已经在运行
-	mu.Lock()
-	if isRunning {
-		mu.Unlock()
-		log.Warn("备份任务已经在运行中，不能重复运行")
-		return fmt.Errorf("备份任务已经在运行中")
+// 读取结果全部为0
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// 增量压缩文件夹，ctx取消时在安全的位置停止，删除未完成的分片并把本次运行记录为中断
+func (b *BackupInfo) Backup(ctx context.Context) error {
+	return b.backup(ctx, nil)
+}
+
+// BackupPaths 只检查指定的相对路径并备份其中变化的文件，不遍历整个目录
+func (b *BackupInfo) BackupPaths(ctx context.Context, paths []string) error {
+	return b.backup(ctx, paths)
+}
+
+// paths为nil时遍历整个目录
+func (b *BackupInfo) backup(ctx context.Context, paths []string) error {
+	if ctx.Err() != nil {
+		return fmt.Errorf("程序正在退出，不再开始新的备份")
 	}
-	isRunning = true
-	mu.Unlock()
 
-	// 确保在函数结束时重置运行状态
-	defer func() {
-		mu.Lock()
-		isRunning = false
-		mu.Unlock()
-	}()
+	// 同一个任务同一时间只能有一个备份在运行，包括其他进程中的备份
+	backupID := filepath.Base(b.SrcDir)
+	unlock, err := acquireLock(jobLockName(backupID))
+	if err != nil {
+		log.Warn("备份任务不能重复运行: %v", err)
+		return fmt.Errorf("备份任务已经在运行中: %v", err)
+	}
+	defer unlock()
 
+	// 暂停的任务恢复后才能运行
+	control, err := loadJobControl(backupID)
+	if err != nil {
+		log.Error("%v", err)
+		return err
+	}
+	if control == db.JobControlPaused {
+		log.Info("任务已暂停，不开始新的备份: %s", backupID)
+		return fmt.Errorf("任务已暂停")
+	}
+	startedAt := time.Now()
+	ctx, stop := startControl(ctx, backupID, startedAt)
+	defer stop()
+
+	err = b.runWithHooks(ctx, paths, startedAt)
+	saveRunLog(backupID, startedAt.Format("20060102_150405"))
+	// 只检查部分路径的备份不能代替计划的完整备份，不更新任务状态
+	if paths == nil {
+		b.saveJobState(startedAt, runStatus(ctx, err), err)
+	}
+	return err
+}
+
+// 执行一次备份，由backup保证同一时间只有一个备份在运行，timestamp用于命名本次运行和分片
+func (b *BackupInfo) runBackup(ctx context.Context, paths []string, timestamp string) (err error) {
 	// 添加输入参数验证
 	if b.SrcDir == "" || b.OutputDir == "" {
 		log.Error("源目录和输出目录不能为空")
@@ -324,161 +481,717 @@ func (b *BackupInfo) Backup() error {
 	}
 
 	defer func() {
-		if err := recover(); err != nil {
-			log.Error("压缩过程发生严重错误: %v", err)
+		if r := recover(); r != nil {
+			log.Error("压缩过程发生严重错误: %v", r)
+			err = fmt.Errorf("压缩过程发生严重错误: %v", r)
 		}
 	}()
 
 	backupID := filepath.Base(b.SrcDir)
 
-	// 只获取一次文件列表，后面复用这个结果
-	currentFiles, err := getFilesList(b.SrcDir)
+	if b.Uploader != nil {
+		cleanupStreamChunks(ctx, b.Uploader, backupID)
+		b.uploadPendingParts(ctx, backupID)
+	}
+
+	// 只获取一次文件列表，后面复用这个结果。指定了路径时在上一次的文件记录基础上只更新这些路径。
+	// 仓库模式不保存文件记录，每个快照都必须包含所有文件，始终遍历整个目录，未变化的文件复用上一次快照的数据块
+	var currentFiles, candidates map[string]FileInfo
+	if paths == nil || b.Mode == ModeRepository {
+		currentFiles, err = getFilesList(ctx, b.SrcDir)
+		candidates = currentFiles
+	} else {
+		currentFiles, candidates, err = getChangedFilesList(ctx, b.SrcDir, backupID, paths)
+	}
 	if err != nil {
 		log.Error("获取文件列表失败: %v", err)
 		return err
 	}
 
+	if b.Mode == ModeRepository {
+		return b.backupRepository(ctx, backupID, timestamp, currentFiles)
+	}
+
 	// 检查需要更新的文件，复用已获取的文件列表
-	filesToUpdate, err := needsBackup(currentFiles, backupID, b.ForceFull)
+	filesToUpdate, err := needsBackup(candidates, backupID, b.ForceFull)
 	if err != nil {
 		log.Error("检查需要更新的文件失败: %v", err)
 		return err
 	}
 
-	if len(filesToUpdate) == 0 {
+	// 命令源每次完整备份都重新执行，监听触发的备份只处理变化的文件
+	sources := b.Sources
+	if paths != nil {
+		sources = nil
+	}
+
+	if len(filesToUpdate) == 0 && len(sources) == 0 {
 		log.Info("没有文件需要更新")
 		return nil
 	}
+	runningControl(backupID).setTotal(len(filesToUpdate))
+
+	// 记录本次备份运行，分片和目录项都关联到该记录
+	run := &db.BackupRun{
+		BackupID:  backupID,
+		Timestamp: timestamp,
+		Full:      b.ForceFull,
+		Status:    db.RunStatusRunning,
+		StartedAt: time.Now(),
+	}
+	if _, err := db.CreateBackupRun(run); err != nil {
+		log.Error("创建备份运行记录失败: %v", err)
+		return fmt.Errorf("创建备份运行记录失败: %v", err)
+	}
+
+	res, err := b.archiveFiles(ctx, run, filesToUpdate, sources)
+	// 命令源失败不影响其他文件的备份，本次运行仍然按失败处理
+	var sourceErr error
+	if len(res.failed) > 0 {
+		sourceErr = fmt.Errorf("命令源执行失败: %s", strings.Join(res.failed, ", "))
+	}
+
+	run.Status = runStatus(ctx, err)
+	run.FinishedAt = time.Now()
+	if err != nil {
+		run.Error = err.Error()
+	} else if sourceErr != nil {
+		run.Status = db.RunStatusFailed
+		run.Error = sourceErr.Error()
+	}
+	if ferr := db.FinishBackupRun(run); ferr != nil {
+		log.Error("更新备份运行记录失败: %v", ferr)
+	}
+
+	if err != nil {
+		if run.Status == db.RunStatusInterrupted || run.Status == db.RunStatusCancelled {
+			// 只更新已经写入完成分片的文件，恢复后的下一次备份从断点继续
+			if cerr := b.saveCheckpoint(backupID, currentFiles, res); cerr != nil {
+				log.Error("保存备份断点失败: %v", cerr)
+			}
+			msg := "备份被中断"
+			if run.Status == db.RunStatusCancelled {
+				msg = "备份已取消"
+			}
+			log.Warn("%s: %s, 已完成的%d个文件保留在已写完的分片中", msg, timestamp, len(res.done))
+			return fmt.Errorf("%s: %v", msg, err)
+		}
+		return err
+	}
+
+	// 备份完成后，直接使用已有的文件列表更新数据库记录
+	err = updateFileRecords(currentFiles, backupID)
+	if err != nil {
+		return fmt.Errorf("更新文件记录失败: %v", err)
+	}
+
+	// 备份成功后才保存签名，保证下一次的差异基于已备份的版本
+	if err := b.saveFileSignatures(backupID, res.sigs); err != nil {
+		log.Error("保存文件签名失败: %v", err)
+		return fmt.Errorf("保存文件签名失败: %v", err)
+	}
+
+	return sourceErr
+}
+
+// 压缩的结果，出错时也返回已经写入完成分片的文件，用于中断后从断点继续
+type archiveResult struct {
+	sigs   []*db.FileSignature // 大文件的分块签名
+	failed []string            // 执行失败的命令源名称
+	done   []string            // 所在分片已经完成并记录的文件
+}
+
+// 保存已经写入完成分片的文件的记录和签名，其他文件在下一次备份时重新检查
+func (b *BackupInfo) saveCheckpoint(backupID string, currentFiles map[string]FileInfo, res *archiveResult) error {
+	if len(res.done) == 0 {
+		return nil
+	}
+
+	done := make(map[string]bool, len(res.done))
+	records := make([]*db.FileRecord, 0, len(res.done))
+	for _, p := range res.done {
+		done[filepath.ToSlash(p)] = true
+		if info, ok := currentFiles[p]; ok {
+			records = append(records, &db.FileRecord{
+				Path:     info.Path,
+				ModTime:  info.ModTime,
+				Hash:     info.Hash,
+				BackupID: backupID,
+			})
+		}
+	}
+	if err := db.ReplaceFileRecords(records); err != nil {
+		return fmt.Errorf("更新文件记录失败: %v", err)
+	}
+
+	var sigs []*db.FileSignature
+	for _, sig := range res.sigs {
+		if done[sig.Path] {
+			sigs = append(sigs, sig)
+		}
+	}
+	if err := b.saveFileSignatures(backupID, sigs); err != nil {
+		return fmt.Errorf("保存文件签名失败: %v", err)
+	}
+	return nil
+}
 
+// 将需要更新的文件和命令源的输出压缩到分片中并上传，同时记录分片和目录项
+func (b *BackupInfo) archiveFiles(ctx context.Context, run *db.BackupRun, filesToUpdate map[string]bool, sources []CommandSource) (*archiveResult, error) {
 	log.Debug("开始压缩目录: %s", b.SrcDir)
+	res := &archiveResult{}
 
 	// 确保输出目录存在
 	if err := os.MkdirAll(b.OutputDir, 0755); err != nil {
 		log.Error("创建输出目录失败: %v", err)
-		return fmt.Errorf("创建输出目录失败: %v", err)
+		return res, fmt.Errorf("创建输出目录失败: %v", err)
 	}
 
-	timestamp := time.Now().Format("20060102_150405")
+	backupID := run.BackupID
+	timestamp := run.Timestamp
+	partSize := b.partSize()
 
 	// 用于跟踪当前压缩文件的大小
 	var currentZipSize int64 = 0
 	var zipIndex = 1
-	var currentArchive *zip.Writer
-	var currentZipFile *os.File
+	var currentArchive archive.Writer
+	var currentZipFile io.WriteCloser // 本地分片文件，流式上传时为streamWriter
+	var currentPartName string
+	var currentEntries []*db.BackupEntry
+	var parts []*db.BackupPart
+	var partFiles []string    // 当前分片中已经写完的文件
+	var inconsistent []string // 备份过程中仍在变化的文件
+
+	// 关闭当前zip文件并记录分片和目录项
+	finishZipFile := func() error {
+		err := currentArchive.Close()
+		if err == nil {
+			// 流式上传时关闭会上传最后一块
+			err = currentZipFile.Close()
+		} else {
+			currentZipFile.Close()
+		}
+		out := currentZipFile
+		currentArchive = nil
+		currentZipFile = nil
+		sw, streamed := out.(*streamWriter)
+		if err != nil {
+			if streamed {
+				sw.abort()
+			}
+			log.Error("关闭压缩文件失败: %v", err)
+			return fmt.Errorf("关闭压缩文件失败: %v", err)
+		}
+
+		partNum := zipIndex - 1
+		part := &db.BackupPart{
+			RunID:   run.ID,
+			PartNum: partNum,
+			Name:    currentPartName,
+		}
+		if streamed {
+			part.Size = sw.size
+			part.Chunks = sw.chunks
+			part.Uploaded = true
+		} else {
+			partPath := filepath.Join(b.OutputDir, currentPartName)
+			if info, err := os.Stat(partPath); err == nil {
+				part.Size = info.Size()
+			}
+			if b.Parity > 0 {
+				if _, err := parity.CreateFile(partPath, b.Parity); err != nil {
+					log.Error("生成恢复数据失败: %v", err)
+					return fmt.Errorf("生成恢复数据失败: %v", err)
+				}
+			}
+		}
+		if err := db.SaveBackupPart(part); err != nil {
+			if streamed {
+				sw.abort()
+			}
+			log.Error("保存分片记录失败: %v", err)
+			return fmt.Errorf("保存分片记录失败: %v", err)
+		}
+		parts = append(parts, part)
+		if streamed {
+			if err := sw.release(); err != nil {
+				log.Error("%v", err)
+				return err
+			}
+		}
+
+		for _, entry := range currentEntries {
+			entry.RunID = run.ID
+			entry.PartNum = partNum
+			if entry.Invalid {
+				continue
+			}
+			run.FileCount++
+			run.TotalSize += entry.Size
+		}
+		if err := db.BatchSaveBackupEntries(currentEntries); err != nil {
+			log.Error("保存目录项失败: %v", err)
+			return fmt.Errorf("保存目录项失败: %v", err)
+		}
+		currentEntries = nil
+		res.done = append(res.done, partFiles...)
+		partFiles = nil
+		return nil
+	}
 
 	// 创建新的zip文件函数
 	createNewZipFile := func() error {
 		if currentZipFile != nil {
-			currentArchive.Close()
-			currentZipFile.Close()
+			if err := finishZipFile(); err != nil {
+				return err
+			}
 		}
 
-		destZip := filepath.Join(b.OutputDir, fmt.Sprintf("%s_%s_part%d.zip", backupID, timestamp, zipIndex))
-		zipfile, err := os.Create(destZip)
+		opts := b.archiveOptions()
+		partName := fmt.Sprintf("%s_%s_part%d%s", backupID, timestamp, zipIndex, opts.Ext())
+		var zipfile io.WriteCloser
+		if b.Stream {
+			zipfile = newStreamWriter(ctx, b.Uploader, backupID, b.BasePath, partName)
+		} else {
+			f, err := os.Create(filepath.Join(b.OutputDir, partName))
+			if err != nil {
+				log.Error("创建压缩文件失败: %v", err)
+				return fmt.Errorf("创建压缩文件失败: %v", err)
+			}
+			zipfile = f
+		}
+		aw, err := archive.NewWriter(zipfile, opts)
 		if err != nil {
-			log.Error("创建zip文件失败: %v", err)
-			return fmt.Errorf("创建zip文件失败: %v", err)
+			zipfile.Close()
+			log.Error("创建压缩文件失败: %v", err)
+			return fmt.Errorf("创建压缩文件失败: %v", err)
 		}
 		currentZipFile = zipfile
-		currentArchive = zip.NewWriter(zipfile)
+		currentPartName = partName
+		currentArchive = aw
 		currentZipSize = 0
 		zipIndex++
 		return nil
 	}
 
+	// 切换到新的分片，并上传前一个分片
+	rollPart := func() error {
+		if err := createNewZipFile(); err != nil {
+			return err
+		}
+
+		// 如果有上传器，上传前一个文件，流式上传的分片已经上传完成
+		if prev := parts[len(parts)-1]; b.Uploader != nil && !prev.Uploaded {
+			return b.uploadPart(ctx, prev)
+		}
+		return nil
+	}
+
+	// 将文件拆分为多个片段，先填满当前分片的剩余空间，之后每个分片一个片段
+	writeSegments := func(fullPath, filePath string, info os.FileInfo, sig io.Writer) error {
+		file, err := os.Open(fullPath)
+		if err != nil {
+			log.Error("打开文件失败: %v", err)
+			return fmt.Errorf("打开文件失败: %v", err)
+		}
+		defer file.Close()
+
+		if currentZipSize >= partSize {
+			if err := rollPart(); err != nil {
+				return err
+			}
+		}
+
+		size := info.Size()
+		first := partSize - currentZipSize
+		total := 1 + int((size-first+partSize-1)/partSize)
+		name := filepath.ToSlash(filePath)
+		reader := bufio.NewReaderSize(contextReader{ctx, file}, defaultBufferSize)
+		head, _ := reader.Peek(sniffSize)
+		method := b.selectCompression(filePath, head)
+
+		log.Info("文件超过分片大小，拆分为%d个片段: %s", total, filePath)
+
+		var offset int64
+		var changed bool // 之前的片段读取时文件已经变小
+		for n := 1; offset < size; n++ {
+			if n > 1 {
+				if err := rollPart(); err != nil {
+					return err
+				}
+			}
+
+			segSize := min(partSize-currentZipSize, size-offset)
+			entry, err := compressSegment(currentArchive, reader, name, n, total, segSize, info, method, sig, b.Format.FixedSize())
+			if err != nil {
+				return err
+			}
+			if n == total {
+				// 拆分的文件不重新压缩，只在最后一段标记读取过程中是否被修改
+				entry.Inconsistent = entry.Inconsistent || changed || fileChanged(fullPath, info)
+				if entry.Inconsistent {
+					inconsistent = append(inconsistent, filePath)
+				}
+			}
+			changed = changed || entry.Inconsistent
+			currentEntries = append(currentEntries, entry)
+			currentZipSize += entry.Size
+			offset += segSize
+		}
+		return nil
+	}
+
 	// 创建第一个zip文件
 	if err := createNewZipFile(); err != nil {
-		return err
+		return res, err
 	}
 	defer func() {
+		// 出错时不再上传未完成的分片，并删除已上传的分块
+		if sw, ok := currentZipFile.(*streamWriter); ok {
+			sw.abort()
+		}
 		if currentArchive != nil {
 			currentArchive.Close()
 		}
 		if currentZipFile != nil {
 			currentZipFile.Close()
+			// 未写完的分片没有记录，不能用于还原
+			if _, ok := currentZipFile.(*os.File); ok {
+				log.Info("删除未完成的分片: %s", currentPartName)
+				os.Remove(filepath.Join(b.OutputDir, currentPartName))
+			}
 		}
 	}()
 
-	// 修改文件压缩逻辑
-	for filePath := range filesToUpdate {
-		fullPath := filepath.Join(b.SrcDir, filePath)
+	// 写入计算好的文件差异，当前分片放不下时先切换到新的分片
+	writeDelta := func(d *fileDelta, fullPath string) (*db.BackupEntry, error) {
+		if currentZipSize > 0 && currentZipSize+d.size > partSize {
+			if err := rollPart(); err != nil {
+				return nil, err
+			}
+		}
+		entry, err := d.write(currentArchive)
+		if err != nil {
+			return nil, err
+		}
+		res.sigs = append(res.sigs, d.sig)
+		entry.Inconsistent = fileChanged(fullPath, d.info)
+		return entry, nil
+	}
+
+	// 压缩一个文件，fullPath为读取内容的路径，目录和已经不存在的文件返回nil
+	archiveFile := func(fullPath, filePath string) (*db.BackupEntry, error) {
 		info, err := os.Stat(fullPath)
 		if err != nil {
 			log.Error("获取文件信息失败: %v", err)
-			continue
+			return nil, nil
 		}
 
-		// 如果当前文件加上当前zip大小超过限制，创建新的zip文件
-		if !info.IsDir() && currentZipSize+info.Size() > maxZipSize {
-			if err := createNewZipFile(); err != nil {
-				return err
+		// 如果当前文件加上当前zip大小超过限制，创建新的zip文件，超过分片大小的文件会被拆分，不需要提前切换
+		if !info.IsDir() && info.Size() <= partSize && currentZipSize+info.Size() > partSize {
+			if err := rollPart(); err != nil {
+				return nil, err
 			}
+		}
 
-			// 如果有上传器，上传前一个文件
-			if b.Uploader != nil {
-				prevZipPath := filepath.Join(b.OutputDir, fmt.Sprintf("%s_%s_part%d.zip", backupID, timestamp, zipIndex-2))
-				log.Info("开始上传文件: %s", prevZipPath)
-				err = b.Uploader.UploadBigFile(b.BasePath, prevZipPath)
-				if err != nil {
-					return fmt.Errorf("上传文件失败: %v", err)
-				}
-				// 上传成功后删除本地文件
-				os.Remove(prevZipPath)
+		// 开启差异备份时大文件只写入变化的块，没有上一次的签名时写入整个文件并计算签名
+		var entry *db.BackupEntry
+		var builder *delta.SignatureBuilder
+		if b.Delta && !info.IsDir() && info.Size() >= deltaMinSize {
+			var d *fileDelta
+			d, err = b.prepareDeltaFile(ctx, backupID, fullPath, filePath, info)
+			if d != nil && d.size > partSize {
+				// 差异不能拆分到多个分片中，超过分片大小时备份整个文件，由writeSegments拆分
+				log.Info("文件差异超过分片大小(%d字节)，备份整个文件: %s", d.size, filePath)
+				d.Close()
+				d = nil
+			}
+			if d != nil {
+				entry, err = writeDelta(d, fullPath)
+				d.Close()
+			}
+			if entry == nil && err == nil {
+				builder = delta.NewSignatureBuilder(0)
 			}
 		}
 
-		// 压缩文件
-		err = b.compressFile(currentArchive, b.SrcDir, filePath, b.Password)
+		if entry == nil && err == nil {
+			var sigWriter io.Writer
+			if builder != nil {
+				sigWriter = builder
+			}
+
+			if !info.IsDir() && info.Size() > partSize {
+				// 超过分片大小的文件拆分为多个片段写入连续的分片
+				err = writeSegments(fullPath, filePath, info, sigWriter)
+			} else {
+				// 文件在读取过程中被修改时重新读取，只有最后一次读取的内容写入压缩包
+				entry, err = b.compressFile(ctx, currentArchive, fullPath, filePath, sigWriter)
+			}
+			if err == nil && builder != nil {
+				res.sigs = append(res.sigs, newFileSignature(backupID, filepath.ToSlash(filePath), builder.Signature()))
+			}
+		}
 		if err != nil {
 			log.Error("压缩文件失败: %v", err)
-			return fmt.Errorf("压缩文件失败: %v", err)
+			return nil, fmt.Errorf("压缩文件失败: %v", err)
+		}
+		if entry != nil && entry.Inconsistent {
+			inconsistent = append(inconsistent, filePath)
 		}
+		return entry, nil
+	}
 
-		if !info.IsDir() {
-			currentZipSize += info.Size()
+	// 把命令源已经写入的片段标记为无效，不计入运行的文件数量和大小。
+	// 已经随前面的分片保存的目录项在数据库中更新，当前分片的目录项保存时带上标记
+	invalidateSegments := func(src CommandSource, written []*db.BackupEntry) error {
+		var saved []string
+		for _, entry := range written {
+			entry.Invalid = true
+			if entry.RunID != 0 {
+				saved = append(saved, entry.Path)
+				run.FileCount--
+				run.TotalSize -= entry.Size
+			}
+		}
+		if len(saved) == 0 {
+			return nil
+		}
+		if err := db.InvalidateBackupEntries(run.ID, saved); err != nil {
+			log.Error("标记命令源 %s 的目录项失败: %v", src.Name, err)
+			return fmt.Errorf("标记命令源 %s 的目录项失败: %v", src.Name, err)
 		}
+		return nil
+	}
+
+	// 执行命令并把标准输出按块写入压缩包，返回命令是否成功，只有写入压缩包失败时返回错误。
+	// 输出不超过一块时写为一个普通文件；否则写为片段，最后一段在命令成功退出后才写入，
+	// 失败时已写入片段的目录项标记为无效，还原后只会留下未完成的临时文件
+	writeSource := func(src CommandSource, buf []byte) (bool, error) {
+		log.Info("开始执行命令源: %s", src.Name)
+		stream, err := b.startSource(ctx, src, run)
+		if err != nil {
+			log.Error("命令源 %s 启动失败: %v", src.Name, err)
+			return false, nil
+		}
+
+		modTime := time.Now()
+		var method archive.Method
+		var total int64
+		var written []*db.BackupEntry
+		for n := 1; ; n++ {
+			// 暂停时不再读取输出，命令写满管道后会等待
+			if err := utils.WaitIfPaused(ctx); err != nil {
+				stream.kill(err)
+				return false, invalidateSegments(src, written)
+			}
+			size, last, err := stream.next(buf)
+			if err != nil {
+				log.Error("读取命令源 %s 的输出失败: %v", src.Name, stream.kill(err))
+				return false, invalidateSegments(src, written)
+			}
+			if last {
+				if err := stream.wait(); err != nil {
+					log.Error("命令源 %s 执行失败: %v", src.Name, err)
+					return false, invalidateSegments(src, written)
+				}
+			}
+
+			data := buf[:size]
+			if n == 1 {
+				method = b.selectCompression(src.Name, data[:min(size, sniffSize)])
+			}
+			name := src.Name
+			if !last || n > 1 {
+				// 总段数在读完之前未知，之前的片段总数记为0，最后一段记为实际段数
+				name = segmentName(src.Name, n, 0)
+				if last {
+					name = segmentName(src.Name, n, n)
+				}
+			}
+
+			if currentZipSize > 0 && currentZipSize+int64(size) > partSize {
+				if err := rollPart(); err != nil {
+					stream.kill(err)
+					return false, err
+				}
+			}
+			entry, err := writeSourceEntry(currentArchive, name, data, modTime, method)
+			if err != nil {
+				stream.kill(err)
+				log.Error("写入命令源 %s 失败: %v", src.Name, err)
+				return false, fmt.Errorf("写入命令源 %s 失败: %v", src.Name, err)
+			}
+			currentEntries = append(currentEntries, entry)
+			written = append(written, entry)
+			currentZipSize += entry.Size
+			total += entry.Size
+
+			if last {
+				log.Info("命令源 %s 完成, 共%d字节", src.Name, total)
+				return true, nil
+			}
+		}
+	}
+
+	// 在线备份的SQLite数据库已经包含WAL等辅助文件中的内容，辅助文件变化时改为备份数据库
+	paths := make([]string, 0, len(filesToUpdate))
+	for p := range filesToUpdate {
+		paths = append(paths, p)
+	}
+	sidecars, sqliteChecked := b.sqliteSidecars(paths)
+	for sidecar, dbPath := range sidecars {
+		delete(filesToUpdate, sidecar)
+		filesToUpdate[dbPath] = true
+	}
+
+	// 修改文件压缩逻辑，每个文件开始前检查是否需要暂停或停止
+	ctl := runningControl(backupID)
+	for filePath := range filesToUpdate {
+		if err := utils.WaitIfPaused(ctx); err != nil {
+			return res, err
+		}
+		// SQLite数据库读取一致的快照，读取完成后删除
+		fullPath, cleanup := b.sourceFile(ctx, filePath, sqliteChecked)
+		entry, err := archiveFile(fullPath, filePath)
+		cleanup()
+		if err != nil {
+			return res, err
+		}
+		var size int64
+		if entry != nil {
+			currentEntries = append(currentEntries, entry)
+			currentZipSize += entry.Size
+			size = entry.Size
+		}
+		partFiles = append(partFiles, filePath)
+		ctl.addDone(size)
+	}
+
+	// 命令源的输出直接写入压缩包，命令失败时记录名称后继续
+	if len(sources) > 0 {
+		buf := make([]byte, sourceChunkSize)
+		for _, src := range sources {
+			if err := utils.WaitIfPaused(ctx); err != nil {
+				return res, err
+			}
+			ok, err := writeSource(src, buf)
+			if err != nil {
+				return res, err
+			}
+			if !ok {
+				res.failed = append(res.failed, src.Name)
+			}
+		}
+	}
+
+	// 被取消的命令源没有写完，不能关闭分片
+	if err := ctx.Err(); err != nil {
+		return res, err
 	}
 
 	// 关闭最后一个压缩文件
-	currentArchive.Close()
-	currentZipFile.Close()
+	if err := finishZipFile(); err != nil {
+		return res, err
+	}
 
-	// 上传最后的文件
+	// 上传剩余的文件
 	if b.Uploader != nil {
-		for i := 1; i < zipIndex; i++ {
-			lastZipPath := filepath.Join(b.OutputDir, fmt.Sprintf("%s_%s_part%d.zip", backupID, timestamp, i))
-			if _, err := os.Stat(lastZipPath); err == nil {
-				log.Info("开始上传文件: %s", lastZipPath)
-				err = b.Uploader.UploadBigFile(b.BasePath, lastZipPath)
-				if err != nil {
-					return fmt.Errorf("上传文件失败: %v", err)
-				}
-				// 上传成功后删除本地文件
-				os.Remove(lastZipPath)
+		for _, part := range parts {
+			if part.Uploaded {
+				continue
+			}
+			if err := b.uploadPart(ctx, part); err != nil {
+				return res, err
 			}
 		}
 	}
 
+	run.Inconsistent = int64(len(inconsistent))
+	if len(inconsistent) > 0 {
+		log.Warn("以下%d个文件在备份过程中仍在变化，备份的内容可能不完整: %s", len(inconsistent), strings.Join(inconsistent, ", "))
+	}
+
 	log.Info("压缩文件完成")
 
-	// 备份完成后，直接使用已有的文件列表更新数据库记录
-	err = updateFileRecords(currentFiles, backupID)
-	if err != nil {
-		return fmt.Errorf("更新文件记录失败: %v", err)
+	return res, nil
+}
+
+// 上传分片及其恢复文件并校验远端哈希，失败时保留本地文件下次重新上传，
+// 成功后标记分片已上传并删除本地文件
+func (b *BackupInfo) uploadPart(ctx context.Context, part *db.BackupPart) error {
+	localPath := filepath.Join(b.OutputDir, part.Name)
+	parPath := localPath + parity.Ext
+
+	if err := b.uploadFile(ctx, localPath); err != nil {
+		return err
+	}
+	if _, err := os.Stat(parPath); err == nil {
+		if err := b.uploadFile(ctx, parPath); err != nil {
+			return err
+		}
 	}
 
+	if err := db.MarkBackupPartUploaded(part.ID); err != nil {
+		log.Error("更新分片上传状态失败: %v", err)
+		return fmt.Errorf("更新分片上传状态失败: %v", err)
+	}
+	part.Uploaded = true
+
+	// 上传成功后删除本地文件
+	os.Remove(localPath)
+	os.Remove(parPath)
 	return nil
 }
 
-// 启动定时备份任务
-func (b *BackupInfo) StartScheduledBackup() {
+// 上传文件，哈希不一致时重新上传
+func (b *BackupInfo) uploadFile(ctx context.Context, localPath string) error {
+	var err error
+	for attempt := 1; attempt <= maxUploadAttempts; attempt++ {
+		log.Info("开始上传文件: %s", localPath)
+		err = b.Uploader.UploadBigFile(ctx, b.BasePath, localPath)
+		if err == nil || !errors.Is(err, utils.ErrHashMismatch) {
+			break
+		}
+		log.Warn("远端文件哈希不一致，重新上传(%d/%d): %s", attempt, maxUploadAttempts, filepath.Base(localPath))
+	}
+	if err != nil {
+		return fmt.Errorf("上传文件失败: %v", err)
+	}
+	return nil
+}
+
+// 重新上传之前备份中上传失败的分片
+func (b *BackupInfo) uploadPendingParts(ctx context.Context, backupID string) {
+	parts, err := db.LoadPendingBackupParts(backupID)
+	if err != nil {
+		log.Error("加载待上传分片失败: %v", err)
+		return
+	}
+
+	for _, part := range parts {
+		if ctx.Err() != nil {
+			return
+		}
+		if _, err := os.Stat(filepath.Join(b.OutputDir, part.Name)); err != nil {
+			continue
+		}
+		log.Info("重新上传之前失败的分片: %s", part.Name)
+		if err := b.uploadPart(ctx, part); err != nil {
+			log.Error("重新上传分片失败: %v", err)
+		}
+	}
+}
+
+// 启动定时备份任务，ctx取消后不再触发新的备份
+func (b *BackupInfo) StartScheduledBackup(ctx context.Context) {
 	c := cron.New()
 
 	// 每天0点执行备份
 	_, err := c.AddFunc(b.Cron, func() {
 		log.Info("开始执行定时备份任务: %s", b.Cron)
 
-		err := b.Backup()
+		err := b.Backup(ctx)
 		if err != nil {
 			log.Error("定时备份失败: %v", err)
 		} else {
@@ -492,5 +1205,9 @@ func (b *BackupInfo) StartScheduledBackup() {
 	}
 
 	c.Start()
+	go func() {
+		<-ctx.Done()
+		c.Stop()
+	}()
 	log.Info("定时备份任务已启动,将在每天0点执行")
 }
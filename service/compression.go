@@ -0,0 +1,151 @@
+package service
+
+import (
+	"compress/flate"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"auto-backup/archive"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+const (
+	// 自动选择压缩方式
+	CompressionAuto = "auto"
+
+	// 读取文件开头用于识别类型和试压缩的大小
+	sniffSize = 64 * 1024
+	// 小于该大小的数据试压缩结果不可靠，直接使用默认级别
+	probeMinSize = 512
+	// 试压缩后大小超过原始大小的该比例时认为无法压缩
+	probeStoreRatio = 0.9
+	// 试压缩后大小低于原始大小的该比例时使用最高压缩率
+	probeBestRatio = 0.25
+)
+
+// 内容本身已经压缩过的类型，按MIME类型及其父类型匹配，
+// docx/xlsx/odt/epub/jar/apk等基于zip的格式会匹配到application/zip
+var compressedMimeTypes = []string{
+	"application/zip",
+	"application/gzip",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"application/x-xz",
+	"application/zstd",
+	"application/x-bzip2",
+	"application/lzip",
+	"application/vnd.ms-cab-compressed",
+}
+
+// image/、video/、audio/下未压缩的类型，其余的媒体类型都按已压缩处理
+var uncompressedMediaTypes = []string{
+	"image/bmp",
+	"image/tiff",
+	"image/svg+xml",
+	"image/x-icon",
+	"image/vnd.adobe.photoshop",
+	"image/x-xcf",
+	"image/vnd.radiance",
+	"image/vnd.dwg",
+	"image/x-xpixmap",
+	"audio/wav",
+	"audio/aiff",
+	"audio/basic",
+	"audio/midi",
+}
+
+// 文件太小无法识别内容时按扩展名判断的已压缩类型
+var compressedExts = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true,
+	".mp3": true, ".mp4": true, ".zip": true,
+	".rar": true, ".7z": true, ".gz": true,
+}
+
+// ParseCompression 校验配置中的压缩级别，空字符串使用auto，格式不能区分的固定级别返回错误
+func ParseCompression(s string, format archive.Format) (string, error) {
+	if s == "" || s == CompressionAuto {
+		return CompressionAuto, nil
+	}
+	m, err := archive.ParseMethod(s)
+	if err != nil {
+		return "", err
+	}
+	if !format.SupportsMethod(m) {
+		return "", fmt.Errorf("%s格式只支持store和default压缩级别，%s需要使用tar.zst格式", format, s)
+	}
+	return s, nil
+}
+
+// 选择文件的压缩方式，head为文件开头的数据。
+// 配置了固定的压缩级别时直接使用，auto时根据内容识别文件类型并试压缩开头的数据
+func (b *BackupInfo) selectCompression(filename string, head []byte) archive.Method {
+	if b.Compression != "" && b.Compression != CompressionAuto {
+		if m, err := archive.ParseMethod(b.Compression); err == nil {
+			return m
+		}
+	}
+	return detectCompression(filename, head)
+}
+
+func detectCompression(filename string, head []byte) archive.Method {
+	if len(head) < probeMinSize {
+		if compressedExts[strings.ToLower(filepath.Ext(filename))] {
+			return archive.Store
+		}
+		return archive.Deflate
+	}
+
+	if isCompressedType(mimetype.Detect(head)) {
+		return archive.Store
+	}
+
+	ratio := probeRatio(head)
+	switch {
+	case ratio > probeStoreRatio:
+		return archive.Store
+	case ratio < probeBestRatio:
+		return archive.Best
+	}
+	return archive.Deflate
+}
+
+func isCompressedType(mtype *mimetype.MIME) bool {
+	for m := mtype; m != nil; m = m.Parent() {
+		for _, t := range compressedMimeTypes {
+			if m.Is(t) {
+				return true
+			}
+		}
+		for _, t := range uncompressedMediaTypes {
+			if m.Is(t) {
+				return false
+			}
+		}
+		mime := m.String()
+		if strings.HasPrefix(mime, "image/") || strings.HasPrefix(mime, "video/") || strings.HasPrefix(mime, "audio/") {
+			return true
+		}
+	}
+	return false
+}
+
+// 用最快的deflate级别试压缩，返回压缩后与原始大小的比例
+func probeRatio(data []byte) float64 {
+	var counter byteCounter
+	fw, err := flate.NewWriter(&counter, flate.BestSpeed)
+	if err != nil {
+		return 0
+	}
+	fw.Write(data)
+	fw.Close()
+	return float64(counter) / float64(len(data))
+}
+
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,82 @@
+package service
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"auto-backup/archive"
+)
+
+func TestParseCompression(t *testing.T) {
+	tests := []struct {
+		level   string
+		format  archive.Format
+		want    string
+		wantErr bool
+	}{
+		{"", archive.FormatZip, CompressionAuto, false},
+		{"auto", archive.FormatZip, CompressionAuto, false},
+		{"store", archive.FormatZip, "store", false},
+		{"default", archive.FormatZip, "default", false},
+		{"fast", archive.FormatZip, "", true},
+		{"best", archive.FormatZip, "", true},
+		{"fast", archive.FormatTarZst, "fast", false},
+		{"best", archive.FormatTarZst, "best", false},
+		{"max", archive.FormatTarZst, "", true},
+	}
+	for _, tt := range tests {
+		got, err := ParseCompression(tt.level, tt.format)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseCompression(%q, %s) = %q, %v, want %q, error %v", tt.level, tt.format, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestDetectCompression(t *testing.T) {
+	pad := func(head []byte, n int) []byte {
+		return append(head, make([]byte, n)...)
+	}
+	random := []byte(randomData(3, sniffSize))
+	// 随机的8个字母，压缩率在存储和最高级别之间
+	letters := make([]byte, sniffSize)
+	for i, c := range random {
+		letters[i] = 'a' + c%8
+	}
+	tests := []struct {
+		name     string
+		filename string
+		head     []byte
+		want     archive.Method
+	}{
+		// 内容太少时按扩展名判断
+		{"small jpg", "a.JPG", []byte("tiny"), archive.Store},
+		{"small text", "a.txt", []byte("tiny"), archive.Deflate},
+		// 按内容识别已压缩的类型，不依赖扩展名
+		{"png", "image.dat", pad([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), 1024), archive.Store},
+		{"gzip", "data.bin", pad([]byte{0x1f, 0x8b, 0x08}, 1024), archive.Store},
+		{"zip based", "report.docx", pad([]byte("PK\x03\x04"), 1024), archive.Store},
+		// 未压缩的图片类型和其他内容按试压缩的结果选择
+		{"bmp", "a.bmp", pad([]byte("BM"), 4096), archive.Best},
+		{"log", "app.log", []byte(strings.Repeat("INFO request handled in 3ms\n", 2000)), archive.Best},
+		{"random", "a.txt", random, archive.Store},
+		{"letters", "a.txt", letters, archive.Deflate},
+	}
+	for _, tt := range tests {
+		if got := detectCompression(tt.filename, tt.head); got != tt.want {
+			t.Errorf("%s: detectCompression() = %d, want %d (ratio %.2f)", tt.name, got, tt.want, probeRatio(tt.head))
+		}
+	}
+}
+
+func TestSelectCompression_FixedLevel(t *testing.T) {
+	b := &BackupInfo{Compression: "store"}
+	log := bytes.Repeat([]byte("aaaa"), 1024)
+	if got := b.selectCompression("a.log", log); got != archive.Store {
+		t.Errorf("selectCompression() = %d, want Store", got)
+	}
+	b.Compression = CompressionAuto
+	if got := b.selectCompression("a.log", log); got != archive.Best {
+		t.Errorf("selectCompression() = %d, want Best", got)
+	}
+}
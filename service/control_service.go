@@ -0,0 +1,234 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"auto-backup/db"
+	"auto-backup/log"
+	"auto-backup/utils"
+)
+
+// 每次运行保存的日志行数
+const runLogLines = 2000
+
+// 运行备份的进程检查控制状态的间隔，命令行修改的状态在该时间内生效，测试中缩短
+var controlPollInterval = 2 * time.Second
+
+// 通过命令行或HTTP接口取消时ctx的原因，用于和程序退出导致的中断区分
+var errBackupCancelled = errors.New("备份已取消")
+
+// 本进程中正在运行的备份的控制方式
+type jobControl struct {
+	gate      *utils.PauseGate
+	cancel    context.CancelCauseFunc
+	log       *log.Recorder // 本次运行期间输出的日志
+	startedAt time.Time
+
+	// 备份进度，由备份过程更新，管理接口读取
+	filesTotal atomic.Int64
+	filesDone  atomic.Int64
+	bytesDone  atomic.Int64
+}
+
+// Progress 正在运行的备份的进度
+type Progress struct {
+	FilesTotal int64 `json:"files_total"` // 本次需要备份的文件数量
+	FilesDone  int64 `json:"files_done"`  // 已经写入压缩包的文件数量
+	BytesDone  int64 `json:"bytes_done"`  // 已经写入压缩包的字节数
+}
+
+// 记录本次需要备份的文件数量，ctl为nil时忽略，下同
+func (ctl *jobControl) setTotal(n int) {
+	if ctl != nil {
+		ctl.filesTotal.Store(int64(n))
+	}
+}
+
+// 记录一个文件已经写入压缩包
+func (ctl *jobControl) addDone(size int64) {
+	if ctl != nil {
+		ctl.filesDone.Add(1)
+		ctl.bytesDone.Add(size)
+	}
+}
+
+func (ctl *jobControl) progress() *Progress {
+	return &Progress{
+		FilesTotal: ctl.filesTotal.Load(),
+		FilesDone:  ctl.filesDone.Load(),
+		BytesDone:  ctl.bytesDone.Load(),
+	}
+}
+
+var (
+	controlsMu sync.Mutex
+	controls   = make(map[string]*jobControl)
+)
+
+// 注册正在运行的备份并开始记录日志，返回携带暂停开关的ctx和结束时调用的注销函数
+func startControl(ctx context.Context, backupID string, startedAt time.Time) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	ctl := &jobControl{
+		gate:      utils.NewPauseGate(),
+		cancel:    cancel,
+		log:       log.NewRecorder(runLogLines),
+		startedAt: startedAt,
+	}
+
+	controlsMu.Lock()
+	controls[backupID] = ctl
+	controlsMu.Unlock()
+
+	return utils.WithPauseGate(ctx, ctl.gate), func() {
+		controlsMu.Lock()
+		delete(controls, backupID)
+		controlsMu.Unlock()
+		cancel(nil)
+		ctl.log.Stop()
+	}
+}
+
+// 返回本进程中正在运行的备份，没有时返回nil
+func runningControl(backupID string) *jobControl {
+	controlsMu.Lock()
+	defer controlsMu.Unlock()
+	return controls[backupID]
+}
+
+// 保存正在运行的备份记录的日志，没有创建运行记录时(例如没有文件需要更新)不保存
+func saveRunLog(backupID, timestamp string) {
+	ctl := runningControl(backupID)
+	if ctl == nil {
+		return
+	}
+	if err := db.SaveBackupRunLog(backupID, timestamp, ctl.log.String()); err != nil {
+		log.Error("保存运行日志失败: %v", err)
+	}
+}
+
+// 加载任务的控制状态，没有记录时为正常
+func loadJobControl(backupID string) (string, error) {
+	state, err := db.LoadJobState(backupID)
+	if err != nil {
+		return "", fmt.Errorf("加载任务状态失败: %v", err)
+	}
+	if state == nil {
+		return db.JobControlNone, nil
+	}
+	return state.Control, nil
+}
+
+// PauseJob 暂停任务：正在运行的备份在读取或上传下一块数据之前等待，之后计划的备份也不再开始，
+// 状态保存在数据库中，重启后仍然有效
+func PauseJob(backupID string) error {
+	if err := db.SetJobControl(backupID, db.JobControlPaused); err != nil {
+		log.Error("保存任务控制状态失败: %v", err)
+		return fmt.Errorf("保存任务控制状态失败: %v", err)
+	}
+	if ctl := runningControl(backupID); ctl != nil {
+		ctl.gate.Pause()
+	}
+	log.Info("任务已暂停: %s", backupID)
+	return nil
+}
+
+// ResumeJob 恢复任务：正在等待的备份继续运行，没有正在运行的备份时由运行备份的进程重新开始一次备份，
+// 上一次中断时已经写完的文件不会重新备份
+func ResumeJob(backupID string) error {
+	if err := db.SetJobControl(backupID, db.JobControlNone); err != nil {
+		log.Error("保存任务控制状态失败: %v", err)
+		return fmt.Errorf("保存任务控制状态失败: %v", err)
+	}
+	if ctl := runningControl(backupID); ctl != nil {
+		ctl.gate.Resume()
+	}
+	log.Info("任务已恢复: %s", backupID)
+	return nil
+}
+
+// CancelJob 取消任务正在运行的备份并清除暂停状态，运行记录标记为cancelled
+func CancelJob(backupID string) error {
+	if err := db.SetJobControl(backupID, db.JobControlCancel); err != nil {
+		log.Error("保存任务控制状态失败: %v", err)
+		return fmt.Errorf("保存任务控制状态失败: %v", err)
+	}
+	if ctl := runningControl(backupID); ctl != nil {
+		ctl.cancel(errBackupCancelled)
+	}
+	log.Info("已请求取消任务: %s", backupID)
+	return nil
+}
+
+// WatchControl 定期读取任务的控制状态并应用到本进程中正在运行的备份，
+// 命令行在其他进程中修改的状态也由这里执行。暂停的任务恢复后立即开始一次备份
+func (b *BackupInfo) WatchControl(ctx context.Context) {
+	backupID := filepath.Base(b.SrcDir)
+	prev, err := loadJobControl(backupID)
+	if err != nil {
+		log.Error("%v", err)
+	}
+	switch prev {
+	case db.JobControlPaused:
+		log.Warn("任务处于暂停状态，恢复后才会继续备份: %s", backupID)
+	case db.JobControlCancel:
+		// 启动前留下的取消请求没有对应的备份，不能用于取消之后开始的备份
+		if err := db.SetJobControl(backupID, db.JobControlNone); err != nil {
+			log.Error("保存任务控制状态失败: %v", err)
+		}
+		prev = db.JobControlNone
+	}
+
+	ticker := time.NewTicker(controlPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		control, err := loadJobControl(backupID)
+		if err != nil {
+			log.Error("%v", err)
+			continue
+		}
+
+		ctl := runningControl(backupID)
+		switch control {
+		case db.JobControlPaused:
+			if ctl != nil && !ctl.gate.Paused() {
+				log.Info("暂停正在运行的备份: %s", backupID)
+				ctl.gate.Pause()
+			}
+		case db.JobControlCancel:
+			if ctl != nil {
+				log.Info("取消正在运行的备份: %s", backupID)
+				ctl.cancel(errBackupCancelled)
+			}
+			if err := db.SetJobControl(backupID, db.JobControlNone); err != nil {
+				log.Error("保存任务控制状态失败: %v", err)
+			}
+			control = db.JobControlNone
+		default:
+			if ctl != nil && ctl.gate.Paused() {
+				log.Info("恢复正在运行的备份: %s", backupID)
+				ctl.gate.Resume()
+			} else if ctl == nil && prev == db.JobControlPaused {
+				go func() {
+					log.Info("任务已恢复，继续备份: %s", backupID)
+					if err := b.Backup(ctx); err != nil {
+						log.Error("恢复后的备份失败: %v", err)
+					}
+				}()
+			}
+		}
+		prev = control
+	}
+}
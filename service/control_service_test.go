@@ -0,0 +1,149 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"auto-backup/db"
+)
+
+func setControlPollInterval(t *testing.T, d time.Duration) {
+	t.Helper()
+	old := controlPollInterval
+	controlPollInterval = d
+	t.Cleanup(func() { controlPollInterval = old })
+}
+
+// 在后台运行WatchControl，测试结束时停止并等待恢复后开始的备份结束
+func startWatchControl(t *testing.T, b *BackupInfo) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		b.WatchControl(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+		WaitIdle()
+	})
+}
+
+// 等待cond成立，超时后测试失败
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func countRuns(t *testing.T, backupID string) int {
+	t.Helper()
+	runs, err := db.ListBackupRuns(backupID, 10)
+	if err != nil {
+		t.Fatalf("ListBackupRuns() error = %v", err)
+	}
+	return len(runs)
+}
+
+func TestWatchControl_ResumeStartsBackup(t *testing.T) {
+	setControlPollInterval(t, 20*time.Millisecond)
+	b := newTestJob(t, map[string]string{"a.txt": "a", "b.txt": "b"})
+	backupID := filepath.Base(b.SrcDir)
+
+	if err := PauseJob(backupID); err != nil {
+		t.Fatalf("PauseJob() error = %v", err)
+	}
+	startWatchControl(t, b)
+
+	// 暂停期间不开始备份
+	time.Sleep(10 * controlPollInterval)
+	if n := countRuns(t, backupID); n != 0 {
+		t.Fatalf("backup runs while paused = %d, want 0", n)
+	}
+
+	if err := ResumeJob(backupID); err != nil {
+		t.Fatalf("ResumeJob() error = %v", err)
+	}
+	waitFor(t, "backup after resume", func() bool {
+		runs, err := db.ListBackupRuns(backupID, 1)
+		return err == nil && len(runs) == 1 && runs[0].Status != db.RunStatusRunning
+	})
+	run := lastRun(t, b)
+	if run.FileCount != 2 {
+		t.Errorf("FileCount = %d, want 2", run.FileCount)
+	}
+
+	// 恢复只触发一次备份
+	time.Sleep(10 * controlPollInterval)
+	WaitIdle()
+	if n := countRuns(t, backupID); n != 1 {
+		t.Errorf("backup runs after resume = %d, want 1", n)
+	}
+}
+
+func TestWatchControl_RunningBackup(t *testing.T) {
+	setControlPollInterval(t, 20*time.Millisecond)
+	b := newTestJob(t, nil)
+	backupID := filepath.Base(b.SrcDir)
+	startWatchControl(t, b)
+
+	// 模拟本进程中正在运行的备份
+	ctx, stop := startControl(context.Background(), backupID, time.Now())
+	defer stop()
+	ctl := runningControl(backupID)
+
+	if err := db.SetJobControl(backupID, db.JobControlPaused); err != nil {
+		t.Fatalf("SetJobControl() error = %v", err)
+	}
+	waitFor(t, "pause", ctl.gate.Paused)
+
+	// 正在运行的备份恢复后继续，不开始新的备份
+	if err := db.SetJobControl(backupID, db.JobControlNone); err != nil {
+		t.Fatalf("SetJobControl() error = %v", err)
+	}
+	waitFor(t, "resume", func() bool { return !ctl.gate.Paused() })
+	time.Sleep(5 * controlPollInterval)
+	if n := countRuns(t, backupID); n != 0 {
+		t.Errorf("backup runs = %d, want 0", n)
+	}
+
+	// 其他进程写入的取消请求取消正在运行的备份后清除
+	if err := db.SetJobControl(backupID, db.JobControlCancel); err != nil {
+		t.Fatalf("SetJobControl() error = %v", err)
+	}
+	waitFor(t, "cancel", func() bool { return ctx.Err() != nil })
+	if cause := context.Cause(ctx); !errors.Is(cause, errBackupCancelled) {
+		t.Errorf("context.Cause() = %v, want %v", cause, errBackupCancelled)
+	}
+	waitFor(t, "control reset", func() bool {
+		control, err := loadJobControl(backupID)
+		return err == nil && control == db.JobControlNone
+	})
+}
+
+func TestWatchControl_ClearsStaleCancel(t *testing.T) {
+	setControlPollInterval(t, 20*time.Millisecond)
+	b := newTestJob(t, nil)
+	backupID := filepath.Base(b.SrcDir)
+
+	// 启动前留下的取消请求不能取消之后开始的备份
+	if err := db.SetJobControl(backupID, db.JobControlCancel); err != nil {
+		t.Fatalf("SetJobControl() error = %v", err)
+	}
+	startWatchControl(t, b)
+	waitFor(t, "control reset", func() bool {
+		control, err := loadJobControl(backupID)
+		return err == nil && control == db.JobControlNone
+	})
+}
@@ -0,0 +1,203 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"auto-backup/archive"
+	"auto-backup/db"
+	"auto-backup/delta"
+	"auto-backup/log"
+)
+
+const (
+	// 达到该大小的文件保存分块签名，变化时只备份差异
+	deltaMinSize = 64 * 1024 * 1024
+	// 差异超过文件大小的该比例时直接备份整个文件
+	deltaMaxRatio = 0.5
+	// 差异在压缩包中的路径前缀，源目录中的隐藏文件不会被备份，不会与之冲突
+	deltaPrefix = ".auto-backup/delta/"
+)
+
+// 计算完成的文件差异，保存在临时文件中，写入压缩包或放弃后需要调用Close删除
+type fileDelta struct {
+	tmp  *os.File
+	size int64  // 差异的大小
+	name string // 使用/分隔的文件路径
+	info os.FileInfo
+	sig  *db.FileSignature // 当前版本的签名，写入差异后保存
+}
+
+func (d *fileDelta) Close() {
+	d.tmp.Close()
+	os.Remove(d.tmp.Name())
+}
+
+// 有上一次备份的签名时计算文件差异，没有签名或差异过大时返回nil，由调用方写入整个文件
+func (b *BackupInfo) prepareDeltaFile(ctx context.Context, backupID, fullPath, filePath string, info os.FileInfo) (*fileDelta, error) {
+	if b.ForceFull {
+		return nil, nil
+	}
+
+	base, err := db.LoadFileSignature(backupID, filepath.ToSlash(filePath))
+	if err != nil {
+		log.Error("加载文件签名失败: %v", err)
+		return nil, fmt.Errorf("加载文件签名失败: %v", err)
+	}
+	if base == nil {
+		return nil, nil
+	}
+	return b.prepareDelta(ctx, fullPath, filePath, info, base)
+}
+
+// 计算文件相对于上一次备份的差异，差异过大时返回nil由调用方写入整个文件。
+// 差异先写入临时文件，调用方按差异的大小选择分片后再写入压缩包
+func (b *BackupInfo) prepareDelta(ctx context.Context, fullPath, filePath string, info os.FileInfo, base *db.FileSignature) (*fileDelta, error) {
+	file, err := os.Open(fullPath)
+	if err != nil {
+		log.Error("打开文件失败: %v", err)
+		return nil, fmt.Errorf("打开文件失败: %v", err)
+	}
+	defer file.Close()
+
+	// tar格式需要预先知道大小，先把差异写入临时文件
+	tmp, err := os.CreateTemp(b.OutputDir, ".delta-*")
+	if err != nil {
+		log.Error("创建临时文件失败: %v", err)
+		return nil, fmt.Errorf("创建临时文件失败: %v", err)
+	}
+	d := &fileDelta{tmp: tmp, name: filepath.ToSlash(filePath), info: info}
+
+	baseSig := &delta.Signature{
+		BlockSize: base.BlockSize,
+		Size:      base.Size,
+		Hash:      base.Hash,
+		Blocks:    base.Blocks,
+	}
+	builder := delta.NewSignatureBuilder(base.BlockSize)
+	if err := delta.Write(tmp, baseSig, bufio.NewReaderSize(contextReader{ctx, file}, defaultBufferSize), builder); err != nil {
+		d.Close()
+		log.Error("计算文件差异失败: %v", err)
+		return nil, fmt.Errorf("计算文件差异失败: %v", err)
+	}
+
+	if d.size, err = tmp.Seek(0, io.SeekCurrent); err != nil {
+		d.Close()
+		return nil, fmt.Errorf("获取差异大小失败: %v", err)
+	}
+	if float64(d.size) > float64(info.Size())*deltaMaxRatio {
+		d.Close()
+		log.Info("文件差异过大(%d/%d字节)，备份整个文件: %s", d.size, info.Size(), filePath)
+		return nil, nil
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		d.Close()
+		return nil, fmt.Errorf("读取差异失败: %v", err)
+	}
+
+	d.sig = newFileSignature(base.BackupID, d.name, builder.Signature())
+	return d, nil
+}
+
+// 把差异写入压缩包
+func (d *fileDelta) write(aw archive.Writer) (*db.BackupEntry, error) {
+	header := &archive.Header{
+		Name:    deltaPrefix + d.name,
+		Size:    d.size,
+		Mode:    d.info.Mode(),
+		ModTime: d.info.ModTime(),
+		Method:  archive.Deflate,
+		Info:    d.info,
+	}
+	writer, err := aw.Create(header)
+	if err != nil {
+		log.Error("创建文件头失败: %v", err)
+		return nil, fmt.Errorf("创建文件头失败: %v", err)
+	}
+
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(writer, hasher), d.tmp); err != nil {
+		log.Error("写入文件差异失败: %v", err)
+		return nil, fmt.Errorf("写入文件差异失败: %v", err)
+	}
+
+	log.Info("备份文件差异: %s, %d/%d字节", d.name, d.size, d.info.Size())
+
+	return &db.BackupEntry{
+		Path:    header.Name,
+		Size:    d.size,
+		Hash:    hex.EncodeToString(hasher.Sum(nil)),
+		ModTime: d.info.ModTime(),
+	}, nil
+}
+
+func newFileSignature(backupID, path string, sig *delta.Signature) *db.FileSignature {
+	return &db.FileSignature{
+		BackupID:  backupID,
+		Path:      path,
+		BlockSize: sig.BlockSize,
+		Size:      sig.Size,
+		Hash:      sig.Hash,
+		Blocks:    sig.Blocks,
+		UpdatedAt: time.Now(),
+	}
+}
+
+// 保存本次备份的文件签名，未开启差异备份时清除旧签名，避免重新开启后基于过期的版本计算差异
+func (b *BackupInfo) saveFileSignatures(backupID string, sigs []*db.FileSignature) error {
+	if !b.Delta {
+		return db.DeleteFileSignatures(backupID)
+	}
+	if len(sigs) == 0 {
+		return nil
+	}
+	return db.BatchSaveFileSignatures(sigs)
+}
+
+// 将差异应用到输出目录中已还原的上一个版本
+func (r *RestoreInfo) applyDelta(h *archive.Header, rd io.Reader) error {
+	name := strings.TrimPrefix(h.Name, deltaPrefix)
+	outPath := filepath.Join(r.OutputDir, filepath.FromSlash(name))
+
+	base, err := os.Open(outPath)
+	if err != nil {
+		return fmt.Errorf("缺少差异的基础文件 %s，请先还原之前的备份或使用 -chain: %v", name, err)
+	}
+	defer base.Close()
+
+	info, err := base.Stat()
+	if err != nil {
+		return fmt.Errorf("获取基础文件信息失败: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(outPath), ".delta-*")
+	if err != nil {
+		return fmt.Errorf("创建临时文件失败: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriterSize(tmp, defaultBufferSize)
+	err = delta.Apply(w, base, info.Size(), rd)
+	if err == nil {
+		err = w.Flush()
+	}
+	tmp.Close()
+	if err != nil {
+		return fmt.Errorf("应用文件差异失败 %s: %v", name, err)
+	}
+
+	if err := os.Rename(tmp.Name(), outPath); err != nil {
+		return fmt.Errorf("替换文件失败: %v", err)
+	}
+
+	restoreMetadata(outPath, h)
+	return nil
+}
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"auto-backup/db"
+)
+
+// 修改文件中从offset开始的n个字节
+func modifyFile(t *testing.T, path string, offset, n int) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := offset; i < offset+n; i++ {
+		data[i] ^= 0x5a
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 返回运行中路径带有指定前缀的目录项数量
+func countEntries(t *testing.T, run *db.BackupRun, prefix string) int {
+	t.Helper()
+	entries, err := db.LoadBackupEntries(run.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, e := range entries {
+		if strings.HasPrefix(e.Path, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestBackup_DeltaRespectsPartSize(t *testing.T) {
+	if testing.Short() {
+		t.Skip("差异备份需要64MB以上的文件")
+	}
+	const partSize = 1024 * 1024
+	b := newTestJob(t, map[string]string{"big.bin": randomData(2, deltaMinSize+partSize)})
+	b.Delta = true
+	b.PartSize = partSize
+	b.Password = ""
+	path := filepath.Join(b.SrcDir, "big.bin")
+
+	// 第一次备份没有签名，写入整个文件
+	mustBackup(t, b)
+	first := lastRun(t, b)
+
+	// 小的修改只写入差异，差异放在一个分片中
+	time.Sleep(time.Second)
+	modifyFile(t, path, 1000, 1000)
+	mustBackup(t, b)
+	second := lastRun(t, b)
+	if n := countEntries(t, second, deltaPrefix); n != 1 {
+		t.Fatalf("small change wrote %d delta entries, want 1", n)
+	}
+	parts, err := db.LoadBackupParts(second.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, part := range parts {
+		if part.Size > partSize+64*1024 {
+			t.Errorf("part %s is %d bytes, larger than part size %d", part.Name, part.Size, partSize)
+		}
+	}
+
+	// 差异超过分片大小时备份整个文件，拆分为片段。快速哈希只读取文件首尾，修改需要包含开头
+	time.Sleep(time.Second)
+	modifyFile(t, path, 0, 3*partSize)
+	mustBackup(t, b)
+	third := lastRun(t, b)
+	if n := countEntries(t, third, deltaPrefix); n != 0 {
+		t.Fatalf("oversized delta wrote %d delta entries, want 0", n)
+	}
+	if n := countEntries(t, third, segmentPrefix); n < 2 {
+		t.Fatalf("oversized delta fell back to %d segments, want the whole file split", n)
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := restoreTree(t, b, third.Timestamp, true)
+	if got["big.bin"] != string(want) {
+		t.Fatalf("chain restore from %s differs from source", first.Timestamp)
+	}
+}
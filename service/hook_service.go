@@ -0,0 +1,174 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"auto-backup/db"
+	"auto-backup/log"
+)
+
+// 脚本默认的超时时间
+const defaultHookTimeout = 5 * time.Minute
+
+// 超时后等待脚本的子进程关闭输出的时间
+const hookWaitDelay = 5 * time.Second
+
+// 钩子脚本名称，通过BACKUP_HOOK传给脚本
+const (
+	HookPreBackup  = "pre_backup"
+	HookPostBackup = "post_backup"
+	HookOnSuccess  = "on_success"
+	HookOnFailure  = "on_failure"
+)
+
+// Hooks 备份前后执行的命令，为空时不执行
+type Hooks struct {
+	PreBackup  string        // 读取源目录之前执行，例如停止服务或导出数据库
+	PostBackup string        // 备份结束后执行，无论成功或失败
+	OnSuccess  string        // 备份成功后执行
+	OnFailure  string        // 备份失败后执行
+	Timeout    time.Duration // 每个命令的超时时间，0使用默认值
+	// 前置命令失败时中止备份，否则只记录错误后继续备份
+	AbortOnPreFailure bool
+	// 监听触发的备份不执行命令，默认执行，前置命令需要停止服务或导出数据库时不能跳过
+	SkipOnWatch bool
+}
+
+// 一次备份运行中传给脚本的信息
+type hookRun struct {
+	backupID  string
+	timestamp string // 本次运行的时间戳，同时是分片名称和还原时使用的标识
+	runID     int64  // backup_runs中的ID，创建运行记录之前为0
+	status    string
+	err       error
+	parts     []string
+}
+
+// 按时间戳加载本次运行的记录ID和生成的分片名称，没有文件需要备份时没有运行记录
+func (h *hookRun) loadParts() {
+	run, err := db.LoadBackupRun(h.backupID, h.timestamp)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Error("加载备份运行记录失败: %v", err)
+		}
+		return
+	}
+	h.runID = run.ID
+
+	parts, err := db.LoadBackupParts(run.ID)
+	if err != nil {
+		log.Error("加载分片记录失败: %v", err)
+		return
+	}
+	for _, p := range parts {
+		h.parts = append(h.parts, p.Name)
+	}
+}
+
+// 脚本的环境变量，在当前进程的环境变量基础上追加
+func (b *BackupInfo) hookEnv(hook string, run *hookRun) []string {
+	env := append(os.Environ(),
+		"BACKUP_HOOK="+hook,
+		"BACKUP_JOB="+run.backupID,
+		"BACKUP_TIMESTAMP="+run.timestamp,
+		"BACKUP_SRC_DIR="+b.SrcDir,
+		"BACKUP_OUTPUT_DIR="+b.OutputDir,
+		"BACKUP_STATUS="+run.status,
+		// 分片名称每行一个，目录名可能包含空格
+		"BACKUP_PARTS="+strings.Join(run.parts, "\n"),
+		"BACKUP_PART_COUNT="+strconv.Itoa(len(run.parts)),
+	)
+	if run.runID > 0 {
+		env = append(env, "BACKUP_RUN_ID="+strconv.FormatInt(run.runID, 10))
+	}
+	if run.err != nil {
+		env = append(env, "BACKUP_ERROR="+run.err.Error())
+	}
+	return env
+}
+
+// 使用sh执行一个钩子命令，命令为空时直接返回，ctx取消时终止命令
+func (b *BackupInfo) runHook(ctx context.Context, hook, command string, run *hookRun) error {
+	if command == "" {
+		return nil
+	}
+
+	timeout := b.Hooks.Timeout
+	if timeout <= 0 {
+		timeout = defaultHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Dir = b.SrcDir
+	cmd.Env = b.hookEnv(hook, run)
+	killProcessGroup(cmd)
+	// 后台子进程持有输出时，超时后不会一直等待
+	cmd.WaitDelay = hookWaitDelay
+
+	log.Info("执行%s脚本: %s", hook, command)
+	start := time.Now()
+	output, err := cmd.CombinedOutput()
+	if out := strings.TrimSpace(string(output)); out != "" {
+		log.Info("%s脚本输出:\n%s", hook, out)
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		log.Error("%s脚本执行超时(%v)", hook, timeout)
+		return fmt.Errorf("%s脚本执行超时(%v)", hook, timeout)
+	}
+	if err != nil {
+		log.Error("%s脚本执行失败: %v", hook, err)
+		return fmt.Errorf("%s脚本执行失败: %v", hook, err)
+	}
+
+	log.Info("%s脚本执行完成, 耗时%v", hook, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// 执行前置命令后运行备份，结束后按结果执行后置命令。
+// 监听触发的备份(paths不为nil)只在没有开启SkipOnWatch时执行钩子
+func (b *BackupInfo) runWithHooks(ctx context.Context, paths []string, startedAt time.Time) error {
+	run := &hookRun{
+		backupID:  filepath.Base(b.SrcDir),
+		timestamp: startedAt.Format("20060102_150405"),
+		status:    db.RunStatusRunning,
+	}
+	if paths != nil && b.Hooks.SkipOnWatch {
+		return b.runBackup(ctx, paths, run.timestamp)
+	}
+
+	var err error
+	if herr := b.runHook(ctx, HookPreBackup, b.Hooks.PreBackup, run); herr != nil && b.Hooks.AbortOnPreFailure {
+		log.Error("前置脚本失败，中止备份")
+		err = fmt.Errorf("中止备份: %v", herr)
+	} else {
+		err = b.runBackup(ctx, paths, run.timestamp)
+	}
+
+	run.status = runStatus(ctx, err)
+	run.err = err
+	run.loadParts()
+
+	// 后置命令的失败只记录日志，不影响备份结果。
+	// 中断时后置命令仍然执行完，以便恢复前置命令停止的服务
+	postCtx := context.WithoutCancel(ctx)
+	b.runHook(postCtx, HookPostBackup, b.Hooks.PostBackup, run)
+	if err == nil {
+		b.runHook(postCtx, HookOnSuccess, b.Hooks.OnSuccess, run)
+	} else {
+		b.runHook(postCtx, HookOnFailure, b.Hooks.OnFailure, run)
+	}
+
+	return err
+}
@@ -0,0 +1,161 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"auto-backup/db"
+)
+
+// 每个钩子向日志文件追加一行"钩子名 状态"，返回日志文件路径
+func setHookLog(t *testing.T, b *BackupInfo) string {
+	t.Helper()
+	logPath := filepath.Join(t.TempDir(), "hooks.log")
+	record := `echo "$BACKUP_HOOK $BACKUP_STATUS $BACKUP_PART_COUNT" >> ` + logPath
+	b.Hooks = Hooks{
+		PreBackup:  record,
+		PostBackup: record,
+		OnSuccess:  record,
+		OnFailure:  record,
+	}
+	return logPath
+}
+
+func readHookLog(t *testing.T, path string) []string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+func assertHookLog(t *testing.T, path string, want ...string) {
+	t.Helper()
+	if got := readHookLog(t, path); strings.Join(got, ";") != strings.Join(want, ";") {
+		t.Errorf("hooks = %q, want %q", got, want)
+	}
+}
+
+func TestRunWithHooks_Success(t *testing.T) {
+	b := newTestJob(t, map[string]string{"a.txt": "hello"})
+	logPath := setHookLog(t, b)
+	mustBackup(t, b)
+
+	assertHookLog(t, logPath,
+		"pre_backup running 0",
+		"post_backup success 1",
+		"on_success success 1",
+	)
+}
+
+func TestRunWithHooks_RunID(t *testing.T) {
+	b := newTestJob(t, map[string]string{"a.txt": "hello"})
+	logPath := filepath.Join(t.TempDir(), "hooks.log")
+	record := `echo "$BACKUP_HOOK id=$BACKUP_RUN_ID ts=$BACKUP_TIMESTAMP" >> ` + logPath
+	b.Hooks = Hooks{PreBackup: record, PostBackup: record}
+	mustBackup(t, b)
+
+	// 前置命令执行时还没有运行记录
+	run := lastRun(t, b)
+	assertHookLog(t, logPath,
+		"pre_backup id= ts="+run.Timestamp,
+		fmt.Sprintf("post_backup id=%d ts=%s", run.ID, run.Timestamp),
+	)
+}
+
+func TestRunWithHooks_AbortOnPreFailure(t *testing.T) {
+	b := newTestJob(t, map[string]string{"a.txt": "hello"})
+	logPath := setHookLog(t, b)
+	b.Hooks.PreBackup = "exit 1"
+	b.Hooks.AbortOnPreFailure = true
+
+	err := b.Backup(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "中止备份") {
+		t.Fatalf("Backup() error = %v, want abort", err)
+	}
+	// 中止时不读取源目录，没有运行记录，后置命令仍然执行
+	runs, err := db.ListBackupRuns(filepath.Base(b.SrcDir), 0)
+	if err != nil || len(runs) != 0 {
+		t.Errorf("ListBackupRuns() = %d, %v, want no runs", len(runs), err)
+	}
+	assertHookLog(t, logPath,
+		"post_backup failed 0",
+		"on_failure failed 0",
+	)
+}
+
+func TestRunWithHooks_ContinueOnPreFailure(t *testing.T) {
+	b := newTestJob(t, map[string]string{"a.txt": "hello"})
+	logPath := setHookLog(t, b)
+	b.Hooks.PreBackup = "exit 1"
+
+	mustBackup(t, b)
+	assertHookLog(t, logPath,
+		"post_backup success 1",
+		"on_success success 1",
+	)
+}
+
+func TestRunWithHooks_OnFailureAfterCancel(t *testing.T) {
+	b := newTestJob(t, map[string]string{"a.txt": "hello"})
+	logPath := setHookLog(t, b)
+	b.Hooks.PreBackup = "sleep 5"
+
+	// 前置命令运行时取消，命令被终止，后置命令不受取消影响
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	time.AfterFunc(200*time.Millisecond, cancel)
+
+	start := time.Now()
+	if err := b.Backup(ctx); err == nil {
+		t.Fatal("Backup() error = nil, want cancellation")
+	}
+	if elapsed := time.Since(start); elapsed > 4*time.Second {
+		t.Errorf("Backup() took %v, pre_backup was not stopped", elapsed)
+	}
+	assertHookLog(t, logPath,
+		"post_backup interrupted 0",
+		"on_failure interrupted 0",
+	)
+}
+
+func TestRunWithHooks_WatchRuns(t *testing.T) {
+	b := newTestJob(t, map[string]string{"a.txt": "hello"})
+	mustBackup(t, b)
+	logPath := setHookLog(t, b)
+
+	// 默认监听触发的备份同样执行钩子
+	time.Sleep(time.Second)
+	writeFiles(t, b.SrcDir, map[string]string{"a.txt": "changed"})
+	if err := b.BackupPaths(context.Background(), []string{"a.txt"}); err != nil {
+		t.Fatalf("BackupPaths() error = %v", err)
+	}
+	assertHookLog(t, logPath,
+		"pre_backup running 0",
+		"post_backup success 1",
+		"on_success success 1",
+	)
+}
+
+func TestRunWithHooks_SkipOnWatch(t *testing.T) {
+	b := newTestJob(t, map[string]string{"a.txt": "hello"})
+	mustBackup(t, b)
+	logPath := setHookLog(t, b)
+	b.Hooks.SkipOnWatch = true
+
+	time.Sleep(time.Second)
+	writeFiles(t, b.SrcDir, map[string]string{"a.txt": "changed"})
+	if err := b.BackupPaths(context.Background(), []string{"a.txt"}); err != nil {
+		t.Fatalf("BackupPaths() error = %v", err)
+	}
+	assertHookLog(t, logPath)
+}
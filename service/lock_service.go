@@ -0,0 +1,77 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"auto-backup/db"
+	"auto-backup/log"
+	"auto-backup/utils"
+)
+
+// 多个任务共用的仓库使用的锁名称，备份任务的锁名称带有前缀，不会与之冲突
+const repositoryLockName = "repository"
+
+// 备份任务的锁名称
+func jobLockName(backupID string) string {
+	return "job_" + backupID
+}
+
+// 本进程中正在运行的任务，值在任务结束时关闭
+var (
+	jobsMu sync.Mutex
+	jobs   = make(map[string]chan struct{})
+)
+
+// 获取名为name的锁：同一进程内通过jobs互斥，不同进程之间通过锁文件互斥。
+// 锁已被持有时立即返回错误，成功时返回释放锁的函数
+func acquireLock(name string) (func(), error) {
+	jobsMu.Lock()
+	if _, ok := jobs[name]; ok {
+		jobsMu.Unlock()
+		return nil, fmt.Errorf("%s正在运行中", name)
+	}
+	done := make(chan struct{})
+	jobs[name] = done
+	jobsMu.Unlock()
+
+	release := func() {
+		jobsMu.Lock()
+		delete(jobs, name)
+		jobsMu.Unlock()
+		close(done)
+	}
+
+	// 守护进程和手动执行的命令可能同时运行，使用同一个数据库时通过锁文件协调
+	fl, err := utils.TryLockFile(db.LockPath(name))
+	if err != nil {
+		release()
+		if errors.Is(err, utils.ErrLocked) {
+			return nil, fmt.Errorf("%s正在被其他进程使用(%v)", name, err)
+		}
+		log.Error("获取锁文件失败: %v", err)
+		return nil, fmt.Errorf("获取锁文件失败: %v", err)
+	}
+
+	return func() {
+		if err := fl.Unlock(); err != nil {
+			log.Warn("释放锁文件失败: %s, %v", name, err)
+		}
+		release()
+	}, nil
+}
+
+// WaitIdle 等待本进程中所有正在运行的备份结束，没有备份运行时直接返回
+func WaitIdle() {
+	jobsMu.Lock()
+	running := make([]chan struct{}, 0, len(jobs))
+	for _, done := range jobs {
+		running = append(running, done)
+	}
+	jobsMu.Unlock()
+
+	for _, done := range running {
+		<-done
+	}
+}
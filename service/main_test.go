@@ -0,0 +1,125 @@
+package service
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"auto-backup/archive"
+	"auto-backup/db"
+)
+
+// 数据库和任务锁位于工作目录下的config目录，测试在临时目录中运行
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "auto-backup-service-")
+	if err != nil {
+		panic(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		panic(err)
+	}
+	if err := os.Mkdir("config", 0755); err != nil {
+		panic(err)
+	}
+	db.InitDB()
+
+	code := m.Run()
+
+	db.CloseDB()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// 创建测试用的备份任务，源目录以测试名命名，保证每个测试的backupID不同
+func newTestJob(t *testing.T, files map[string]string) *BackupInfo {
+	t.Helper()
+	root := t.TempDir()
+	src := filepath.Join(root, strings.NewReplacer("/", "_", " ", "_").Replace(t.Name()))
+	writeFiles(t, src, files)
+	return &BackupInfo{
+		SrcDir:    src,
+		OutputDir: filepath.Join(root, "out"),
+		Password:  "secret",
+		Format:    archive.FormatZip,
+		Mode:      ModeArchive,
+	}
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// 读取目录下所有文件的内容，键为使用/分隔的相对路径
+func readTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// 执行一次完整备份，失败时结束测试
+func mustBackup(t *testing.T, b *BackupInfo) {
+	t.Helper()
+	if err := b.Backup(context.Background()); err != nil {
+		t.Fatalf("Backup() error = %v", err)
+	}
+}
+
+// 按备份记录还原到新目录并返回还原后的文件
+func restoreTree(t *testing.T, b *BackupInfo, timestamp string, chain bool) map[string]string {
+	t.Helper()
+	out := filepath.Join(t.TempDir(), "restored")
+	r := &RestoreInfo{
+		ZipDir:    b.OutputDir,
+		OutputDir: out,
+		Password:  b.Password,
+		BackupID:  filepath.Base(b.SrcDir),
+		Timestamp: timestamp,
+		Chain:     chain,
+		Mode:      b.Mode,
+		BasePath:  b.BasePath,
+		Uploader:  b.Uploader,
+	}
+	if err := r.Restore(); err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+	return readTree(t, out)
+}
+
+// 返回最近一次成功的备份运行
+func lastRun(t *testing.T, b *BackupInfo) *db.BackupRun {
+	t.Helper()
+	run, err := db.LoadBackupRun(filepath.Base(b.SrcDir), "")
+	if err != nil {
+		t.Fatalf("LoadBackupRun() error = %v", err)
+	}
+	return run
+}
@@ -0,0 +1,413 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"filippo.io/age"
+	"github.com/robfig/cron/v3"
+
+	"auto-backup/archive"
+	"auto-backup/db"
+	"auto-backup/log"
+	"auto-backup/model"
+)
+
+// 管理接口返回的错误，HTTP接口按这些错误返回对应的状态码
+var (
+	ErrJobNotFound  = errors.New("任务不存在")
+	ErrRunNotFound  = errors.New("运行记录不存在")
+	ErrJobRunning   = errors.New("任务正在运行")
+	ErrJobPaused    = errors.New("任务已暂停")
+	ErrAuthDisabled = errors.New("没有配置OneDrive上传")
+	ErrAuthFlow     = errors.New("OneDrive使用其他认证方式")
+)
+
+// 还原任务的状态
+const (
+	RestoreStatusRunning = "running"
+	RestoreStatusSuccess = "success"
+	RestoreStatusFailed  = "failed"
+)
+
+// JobStatus 备份任务的配置和当前状态
+type JobStatus struct {
+	ID        string       `json:"id"`
+	SrcDir    string       `json:"src_dir"`
+	Mode      string       `json:"mode"`
+	Cron      string       `json:"cron"`
+	Running   bool         `json:"running"`
+	Paused    bool         `json:"paused"`
+	NextRun   time.Time    `json:"next_run"`   // 下一次计划备份的时间
+	StartedAt time.Time    `json:"started_at"` // 正在运行的备份的开始时间
+	Progress  *Progress    `json:"progress"`   // 正在运行的备份的进度，没有运行时为nil
+	State     *db.JobState `json:"state"`      // 最近一次运行的结果，从未运行时为nil
+}
+
+// RunDetail 一次备份运行的记录和分片
+type RunDetail struct {
+	*db.BackupRun
+	Parts []*db.BackupPart `json:"parts"`
+}
+
+// RestoreRequest 通过管理接口发起的还原
+type RestoreRequest struct {
+	Timestamp string `json:"timestamp"` // 要还原的备份时间
+	OutputDir string `json:"output"`    // 还原的目标目录
+	Chain     bool   `json:"chain"`     // 依次还原该时间及之前的所有备份
+	Identity  string `json:"identity"`  // 可选，age私钥文件
+}
+
+// RestoreTask 后台执行的还原及其结果
+type RestoreTask struct {
+	ID         int       `json:"id"`
+	BackupID   string    `json:"backup_id"`
+	Timestamp  string    `json:"timestamp"`
+	OutputDir  string    `json:"output"`
+	Chain      bool      `json:"chain"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// AuthStatus OneDrive的认证状态
+type AuthStatus struct {
+	Enabled       bool      `json:"enabled"`       // 是否配置了OneDrive上传
+	Flow          string    `json:"flow"`          // 认证方式: code 或 device
+	Authenticated bool      `json:"authenticated"` // 是否有未过期的访问令牌
+	UserID        string    `json:"user_id"`
+	ExpiresAt     time.Time `json:"expires_at"`
+}
+
+// JobController 管理接口使用的任务控制器，查询和触发本进程中配置的备份任务
+type JobController struct {
+	ctx context.Context
+
+	mu         sync.Mutex
+	jobs       map[string]*BackupInfo
+	restores   []*RestoreTask
+	authURL    func() (string, error)
+	deviceAuth func() (*model.DeviceAuth, error)
+}
+
+// NewJobController 创建任务控制器，ctx取消后不再开始新的备份
+func NewJobController(ctx context.Context) *JobController {
+	return &JobController{
+		ctx:  ctx,
+		jobs: make(map[string]*BackupInfo),
+	}
+}
+
+// AddJob 添加备份任务，任务ID为源目录的目录名
+func (c *JobController) AddJob(b *BackupInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.jobs[filepath.Base(b.SrcDir)] = b
+}
+
+// SetAuthURLFunc 设置生成OneDrive认证地址的函数，未设置表示没有配置上传
+func (c *JobController) SetAuthURLFunc(fn func() (string, error)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.authURL = fn
+}
+
+// SetDeviceAuthFunc 设置开始设备代码认证的函数，和SetAuthURLFunc只设置其中一个
+func (c *JobController) SetDeviceAuthFunc(fn func() (*model.DeviceAuth, error)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deviceAuth = fn
+}
+
+func (c *JobController) job(backupID string) (*BackupInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.jobs[backupID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrJobNotFound, backupID)
+	}
+	return b, nil
+}
+
+// Jobs 返回所有任务的状态，按任务ID排列
+func (c *JobController) Jobs() ([]*JobStatus, error) {
+	c.mu.Lock()
+	ids := make([]string, 0, len(c.jobs))
+	for id := range c.jobs {
+		ids = append(ids, id)
+	}
+	c.mu.Unlock()
+	sort.Strings(ids)
+
+	jobs := make([]*JobStatus, 0, len(ids))
+	for _, id := range ids {
+		job, err := c.Job(id)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// Job 返回任务的配置和当前状态
+func (c *JobController) Job(backupID string) (*JobStatus, error) {
+	b, err := c.job(backupID)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := db.LoadJobState(backupID)
+	if err != nil {
+		log.Error("加载任务状态失败: %v", err)
+		return nil, fmt.Errorf("加载任务状态失败: %v", err)
+	}
+
+	job := &JobStatus{
+		ID:     backupID,
+		SrcDir: b.SrcDir,
+		Mode:   b.Mode,
+		Cron:   b.Cron,
+		State:  state,
+		Paused: state != nil && state.Control == db.JobControlPaused,
+	}
+	if schedule, err := cron.ParseStandard(b.Cron); err == nil {
+		job.NextRun = schedule.Next(time.Now())
+	}
+	if ctl := runningControl(backupID); ctl != nil {
+		job.Running = true
+		job.StartedAt = ctl.startedAt
+		job.Progress = ctl.progress()
+	}
+	return job, nil
+}
+
+// RunBackup 在后台开始一次完整备份，任务正在运行或已暂停时返回错误
+func (c *JobController) RunBackup(backupID string) error {
+	b, err := c.job(backupID)
+	if err != nil {
+		return err
+	}
+	if runningControl(backupID) != nil {
+		return ErrJobRunning
+	}
+	control, err := loadJobControl(backupID)
+	if err != nil {
+		log.Error("%v", err)
+		return err
+	}
+	if control == db.JobControlPaused {
+		return ErrJobPaused
+	}
+
+	go func() {
+		log.Info("通过管理接口开始备份: %s", backupID)
+		if err := b.Backup(c.ctx); err != nil {
+			log.Error("管理接口触发的备份失败: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Runs 返回任务最近的运行记录，从新到旧排列
+func (c *JobController) Runs(backupID string, limit int) ([]*db.BackupRun, error) {
+	if _, err := c.job(backupID); err != nil {
+		return nil, err
+	}
+	runs, err := db.ListBackupRuns(backupID, limit)
+	if err != nil {
+		log.Error("加载运行记录失败: %v", err)
+		return nil, fmt.Errorf("加载运行记录失败: %v", err)
+	}
+	return runs, nil
+}
+
+// Run 返回一次运行的记录和分片
+func (c *JobController) Run(backupID, timestamp string) (*RunDetail, error) {
+	if _, err := c.job(backupID); err != nil {
+		return nil, err
+	}
+	run, err := db.LoadBackupRun(backupID, timestamp)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s", ErrRunNotFound, timestamp)
+	}
+	if err != nil {
+		log.Error("加载运行记录失败: %v", err)
+		return nil, fmt.Errorf("加载运行记录失败: %v", err)
+	}
+
+	parts, err := db.LoadBackupParts(run.ID)
+	if err != nil {
+		log.Error("加载分片记录失败: %v", err)
+		return nil, fmt.Errorf("加载分片记录失败: %v", err)
+	}
+	return &RunDetail{BackupRun: run, Parts: parts}, nil
+}
+
+// RunLog 返回一次运行期间输出的日志，正在运行的备份返回目前为止的日志
+func (c *JobController) RunLog(backupID, timestamp string) (string, error) {
+	if _, err := c.job(backupID); err != nil {
+		return "", err
+	}
+	if ctl := runningControl(backupID); ctl != nil && ctl.startedAt.Format("20060102_150405") == timestamp {
+		return ctl.log.String(), nil
+	}
+
+	text, err := db.LoadBackupRunLog(backupID, timestamp)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("%w: %s", ErrRunNotFound, timestamp)
+	}
+	if err != nil {
+		log.Error("加载运行日志失败: %v", err)
+		return "", fmt.Errorf("加载运行日志失败: %v", err)
+	}
+	return text, nil
+}
+
+// Restore 在后台还原指定时间的备份，通过Restores查看结果
+func (c *JobController) Restore(backupID string, req RestoreRequest) (*RestoreTask, error) {
+	b, err := c.job(backupID)
+	if err != nil {
+		return nil, err
+	}
+	if req.Timestamp == "" || req.OutputDir == "" {
+		return nil, fmt.Errorf("需要指定还原的备份时间和目标目录")
+	}
+
+	var identities []age.Identity
+	if req.Identity != "" {
+		if identities, err = archive.LoadIdentities(req.Identity); err != nil {
+			return nil, err
+		}
+	}
+
+	restoreInfo := &RestoreInfo{
+		ZipDir:     b.OutputDir,
+		OutputDir:  req.OutputDir,
+		Password:   b.Password,
+		BackupID:   backupID,
+		Timestamp:  req.Timestamp,
+		Chain:      req.Chain,
+		Identities: identities,
+		Mode:       b.Mode,
+		BasePath:   b.BasePath,
+		Uploader:   b.Uploader,
+	}
+
+	c.mu.Lock()
+	task := &RestoreTask{
+		ID:        len(c.restores) + 1,
+		BackupID:  backupID,
+		Timestamp: req.Timestamp,
+		OutputDir: req.OutputDir,
+		Chain:     req.Chain,
+		Status:    RestoreStatusRunning,
+		StartedAt: time.Now(),
+	}
+	c.restores = append(c.restores, task)
+	result := *task
+	c.mu.Unlock()
+
+	go func() {
+		log.Info("通过管理接口开始还原: %s %s -> %s", backupID, req.Timestamp, req.OutputDir)
+		err := restoreInfo.Restore()
+		if err != nil {
+			log.Error("管理接口发起的还原失败: %v", err)
+		} else {
+			log.Info("还原完成: %s %s", backupID, req.Timestamp)
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		task.FinishedAt = time.Now()
+		task.Status = RestoreStatusSuccess
+		if err != nil {
+			task.Status = RestoreStatusFailed
+			task.Error = err.Error()
+		}
+	}()
+	return &result, nil
+}
+
+// Restores 返回本进程启动后发起的还原，从新到旧排列
+func (c *JobController) Restores() []*RestoreTask {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tasks := make([]*RestoreTask, 0, len(c.restores))
+	for i := len(c.restores) - 1; i >= 0; i-- {
+		task := *c.restores[i]
+		tasks = append(tasks, &task)
+	}
+	return tasks
+}
+
+// AuthStatus 返回OneDrive的认证状态
+func (c *JobController) AuthStatus() *AuthStatus {
+	c.mu.Lock()
+	authURL, deviceAuth := c.authURL, c.deviceAuth
+	c.mu.Unlock()
+
+	status := &AuthStatus{}
+	switch {
+	case authURL != nil:
+		status.Enabled, status.Flow = true, "code"
+	case deviceAuth != nil:
+		status.Enabled, status.Flow = true, "device"
+	default:
+		return status
+	}
+
+	if info, err := db.LoadAuthInfo(); err == nil {
+		status.UserID = info.UserID
+		status.ExpiresAt = time.Unix(info.ExpiresIn, 0)
+		status.Authenticated = status.ExpiresAt.After(time.Now())
+	}
+	return status
+}
+
+// AuthURL 生成一个新的OneDrive认证地址，每个地址带有独立的state和PKCE校验码
+func (c *JobController) AuthURL() (string, error) {
+	c.mu.Lock()
+	authURL, deviceAuth := c.authURL, c.deviceAuth
+	c.mu.Unlock()
+
+	if authURL == nil {
+		if deviceAuth != nil {
+			return "", ErrAuthFlow
+		}
+		return "", ErrAuthDisabled
+	}
+	return authURL()
+}
+
+// DeviceAuth 开始设备代码认证，返回需要用户输入的代码，已有未过期的代码时返回该代码
+func (c *JobController) DeviceAuth() (*model.DeviceAuth, error) {
+	c.mu.Lock()
+	authURL, deviceAuth := c.authURL, c.deviceAuth
+	c.mu.Unlock()
+
+	if deviceAuth == nil {
+		if authURL != nil {
+			return nil, ErrAuthFlow
+		}
+		return nil, ErrAuthDisabled
+	}
+	return deviceAuth()
+}
+
+// HasJob 返回任务是否存在
+func (c *JobController) HasJob(backupID string) bool {
+	_, err := c.job(backupID)
+	return err == nil
+}
+
+func (c *JobController) Pause(backupID string) error  { return PauseJob(backupID) }
+func (c *JobController) Resume(backupID string) error { return ResumeJob(backupID) }
+func (c *JobController) Cancel(backupID string) error { return CancelJob(backupID) }
@@ -0,0 +1,54 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"auto-backup/db"
+	"auto-backup/log"
+	"auto-backup/parity"
+	"auto-backup/utils"
+)
+
+// 使用恢复文件检查分片，有损坏的块时原地修复
+func repairPartFile(partPath, parPath string) error {
+	result, err := parity.RepairFile(partPath, parPath)
+	if err != nil {
+		return fmt.Errorf("使用恢复数据修复分片失败: %v", err)
+	}
+	if result.Repaired {
+		log.Warn("分片%s有%d/%d个块损坏，已使用恢复数据修复", filepath.Base(partPath), result.Damaged, result.Blocks)
+	}
+	return nil
+}
+
+// 校验前使用恢复文件修复分片，本地没有恢复文件时从远端下载，没有生成恢复文件的分片直接跳过
+func (v *VerifyInfo) repairPart(part *db.BackupPart, partPath string) error {
+	for _, parPath := range []string{partPath + parity.Ext, filepath.Join(v.ZipDir, part.Name+parity.Ext)} {
+		if _, err := os.Stat(parPath); err == nil {
+			return repairPartFile(partPath, parPath)
+		}
+	}
+
+	// 流式上传的分片没有恢复文件
+	if v.Uploader == nil || part.Chunks > 0 {
+		return nil
+	}
+
+	tmpDir, err := os.MkdirTemp("", "auto-backup-parity-")
+	if err != nil {
+		return fmt.Errorf("创建临时目录失败: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	parPath := filepath.Join(tmpDir, part.Name+parity.Ext)
+	if err := v.Uploader.DownloadFile(v.context(), v.BasePath, part.Name+parity.Ext, parPath); err != nil {
+		if errors.Is(err, utils.ErrNotFound) {
+			return nil
+		}
+		return fmt.Errorf("下载恢复文件失败: %v", err)
+	}
+	return repairPartFile(partPath, parPath)
+}
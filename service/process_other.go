@@ -0,0 +1,8 @@
+//go:build !unix
+
+package service
+
+import "os/exec"
+
+// 没有进程组的平台上只终止命令本身，子进程持有输出时最多再等待WaitDelay
+func killProcessGroup(cmd *exec.Cmd) {}
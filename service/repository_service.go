@@ -0,0 +1,331 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"auto-backup/archive"
+	"auto-backup/db"
+	"auto-backup/log"
+	"auto-backup/repository"
+	"auto-backup/uploader"
+	"auto-backup/utils"
+)
+
+// 备份存储模式
+const (
+	ModeArchive    = "archive"    // 每次备份生成压缩包分片
+	ModeRepository = "repository" // 按内容分块去重的仓库
+)
+
+// 仓库在输出目录和远端目录下的子目录名
+const repositoryDir = "repository"
+
+// ParseMode 解析配置中的存储模式，空字符串使用压缩包模式
+func ParseMode(s string) (string, error) {
+	switch s {
+	case "", ModeArchive:
+		return ModeArchive, nil
+	case ModeRepository:
+		return ModeRepository, nil
+	default:
+		return "", fmt.Errorf("不支持的存储模式: %s", s)
+	}
+}
+
+// 打开仓库的参数，所有备份任务共用同一个远端仓库以便跨任务去重
+func repositoryOptions(outputDir, basePath, password string, up uploader.Uploader) repository.Options {
+	return repository.Options{
+		Dir:      filepath.Join(outputDir, repositoryDir),
+		Remote:   path.Join(basePath, repositoryDir),
+		Password: password,
+		Uploader: up,
+	}
+}
+
+// 仓库模式的备份：每次生成完整快照，未变化的文件复用上一次快照的数据块，
+// 变化的文件重新分块，只有仓库中不存在的数据块会被写入和上传
+func (b *BackupInfo) backupRepository(ctx context.Context, backupID, timestamp string, currentFiles map[string]FileInfo) error {
+	// 仓库的数据块索引和数据包由所有任务共用，同一时间只能有一个任务写入
+	unlock, err := acquireLock(repositoryLockName)
+	if err != nil {
+		log.Error("仓库正在被其他备份使用: %v", err)
+		return fmt.Errorf("仓库正在被其他备份使用: %v", err)
+	}
+	defer unlock()
+
+	opts := repositoryOptions(b.OutputDir, b.BasePath, b.Password, b.Uploader)
+	opts.Context = ctx
+	repo, err := repository.Open(opts)
+	if err != nil {
+		log.Error("打开仓库失败: %v", err)
+		return fmt.Errorf("打开仓库失败: %v", err)
+	}
+	defer repo.Close()
+
+	repo.UploadPending()
+
+	run := &db.BackupRun{
+		BackupID:  backupID,
+		Timestamp: timestamp,
+		Full:      true,
+		Status:    db.RunStatusRunning,
+		StartedAt: time.Now(),
+	}
+	if _, err := db.CreateBackupRun(run); err != nil {
+		log.Error("创建备份运行记录失败: %v", err)
+		return fmt.Errorf("创建备份运行记录失败: %v", err)
+	}
+
+	err = b.writeSnapshot(ctx, repo, run, currentFiles)
+
+	// 中断时未写完的数据包在关闭仓库时删除，已写完的数据包下次备份时复用
+	run.Status = runStatus(ctx, err)
+	run.FinishedAt = time.Now()
+	if err != nil {
+		run.Error = err.Error()
+	}
+	if ferr := db.FinishBackupRun(run); ferr != nil {
+		log.Error("更新备份运行记录失败: %v", ferr)
+	}
+
+	return err
+}
+
+// 将当前文件写入仓库并保存快照
+func (b *BackupInfo) writeSnapshot(ctx context.Context, repo *repository.Repository, run *db.BackupRun, currentFiles map[string]FileInfo) error {
+	prevFiles := loadPreviousSnapshot(repo, run.BackupID)
+
+	paths := make([]string, 0, len(currentFiles))
+	for p := range currentFiles {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	snapshot := &repository.Snapshot{
+		BackupID:  run.BackupID,
+		Timestamp: run.Timestamp,
+		Time:      run.StartedAt,
+	}
+
+	// 在线备份的SQLite数据库已经包含辅助文件中的内容，辅助文件不写入快照
+	sidecars, sqliteChecked := b.sqliteSidecars(paths)
+	hasSidecars := make(map[string]bool)
+	for _, dbPath := range sidecars {
+		hasSidecars[dbPath] = true
+	}
+
+	var reused int
+	for _, relPath := range paths {
+		if err := utils.WaitIfPaused(ctx); err != nil {
+			return err
+		}
+		if _, ok := sidecars[relPath]; ok {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(b.SrcDir, relPath))
+		if err != nil {
+			log.Error("获取文件信息失败: %v", err)
+			continue
+		}
+
+		f := &repository.SnapshotFile{
+			Path:    filepath.ToSlash(relPath),
+			Mode:    info.Mode(),
+			ModTime: info.ModTime(),
+		}
+		if info.IsDir() {
+			snapshot.Files = append(snapshot.Files, f)
+			continue
+		}
+
+		// 大小和修改时间都没有变化时直接复用上一次快照的数据块列表，
+		// 有WAL等辅助文件的数据库写入时本身可能不变，需要重新读取
+		if prev, ok := prevFiles[f.Path]; ok && !hasSidecars[relPath] && prev.Size == info.Size() && prev.ModTime.Equal(info.ModTime()) {
+			exists, err := repo.HasChunks(prev.Chunks)
+			if err != nil {
+				log.Error("查询数据块索引失败: %v", err)
+				return fmt.Errorf("查询数据块索引失败: %v", err)
+			}
+			if exists {
+				f.Size, f.Hash, f.Chunks = prev.Size, prev.Hash, prev.Chunks
+				reused++
+			}
+		}
+
+		if f.Chunks == nil && info.Size() > 0 {
+			log.Debug("写入文件: %s", f.Path)
+			// SQLite数据库读取一致的快照，读取完成后删除
+			fullPath, cleanup := b.sourceFile(ctx, relPath, sqliteChecked)
+			err := repo.AddFile(fullPath, f)
+			cleanup()
+			if err != nil {
+				log.Error("写入仓库失败: %v", err)
+				return fmt.Errorf("写入仓库失败: %v", err)
+			}
+		}
+
+		snapshot.Files = append(snapshot.Files, f)
+		run.FileCount++
+		run.TotalSize += f.Size
+	}
+
+	if err := repo.SaveSnapshot(snapshot); err != nil {
+		log.Error("保存快照失败: %v", err)
+		return fmt.Errorf("保存快照失败: %v", err)
+	}
+
+	record := &db.RepoSnapshot{
+		BackupID:  run.BackupID,
+		Timestamp: run.Timestamp,
+		RunID:     run.ID,
+		FileCount: run.FileCount,
+		TotalSize: run.TotalSize,
+		NewSize:   repo.NewSize(),
+		CreatedAt: time.Now(),
+	}
+	if err := db.SaveRepoSnapshot(record); err != nil {
+		log.Error("保存快照记录失败: %v", err)
+		return fmt.Errorf("保存快照记录失败: %v", err)
+	}
+
+	log.Info("快照完成: %s, 文件%d个, 共%d字节, 复用%d个未变化的文件, 新写入%d字节",
+		run.Timestamp, run.FileCount, run.TotalSize, reused, repo.NewSize())
+	return nil
+}
+
+// 加载上一次快照的文件列表，失败时返回空，所有文件重新分块
+func loadPreviousSnapshot(repo *repository.Repository, backupID string) map[string]*repository.SnapshotFile {
+	files := make(map[string]*repository.SnapshotFile)
+
+	snapshots, err := db.LoadRepoSnapshots(backupID)
+	if err != nil || len(snapshots) == 0 {
+		return files
+	}
+
+	prev, err := repo.LoadSnapshot(backupID, snapshots[0].Timestamp)
+	if err != nil {
+		log.Warn("加载上一次快照失败, 将重新读取所有文件: %v", err)
+		return files
+	}
+
+	for _, f := range prev.Files {
+		files[f.Path] = f
+	}
+	return files
+}
+
+// 从仓库还原快照，没有指定时间时列出所有可用的快照
+func (r *RestoreInfo) restoreRepository() error {
+	if r.Timestamp == "" {
+		snapshots, err := db.LoadRepoSnapshots(r.BackupID)
+		if err != nil {
+			return fmt.Errorf("加载快照记录失败: %v", err)
+		}
+
+		log.Info("可用的快照:")
+		for _, s := range snapshots {
+			log.Info("- %s (文件%d个, 共%d字节)", s.Timestamp, s.FileCount, s.TotalSize)
+		}
+		return fmt.Errorf("请指定要还原的备份时间")
+	}
+
+	repo, err := repository.Open(repositoryOptions(r.ZipDir, r.BasePath, r.Password, r.Uploader))
+	if err != nil {
+		return fmt.Errorf("打开仓库失败: %v", err)
+	}
+	defer repo.Close()
+
+	snapshot, err := repo.LoadSnapshot(r.BackupID, r.Timestamp)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(r.OutputDir, 0755); err != nil {
+		return fmt.Errorf("创建输出目录失败: %v", err)
+	}
+
+	log.Info("开始还原快照: %s (%s), 共%d项", snapshot.BackupID, snapshot.Timestamp, len(snapshot.Files))
+
+	for _, f := range snapshot.Files {
+		outPath := filepath.Join(r.OutputDir, filepath.FromSlash(f.Path))
+
+		if f.Mode.IsDir() {
+			if err := os.MkdirAll(outPath, f.Mode.Perm()); err != nil {
+				return fmt.Errorf("创建目录失败: %v", err)
+			}
+			continue
+		}
+
+		if err := restoreSnapshotFile(repo, f, outPath); err != nil {
+			return fmt.Errorf("还原文件 %s 失败: %v", f.Path, err)
+		}
+	}
+
+	log.Info("还原完成")
+	return nil
+}
+
+func restoreSnapshotFile(repo *repository.Repository, f *repository.SnapshotFile, outPath string) error {
+	if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+		return fmt.Errorf("创建父目录失败: %v", err)
+	}
+
+	outFile, err := os.OpenFile(outPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode.Perm())
+	if err != nil {
+		return fmt.Errorf("创建输出文件失败: %v", err)
+	}
+
+	w := bufio.NewWriterSize(outFile, defaultBufferSize)
+	err = repo.ReadFile(f, w)
+	if err == nil {
+		err = w.Flush()
+	}
+	outFile.Close()
+	if err != nil {
+		return err
+	}
+
+	restoreMetadata(outPath, &archive.Header{Mode: f.Mode, ModTime: f.ModTime})
+	return nil
+}
+
+// 校验仓库中的快照：读取每个文件的所有数据块，校验数据块ID和文件哈希
+func (v *VerifyInfo) verifyRepository(run *db.BackupRun) (*db.VerifyReport, error) {
+	repo, err := repository.Open(repositoryOptions(v.ZipDir, v.BasePath, v.Password, v.Uploader))
+	if err != nil {
+		return nil, fmt.Errorf("打开仓库失败: %v", err)
+	}
+	defer repo.Close()
+
+	report := &db.VerifyReport{
+		RunID:     run.ID,
+		StartedAt: time.Now(),
+	}
+	var failures []string
+
+	snapshot, err := repo.LoadSnapshot(run.BackupID, run.Timestamp)
+	if err != nil {
+		failures = append(failures, fmt.Sprintf("加载快照失败: %v", err))
+	} else {
+		log.Info("开始校验快照: %s (%s), 共%d项", run.BackupID, run.Timestamp, len(snapshot.Files))
+		for _, f := range snapshot.Files {
+			if f.Mode.IsDir() {
+				continue
+			}
+			report.Checked++
+			if err := repo.ReadFile(f, io.Discard); err != nil {
+				failures = append(failures, fmt.Sprintf("%s: %v", f.Path, err))
+			}
+		}
+	}
+
+	return v.finishReport(report, failures)
+}
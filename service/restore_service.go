@@ -1,7 +1,10 @@
 package service
 
 import (
+	"auto-backup/archive"
 	"auto-backup/log"
+	"auto-backup/parity"
+	"auto-backup/uploader"
 	"fmt"
 	"io"
 	"os"
@@ -10,7 +13,7 @@ import (
 	"strings"
 	"time"
 
-	"github.com/alexmullins/zip"
+	"filippo.io/age"
 )
 
 type RestoreInfo struct {
@@ -19,6 +22,13 @@ type RestoreInfo struct {
 	Password  string // 解压密码
 	BackupID  string // 备份ID
 	Timestamp string // 可选，指定要还原的备份时间
+	Chain     bool   // 依次还原该时间及之前的所有备份，用于还原增量备份和文件差异
+
+	Identities []age.Identity // 可选，还原age加密的分片时使用的私钥
+
+	Mode     string            // 存储模式，仓库模式从快照还原
+	BasePath string            // 远端备份目录，仓库模式下载数据包时使用
+	Uploader uploader.Uploader // 可选，仓库模式本地没有数据包时用于下载
 }
 
 // 备份分片信息
@@ -29,8 +39,15 @@ type BackupPart struct {
 }
 
 func (r *RestoreInfo) Restore() error {
-	// 1. 查找所有分片文件并解析信息
-	pattern := fmt.Sprintf("%s_*.zip", r.BackupID)
+	if r.Mode == ModeRepository {
+		return r.restoreRepository()
+	}
+
+	// 1. 查找所有分片文件并解析信息，流式上传的分片先拼接各个分块
+	pattern := fmt.Sprintf("%s_*_part*", r.BackupID)
+	if err := joinStreamChunks(r.ZipDir, pattern); err != nil {
+		return err
+	}
 	matches, err := filepath.Glob(filepath.Join(r.ZipDir, pattern))
 	if err != nil {
 		return fmt.Errorf("查找分片文件失败: %v", err)
@@ -43,6 +60,10 @@ func (r *RestoreInfo) Restore() error {
 	// 2. 解析所有备份文件信息
 	backupFiles := make(map[string][]BackupPart) // key: timestamp
 	for _, path := range matches {
+		if _, ok := archive.FormatFromName(path); !ok {
+			continue
+		}
+
 		timestamp, partNum, err := parseBackupFileName(path)
 		if err != nil {
 			log.Warn("跳过无效的备份文件: %s, 错误: %v", path, err)
@@ -73,26 +94,47 @@ func (r *RestoreInfo) Restore() error {
 	}
 
 	// 4. 获取指定时间的备份文件
-	parts, exists := backupFiles[r.Timestamp]
-	if !exists {
+	if _, exists := backupFiles[r.Timestamp]; !exists {
 		return fmt.Errorf("未找到指定时间(%s)的备份文件", r.Timestamp)
 	}
 
-	// 5. 按分片序号排序
-	sort.Slice(parts, func(i, j int) bool {
-		return parts[i].PartNum < parts[j].PartNum
-	})
+	// 链式还原时按时间顺序依次还原之前的所有备份
+	timestamps := []string{r.Timestamp}
+	if r.Chain {
+		timestamps = timestamps[:0]
+		for ts := range backupFiles {
+			if ts <= r.Timestamp {
+				timestamps = append(timestamps, ts)
+			}
+		}
+		sort.Strings(timestamps)
+	}
 
-	// 6. 确保输出目录存在
+	// 5. 确保输出目录存在
 	if err := os.MkdirAll(r.OutputDir, 0755); err != nil {
 		return fmt.Errorf("创建输出目录失败: %v", err)
 	}
 
-	// 7. 依次解压每个分片
-	for i, part := range parts {
-		log.Info("正在解压第%d/%d个分片: %s", i+1, len(parts), filepath.Base(part.Path))
-		if err := r.extractZipFile(part.Path); err != nil {
-			return fmt.Errorf("解压文件 %s 失败: %v", part.Path, err)
+	for _, ts := range timestamps {
+		parts := backupFiles[ts]
+
+		// 6. 按分片序号排序
+		sort.Slice(parts, func(i, j int) bool {
+			return parts[i].PartNum < parts[j].PartNum
+		})
+
+		// 7. 依次解压每个分片
+		log.Info("正在还原备份: %s", ts)
+		for i, part := range parts {
+			log.Info("正在解压第%d/%d个分片: %s", i+1, len(parts), filepath.Base(part.Path))
+			if _, err := os.Stat(part.Path + parity.Ext); err == nil {
+				if err := repairPartFile(part.Path, part.Path+parity.Ext); err != nil {
+					log.Warn("%v, 继续尝试解压: %s", err, filepath.Base(part.Path))
+				}
+			}
+			if err := r.extractZipFile(part.Path); err != nil {
+				return fmt.Errorf("解压文件 %s 失败: %v", part.Path, err)
+			}
 		}
 	}
 
@@ -101,16 +143,23 @@ func (r *RestoreInfo) Restore() error {
 }
 
 // 解析备份文件名
-// 文件名格式: backupID_20060102_150405_partN.zip
+// 文件名格式: backupID_20060102_150405_partN.zip 或 backupID_20060102_150405_partN.tar.zst，可能带有.age后缀
 func parseBackupFileName(filename string) (time.Time, int, error) {
 	base := filepath.Base(filename)
+	if _, ok := archive.FormatFromName(base); !ok {
+		return time.Time{}, 0, fmt.Errorf("无效的文件扩展名")
+	}
+	base = archive.TrimExt(base)
+
+	// 备份ID中可能包含下划线，从后往前取时间和分片序号
 	parts := strings.Split(base, "_")
-	if len(parts) != 4 {
+	if len(parts) < 4 {
 		return time.Time{}, 0, fmt.Errorf("无效的文件名格式")
 	}
+	parts = parts[len(parts)-3:]
 
 	// 解析时间戳
-	timeStr := parts[1] + "_" + strings.TrimSuffix(parts[2], "_part")
+	timeStr := parts[0] + "_" + parts[1]
 	timestamp, err := time.ParseInLocation("20060102_150405", timeStr, time.Local)
 	if err != nil {
 		return time.Time{}, 0, fmt.Errorf("无效的时间格式: %v", err)
@@ -118,7 +167,7 @@ func parseBackupFileName(filename string) (time.Time, int, error) {
 
 	// 解析分片序号
 	var partNum int
-	_, err = fmt.Sscanf(parts[3], "part%d.zip", &partNum)
+	_, err = fmt.Sscanf(parts[2], "part%d", &partNum)
 	if err != nil {
 		return time.Time{}, 0, fmt.Errorf("无效的分片序号: %v", err)
 	}
@@ -127,27 +176,37 @@ func parseBackupFileName(filename string) (time.Time, int, error) {
 }
 
 func (r *RestoreInfo) extractZipFile(zipPath string) error {
-	reader, err := zip.OpenReader(zipPath)
+	reader, err := archive.OpenReader(zipPath, archive.Options{
+		Password:   r.Password,
+		Passphrase: r.Password,
+		Identities: r.Identities,
+	})
 	if err != nil {
-		return fmt.Errorf("打开zip文件失败: %v", err)
+		return fmt.Errorf("打开压缩文件失败: %v", err)
 	}
 	defer reader.Close()
 
 	// 遍历压缩文件中的每个文件
-	for _, file := range reader.File {
-		if file.IsEncrypted() {
-			file.SetPassword(r.Password)
+	return reader.Walk(func(h *archive.Header, rd io.Reader) error {
+		// 文件差异应用到已还原的上一个版本
+		if strings.HasPrefix(h.Name, deltaPrefix) {
+			return r.applyDelta(h, rd)
+		}
+
+		// 超过分片大小的文件按顺序拼接各个片段
+		if strings.HasPrefix(h.Name, segmentPrefix) {
+			return r.writeSegment(h, rd)
 		}
 
 		// 构建完整的输出路径
-		outPath := filepath.Join(r.OutputDir, file.Name)
+		outPath := filepath.Join(r.OutputDir, h.Name)
 
-		if file.FileInfo().IsDir() {
+		if h.Mode.IsDir() {
 			// 创建目录
-			if err := os.MkdirAll(outPath, file.Mode()); err != nil {
+			if err := os.MkdirAll(outPath, h.Mode.Perm()); err != nil {
 				return fmt.Errorf("创建目录失败: %v", err)
 			}
-			continue
+			return nil
 		}
 
 		// 确保父目录存在
@@ -156,32 +215,39 @@ func (r *RestoreInfo) extractZipFile(zipPath string) error {
 		}
 
 		// 创建输出文件
-		outFile, err := os.OpenFile(outPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, file.Mode())
+		outFile, err := os.OpenFile(outPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, h.Mode.Perm())
 		if err != nil {
 			return fmt.Errorf("创建输出文件失败: %v", err)
 		}
 
-		// 打开压缩文件
-		rc, err := file.Open()
-		if err != nil {
-			outFile.Close()
-			return fmt.Errorf("打开压缩文件失败: %v", err)
-		}
-
 		// 复制文件内容
-		_, err = io.Copy(outFile, rc)
-		rc.Close()
+		_, err = io.Copy(outFile, rd)
 		outFile.Close()
 
 		if err != nil {
 			return fmt.Errorf("解压文件内容失败: %v", err)
 		}
 
-		// 保持文件修改时间
-		if err := os.Chtimes(outPath, file.ModTime(), file.ModTime()); err != nil {
-			log.Warn("设置文件时间失败: %v", err)
+		restoreMetadata(outPath, h)
+		return nil
+	})
+}
+
+// 还原文件权限、属主和修改时间，失败时只记录警告
+func restoreMetadata(path string, h *archive.Header) {
+	if err := os.Chmod(path, h.Mode.Perm()); err != nil {
+		log.Warn("设置文件权限失败: %v", err)
+	}
+
+	// 只有root才能修改属主
+	if h.Owner && os.Geteuid() == 0 {
+		if err := os.Lchown(path, h.Uid, h.Gid); err != nil {
+			log.Warn("设置文件属主失败: %v", err)
 		}
 	}
 
-	return nil
+	// 保持文件修改时间
+	if err := os.Chtimes(path, h.ModTime, h.ModTime); err != nil {
+		log.Warn("设置文件时间失败: %v", err)
+	}
 }
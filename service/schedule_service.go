@@ -0,0 +1,108 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/robfig/cron/v3"
+
+	"auto-backup/db"
+	"auto-backup/log"
+)
+
+// 程序启动时的备份策略
+const (
+	StartupMissed = "missed" // 只在错过了计划的备份时执行，类似anacron
+	StartupAlways = "always" // 每次启动都执行
+	StartupNever  = "never"  // 启动时不执行，只按计划执行
+)
+
+// ParseStartupRun 解析配置中的启动策略，空字符串使用missed
+func ParseStartupRun(s string) (string, error) {
+	switch s {
+	case "":
+		return StartupMissed, nil
+	case StartupMissed, StartupAlways, StartupNever:
+		return s, nil
+	}
+	return "", fmt.Errorf("不支持的启动备份策略: %s", s)
+}
+
+// 记录本次运行的结果，用于下次启动时判断是否错过了计划的备份
+func (b *BackupInfo) saveJobState(startedAt time.Time, status string, runErr error) {
+	backupID := filepath.Base(b.SrcDir)
+	state, err := db.LoadJobState(backupID)
+	if err != nil {
+		log.Error("加载任务状态失败: %v", err)
+		return
+	}
+	if state == nil {
+		state = &db.JobState{BackupID: backupID}
+	}
+
+	state.LastRunAt = startedAt
+	state.LastStatus = status
+	state.LastError = ""
+	if runErr != nil {
+		state.LastError = runErr.Error()
+	} else {
+		state.LastSuccessAt = startedAt
+	}
+
+	if err := db.SaveJobState(state); err != nil {
+		log.Error("保存任务状态失败: %v", err)
+	}
+}
+
+// MissedRun 判断上一次成功运行之后是否错过了计划的备份，从未成功运行过时返回true
+func (b *BackupInfo) MissedRun(now time.Time) (bool, error) {
+	schedule, err := cron.ParseStandard(b.Cron)
+	if err != nil {
+		return false, fmt.Errorf("解析cron表达式失败: %v", err)
+	}
+
+	state, err := db.LoadJobState(filepath.Base(b.SrcDir))
+	if err != nil {
+		return false, fmt.Errorf("加载任务状态失败: %v", err)
+	}
+	if state == nil || state.LastSuccessAt.IsZero() {
+		log.Info("没有成功备份的记录")
+		return true, nil
+	}
+
+	// 数据库中读出的时间为UTC，cron表达式按本地时间计算
+	last := state.LastSuccessAt.In(time.Local)
+	next := schedule.Next(last)
+	if next.After(now) {
+		log.Info("上一次成功备份: %s, 下一次计划备份: %s", last.Format(time.DateTime), next.Format(time.DateTime))
+		return false, nil
+	}
+	log.Info("上一次成功备份: %s, 错过了%s的计划备份", last.Format(time.DateTime), next.Format(time.DateTime))
+	return true, nil
+}
+
+// RunAtStartup 按启动策略决定是否立即执行一次备份
+func (b *BackupInfo) RunAtStartup(ctx context.Context, policy string) {
+	switch policy {
+	case StartupNever:
+		log.Info("启动时不执行备份，等待下一次计划备份")
+		return
+	case StartupMissed:
+		missed, err := b.MissedRun(time.Now())
+		if err != nil {
+			log.Error("检查错过的备份失败: %v", err)
+			return
+		}
+		if !missed {
+			log.Info("没有错过计划的备份，启动时不执行备份")
+			return
+		}
+	}
+
+	log.Info("启动时执行备份")
+	if err := b.Backup(ctx); err != nil {
+		log.Error("启动时备份失败: %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+package service
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"auto-backup/db"
+)
+
+func TestMissedRun(t *testing.T) {
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2026, 3, day, hour, minute, 0, 0, time.Local)
+	}
+	tests := []struct {
+		name        string
+		cron        string
+		lastSuccess time.Time // 零值表示没有成功运行过
+		failedOnly  bool      // 只有失败的运行记录
+		now         time.Time
+		want        bool
+	}{
+		{name: "没有运行记录", cron: "0 3 * * *", now: at(10, 12, 0), want: true},
+		{name: "只有失败的运行", cron: "0 3 * * *", failedOnly: true, now: at(10, 12, 0), want: true},
+		{name: "每天_计划时间之前", cron: "0 3 * * *", lastSuccess: at(9, 3, 0), now: at(10, 2, 59), want: false},
+		{name: "每天_错过计划时间", cron: "0 3 * * *", lastSuccess: at(9, 3, 0), now: at(10, 4, 0), want: true},
+		{name: "每天_停机多天", cron: "0 3 * * *", lastSuccess: at(5, 3, 0), now: at(10, 2, 0), want: true},
+		{name: "每小时_下一次之前", cron: "0 * * * *", lastSuccess: at(10, 10, 0), now: at(10, 10, 59), want: false},
+		{name: "每小时_正好到计划时间", cron: "0 * * * *", lastSuccess: at(10, 10, 0), now: at(10, 11, 0), want: true},
+		{name: "手动备份晚于计划时间", cron: "0 3 * * *", lastSuccess: at(10, 8, 0), now: at(10, 20, 0), want: false},
+		{name: "每周_同一周", cron: "0 3 * * 1", lastSuccess: at(9, 3, 0), now: at(15, 23, 0), want: false},
+		{name: "每周_下一周", cron: "0 3 * * 1", lastSuccess: at(9, 3, 0), now: at(16, 3, 30), want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestJob(t, nil)
+			b.Cron = tt.cron
+			backupID := filepath.Base(b.SrcDir)
+			if !tt.lastSuccess.IsZero() {
+				if err := db.SaveJobState(&db.JobState{BackupID: backupID, LastRunAt: tt.lastSuccess, LastStatus: db.RunStatusSuccess, LastSuccessAt: tt.lastSuccess}); err != nil {
+					t.Fatalf("SaveJobState() error = %v", err)
+				}
+			}
+			if tt.failedOnly {
+				if err := db.SaveJobState(&db.JobState{BackupID: backupID, LastRunAt: tt.now.Add(-time.Hour), LastStatus: db.RunStatusFailed}); err != nil {
+					t.Fatalf("SaveJobState() error = %v", err)
+				}
+			}
+
+			got, err := b.MissedRun(tt.now)
+			if err != nil {
+				t.Fatalf("MissedRun() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("MissedRun() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMissedRun_InvalidCron(t *testing.T) {
+	b := newTestJob(t, nil)
+	b.Cron = "not a cron"
+	if _, err := b.MissedRun(time.Now()); err == nil {
+		t.Error("MissedRun() with invalid cron succeeded")
+	}
+}
+
+func TestRunAtStartup(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     string
+		recentRun  bool // 刚刚成功备份过，没有错过计划
+		wantBackup bool
+	}{
+		{name: "never", policy: StartupNever, wantBackup: false},
+		{name: "always_没有错过", policy: StartupAlways, recentRun: true, wantBackup: true},
+		{name: "missed_没有记录", policy: StartupMissed, wantBackup: true},
+		{name: "missed_没有错过", policy: StartupMissed, recentRun: true, wantBackup: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestJob(t, map[string]string{"a.txt": "a"})
+			b.Cron = "0 3 * * *"
+			backupID := filepath.Base(b.SrcDir)
+			if tt.recentRun {
+				now := time.Now()
+				if err := db.SaveJobState(&db.JobState{BackupID: backupID, LastRunAt: now, LastStatus: db.RunStatusSuccess, LastSuccessAt: now}); err != nil {
+					t.Fatalf("SaveJobState() error = %v", err)
+				}
+			}
+
+			b.RunAtStartup(context.Background(), tt.policy)
+
+			runs, err := db.ListBackupRuns(backupID, 10)
+			if err != nil {
+				t.Fatalf("ListBackupRuns() error = %v", err)
+			}
+			if got := len(runs) > 0; got != tt.wantBackup {
+				t.Fatalf("backup runs = %d, want backup %v", len(runs), tt.wantBackup)
+			}
+			if tt.wantBackup && runs[0].Status != db.RunStatusSuccess {
+				t.Errorf("run status = %s, want %s", runs[0].Status, db.RunStatusSuccess)
+			}
+		})
+	}
+}
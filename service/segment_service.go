@@ -0,0 +1,131 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"auto-backup/archive"
+	"auto-backup/db"
+	"auto-backup/log"
+)
+
+// 超过分片大小的文件拆分后的片段在压缩包中的路径前缀
+const segmentPrefix = ".auto-backup/segments/"
+
+// 还原片段时使用的临时文件后缀
+const partialExt = ".partial"
+
+// 片段名称格式: 前缀 + 文件路径 + .序号-of-总数，命令源的输出在读完之前总数记为0
+var segmentNamePattern = regexp.MustCompile(`^(.+)\.(\d+)-of-(\d+)$`)
+
+func segmentName(name string, n, total int) string {
+	return fmt.Sprintf("%s%s.%d-of-%d", segmentPrefix, name, n, total)
+}
+
+// 解析片段名称，返回原始文件路径、片段序号和总数
+func parseSegmentName(entryName string) (string, int, int, error) {
+	m := segmentNamePattern.FindStringSubmatch(strings.TrimPrefix(entryName, segmentPrefix))
+	if m == nil {
+		return "", 0, 0, fmt.Errorf("无效的片段名称: %s", entryName)
+	}
+	n, _ := strconv.Atoi(m[2])
+	total, _ := strconv.Atoi(m[3])
+	return m[1], n, total, nil
+}
+
+// 从r中读取size字节作为文件的一个片段写入压缩包，所有片段使用相同的压缩方式，sig不为空时同时写入sig。
+// pad为true时文件头中已经写入了size，文件变小时用0补足
+func compressSegment(aw archive.Writer, r io.Reader, name string, n, total int, size int64, info os.FileInfo, method archive.Method, sig io.Writer, pad bool) (*db.BackupEntry, error) {
+	header := &archive.Header{
+		Name:    segmentName(name, n, total),
+		Size:    size,
+		Mode:    info.Mode(),
+		ModTime: info.ModTime(),
+		Method:  method,
+		Info:    info,
+	}
+
+	writer, err := aw.Create(header)
+	if err != nil {
+		log.Error("创建文件头失败: %v", err)
+		return nil, fmt.Errorf("创建文件头失败: %v", err)
+	}
+
+	hasher := sha256.New()
+	dst := io.MultiWriter(writer, hasher)
+	if sig != nil {
+		dst = io.MultiWriter(writer, hasher, sig)
+	}
+	written, err := io.CopyN(dst, r, size)
+	// 文件在读取过程中变小时，tar格式用0补足片段的大小，其他格式只保存读取到的内容
+	inconsistent := errors.Is(err, io.EOF)
+	if inconsistent {
+		err = nil
+		if pad {
+			var padded int64
+			padded, err = io.CopyN(dst, zeroReader{}, size-written)
+			written += padded
+		}
+	}
+	if err != nil {
+		log.Error("复制文件内容失败: %v", err)
+		return nil, fmt.Errorf("复制文件内容失败(%s 第%d/%d段, 已写入%d字节): %v", name, n, total, written, err)
+	}
+
+	return &db.BackupEntry{
+		Path:         header.Name,
+		Size:         written,
+		Hash:         hex.EncodeToString(hasher.Sum(nil)),
+		ModTime:      info.ModTime(),
+		Inconsistent: inconsistent,
+	}, nil
+}
+
+// 还原文件片段：第一段创建临时文件，之后的片段依次追加，最后一段写完后改名并还原元数据。
+// 片段不完整(缺少分片或命令源执行失败)时只会留下临时文件
+func (r *RestoreInfo) writeSegment(h *archive.Header, rd io.Reader) error {
+	name, n, total, err := parseSegmentName(h.Name)
+	if err != nil {
+		return err
+	}
+	finalPath := filepath.Join(r.OutputDir, filepath.FromSlash(name))
+	outPath := finalPath + partialExt
+
+	flag := os.O_WRONLY | os.O_APPEND
+	if n == 1 {
+		if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+			return fmt.Errorf("创建父目录失败: %v", err)
+		}
+		flag = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+
+	outFile, err := os.OpenFile(outPath, flag, h.Mode.Perm())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("缺少文件 %s 的前面的片段，请按顺序还原所有分片", name)
+		}
+		return fmt.Errorf("打开输出文件失败: %v", err)
+	}
+
+	_, err = io.Copy(outFile, rd)
+	outFile.Close()
+	if err != nil {
+		return fmt.Errorf("解压文件片段失败: %v", err)
+	}
+
+	if n == total {
+		if err := os.Rename(outPath, finalPath); err != nil {
+			return fmt.Errorf("重命名还原的文件失败: %v", err)
+		}
+		restoreMetadata(finalPath, h)
+	}
+	return nil
+}
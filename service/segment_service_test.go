@@ -0,0 +1,125 @@
+package service
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"auto-backup/archive"
+	"auto-backup/db"
+)
+
+func TestSegmentName_RoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		n, total int
+	}{
+		{"a.bin", 1, 3},
+		{"dir/b.1-of-2", 2, 2},
+		{"cmd.sql", 4, 0},
+	}
+	for _, tt := range tests {
+		entry := segmentName(tt.name, tt.n, tt.total)
+		name, n, total, err := parseSegmentName(entry)
+		if err != nil {
+			t.Fatalf("parseSegmentName(%q) error = %v", entry, err)
+		}
+		if name != tt.name || n != tt.n || total != tt.total {
+			t.Errorf("parseSegmentName(%q) = %q, %d, %d", entry, name, n, total)
+		}
+	}
+
+	if _, _, _, err := parseSegmentName(segmentPrefix + "a.bin"); err == nil {
+		t.Error("parseSegmentName() without segment suffix should fail")
+	}
+}
+
+// 文件在读取过程中变小时只有tar格式需要用0补足文件头中的大小
+func TestCompressSegment_Shrunk(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.bin")
+	if err := os.WriteFile(path, []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		format archive.Format
+		size   int64
+	}{
+		{archive.FormatZip, 3},
+		{archive.FormatTarZst, 10},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		aw, err := archive.NewWriter(&buf, archive.Options{Format: tt.format})
+		if err != nil {
+			t.Fatalf("NewWriter() error = %v", err)
+		}
+		entry, err := compressSegment(aw, strings.NewReader("abc"), "a.bin", 1, 1, info.Size(), info, archive.Store, nil, tt.format.FixedSize())
+		if err != nil {
+			t.Fatalf("%s: compressSegment() error = %v", tt.format, err)
+		}
+		if err := aw.Close(); err != nil {
+			t.Fatalf("%s: Close() error = %v", tt.format, err)
+		}
+		if entry.Size != tt.size || !entry.Inconsistent {
+			t.Errorf("%s: entry size = %d, inconsistent = %v, want %d, true", tt.format, entry.Size, entry.Inconsistent, tt.size)
+		}
+	}
+}
+
+// 随机内容，压缩后大小和原始大小接近，便于控制分片大小
+func randomData(seed int64, n int) string {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return string(data)
+}
+
+func TestBackup_SplitsLargeFile(t *testing.T) {
+	const partSize = 64 * 1024
+	files := map[string]string{
+		"small.txt": "hello",
+		"big.bin":   randomData(1, partSize*5/2),
+		"dir/c.txt": strings.Repeat("c", 1000),
+	}
+	b := newTestJob(t, files)
+	b.PartSize = partSize
+	mustBackup(t, b)
+
+	run := lastRun(t, b)
+	entries, err := db.LoadBackupEntries(run.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var segments []*db.BackupEntry
+	for _, e := range entries {
+		if strings.HasPrefix(e.Path, segmentPrefix) {
+			segments = append(segments, e)
+		}
+	}
+	if len(segments) < 3 {
+		t.Fatalf("big.bin split into %d segments, want at least 3", len(segments))
+	}
+	// 每个片段位于不同的分片中，按顺序排列
+	for i := 1; i < len(segments); i++ {
+		if segments[i].PartNum <= segments[i-1].PartNum {
+			t.Errorf("segment %s in part %d, previous in part %d", segments[i].Path, segments[i].PartNum, segments[i-1].PartNum)
+		}
+	}
+
+	got := restoreTree(t, b, run.Timestamp, false)
+	if len(got) != len(files) {
+		t.Fatalf("restored %d files, want %d", len(got), len(files))
+	}
+	for name, data := range files {
+		if got[name] != data {
+			t.Errorf("restored %s differs from source", name)
+		}
+	}
+}
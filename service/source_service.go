@@ -0,0 +1,204 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"auto-backup/archive"
+	"auto-backup/db"
+)
+
+const (
+	// 命令输出按该大小在内存中分块写入压缩包，输出不超过一块时写为一个普通文件
+	sourceChunkSize = 16 * 1024 * 1024
+	// 命令失败时日志中保留的标准错误输出长度
+	sourceStderrSize = 4096
+	// 命令源在压缩包中的文件权限
+	sourceFileMode = 0600
+)
+
+// CommandSource 内容来自命令标准输出的虚拟文件，例如pg_dump、mysqldump的输出
+type CommandSource struct {
+	Name    string        // 在压缩包中的相对路径，还原到输出目录下的该路径
+	Command string        // 使用sh -c执行的命令
+	Timeout time.Duration // 超时时间，0不限制
+}
+
+// ValidateSources 检查命令源的名称，名称必须是不重复的相对路径
+func ValidateSources(sources []CommandSource) error {
+	names := make(map[string]bool)
+	for _, src := range sources {
+		if src.Name == "" || src.Command == "" {
+			return fmt.Errorf("命令源的name和command不能为空")
+		}
+		clean := path.Clean(src.Name)
+		if clean != src.Name || path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+			return fmt.Errorf("命令源名称必须是规范的相对路径: %s", src.Name)
+		}
+		// 隐藏路径留给差异和片段等内部条目使用
+		for _, part := range strings.Split(clean, "/") {
+			if part[0] == '.' {
+				return fmt.Errorf("命令源名称不能包含隐藏文件或目录: %s", src.Name)
+			}
+		}
+		if names[clean] {
+			return fmt.Errorf("命令源名称重复: %s", src.Name)
+		}
+		names[clean] = true
+	}
+	return nil
+}
+
+// 正在运行的命令源，按块读取标准输出
+type sourceStream struct {
+	src    CommandSource
+	cmd    *exec.Cmd
+	stdout *bufio.Reader
+	stderr *tailBuffer
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// 启动命令源的命令，环境变量中追加本次运行的信息，parent取消时终止命令
+func (b *BackupInfo) startSource(parent context.Context, src CommandSource, run *db.BackupRun) (*sourceStream, error) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if src.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(parent, src.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(parent)
+	}
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", src.Command)
+	cmd.Dir = b.SrcDir
+	cmd.Env = append(os.Environ(),
+		"BACKUP_JOB="+run.BackupID,
+		"BACKUP_RUN_ID="+strconv.FormatInt(run.ID, 10),
+		"BACKUP_TIMESTAMP="+run.Timestamp,
+		"BACKUP_SOURCE="+src.Name,
+	)
+	cmd.WaitDelay = hookWaitDelay
+	stderr := &tailBuffer{max: sourceStderrSize}
+	cmd.Stderr = stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("创建输出管道失败: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return nil, fmt.Errorf("启动命令失败: %v", err)
+	}
+	// 后台子进程可能一直持有输出管道，取消或超时时关闭管道，使正在进行的读取立即返回
+	context.AfterFunc(ctx, func() { stdout.Close() })
+
+	return &sourceStream{
+		src:    src,
+		cmd:    cmd,
+		stdout: bufio.NewReader(stdout),
+		stderr: stderr,
+		ctx:    ctx,
+		cancel: cancel,
+	}, nil
+}
+
+// 读取下一块输出到buf，返回读取的字节数和是否已经读到输出结尾
+func (s *sourceStream) next(buf []byte) (int, bool, error) {
+	n, err := io.ReadFull(s.stdout, buf)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return n, true, nil
+	}
+	if err != nil {
+		return n, false, err
+	}
+	// 刚好读满一块时再看一下后面是否还有输出
+	if _, err := s.stdout.Peek(1); errors.Is(err, io.EOF) {
+		return n, true, nil
+	}
+	return n, false, nil
+}
+
+// 等待命令结束，退出码不为0或超时时返回错误，错误中包含标准错误输出的结尾
+func (s *sourceStream) wait() error {
+	err := s.cmd.Wait()
+	defer s.cancel()
+	if err == nil {
+		return nil
+	}
+
+	if errors.Is(s.ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("执行超时(%v)", s.src.Timeout)
+	}
+	if out := strings.TrimSpace(s.stderr.String()); out != "" {
+		return fmt.Errorf("%v: %s", err, out)
+	}
+	return err
+}
+
+// 读取或写入出错时终止命令，超时导致的读取错误返回超时
+func (s *sourceStream) kill(err error) error {
+	s.cancel()
+	s.cmd.Wait()
+	if errors.Is(s.ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("执行超时(%v)", s.src.Timeout)
+	}
+	return err
+}
+
+// 把内存中的一块数据作为一个文件写入压缩包
+func writeSourceEntry(aw archive.Writer, name string, data []byte, modTime time.Time, method archive.Method) (*db.BackupEntry, error) {
+	header := &archive.Header{
+		Name:    name,
+		Size:    int64(len(data)),
+		Mode:    sourceFileMode,
+		ModTime: modTime,
+		Method:  method,
+	}
+	writer, err := aw.Create(header)
+	if err != nil {
+		return nil, fmt.Errorf("创建文件头失败: %v", err)
+	}
+
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(writer, hasher), bytes.NewReader(data)); err != nil {
+		return nil, fmt.Errorf("写入命令输出失败: %v", err)
+	}
+
+	return &db.BackupEntry{
+		Path:    name,
+		Size:    header.Size,
+		Hash:    hex.EncodeToString(hasher.Sum(nil)),
+		ModTime: modTime,
+	}, nil
+}
+
+// 只保留最后max字节的写入缓冲
+type tailBuffer struct {
+	buf []byte
+	max int
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.max {
+		t.buf = t.buf[len(t.buf)-t.max:]
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	return string(t.buf)
+}
@@ -0,0 +1,145 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"auto-backup/db"
+)
+
+func TestValidateSources(t *testing.T) {
+	tests := []struct {
+		name    string
+		sources []CommandSource
+		wantErr bool
+	}{
+		{"空列表", nil, false},
+		{"正常", []CommandSource{{Name: "dumps/app.sql", Command: "true"}, {Name: "b.tar", Command: "true"}}, false},
+		{"名称为空", []CommandSource{{Command: "true"}}, true},
+		{"命令为空", []CommandSource{{Name: "a.sql"}}, true},
+		{"绝对路径", []CommandSource{{Name: "/a.sql", Command: "true"}}, true},
+		{"上级目录", []CommandSource{{Name: "../a.sql", Command: "true"}}, true},
+		{"不规范的路径", []CommandSource{{Name: "dumps//a.sql", Command: "true"}}, true},
+		{"隐藏文件", []CommandSource{{Name: "dumps/.a.sql", Command: "true"}}, true},
+		{"隐藏目录", []CommandSource{{Name: ".dumps/a.sql", Command: "true"}}, true},
+		{"名称重复", []CommandSource{{Name: "a.sql", Command: "true"}, {Name: "a.sql", Command: "false"}}, true},
+	}
+	for _, tt := range tests {
+		err := ValidateSources(tt.sources)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: ValidateSources() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestBackup_CommandSources(t *testing.T) {
+	b := newTestJob(t, map[string]string{"a.txt": "file"})
+	b.Sources = []CommandSource{
+		{Name: "small.txt", Command: `printf '%s' "$BACKUP_SOURCE"`},
+		{Name: "env.txt", Command: `printf '%s %s' "$BACKUP_RUN_ID" "$BACKUP_TIMESTAMP"`},
+		// 超过一块的输出拆分为多个片段写入
+		{Name: "dumps/big.txt", Command: "yes backup | head -c 40000000"},
+	}
+	mustBackup(t, b)
+
+	run := lastRun(t, b)
+	if n := countEntries(t, run, segmentPrefix+"dumps/big.txt"); n != 3 {
+		t.Errorf("big.txt segments = %d, want 3", n)
+	}
+
+	got := restoreTree(t, b, run.Timestamp, false)
+	if got["a.txt"] != "file" || got["small.txt"] != "small.txt" {
+		t.Errorf("restored a.txt = %q, small.txt = %q", got["a.txt"], got["small.txt"])
+	}
+	if want := fmt.Sprintf("%d %s", run.ID, run.Timestamp); got["env.txt"] != want {
+		t.Errorf("restored env.txt = %q, want %q", got["env.txt"], want)
+	}
+	big := got["dumps/big.txt"]
+	if len(big) != 40000000 || !strings.HasPrefix(big, "backup\nbackup\n") {
+		t.Errorf("restored big.txt = %d bytes", len(big))
+	}
+}
+
+func TestBackup_CommandSourceFailure(t *testing.T) {
+	b := newTestJob(t, map[string]string{"a.txt": "file"})
+	b.Sources = []CommandSource{
+		{Name: "failed.sql", Command: "echo partial; echo broken >&2; exit 3"},
+		{Name: "slow.sql", Command: "sleep 10", Timeout: 100 * time.Millisecond},
+	}
+
+	err := b.Backup(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "failed.sql") {
+		t.Fatalf("Backup() error = %v, want failed command source", err)
+	}
+
+	runs, err := db.ListBackupRuns(filepath.Base(b.SrcDir), 1)
+	if err != nil || len(runs) != 1 {
+		t.Fatalf("ListBackupRuns() = %d, %v", len(runs), err)
+	}
+	run := runs[0]
+	if run.Status != db.RunStatusFailed {
+		t.Errorf("run status = %s, want failed", run.Status)
+	}
+	// 失败的命令源不写入，其他文件仍然正常备份
+	if countEntries(t, run, "failed.sql") != 0 || countEntries(t, run, "slow.sql") != 0 || countEntries(t, run, "a.txt") != 1 {
+		t.Error("failed command sources should not be written")
+	}
+
+	got := restoreTree(t, b, run.Timestamp, false)
+	if _, ok := got["failed.sql"]; ok || got["a.txt"] != "file" {
+		t.Errorf("restored files = %v", got)
+	}
+}
+
+func TestBackup_CommandSourceFailureSegments(t *testing.T) {
+	b := newTestJob(t, map[string]string{"a.txt": "file"})
+	// 第一段和a.txt在第一个分片中，第二段写入时切换分片
+	b.PartSize = 20 * 1024 * 1024
+	b.Sources = []CommandSource{
+		{Name: "dumps/big.txt", Command: "yes backup | head -c 40000000; exit 3"},
+	}
+
+	if err := b.Backup(context.Background()); err == nil {
+		t.Fatal("Backup() error = nil, want failed command source")
+	}
+
+	runs, err := db.ListBackupRuns(filepath.Base(b.SrcDir), 1)
+	if err != nil || len(runs) != 1 {
+		t.Fatalf("ListBackupRuns() = %d, %v", len(runs), err)
+	}
+	run := runs[0]
+	entries, err := db.LoadBackupEntries(run.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := make(map[int]bool)
+	segments := 0
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Path, segmentPrefix+"dumps/big.txt") {
+			if e.Invalid {
+				t.Errorf("%s marked invalid", e.Path)
+			}
+			continue
+		}
+		segments++
+		parts[e.PartNum] = true
+		if !e.Invalid {
+			t.Errorf("segment %s (part %d) not marked invalid", e.Path, e.PartNum)
+		}
+	}
+	if segments != 2 || len(parts) != 2 {
+		t.Errorf("written segments = %d in %d parts, want 2 in 2", segments, len(parts))
+	}
+	if run.FileCount != 1 || run.TotalSize != 4 {
+		t.Errorf("run file count = %d, total size = %d, want 1, 4", run.FileCount, run.TotalSize)
+	}
+
+	got := restoreTree(t, b, run.Timestamp, false)
+	if _, ok := got["dumps/big.txt"]; ok || got["a.txt"] != "file" {
+		t.Errorf("restored big.txt = %v, a.txt = %q", ok, got["a.txt"])
+	}
+}
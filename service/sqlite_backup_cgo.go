@@ -0,0 +1,76 @@
+//go:build cgo
+
+package service
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+func backupSQLite(ctx context.Context, srcPath, dstPath string) error {
+	// 只读打开源数据库，路径中的特殊字符需要转义
+	srcDSN := fmt.Sprintf("file:%s?mode=ro&_busy_timeout=%d", (&url.URL{Path: srcPath}).EscapedPath(), sqliteBusyTimeout.Milliseconds())
+	src, err := sql.Open("sqlite3", srcDSN)
+	if err != nil {
+		return fmt.Errorf("打开数据库失败: %v", err)
+	}
+	defer src.Close()
+
+	dst, err := sql.Open("sqlite3", dstPath)
+	if err != nil {
+		return fmt.Errorf("创建快照数据库失败: %v", err)
+	}
+	defer dst.Close()
+
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("打开数据库失败: %v", err)
+	}
+	defer srcConn.Close()
+
+	dstConn, err := dst.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("创建快照数据库失败: %v", err)
+	}
+	defer dstConn.Close()
+
+	return dstConn.Raw(func(dc any) error {
+		return srcConn.Raw(func(sc any) error {
+			bk, err := dc.(*sqlite3.SQLiteConn).Backup("main", sc.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return fmt.Errorf("开始在线备份失败: %v", err)
+			}
+			// 一次复制所有页，复制期间其他连接无法写入，避免源数据库变化后重新开始。
+			// 数据库被锁定时Step返回未完成，稍后重试
+			deadline := time.Now().Add(sqliteBusyTimeout)
+			for {
+				if err := ctx.Err(); err != nil {
+					bk.Finish()
+					return err
+				}
+				done, err := bk.Step(-1)
+				if err != nil {
+					bk.Finish()
+					return fmt.Errorf("在线备份失败: %v", err)
+				}
+				if done {
+					break
+				}
+				if time.Now().After(deadline) {
+					bk.Finish()
+					return fmt.Errorf("等待数据库锁超时(%v)", sqliteBusyTimeout)
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+			if err := bk.Finish(); err != nil {
+				return fmt.Errorf("完成在线备份失败: %v", err)
+			}
+			return nil
+		})
+	})
+}
@@ -0,0 +1,13 @@
+//go:build !cgo
+
+package service
+
+import (
+	"context"
+	"fmt"
+)
+
+// 没有cgo时SQLite驱动不可用，无法使用在线备份接口
+func backupSQLite(ctx context.Context, srcPath, dstPath string) error {
+	return fmt.Errorf("程序编译时没有启用cgo，不支持SQLite在线备份")
+}
@@ -0,0 +1,183 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"auto-backup/log"
+)
+
+// SQLite数据库的读取方式
+const (
+	SQLiteAuto  = "auto"  // 按文件头识别所有SQLite数据库
+	SQLitePaths = "paths" // 只处理sqlite_paths中配置的文件
+	SQLiteOff   = "off"   // 按普通文件直接复制
+)
+
+// SQLite数据库文件开头的16字节
+var sqliteHeader = []byte("SQLite format 3\x00")
+
+// 数据库的辅助文件，内容已经包含在在线备份的快照中
+var sqliteSidecarSuffixes = []string{"-wal", "-shm", "-journal"}
+
+// 在线备份等待数据库写锁释放的时间
+const sqliteBusyTimeout = 30 * time.Second
+
+// ParseSQLiteCapture 解析配置中的SQLite读取方式，空字符串使用auto
+func ParseSQLiteCapture(s string) (string, error) {
+	switch s {
+	case "":
+		return SQLiteAuto, nil
+	case SQLiteAuto, SQLitePaths, SQLiteOff:
+		return s, nil
+	}
+	return "", fmt.Errorf("不支持的SQLite读取方式: %s", s)
+}
+
+// 相对路径是否匹配sqlite_paths中的规则，不包含/的规则只匹配文件名
+func (b *BackupInfo) matchSQLitePath(relPath string) bool {
+	name := filepath.ToSlash(relPath)
+	for _, pattern := range b.SQLitePaths {
+		target := name
+		if !strings.Contains(pattern, "/") {
+			target = path.Base(name)
+		}
+		if ok, _ := path.Match(pattern, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// 是否需要通过SQLite在线备份接口读取该文件
+func (b *BackupInfo) captureSQLite(relPath string) bool {
+	if b.SQLiteCapture == SQLiteOff {
+		return false
+	}
+	matched := b.matchSQLitePath(relPath)
+	if !matched && b.SQLiteCapture == SQLitePaths {
+		return false
+	}
+
+	ok := isSQLiteFile(filepath.Join(b.SrcDir, relPath))
+	if matched && !ok {
+		log.Warn("配置的SQLite文件不是有效的数据库，直接复制: %s", relPath)
+	}
+	return ok
+}
+
+func isSQLiteFile(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	head := make([]byte, len(sqliteHeader))
+	if _, err := io.ReadFull(f, head); err != nil {
+		return false
+	}
+	return bytes.Equal(head, sqliteHeader)
+}
+
+// 按相对路径缓存是否需要在线备份，同一次备份中每个文件只读取一次文件头
+type sqliteChecks map[string]bool
+
+func (b *BackupInfo) checkSQLite(checked sqliteChecks, relPath string) bool {
+	capture, seen := checked[relPath]
+	if !seen {
+		capture = b.captureSQLite(relPath)
+		checked[relPath] = capture
+	}
+	return capture
+}
+
+// 找出需要在线备份的数据库的辅助文件，返回辅助文件到数据库相对路径的映射，以及检查过的数据库，
+// 读取文件内容时通过sourceFile复用检查结果。
+// 辅助文件不单独备份，只有辅助文件变化(如WAL模式下的写入)时数据库本身也需要重新备份
+func (b *BackupInfo) sqliteSidecars(paths []string) (map[string]string, sqliteChecks) {
+	sidecars := make(map[string]string)
+	checked := make(sqliteChecks)
+	if b.SQLiteCapture == SQLiteOff {
+		return sidecars, checked
+	}
+
+	for _, p := range paths {
+		for _, suffix := range sqliteSidecarSuffixes {
+			dbPath, ok := strings.CutSuffix(p, suffix)
+			if !ok {
+				continue
+			}
+			if b.checkSQLite(checked, dbPath) {
+				sidecars[p] = dbPath
+			}
+		}
+	}
+	return sidecars, checked
+}
+
+// 返回读取文件内容时使用的路径。需要在线备份的数据库先生成一致的快照，
+// 快照保留原文件的权限和修改时间，使用完后调用cleanup删除
+func (b *BackupInfo) sourceFile(ctx context.Context, relPath string, checked sqliteChecks) (string, func()) {
+	fullPath := filepath.Join(b.SrcDir, relPath)
+	if !b.checkSQLite(checked, relPath) {
+		return fullPath, func() {}
+	}
+
+	snapshot, err := snapshotSQLite(ctx, fullPath, b.OutputDir)
+	if err != nil {
+		// 数据库被独占锁定等情况下无法在线备份，退回到直接复制。取消时由调用方停止备份
+		if ctx.Err() == nil {
+			log.Warn("SQLite在线备份失败，直接复制文件，备份的数据库可能不一致: %s, %v", relPath, err)
+		}
+		return fullPath, func() {}
+	}
+	log.Info("已生成SQLite数据库快照: %s", relPath)
+
+	return snapshot, func() { removeSQLiteFile(snapshot) }
+}
+
+// 使用SQLite在线备份接口把数据库复制到临时目录下，复制期间持有读锁，得到某一时刻一致的内容
+func snapshotSQLite(ctx context.Context, srcPath, tmpDir string) (string, error) {
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return "", fmt.Errorf("获取文件信息失败: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(tmpDir, ".sqlite-*")
+	if err != nil {
+		return "", fmt.Errorf("创建临时文件失败: %v", err)
+	}
+	tmp.Close()
+	dstPath := tmp.Name()
+
+	if err := backupSQLite(ctx, srcPath, dstPath); err != nil {
+		removeSQLiteFile(dstPath)
+		return "", err
+	}
+
+	if err := os.Chmod(dstPath, info.Mode().Perm()); err != nil {
+		removeSQLiteFile(dstPath)
+		return "", fmt.Errorf("设置快照权限失败: %v", err)
+	}
+	if err := os.Chtimes(dstPath, info.ModTime(), info.ModTime()); err != nil {
+		removeSQLiteFile(dstPath)
+		return "", fmt.Errorf("设置快照修改时间失败: %v", err)
+	}
+	return dstPath, nil
+}
+
+// 删除快照及SQLite可能留下的辅助文件
+func removeSQLiteFile(path string) {
+	os.Remove(path)
+	for _, suffix := range sqliteSidecarSuffixes {
+		os.Remove(path + suffix)
+	}
+}
@@ -0,0 +1,117 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 创建WAL模式的数据库并写入n行，返回的连接保持打开，写入的数据留在-wal文件中
+func openWALDatabase(t *testing.T, path string, n int) *sql.DB {
+	t.Helper()
+	conn, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetMaxOpenConns(1)
+	t.Cleanup(func() { conn.Close() })
+
+	for _, stmt := range []string{
+		"PRAGMA journal_mode=WAL",
+		"PRAGMA wal_autocheckpoint=0",
+		"CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT)",
+	} {
+		if _, err := conn.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	for i := 0; i < n; i++ {
+		if _, err := conn.Exec("INSERT INTO items (name) VALUES (?)", "item"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(path + "-wal"); err != nil {
+		t.Fatalf("WAL file missing: %v", err)
+	}
+	return conn
+}
+
+func countItems(t *testing.T, path string) int {
+	t.Helper()
+	conn, err := sql.Open("sqlite3", path+"?mode=ro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var n int
+	if err := conn.QueryRow("SELECT COUNT(*) FROM items").Scan(&n); err != nil {
+		t.Fatalf("count items in %s: %v", path, err)
+	}
+	return n
+}
+
+func TestSnapshotSQLite_WAL(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "app.db")
+	openWALDatabase(t, src, 100)
+	if err := os.Chmod(src, 0640); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(src, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := snapshotSQLite(context.Background(), src, t.TempDir())
+	if err != nil {
+		t.Fatalf("snapshotSQLite() error = %v", err)
+	}
+	defer removeSQLiteFile(snapshot)
+
+	info, err := os.Stat(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 || !info.ModTime().Equal(modTime) {
+		t.Errorf("snapshot mode = %v, mod time = %v, want 0640, %v", info.Mode().Perm(), info.ModTime(), modTime)
+	}
+	// 快照是独立的数据库文件，包含只写入了WAL的数据
+	if _, err := os.Stat(snapshot + "-wal"); !os.IsNotExist(err) {
+		t.Errorf("snapshot has WAL file: %v", err)
+	}
+	if n := countItems(t, snapshot); n != 100 {
+		t.Errorf("snapshot items = %d, want 100", n)
+	}
+}
+
+func TestBackup_SQLiteWAL(t *testing.T) {
+	b := newTestJob(t, map[string]string{"a.txt": "file"})
+	openWALDatabase(t, filepath.Join(b.SrcDir, "app.db"), 50)
+	mustBackup(t, b)
+
+	out := filepath.Join(t.TempDir(), "restored")
+	r := &RestoreInfo{
+		ZipDir:    b.OutputDir,
+		OutputDir: out,
+		Password:  b.Password,
+		BackupID:  filepath.Base(b.SrcDir),
+		Timestamp: lastRun(t, b).Timestamp,
+	}
+	if err := r.Restore(); err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+
+	// 辅助文件不单独备份，数据库本身包含WAL中的数据
+	got := readTree(t, out)
+	for _, suffix := range sqliteSidecarSuffixes {
+		if _, ok := got["app.db"+suffix]; ok {
+			t.Errorf("sidecar app.db%s was backed up", suffix)
+		}
+	}
+	if n := countItems(t, filepath.Join(out, "app.db")); n != 50 {
+		t.Errorf("restored items = %d, want 50", n)
+	}
+}
@@ -0,0 +1,95 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"auto-backup/log"
+)
+
+// 不超过该大小的文件暂存在内存中，更大的文件暂存到输出目录中的临时文件
+const stageMemSize = 16 * 1024 * 1024
+
+// 暂存的文件内容。文件在读取过程中被修改时重新读取，只有最后一次读取的内容写入压缩包
+type stagedFile struct {
+	info    os.FileInfo   // 开始读取前的文件信息
+	data    *bytes.Reader // 内存中暂存的内容
+	tmp     *os.File      // 较大文件暂存的临时文件
+	size    int64         // 暂存的字节数，不超过开始读取时的大小
+	changed bool          // 读取过程中文件被修改
+}
+
+func (s *stagedFile) reader() io.Reader {
+	if s.tmp != nil {
+		return s.tmp
+	}
+	return s.data
+}
+
+func (s *stagedFile) Close() {
+	if s.tmp != nil {
+		s.tmp.Close()
+		os.Remove(s.tmp.Name())
+	}
+}
+
+// 读取文件到暂存区，读取过程中被修改时等待后重新读取，最多retries次，
+// 仍在变化时返回最后一次读取的内容并标记changed
+func (b *BackupInfo) stageFile(ctx context.Context, fullPath, filePath string, retries int) (*stagedFile, error) {
+	for attempt := 1; ; attempt++ {
+		s, err := b.stageOnce(ctx, fullPath)
+		if err != nil || !s.changed || attempt > retries {
+			return s, err
+		}
+		s.Close()
+		log.Warn("文件在读取过程中被修改，重新读取(%d/%d): %s", attempt, retries, filePath)
+		time.Sleep(modifiedRetryDelay)
+	}
+}
+
+func (b *BackupInfo) stageOnce(ctx context.Context, fullPath string) (*stagedFile, error) {
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		log.Error("获取文件信息失败: %v", err)
+		return nil, fmt.Errorf("获取文件信息失败: %v", err)
+	}
+
+	file, err := os.Open(fullPath)
+	if err != nil {
+		log.Error("打开文件失败: %v", err)
+		return nil, fmt.Errorf("打开文件失败: %v", err)
+	}
+	defer file.Close()
+
+	// 只读取获取信息时的大小，文件变大时多出的内容不保存
+	src := io.LimitReader(contextReader{ctx, file}, info.Size())
+	s := &stagedFile{info: info}
+	if info.Size() <= stageMemSize {
+		var buf bytes.Buffer
+		buf.Grow(int(info.Size()))
+		s.size, err = buf.ReadFrom(src)
+		s.data = bytes.NewReader(buf.Bytes())
+	} else {
+		s.tmp, err = os.CreateTemp(b.OutputDir, ".stage-*")
+		if err != nil {
+			log.Error("创建临时文件失败: %v", err)
+			return nil, fmt.Errorf("创建临时文件失败: %v", err)
+		}
+		s.size, err = io.Copy(s.tmp, src)
+		if err == nil {
+			_, err = s.tmp.Seek(0, io.SeekStart)
+		}
+	}
+	if err != nil {
+		s.Close()
+		log.Error("读取文件内容失败: %v", err)
+		return nil, fmt.Errorf("读取文件内容失败: %v", err)
+	}
+
+	s.changed = s.size < info.Size() || fileChanged(fullPath, info)
+	return s, nil
+}
@@ -0,0 +1,113 @@
+package service
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"auto-backup/archive"
+)
+
+// 每次查找ctx中的值时调用hook。读取文件内容前会检查暂停开关，hook在文件打开后、读取前执行
+type hookContext struct {
+	context.Context
+	hook func()
+}
+
+func (c hookContext) Value(key any) any {
+	c.hook()
+	return c.Context.Value(key)
+}
+
+// 追加内容，文件的大小和修改时间都会变化
+func appendText(t *testing.T, path, data string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStageFile_ModifiedDuringRead(t *testing.T) {
+	b := newTestJob(t, map[string]string{"log.txt": "first"})
+	path := filepath.Join(b.SrcDir, "log.txt")
+
+	// 第一次读取时追加内容，重新读取后得到修改后的完整内容
+	fired := false
+	ctx := hookContext{context.Background(), func() {
+		if !fired {
+			fired = true
+			appendText(t, path, " second")
+		}
+	}}
+	staged, err := b.stageFile(ctx, path, "log.txt", 1)
+	if err != nil {
+		t.Fatalf("stageFile() error = %v", err)
+	}
+	defer staged.Close()
+	if staged.changed || staged.data == nil || staged.size != int64(len("first second")) {
+		t.Fatalf("stageFile() changed = %v, size = %d, want consistent copy of %d bytes", staged.changed, staged.size, len("first second"))
+	}
+}
+
+func TestCompressFile_ModifiedDuringRead(t *testing.T) {
+	b := newTestJob(t, map[string]string{"log.txt": "line\n"})
+	b.ModifiedRetries = 1
+	path := filepath.Join(b.SrcDir, "log.txt")
+
+	// 每次读取都在追加，重新读取后仍在变化，压缩包中也只能有最后一次读取的副本
+	ctx := hookContext{context.Background(), func() {
+		appendText(t, path, "line\n")
+	}}
+
+	partPath := filepath.Join(t.TempDir(), "part.zip")
+	f, err := os.Create(partPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	opts := archive.Options{Format: archive.FormatZip, Password: b.Password}
+	aw, err := archive.NewWriter(f, opts)
+	if err != nil {
+		t.Fatalf("NewWriter() error = %v", err)
+	}
+	entry, err := b.compressFile(ctx, aw, path, "log.txt", nil)
+	if err != nil {
+		t.Fatalf("compressFile() error = %v", err)
+	}
+	if err := aw.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if !entry.Inconsistent {
+		t.Error("compressFile() entry should be inconsistent")
+	}
+
+	reader, err := archive.OpenReader(partPath, opts)
+	if err != nil {
+		t.Fatalf("OpenReader() error = %v", err)
+	}
+	defer reader.Close()
+	var copies []string
+	err = reader.Walk(func(h *archive.Header, r io.Reader) error {
+		data, err := io.ReadAll(r)
+		copies = append(copies, string(data))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Walk() error = %v", err)
+	}
+	if len(copies) != 1 {
+		t.Fatalf("copies in part = %d, want 1", len(copies))
+	}
+	// 只保存第二次读取开始时的大小，读取过程中追加的内容不保存
+	if copies[0] != strings.Repeat("line\n", 2) || int64(len(copies[0])) != entry.Size {
+		t.Errorf("stored copy = %q, entry size = %d", copies[0], entry.Size)
+	}
+}
@@ -0,0 +1,252 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"auto-backup/db"
+	"auto-backup/log"
+	"auto-backup/uploader"
+	"auto-backup/utils"
+)
+
+// 流式上传时分片按该大小切分为多个远端文件，内存中只缓存一块。
+// OneDrive的上传会话要求每个范围都带上文件总大小，压缩完成前分片大小未知，
+// 而按part_size预先声明大小再补零会破坏压缩包末尾的目录，所以每块作为单独的文件上传
+var streamChunkSize = 32 * 1024 * 1024
+
+// 远端分块的名称格式: 分片文件名 + .四位序号，从1开始
+var streamChunkPattern = regexp.MustCompile(`^(.+)\.(\d{4})$`)
+
+func streamChunkName(partName string, n int) string {
+	return fmt.Sprintf("%s.%04d", partName, n)
+}
+
+// 把写入的分片数据按块直接上传，不在本地保存分片文件
+type streamWriter struct {
+	ctx      context.Context // 取消后正在上传的分块中止
+	up       uploader.Uploader
+	backupID string
+	folder   string
+	name     string
+	buf      []byte
+	chunks   int      // 已上传的块数
+	size     int64    // 已写入的总字节数
+	recorded []string // 已记录到数据库的远端分块，分片完成或删除后清除
+
+	aborted bool
+}
+
+func newStreamWriter(ctx context.Context, up uploader.Uploader, backupID, folder, name string) *streamWriter {
+	return &streamWriter{
+		ctx:      ctx,
+		up:       up,
+		backupID: backupID,
+		folder:   folder,
+		name:     name,
+		buf:      make([]byte, 0, streamChunkSize),
+	}
+}
+
+var errStreamAborted = errors.New("流式上传已中止")
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	if w.aborted {
+		return 0, errStreamAborted
+	}
+	n := len(p)
+	for len(p) > 0 {
+		m := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+m]
+		p = p[m:]
+		if len(w.buf) == cap(w.buf) {
+			if err := w.flush(); err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+	w.size += int64(n)
+	return n, nil
+}
+
+// 上传缓存中的数据作为下一块，哈希不一致时重新上传
+func (w *streamWriter) flush() error {
+	name := streamChunkName(w.name, w.chunks+1)
+
+	// 先记录再上传，上传中断或进程退出后仍能找到远端的残留分块
+	chunk := &db.StreamChunk{BackupID: w.backupID, Folder: w.folder, Name: name, CreatedAt: time.Now()}
+	if err := db.SaveStreamChunk(chunk); err != nil {
+		return fmt.Errorf("保存分块记录失败: %v", err)
+	}
+	w.recorded = append(w.recorded, name)
+
+	var err error
+	for attempt := 1; attempt <= maxUploadAttempts; attempt++ {
+		log.Info("开始上传分块: %s, %d字节", name, len(w.buf))
+		err = w.up.UploadReader(w.ctx, w.folder, name, bytes.NewReader(w.buf), int64(len(w.buf)))
+		if err == nil || !errors.Is(err, utils.ErrHashMismatch) {
+			break
+		}
+		log.Warn("远端文件哈希不一致，重新上传(%d/%d): %s", attempt, maxUploadAttempts, name)
+	}
+	if err != nil {
+		return fmt.Errorf("上传分块 %s 失败: %v", name, err)
+	}
+
+	w.chunks++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// Close 上传剩余的数据
+func (w *streamWriter) Close() error {
+	if w.aborted || (len(w.buf) == 0 && w.chunks > 0) {
+		return nil
+	}
+	return w.flush()
+}
+
+// 中止上传，丢弃缓存的数据并删除已上传的分块。ctx可能已经取消，删除不受其影响
+func (w *streamWriter) abort() {
+	w.aborted = true
+	w.buf = nil
+
+	for _, name := range w.recorded {
+		log.Info("删除未完成分片的远端分块: %s", name)
+		if err := deleteStreamChunk(context.WithoutCancel(w.ctx), w.up, w.folder, name); err != nil {
+			log.Warn("删除远端分块失败，下次备份时重试: %v", err)
+		}
+	}
+	w.recorded = nil
+}
+
+// 分片记录已保存，远端分块归属于该分片，不再需要单独的分块记录
+func (w *streamWriter) release() error {
+	for _, name := range w.recorded {
+		if err := db.DeleteStreamChunk(w.folder, name); err != nil {
+			return fmt.Errorf("删除分块记录失败: %v", err)
+		}
+	}
+	w.recorded = nil
+	return nil
+}
+
+// 删除远端分块和它的记录，远端不存在时视为已删除
+func deleteStreamChunk(ctx context.Context, up uploader.Uploader, folder, name string) error {
+	if err := up.DeleteFile(ctx, folder, name); err != nil && !errors.Is(err, utils.ErrNotFound) {
+		return fmt.Errorf("删除远端分块 %s 失败: %v", name, err)
+	}
+	return db.DeleteStreamChunk(folder, name)
+}
+
+// 删除之前中止的流式上传残留在远端的分块
+func cleanupStreamChunks(ctx context.Context, up uploader.Uploader, backupID string) {
+	chunks, err := db.LoadStreamChunks(backupID)
+	if err != nil {
+		log.Error("加载流式分块记录失败: %v", err)
+		return
+	}
+
+	for _, c := range chunks {
+		log.Info("删除之前中止的流式上传残留的分块: %s", c.Name)
+		if err := deleteStreamChunk(ctx, up, c.Folder, c.Name); err != nil {
+			log.Warn("%v", err)
+		}
+	}
+}
+
+// 从远端依次下载分片的所有分块并拼接为localPath
+func downloadStreamChunks(ctx context.Context, up uploader.Uploader, folder, partName string, chunks int, localPath string) error {
+	out, err := os.Create(localPath)
+	if err != nil {
+		return fmt.Errorf("创建本地文件失败: %v", err)
+	}
+	defer out.Close()
+
+	chunkPath := localPath + ".chunk"
+	defer os.Remove(chunkPath)
+
+	for n := 1; n <= chunks; n++ {
+		name := streamChunkName(partName, n)
+		if err := up.DownloadFile(ctx, folder, name, chunkPath); err != nil {
+			return fmt.Errorf("下载分块 %s 失败: %w", name, err)
+		}
+		if err := appendFile(out, chunkPath); err != nil {
+			return fmt.Errorf("拼接分块 %s 失败: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func appendFile(out io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(out, f)
+	return err
+}
+
+// 把目录中从远端下载的流式分块拼接为完整的分片，分片已存在时跳过
+func joinStreamChunks(dir, pattern string) error {
+	matches, err := filepath.Glob(filepath.Join(dir, pattern))
+	if err != nil {
+		return fmt.Errorf("查找分块文件失败: %v", err)
+	}
+
+	chunks := make(map[string][]int) // key: 分片路径
+	for _, path := range matches {
+		m := streamChunkPattern.FindStringSubmatch(path)
+		if m == nil {
+			continue
+		}
+		n, _ := strconv.Atoi(m[2])
+		chunks[m[1]] = append(chunks[m[1]], n)
+	}
+
+	for partPath, nums := range chunks {
+		if _, err := os.Stat(partPath); err == nil {
+			continue
+		}
+
+		sort.Ints(nums)
+		for i, n := range nums {
+			if n != i+1 {
+				return fmt.Errorf("分片 %s 缺少第%d个分块", filepath.Base(partPath), i+1)
+			}
+		}
+
+		log.Info("拼接流式上传的分片: %s, 共%d个分块", filepath.Base(partPath), len(nums))
+		if err := joinChunkFiles(partPath, len(nums)); err != nil {
+			os.Remove(partPath)
+			return err
+		}
+	}
+	return nil
+}
+
+func joinChunkFiles(partPath string, count int) error {
+	out, err := os.Create(partPath)
+	if err != nil {
+		return fmt.Errorf("创建分片文件失败: %v", err)
+	}
+	defer out.Close()
+
+	for n := 1; n <= count; n++ {
+		if err := appendFile(out, streamChunkName(partPath, n)); err != nil {
+			return fmt.Errorf("拼接分块失败: %v", err)
+		}
+	}
+	return nil
+}
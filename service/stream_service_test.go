@@ -0,0 +1,377 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"auto-backup/db"
+	"auto-backup/utils"
+)
+
+// 内存中的远端存储，按"目录/文件名"保存上传的数据
+type fakeUploader struct {
+	mu    sync.Mutex
+	files map[string][]byte
+
+	failUpload     string            // 上传该文件名时返回错误
+	failDelete     bool              // 删除时返回错误
+	hashMismatches int               // 前几次上传返回远端哈希不一致
+	uploads        int               // 上传次数
+	onUpload       func(name string) // 每次上传成功后调用
+}
+
+func newFakeUploader() *fakeUploader {
+	return &fakeUploader{files: make(map[string][]byte)}
+}
+
+func (u *fakeUploader) UploadBigFile(ctx context.Context, folderPath, localFilePath string) error {
+	data, err := os.ReadFile(localFilePath)
+	if err != nil {
+		return err
+	}
+	return u.put(ctx, folderPath, filepath.Base(localFilePath), data)
+}
+
+func (u *fakeUploader) UploadReader(ctx context.Context, folderPath, fileName string, r io.ReaderAt, size int64) error {
+	data := make([]byte, size)
+	if _, err := r.ReadAt(data, 0); err != nil && err != io.EOF {
+		return err
+	}
+	return u.put(ctx, folderPath, fileName, data)
+}
+
+func (u *fakeUploader) put(ctx context.Context, folder, name string, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if name == u.failUpload {
+		return errors.New("上传失败")
+	}
+	u.mu.Lock()
+	u.uploads++
+	if u.hashMismatches > 0 {
+		u.hashMismatches--
+		u.mu.Unlock()
+		return fmt.Errorf("%w: %s", utils.ErrHashMismatch, name)
+	}
+	u.files[folder+"/"+name] = data
+	u.mu.Unlock()
+	if u.onUpload != nil {
+		u.onUpload(name)
+	}
+	return nil
+}
+
+func (u *fakeUploader) DownloadFile(ctx context.Context, folderPath, fileName, localFilePath string) error {
+	u.mu.Lock()
+	data, ok := u.files[folderPath+"/"+fileName]
+	u.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", utils.ErrNotFound, fileName)
+	}
+	return os.WriteFile(localFilePath, data, 0644)
+}
+
+func (u *fakeUploader) DeleteFile(ctx context.Context, folderPath, fileName string) error {
+	if u.failDelete {
+		return errors.New("删除失败")
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	key := folderPath + "/" + fileName
+	if _, ok := u.files[key]; !ok {
+		return fmt.Errorf("%w: %s", utils.ErrNotFound, fileName)
+	}
+	delete(u.files, key)
+	return nil
+}
+
+// 远端的所有文件名，已排序
+func (u *fakeUploader) names() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var names []string
+	for key := range u.files {
+		names = append(names, filepath.Base(key))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// 缩小分块大小，让测试数据也能拆分为多个分块
+func setStreamChunkSize(t *testing.T, size int) {
+	t.Helper()
+	old := streamChunkSize
+	streamChunkSize = size
+	t.Cleanup(func() { streamChunkSize = old })
+}
+
+// 创建流式上传的测试任务
+func newStreamJob(t *testing.T, files map[string]string) (*BackupInfo, *fakeUploader) {
+	t.Helper()
+	setStreamChunkSize(t, 4*1024)
+	up := newFakeUploader()
+	b := newTestJob(t, files)
+	b.Uploader = up
+	b.BasePath = "backup"
+	b.Stream = true
+	return b, up
+}
+
+// 检查没有残留的分块记录
+func assertNoStreamChunks(t *testing.T, b *BackupInfo) {
+	t.Helper()
+	chunks, err := db.LoadStreamChunks(filepath.Base(b.SrcDir))
+	if err != nil {
+		t.Fatalf("LoadStreamChunks() error = %v", err)
+	}
+	if len(chunks) != 0 {
+		t.Errorf("remaining stream chunk records = %d, want 0", len(chunks))
+	}
+}
+
+func TestUploadFile_HashMismatchRetry(t *testing.T) {
+	up := newFakeUploader()
+	up.hashMismatches = 1
+	b := newTestJob(t, nil)
+	b.Uploader = up
+	b.BasePath = "backup"
+	local := filepath.Join(t.TempDir(), "p.zip")
+	writeFiles(t, filepath.Dir(local), map[string]string{"p.zip": "part"})
+
+	if err := b.uploadFile(context.Background(), local); err != nil {
+		t.Fatalf("uploadFile() error = %v", err)
+	}
+	if up.uploads != 2 || string(up.files["backup/p.zip"]) != "part" {
+		t.Errorf("uploads = %d, remote = %q, want 2 uploads", up.uploads, up.files["backup/p.zip"])
+	}
+
+	// 多次不一致后放弃
+	up.hashMismatches = maxUploadAttempts
+	up.uploads = 0
+	if err := b.uploadFile(context.Background(), local); err == nil {
+		t.Fatal("uploadFile() error = nil, want failure")
+	}
+	if up.uploads != maxUploadAttempts {
+		t.Errorf("uploads = %d, want %d", up.uploads, maxUploadAttempts)
+	}
+}
+
+func TestStreamChunkName(t *testing.T) {
+	name := streamChunkName("job_20240101_000000_part1.zip", 12)
+	if name != "job_20240101_000000_part1.zip.0012" {
+		t.Fatalf("streamChunkName() = %q", name)
+	}
+
+	m := streamChunkPattern.FindStringSubmatch(name)
+	if m == nil || m[1] != "job_20240101_000000_part1.zip" || m[2] != "0012" {
+		t.Errorf("streamChunkPattern match = %q", m)
+	}
+	if streamChunkPattern.MatchString("job_20240101_000000_part1.zip") {
+		t.Error("streamChunkPattern matches part name without chunk number")
+	}
+}
+
+func TestJoinStreamChunks(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		streamChunkName("a_part1.zip", 1): "hello ",
+		streamChunkName("a_part1.zip", 2): "stream ",
+		streamChunkName("a_part1.zip", 3): "chunks",
+		"a_part2.zip":                     "local",
+		streamChunkName("a_part2.zip", 1): "ignored",
+	})
+
+	if err := joinStreamChunks(dir, "a_part*"); err != nil {
+		t.Fatalf("joinStreamChunks() error = %v", err)
+	}
+
+	files := readTree(t, dir)
+	if got := files["a_part1.zip"]; got != "hello stream chunks" {
+		t.Errorf("joined part = %q", got)
+	}
+	// 已存在的分片不重新拼接
+	if got := files["a_part2.zip"]; got != "local" {
+		t.Errorf("existing part = %q, want unchanged", got)
+	}
+}
+
+func TestJoinStreamChunks_Missing(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		streamChunkName("a_part1.zip", 1): "one",
+		streamChunkName("a_part1.zip", 3): "three",
+	})
+
+	err := joinStreamChunks(dir, "a_part*")
+	if err == nil || !strings.Contains(err.Error(), "缺少第2个分块") {
+		t.Fatalf("joinStreamChunks() error = %v, want missing chunk", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a_part1.zip")); !os.IsNotExist(err) {
+		t.Errorf("incomplete part left behind: %v", err)
+	}
+}
+
+func TestDownloadStreamChunks(t *testing.T) {
+	up := newFakeUploader()
+	for n, data := range []string{"first ", "second ", "third"} {
+		up.files["remote/"+streamChunkName("p.zip", n+1)] = []byte(data)
+	}
+
+	local := filepath.Join(t.TempDir(), "p.zip")
+	if err := downloadStreamChunks(context.Background(), up, "remote", "p.zip", 3, local); err != nil {
+		t.Fatalf("downloadStreamChunks() error = %v", err)
+	}
+	data, err := os.ReadFile(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "first second third" {
+		t.Errorf("downloaded part = %q", data)
+	}
+
+	err = downloadStreamChunks(context.Background(), up, "remote", "p.zip", 4, local)
+	if !errors.Is(err, utils.ErrNotFound) {
+		t.Errorf("downloadStreamChunks() error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestBackup_StreamRoundTrip(t *testing.T) {
+	files := map[string]string{
+		"a.bin":     randomData(1, 20*1024),
+		"dir/b.bin": randomData(2, 20*1024),
+		"c.txt":     "hello",
+	}
+	b, up := newStreamJob(t, files)
+	b.PartSize = 16 * 1024
+	mustBackup(t, b)
+
+	run := lastRun(t, b)
+	parts, err := db.LoadBackupParts(run.ID)
+	if err != nil {
+		t.Fatalf("LoadBackupParts() error = %v", err)
+	}
+	if len(parts) < 2 {
+		t.Fatalf("parts = %d, want at least 2", len(parts))
+	}
+	var want []string
+	for _, part := range parts {
+		if part.Chunks < 2 {
+			t.Errorf("part %s chunks = %d, want at least 2", part.Name, part.Chunks)
+		}
+		for n := 1; n <= part.Chunks; n++ {
+			want = append(want, streamChunkName(part.Name, n))
+		}
+	}
+	sort.Strings(want)
+	if got := up.names(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("remote files = %v, want %v", got, want)
+	}
+	assertNoStreamChunks(t, b)
+
+	// 把远端分块下载到输出目录，还原时拼接为分片
+	if err := os.MkdirAll(b.OutputDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range up.names() {
+		if err := up.DownloadFile(context.Background(), b.BasePath, name, filepath.Join(b.OutputDir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := restoreTree(t, b, run.Timestamp, false)
+	if len(got) != len(files) {
+		t.Fatalf("restored %d files, want %d", len(got), len(files))
+	}
+	for name, data := range files {
+		if got[name] != data {
+			t.Errorf("restored %s differs", name)
+		}
+	}
+}
+
+func TestBackup_StreamFailureDeletesChunks(t *testing.T) {
+	b, up := newStreamJob(t, map[string]string{"a.bin": randomData(1, 64*1024)})
+	up.onUpload = func(name string) {
+		// 第二块上传后让第三块失败
+		if strings.HasSuffix(name, ".0002") {
+			up.failUpload = strings.TrimSuffix(name, ".0002") + ".0003"
+		}
+	}
+
+	if err := b.Backup(context.Background()); err == nil {
+		t.Fatal("Backup() error = nil, want upload failure")
+	}
+	if names := up.names(); len(names) != 0 {
+		t.Errorf("remote files after failure = %v, want none", names)
+	}
+	assertNoStreamChunks(t, b)
+}
+
+func TestBackup_StreamCleanupNextRun(t *testing.T) {
+	b, up := newStreamJob(t, map[string]string{"a.bin": randomData(1, 64*1024)})
+	up.failDelete = true
+	up.onUpload = func(name string) {
+		if strings.HasSuffix(name, ".0002") {
+			up.failUpload = strings.TrimSuffix(name, ".0002") + ".0003"
+		}
+	}
+
+	if err := b.Backup(context.Background()); err == nil {
+		t.Fatal("Backup() error = nil, want upload failure")
+	}
+	orphans := up.names()
+	if len(orphans) != 2 {
+		t.Fatalf("remote files after failure = %v, want 2 orphan chunks", orphans)
+	}
+
+	// 下一次备份先删除上次残留的分块，等待一秒保证分片名不同
+	time.Sleep(time.Second)
+	up.failDelete = false
+	up.failUpload = ""
+	up.onUpload = nil
+	mustBackup(t, b)
+
+	remaining := strings.Join(up.names(), ",")
+	for _, name := range orphans {
+		if strings.Contains(remaining, name) {
+			t.Errorf("orphan chunk %s was not deleted", name)
+		}
+	}
+	assertNoStreamChunks(t, b)
+}
+
+func TestBackup_StreamCancelDeletesChunks(t *testing.T) {
+	b, up := newStreamJob(t, map[string]string{"a.bin": randomData(1, 64*1024)})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	up.onUpload = func(name string) {
+		// 分片上传到一半时取消，之后的上传和删除都不能依赖ctx
+		if strings.HasSuffix(name, ".0002") {
+			cancel()
+		}
+	}
+
+	if err := b.Backup(ctx); err == nil {
+		t.Fatal("Backup() error = nil, want cancellation")
+	}
+	runs, err := db.ListBackupRuns(filepath.Base(b.SrcDir), 1)
+	if err != nil {
+		t.Fatalf("ListBackupRuns() error = %v", err)
+	}
+	if len(runs) != 1 || runs[0].Status != db.RunStatusInterrupted {
+		t.Fatalf("runs = %+v, want one interrupted run", runs)
+	}
+	if names := up.names(); len(names) != 0 {
+		t.Errorf("remote files after cancel = %v, want none", names)
+	}
+	assertNoStreamChunks(t, b)
+}
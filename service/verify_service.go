@@ -0,0 +1,217 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+
+	"auto-backup/archive"
+	"auto-backup/db"
+	"auto-backup/log"
+	"auto-backup/uploader"
+)
+
+type VerifyInfo struct {
+	ZipDir    string            // 本地分片所在目录
+	Password  string            // 解压密码
+	BackupID  string            // 备份ID
+	Timestamp string            // 可选，指定要校验的备份时间，默认最近一次成功的备份
+	BasePath  string            // 远端备份目录
+	Uploader  uploader.Uploader // 本地分片不存在时用于下载
+	Mode      string            // 存储模式，仓库模式校验快照中的数据块
+	Context   context.Context   // 取消后中止正在进行的下载，为空时不会取消
+
+	Identities []age.Identity // 可选，校验age加密的分片时使用的私钥
+}
+
+// 下载使用的context，没有配置时不会取消
+func (v *VerifyInfo) context() context.Context {
+	if v.Context == nil {
+		return context.Background()
+	}
+	return v.Context
+}
+
+// 校验一次备份：逐个打开分片，解密并完整读取每个文件以校验CRC，
+// 再与目录记录中的文件列表和哈希进行比对，结果保存到数据库
+func (v *VerifyInfo) Verify() (*db.VerifyReport, error) {
+	run, err := db.LoadBackupRun(v.BackupID, v.Timestamp)
+	if err != nil {
+		log.Error("加载备份运行记录失败: %v", err)
+		return nil, fmt.Errorf("未找到备份记录(%s %s): %v", v.BackupID, v.Timestamp, err)
+	}
+
+	if v.Mode == ModeRepository {
+		return v.verifyRepository(run)
+	}
+
+	parts, err := db.LoadBackupParts(run.ID)
+	if err != nil {
+		return nil, fmt.Errorf("加载分片记录失败: %v", err)
+	}
+
+	entries, err := db.LoadBackupEntries(run.ID)
+	if err != nil {
+		return nil, fmt.Errorf("加载目录项失败: %v", err)
+	}
+
+	// 按分片分组目录项，旧版本中读取时被修改后重新压缩的文件在同一分片中有多个同名的目录项，按写入顺序排列
+	catalog := make(map[int]map[string][]*db.BackupEntry)
+	for _, e := range entries {
+		if catalog[e.PartNum] == nil {
+			catalog[e.PartNum] = make(map[string][]*db.BackupEntry)
+		}
+		catalog[e.PartNum][e.Path] = append(catalog[e.PartNum][e.Path], e)
+	}
+
+	report := &db.VerifyReport{
+		RunID:     run.ID,
+		StartedAt: time.Now(),
+	}
+	var failures []string
+
+	log.Info("开始校验备份: %s (%s), 共%d个分片", run.BackupID, run.Timestamp, len(parts))
+
+	for _, part := range parts {
+		checked, partFailures := v.verifyPart(part, catalog[part.PartNum])
+		report.Checked += checked
+		failures = append(failures, partFailures...)
+	}
+
+	return v.finishReport(report, failures)
+}
+
+// 汇总失败详情并保存校验报告
+func (v *VerifyInfo) finishReport(report *db.VerifyReport, failures []string) (*db.VerifyReport, error) {
+	report.Failed = int64(len(failures))
+	report.Detail = strings.Join(failures, "\n")
+	report.Status = db.VerifyStatusPass
+	if len(failures) > 0 {
+		report.Status = db.VerifyStatusFail
+	}
+	report.FinishedAt = time.Now()
+
+	if err := db.SaveVerifyReport(report); err != nil {
+		log.Error("保存校验报告失败: %v", err)
+		return report, fmt.Errorf("保存校验报告失败: %v", err)
+	}
+
+	log.Info("校验完成: %s, 已校验%d个文件, 失败%d个", report.Status, report.Checked, report.Failed)
+	for _, f := range failures {
+		log.Warn("校验失败: %s", f)
+	}
+
+	return report, nil
+}
+
+// 校验单个分片，返回已校验的文件数量和失败详情
+func (v *VerifyInfo) verifyPart(part *db.BackupPart, expected map[string][]*db.BackupEntry) (int64, []string) {
+	var failures []string
+
+	zipPath, cleanup, err := v.locatePart(part)
+	if err != nil {
+		return 0, []string{fmt.Sprintf("%s: 获取分片失败: %v", part.Name, err)}
+	}
+	defer cleanup()
+
+	// 修复失败时继续校验，记录哪些文件无法读取
+	if err := v.repairPart(part, zipPath); err != nil {
+		failures = append(failures, fmt.Sprintf("%s: %v", part.Name, err))
+	}
+
+	reader, err := archive.OpenReader(zipPath, archive.Options{
+		Password:   v.Password,
+		Passphrase: v.Password,
+		Identities: v.Identities,
+	})
+	if err != nil {
+		return 0, []string{fmt.Sprintf("%s: 打开压缩文件失败: %v", part.Name, err)}
+	}
+	defer reader.Close()
+
+	log.Info("正在校验分片: %s", part.Name)
+
+	var checked int64
+	err = reader.Walk(func(h *archive.Header, rd io.Reader) error {
+		if h.Mode.IsDir() {
+			return nil
+		}
+
+		checked++
+
+		// 完整读取文件，读取结束时会校验CRC或AES认证码
+		hasher := sha256.New()
+		size, err := io.Copy(hasher, rd)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s/%s: 读取失败: %v", part.Name, h.Name, err))
+			return nil
+		}
+		hash := hex.EncodeToString(hasher.Sum(nil))
+
+		// 同名的文件依次与目录项比较
+		queue := expected[h.Name]
+		if len(queue) == 0 {
+			failures = append(failures, fmt.Sprintf("%s/%s: 目录记录中不存在该文件", part.Name, h.Name))
+			return nil
+		}
+		entry := queue[0]
+		expected[h.Name] = queue[1:]
+		if entry.Size != size {
+			failures = append(failures, fmt.Sprintf("%s/%s: 大小不一致, 期望%d, 实际%d", part.Name, h.Name, entry.Size, size))
+		} else if entry.Hash != hash {
+			failures = append(failures, fmt.Sprintf("%s/%s: 哈希不一致", part.Name, h.Name))
+		}
+		return nil
+	})
+	if err != nil {
+		// 流式格式损坏后无法继续读取后面的文件
+		failures = append(failures, fmt.Sprintf("%s: 读取压缩文件失败: %v", part.Name, err))
+	}
+
+	for path, queue := range expected {
+		if len(queue) > 0 {
+			failures = append(failures, fmt.Sprintf("%s/%s: 分片中缺少该文件", part.Name, path))
+		}
+	}
+
+	return checked, failures
+}
+
+// 查找分片的本地路径，本地不存在时从远端下载到临时目录
+func (v *VerifyInfo) locatePart(part *db.BackupPart) (string, func(), error) {
+	localPath := filepath.Join(v.ZipDir, part.Name)
+	if _, err := os.Stat(localPath); err == nil {
+		return localPath, func() {}, nil
+	}
+
+	if v.Uploader == nil {
+		return "", nil, fmt.Errorf("本地不存在分片且未配置上传器: %s", localPath)
+	}
+
+	tmpDir, err := os.MkdirTemp("", "auto-backup-verify-")
+	if err != nil {
+		return "", nil, fmt.Errorf("创建临时目录失败: %v", err)
+	}
+	cleanup := func() { os.RemoveAll(tmpDir) }
+
+	tmpPath := filepath.Join(tmpDir, part.Name)
+	if part.Chunks > 0 {
+		err = downloadStreamChunks(v.context(), v.Uploader, v.BasePath, part.Name, part.Chunks, tmpPath)
+	} else {
+		err = v.Uploader.DownloadFile(v.context(), v.BasePath, part.Name, tmpPath)
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	return tmpPath, cleanup, nil
+}
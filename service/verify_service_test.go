@@ -0,0 +1,89 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"auto-backup/db"
+)
+
+func newVerifyInfo(b *BackupInfo) *VerifyInfo {
+	return &VerifyInfo{
+		ZipDir:   b.OutputDir,
+		Password: b.Password,
+		BackupID: filepath.Base(b.SrcDir),
+		Mode:     b.Mode,
+	}
+}
+
+func TestVerify_Pass(t *testing.T) {
+	b := newTestJob(t, map[string]string{
+		"a.txt":     "hello",
+		"dir/b.txt": strings.Repeat("backup ", 10000),
+	})
+	mustBackup(t, b)
+
+	report, err := newVerifyInfo(b).Verify()
+	if err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if report.Status != db.VerifyStatusPass || report.Checked != 2 || report.Failed != 0 {
+		t.Fatalf("Verify() = %s, checked %d, failed %d: %s", report.Status, report.Checked, report.Failed, report.Detail)
+	}
+}
+
+func TestVerify_CorruptPart(t *testing.T) {
+	b := newTestJob(t, map[string]string{"a.txt": strings.Repeat("0123456789", 10000)})
+	b.Password = ""
+	mustBackup(t, b)
+
+	run := lastRun(t, b)
+	parts, err := db.LoadBackupParts(run.ID)
+	if err != nil || len(parts) != 1 {
+		t.Fatalf("LoadBackupParts() = %d, %v", len(parts), err)
+	}
+	path := filepath.Join(b.OutputDir, parts[0].Name)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 破坏压缩数据的中间部分，读取时CRC校验失败
+	for i := len(data) / 3; i < len(data)/3+16; i++ {
+		data[i] ^= 0xff
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := newVerifyInfo(b).Verify()
+	if err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if report.Status != db.VerifyStatusFail || report.Failed == 0 {
+		t.Fatalf("Verify() = %s, failed %d, want fail", report.Status, report.Failed)
+	}
+}
+
+func TestVerify_MissingPart(t *testing.T) {
+	b := newTestJob(t, map[string]string{"a.txt": "hello"})
+	mustBackup(t, b)
+
+	parts, err := db.LoadBackupParts(lastRun(t, b).ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, part := range parts {
+		os.Remove(filepath.Join(b.OutputDir, part.Name))
+	}
+
+	// 本地没有分片且没有配置上传器时校验失败，不会中断
+	report, err := newVerifyInfo(b).Verify()
+	if err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if report.Status != db.VerifyStatusFail || !strings.Contains(report.Detail, "本地不存在分片") {
+		t.Fatalf("Verify() = %s: %s", report.Status, report.Detail)
+	}
+}
@@ -0,0 +1,284 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"auto-backup/db"
+	"auto-backup/log"
+	"auto-backup/utils"
+)
+
+const (
+	// 最后一次变化之后等待的时间，期间没有新的变化才开始备份
+	defaultWatchDebounce = 30 * time.Second
+	// 持续有变化时，第一次变化之后最多等待的时间
+	defaultWatchMaxDelay = 10 * time.Minute
+)
+
+// 与getFilesList相同的过滤规则：隐藏文件、排除列表中的文件及其所在目录下的所有文件都跳过
+func skipWatchPath(relPath string) bool {
+	for _, name := range strings.Split(relPath, string(filepath.Separator)) {
+		if name == "" {
+			continue
+		}
+		if name[0] == '.' || utils.ExcludedFiles[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// 在上一次备份的文件记录基础上重新检查指定的路径，返回完整的文件列表和需要比较的文件。
+// 不存在的路径及其下的所有记录会被移除，新建的目录会展开其中的所有文件
+func getChangedFilesList(ctx context.Context, srcDir, backupID string, paths []string) (map[string]FileInfo, map[string]FileInfo, error) {
+	records, err := db.LoadFileRecords(backupID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("获取上次备份的记录失败: %v", err)
+	}
+
+	files := make(map[string]FileInfo, len(records))
+	for _, r := range records {
+		files[r.Path] = FileInfo{Path: r.Path, ModTime: r.ModTime, Hash: r.Hash}
+	}
+
+	candidates := make(map[string]FileInfo)
+	for _, relPath := range paths {
+		fullPath := filepath.Join(srcDir, relPath)
+		info, err := os.Lstat(fullPath)
+		if errors.Is(err, fs.ErrNotExist) {
+			delete(files, relPath)
+			prefix := relPath + string(filepath.Separator)
+			for p := range files {
+				if strings.HasPrefix(p, prefix) {
+					delete(files, p)
+				}
+			}
+			continue
+		}
+		if err != nil {
+			log.Warn("获取文件信息失败: %s, %v", fullPath, err)
+			continue
+		}
+
+		if !info.IsDir() {
+			f := FileInfo{Path: relPath, ModTime: info.ModTime()}
+			if f.Hash, err = utils.QuickFileHash(fullPath); err != nil {
+				log.Warn("计算文件哈希失败: %s, %v", fullPath, err)
+				f.Hash = ""
+			}
+			files[relPath] = f
+			candidates[relPath] = f
+			continue
+		}
+
+		// 目录下的文件列表使用与完整备份相同的规则获取
+		sub, err := getFilesList(ctx, fullPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		dir := FileInfo{Path: relPath, ModTime: info.ModTime(), IsDir: true}
+		files[relPath] = dir
+		candidates[relPath] = dir
+		for p, f := range sub {
+			f.Path = filepath.Join(relPath, p)
+			files[f.Path] = f
+			candidates[f.Path] = f
+		}
+	}
+
+	return files, candidates, nil
+}
+
+// 监听源目录的变化，记录变化的路径，安静一段时间或达到最长等待时间后只备份这些路径
+type dirWatcher struct {
+	b     *BackupInfo
+	fw    *fsnotify.Watcher
+	dirty map[string]bool
+	full  bool // 事件队列溢出，可能丢失了变化，需要完整备份
+}
+
+// Watch 监听源目录，变化后自动执行增量备份，直到ctx结束
+func (b *BackupInfo) Watch(ctx context.Context) error {
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Error("创建文件监听失败: %v", err)
+		return fmt.Errorf("创建文件监听失败: %v", err)
+	}
+	defer fw.Close()
+
+	w := &dirWatcher{b: b, fw: fw, dirty: make(map[string]bool)}
+	if err := w.addTree(b.SrcDir, false); err != nil {
+		log.Error("监听目录失败: %v", err)
+		return fmt.Errorf("监听目录失败: %v", err)
+	}
+
+	debounce, maxDelay := b.WatchDebounce, b.WatchMaxDelay
+	if debounce <= 0 {
+		debounce = defaultWatchDebounce
+	}
+	if maxDelay <= 0 {
+		maxDelay = defaultWatchMaxDelay
+	}
+	log.Info("开始监听目录变化: %s, 安静%v或最长%v后备份", b.SrcDir, debounce, maxDelay)
+
+	quiet := time.NewTimer(debounce)
+	quiet.Stop()
+	var maxTimer *time.Timer
+	var maxC <-chan time.Time
+
+	// 有变化时重新开始等待安静期，第一次变化时开始计算最长等待时间
+	arm := func() {
+		if !quiet.Stop() {
+			select {
+			case <-quiet.C:
+			default:
+			}
+		}
+		quiet.Reset(debounce)
+		if maxTimer == nil {
+			maxTimer = time.NewTimer(maxDelay)
+			maxC = maxTimer.C
+		}
+	}
+
+	done := make(chan error, 1)
+	var running []string
+	var runningFull bool
+
+	trigger := func() {
+		if maxTimer != nil {
+			maxTimer.Stop()
+			maxTimer, maxC = nil, nil
+		}
+		if running != nil || (len(w.dirty) == 0 && !w.full) {
+			return
+		}
+
+		running = make([]string, 0, len(w.dirty))
+		for p := range w.dirty {
+			running = append(running, p)
+		}
+		runningFull = w.full
+		w.dirty = make(map[string]bool)
+		w.full = false
+
+		go func(paths []string, full bool) {
+			if full {
+				log.Info("文件变化事件溢出，执行完整备份")
+				done <- b.Backup(ctx)
+				return
+			}
+			log.Info("检测到%d个路径变化，开始备份", len(paths))
+			done <- b.BackupPaths(ctx, paths)
+		}(running, runningFull)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case ev, ok := <-fw.Events:
+			if !ok {
+				return nil
+			}
+			if w.handle(ev) {
+				arm()
+			}
+
+		case err, ok := <-fw.Errors:
+			if !ok {
+				return nil
+			}
+			log.Error("文件监听出错: %v", err)
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				w.full = true
+				arm()
+			}
+
+		case <-quiet.C:
+			trigger()
+
+		case <-maxC:
+			trigger()
+
+		case err := <-done:
+			// 失败(包括其他备份正在运行)时保留变化的路径，稍后重试
+			if err != nil {
+				log.Error("监听触发的备份失败: %v", err)
+				for _, p := range running {
+					w.dirty[p] = true
+				}
+				w.full = w.full || runningFull
+			}
+			running = nil
+			if len(w.dirty) > 0 || w.full {
+				arm()
+			}
+		}
+	}
+}
+
+// 处理一个文件事件，返回是否记录了变化
+func (w *dirWatcher) handle(ev fsnotify.Event) bool {
+	// 只修改权限不影响备份内容
+	if ev.Op == fsnotify.Chmod {
+		return false
+	}
+
+	relPath, err := filepath.Rel(w.b.SrcDir, ev.Name)
+	if err != nil || relPath == "." || skipWatchPath(relPath) {
+		return false
+	}
+
+	// 新建的目录需要加入监听，其中已有的文件也要备份
+	if ev.Has(fsnotify.Create) {
+		if info, err := os.Lstat(ev.Name); err == nil && info.IsDir() {
+			if err := w.addTree(ev.Name, true); err != nil {
+				log.Warn("监听新目录失败: %s, %v", ev.Name, err)
+			}
+		}
+	}
+
+	log.Debug("文件变化: %s %s", ev.Op, relPath)
+	w.dirty[relPath] = true
+	return true
+}
+
+// 监听目录及其所有子目录，mark为true时把其中的文件都记录为变化
+func (w *dirWatcher) addTree(root string, mark bool) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(w.b.SrcDir, path)
+		if err != nil {
+			return err
+		}
+		if relPath != "." && skipWatchPath(relPath) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if d.IsDir() {
+			if err := w.fw.Add(path); err != nil {
+				return fmt.Errorf("监听目录 %s 失败(可能需要增大fs.inotify.max_user_watches): %v", path, err)
+			}
+		}
+		if mark && relPath != "." {
+			w.dirty[relPath] = true
+		}
+		return nil
+	})
+}
@@ -0,0 +1,39 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// 监听触发的备份只传入变化的路径，仓库模式的快照仍然要包含所有文件
+func TestBackupPaths_RepositoryKeepsUnchangedFiles(t *testing.T) {
+	b := newTestJob(t, map[string]string{
+		"a.txt":     "first",
+		"dir/b.txt": "unchanged",
+		"c.txt":     "unchanged too",
+	})
+	b.Mode = ModeRepository
+	mustBackup(t, b)
+
+	time.Sleep(time.Second)
+	writeFiles(t, b.SrcDir, map[string]string{"a.txt": "second"})
+	if err := b.BackupPaths(context.Background(), []string{"a.txt"}); err != nil {
+		t.Fatalf("BackupPaths() error = %v", err)
+	}
+
+	got := restoreTree(t, b, lastRun(t, b).Timestamp, false)
+	want := map[string]string{
+		"a.txt":     "second",
+		"dir/b.txt": "unchanged",
+		"c.txt":     "unchanged too",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("restored files = %v, want %v", got, want)
+	}
+	for name, data := range want {
+		if got[name] != data {
+			t.Errorf("restored %s = %q, want %q", name, got[name], data)
+		}
+	}
+}
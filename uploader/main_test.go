@@ -0,0 +1,68 @@
+package uploader
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"auto-backup/db"
+)
+
+// 授权请求和令牌保存在工作目录下的config/backup.db，测试在临时目录中运行
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "auto-backup-uploader-")
+	if err != nil {
+		panic(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		panic(err)
+	}
+	if err := os.Mkdir("config", 0755); err != nil {
+		panic(err)
+	}
+	db.InitDB()
+
+	code := m.Run()
+
+	db.CloseDB()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// 把授权服务的请求转发到测试服务器，保留原来的路径
+type rewriteTransport struct {
+	target *url.URL
+}
+
+func (t rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = t.target.Scheme
+	req.URL.Host = t.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// 创建请求都发送到handler的上传器
+func newTestUploader(t *testing.T, authFlow string, handler http.Handler) *OneDriveUploader {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	target, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("url.Parse() error = %v", err)
+	}
+	return &OneDriveUploader{
+		config: &OneDriveConfig{
+			ClientID:     "client",
+			ClientSecret: "secret",
+			RedirectURI:  "http://localhost:8080/token",
+			Scope:        "Files.ReadWrite offline_access",
+			AuthFlow:     authFlow,
+		},
+		client: &http.Client{Transport: rewriteTransport{target: target}},
+		done:   make(chan bool, 1),
+		ctx:    context.Background(),
+	}
+}
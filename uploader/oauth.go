@@ -0,0 +1,289 @@
+package uploader
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"auto-backup/db"
+	"auto-backup/log"
+	"auto-backup/model"
+)
+
+const (
+	authorizeURL = "https://login.live.com/oauth20_authorize.srf"
+	// 授权请求的有效时间，超过后回调中的state不再接受
+	authAttemptTTL = 24 * time.Hour
+)
+
+// 生成n字节的随机数，编码为URL安全的字符串
+func randomString(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// 按RFC 7636的S256方式由校验码计算challenge
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// 生成并保存一次授权请求，同时清理过期的请求
+func newAuthAttempt() (*db.AuthAttempt, error) {
+	state, err := randomString(32)
+	if err != nil {
+		return nil, fmt.Errorf("生成state失败: %v", err)
+	}
+	verifier, err := randomString(32)
+	if err != nil {
+		return nil, fmt.Errorf("生成PKCE校验码失败: %v", err)
+	}
+
+	now := time.Now()
+	if err := db.DeleteExpiredAuthAttempts(now.Add(-authAttemptTTL)); err != nil {
+		return nil, fmt.Errorf("清理过期的授权请求失败: %v", err)
+	}
+	attempt := &db.AuthAttempt{State: state, Verifier: verifier, CreatedAt: now}
+	if err := db.SaveAuthAttempt(attempt); err != nil {
+		return nil, fmt.Errorf("保存授权请求失败: %v", err)
+	}
+	return attempt, nil
+}
+
+// OneDrive的认证方式
+const (
+	AuthFlowCode   = "code"   // 浏览器跳转到redirect_uri回调
+	AuthFlowDevice = "device" // 在任意设备的浏览器中输入设备代码，程序轮询令牌
+)
+
+const (
+	deviceCodeURL = "https://login.microsoftonline.com/common/oauth2/v2.0/devicecode"
+	// 轮询令牌的默认间隔，授权服务返回slow_down时增加5个单位
+	defaultDeviceInterval = 5
+	deviceSlowDownStep    = 5
+)
+
+// 授权服务返回的轮询间隔以秒为单位，测试中缩短
+var deviceIntervalUnit = time.Second
+
+// ParseAuthFlow 解析配置中的认证方式，空字符串使用code
+func ParseAuthFlow(s string) (string, error) {
+	switch s {
+	case "":
+		return AuthFlowCode, nil
+	case AuthFlowCode, AuthFlowDevice:
+		return s, nil
+	}
+	return "", fmt.Errorf("不支持的认证方式: %s", s)
+}
+
+// 设备代码接口的响应
+type deviceCodeResponse struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationURI string `json:"verification_uri"`
+	ExpiresIn       int64  `json:"expires_in"`
+	Interval        int64  `json:"interval"`
+	Message         string `json:"message"`
+
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// 使用设备代码认证的应用是公共客户端，令牌请求中不能带client_secret
+func (u *OneDriveUploader) publicClient() bool {
+	return u.config.AuthFlow == AuthFlowDevice
+}
+
+// 向令牌接口提交表单，授权服务返回错误时tokenResp中带有错误码
+func (u *OneDriveUploader) postTokenForm(ctx context.Context, formData url.Values) (*model.TokenResponse, int, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", tokenURL, strings.NewReader(formData.Encode()))
+	if err != nil {
+		return nil, 0, fmt.Errorf("创建请求失败: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("发送请求失败: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, resp.StatusCode, fmt.Errorf("读取响应内容失败: %v", err)
+	}
+	var tokenResp model.TokenResponse
+	if err := json.Unmarshal(body, &tokenResp); err != nil {
+		return nil, resp.StatusCode, fmt.Errorf("解析响应JSON失败: %v", err)
+	}
+	return &tokenResp, resp.StatusCode, nil
+}
+
+// 使用新获取的令牌并保存到auth_info
+func (u *OneDriveUploader) saveToken(tokenResp *model.TokenResponse) {
+	u.config.AccessToken = tokenResp.AccessToken
+	u.config.RefreshToken = tokenResp.RefreshToken
+	u.config.ExpireTime = time.Now().Add(time.Duration(tokenResp.ExpiresIn) * time.Second)
+
+	// 保存认证信息
+	db.SaveAuthInfo(&db.AuthInfo{
+		AccessToken:  u.config.AccessToken,
+		RefreshToken: u.config.RefreshToken,
+		ExpiresIn:    u.config.ExpireTime.Unix(),
+		UserID:       tokenResp.UserID,
+	})
+}
+
+// 申请新的设备代码
+func (u *OneDriveUploader) requestDeviceCode() (*deviceCodeResponse, error) {
+	formData := url.Values{
+		"client_id": {u.config.ClientID},
+		"scope":     {u.config.Scope},
+	}
+	req, err := http.NewRequestWithContext(u.ctx, "POST", deviceCodeURL, strings.NewReader(formData.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("创建请求失败: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("发送请求失败: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("读取响应内容失败: %v", err)
+	}
+	var codeResp deviceCodeResponse
+	if err := json.Unmarshal(body, &codeResp); err != nil {
+		return nil, fmt.Errorf("解析响应JSON失败: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || codeResp.DeviceCode == "" {
+		return nil, fmt.Errorf("获取设备代码失败(%d): %s %s", resp.StatusCode, codeResp.Error, codeResp.ErrorDescription)
+	}
+	return &codeResp, nil
+}
+
+// StartDeviceAuth 开始设备代码认证并在后台轮询令牌，已有未过期的设备代码时直接返回该代码
+func (u *OneDriveUploader) StartDeviceAuth() (*model.DeviceAuth, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.device != nil && u.device.ExpiresAt.After(time.Now()) {
+		auth := *u.device
+		return &auth, nil
+	}
+
+	codeResp, err := u.requestDeviceCode()
+	if err != nil {
+		log.Error("%v", err)
+		return nil, err
+	}
+	u.device = &model.DeviceAuth{
+		UserCode:        codeResp.UserCode,
+		VerificationURI: codeResp.VerificationURI,
+		ExpiresAt:       time.Now().Add(time.Duration(codeResp.ExpiresIn) * time.Second),
+		Message:         codeResp.Message,
+	}
+	go u.pollDeviceToken(codeResp, u.device)
+
+	auth := *u.device
+	return &auth, nil
+}
+
+// 结束设备代码认证，只清除仍然是当前代码的记录
+func (u *OneDriveUploader) finishDeviceAuth(auth *model.DeviceAuth) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.device == auth {
+		u.device = nil
+	}
+}
+
+// 按授权服务要求的间隔轮询令牌，直到用户完成授权、拒绝或代码过期。
+// 认证成功时返回nil，错误已经记录日志，后台轮询时可以忽略
+func (u *OneDriveUploader) pollDeviceToken(codeResp *deviceCodeResponse, auth *model.DeviceAuth) error {
+	defer u.finishDeviceAuth(auth)
+
+	interval := time.Duration(codeResp.Interval) * deviceIntervalUnit
+	if interval <= 0 {
+		interval = defaultDeviceInterval * deviceIntervalUnit
+	}
+	formData := url.Values{
+		"client_id":   {u.config.ClientID},
+		"device_code": {codeResp.DeviceCode},
+		"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+	}
+
+	for {
+		if err := sleepContext(u.ctx, interval); err != nil {
+			return err
+		}
+		if time.Now().After(auth.ExpiresAt) {
+			log.Warn("设备代码%s已过期", auth.UserCode)
+			return fmt.Errorf("设备代码%s已过期", auth.UserCode)
+		}
+
+		tokenResp, _, err := u.postTokenForm(u.ctx, formData)
+		if err != nil {
+			// 网络错误时继续轮询，直到代码过期
+			log.Warn("轮询令牌失败: %v", err)
+			continue
+		}
+		switch tokenResp.Error {
+		case "":
+			u.saveToken(tokenResp)
+			log.Info("设备代码认证成功, 过期时间: %s", u.config.ExpireTime.Format(time.RFC3339))
+			// 只有启动时的认证在等待通知，之后通过管理页面重新认证时没有接收方
+			select {
+			case u.done <- true:
+			default:
+			}
+			return nil
+		case "authorization_pending":
+		case "slow_down":
+			interval += deviceSlowDownStep * deviceIntervalUnit
+		default:
+			// authorization_declined、expired_token等错误不能继续轮询
+			log.Error("设备代码认证失败: %s %s", tokenResp.Error, tokenResp.ErrorDescription)
+			return fmt.Errorf("设备代码认证失败: %s %s", tokenResp.Error, tokenResp.ErrorDescription)
+		}
+	}
+}
+
+// 启动时的设备代码认证，代码过期后自动申请新的代码，直到认证成功或程序退出
+func (u *OneDriveUploader) waitDeviceAuth() error {
+	for {
+		auth, err := u.StartDeviceAuth()
+		if err != nil {
+			return err
+		}
+		log.Info("请先进行认证, 在任意设备的浏览器中打开下面的地址并输入代码 %s (有效期至 %s), 也可以在管理页面中点击认证:",
+			auth.UserCode, auth.ExpiresAt.Format(time.RFC3339))
+		fmt.Println(auth.VerificationURI)
+
+		expired := time.NewTimer(time.Until(auth.ExpiresAt) + time.Second)
+		select {
+		case <-u.done:
+			expired.Stop()
+			return nil
+		case <-expired.C:
+		case <-u.ctx.Done():
+			expired.Stop()
+			return u.ctx.Err()
+		}
+	}
+}
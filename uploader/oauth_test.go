@@ -0,0 +1,341 @@
+package uploader
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"auto-backup/db"
+	"auto-backup/model"
+)
+
+func TestPKCEChallenge(t *testing.T) {
+	// RFC 7636 附录B的测试向量
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	want := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+	if got := pkceChallenge(verifier); got != want {
+		t.Errorf("pkceChallenge() = %q, want %q", got, want)
+	}
+}
+
+func TestNewAuthAttempt(t *testing.T) {
+	a, err := newAuthAttempt()
+	if err != nil {
+		t.Fatalf("newAuthAttempt() error = %v", err)
+	}
+	b, err := newAuthAttempt()
+	if err != nil {
+		t.Fatalf("newAuthAttempt() error = %v", err)
+	}
+
+	// RFC 7636要求校验码为43到128个非保留字符
+	valid := regexp.MustCompile(`^[A-Za-z0-9._~-]{43,128}$`)
+	for _, s := range []string{a.State, a.Verifier, b.State, b.Verifier} {
+		if !valid.MatchString(s) {
+			t.Errorf("invalid random string %q", s)
+		}
+	}
+	if a.State == b.State || a.Verifier == b.Verifier {
+		t.Error("newAuthAttempt() returned repeated values")
+	}
+}
+
+// 模拟令牌接口，按授权地址中的code_challenge校验提交的code_verifier
+type codeServer struct {
+	mu        sync.Mutex
+	challenge string
+	requests  int
+}
+
+func (s *codeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	w.Header().Set("Content-Type", "application/json")
+	if r.URL.Path != "/common/oauth2/v2.0/token" || r.FormValue("grant_type") != "authorization_code" ||
+		r.FormValue("code") != "auth-code" || pkceChallenge(r.FormValue("code_verifier")) != s.challenge {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(model.TokenResponse{Error: "invalid_grant"})
+		return
+	}
+	json.NewEncoder(w).Encode(model.TokenResponse{AccessToken: "access", RefreshToken: "refresh", ExpiresIn: 3600})
+}
+
+// 生成授权地址，返回其中的state并记录code_challenge
+func authURLState(t *testing.T, u *OneDriveUploader, srv *codeServer) string {
+	t.Helper()
+	authURL, err := u.GetAuthUrl()
+	if err != nil {
+		t.Fatalf("GetAuthUrl() error = %v", err)
+	}
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("url.Parse() error = %v", err)
+	}
+	query := parsed.Query()
+	if query.Get("code_challenge_method") != "S256" {
+		t.Fatalf("code_challenge_method = %q, want S256", query.Get("code_challenge_method"))
+	}
+	if query.Get("state") == "" || query.Get("code_challenge") == "" {
+		t.Fatalf("auth url %s has no state or code_challenge", authURL)
+	}
+	srv.mu.Lock()
+	srv.challenge = query.Get("code_challenge")
+	srv.mu.Unlock()
+	return query.Get("state")
+}
+
+func TestExchangeCode(t *testing.T) {
+	srv := &codeServer{}
+	u := newTestUploader(t, AuthFlowCode, srv)
+	state := authURLState(t, u, srv)
+
+	if err := u.exchangeCode("auth-code", state); err != nil {
+		t.Fatalf("exchangeCode() error = %v", err)
+	}
+	if u.config.AccessToken != "access" || u.config.RefreshToken != "refresh" {
+		t.Errorf("token = %q/%q, want access/refresh", u.config.AccessToken, u.config.RefreshToken)
+	}
+	info, err := db.LoadAuthInfo()
+	if err != nil || info == nil || info.AccessToken != "access" {
+		t.Errorf("LoadAuthInfo() = %+v, %v, want saved token", info, err)
+	}
+
+	// state只能使用一次，重复的回调不会再次请求令牌
+	if err := u.exchangeCode("auth-code", state); err == nil {
+		t.Error("exchangeCode() with used state succeeded")
+	}
+	if srv.requests != 1 {
+		t.Errorf("token requests = %d, want 1", srv.requests)
+	}
+}
+
+func TestExchangeCode_RejectsState(t *testing.T) {
+	srv := &codeServer{}
+	u := newTestUploader(t, AuthFlowCode, srv)
+	authURLState(t, u, srv)
+
+	expired := &db.AuthAttempt{State: "expired-state", Verifier: "verifier", CreatedAt: time.Now().Add(-authAttemptTTL - time.Minute)}
+	if err := db.SaveAuthAttempt(expired); err != nil {
+		t.Fatalf("SaveAuthAttempt() error = %v", err)
+	}
+
+	for _, state := range []string{"", "unknown-state", expired.State} {
+		err := u.exchangeCode("auth-code", state)
+		if err == nil || !strings.Contains(err.Error(), "不存在或已过期") {
+			t.Errorf("exchangeCode(%q) error = %v, want expired error", state, err)
+		}
+	}
+	if srv.requests != 0 {
+		t.Errorf("token requests = %d, want 0", srv.requests)
+	}
+}
+
+func TestExchangeCode_WrongVerifier(t *testing.T) {
+	srv := &codeServer{}
+	u := newTestUploader(t, AuthFlowCode, srv)
+	authURLState(t, u, srv)
+
+	// 另一次授权请求的state对应不同的校验码，令牌接口拒绝
+	other, err := newAuthAttempt()
+	if err != nil {
+		t.Fatalf("newAuthAttempt() error = %v", err)
+	}
+	if err := u.exchangeCode("auth-code", other.State); err == nil {
+		t.Error("exchangeCode() with mismatched verifier succeeded")
+	}
+}
+
+// 模拟设备代码的令牌接口，依次返回responses中的错误码，用完后返回令牌
+type deviceServer struct {
+	mu        sync.Mutex
+	responses []string
+	times     []time.Time
+	forms     []url.Values
+	onRequest func(n int)
+}
+
+func (s *deviceServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	s.mu.Lock()
+	s.times = append(s.times, time.Now())
+	s.forms = append(s.forms, r.PostForm)
+	n := len(s.times)
+	var code string
+	if n <= len(s.responses) {
+		code = s.responses[n-1]
+	}
+	onRequest := s.onRequest
+	s.mu.Unlock()
+	if onRequest != nil {
+		onRequest(n)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if code != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(model.TokenResponse{Error: code})
+		return
+	}
+	json.NewEncoder(w).Encode(model.TokenResponse{AccessToken: "device-access", RefreshToken: "device-refresh", ExpiresIn: 3600})
+}
+
+func (s *deviceServer) requests() []time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]time.Time(nil), s.times...)
+}
+
+func setDeviceIntervalUnit(t *testing.T, unit time.Duration) {
+	t.Helper()
+	old := deviceIntervalUnit
+	deviceIntervalUnit = unit
+	t.Cleanup(func() { deviceIntervalUnit = old })
+}
+
+// 以当前设备代码的身份开始轮询
+func pollDevice(u *OneDriveUploader, interval int64) error {
+	auth := &model.DeviceAuth{UserCode: "USER-CODE", ExpiresAt: time.Now().Add(time.Minute)}
+	u.device = auth
+	return u.pollDeviceToken(&deviceCodeResponse{DeviceCode: "device-code", Interval: interval}, auth)
+}
+
+func TestPollDeviceToken_Pending(t *testing.T) {
+	setDeviceIntervalUnit(t, 10*time.Millisecond)
+	srv := &deviceServer{responses: []string{"authorization_pending", "authorization_pending"}}
+	u := newTestUploader(t, AuthFlowDevice, srv)
+
+	if err := pollDevice(u, 1); err != nil {
+		t.Fatalf("pollDeviceToken() error = %v", err)
+	}
+	if n := len(srv.requests()); n != 3 {
+		t.Errorf("token requests = %d, want 3", n)
+	}
+	if u.config.AccessToken != "device-access" {
+		t.Errorf("AccessToken = %q, want device-access", u.config.AccessToken)
+	}
+	select {
+	case <-u.done:
+	default:
+		t.Error("done was not notified")
+	}
+	if u.device != nil {
+		t.Error("device code was not cleared")
+	}
+
+	// 公共客户端的令牌请求不带client_secret
+	form := srv.forms[0]
+	if form.Get("device_code") != "device-code" || form.Get("grant_type") != "urn:ietf:params:oauth:grant-type:device_code" {
+		t.Errorf("token form = %v", form)
+	}
+	if form.Has("client_secret") {
+		t.Error("token form contains client_secret")
+	}
+}
+
+func TestPollDeviceToken_SlowDown(t *testing.T) {
+	unit := 20 * time.Millisecond
+	setDeviceIntervalUnit(t, unit)
+	srv := &deviceServer{responses: []string{"authorization_pending", "slow_down", "authorization_pending"}}
+	u := newTestUploader(t, AuthFlowDevice, srv)
+
+	start := time.Now()
+	if err := pollDevice(u, 1); err != nil {
+		t.Fatalf("pollDeviceToken() error = %v", err)
+	}
+
+	times := srv.requests()
+	if len(times) != 4 {
+		t.Fatalf("token requests = %d, want 4", len(times))
+	}
+	if gap := times[0].Sub(start); gap < unit {
+		t.Errorf("first request after %v, want >= %v", gap, unit)
+	}
+	// slow_down之后的每次轮询间隔都增加5个单位
+	slow := (1 + deviceSlowDownStep) * unit
+	for i := 2; i < len(times); i++ {
+		if gap := times[i].Sub(times[i-1]); gap < slow {
+			t.Errorf("gap before request %d = %v, want >= %v", i+1, gap, slow)
+		}
+	}
+}
+
+func TestPollDeviceToken_ExpiredToken(t *testing.T) {
+	setDeviceIntervalUnit(t, 10*time.Millisecond)
+	srv := &deviceServer{responses: []string{"authorization_pending", "expired_token"}}
+	u := newTestUploader(t, AuthFlowDevice, srv)
+
+	err := pollDevice(u, 1)
+	if err == nil || !strings.Contains(err.Error(), "expired_token") {
+		t.Fatalf("pollDeviceToken() error = %v, want expired_token", err)
+	}
+	if n := len(srv.requests()); n != 2 {
+		t.Errorf("token requests = %d, want 2", n)
+	}
+	if u.config.AccessToken != "" {
+		t.Errorf("AccessToken = %q, want empty", u.config.AccessToken)
+	}
+	select {
+	case <-u.done:
+		t.Error("done was notified after failure")
+	default:
+	}
+	if u.device != nil {
+		t.Error("device code was not cleared")
+	}
+}
+
+func TestPollDeviceToken_CodeExpired(t *testing.T) {
+	setDeviceIntervalUnit(t, 10*time.Millisecond)
+	srv := &deviceServer{}
+	u := newTestUploader(t, AuthFlowDevice, srv)
+
+	// 设备代码在等待期间过期，不再请求令牌
+	auth := &model.DeviceAuth{UserCode: "USER-CODE", ExpiresAt: time.Now()}
+	u.device = auth
+	if err := u.pollDeviceToken(&deviceCodeResponse{DeviceCode: "device-code", Interval: 1}, auth); err == nil {
+		t.Fatal("pollDeviceToken() succeeded with expired code")
+	}
+	if n := len(srv.requests()); n != 0 {
+		t.Errorf("token requests = %d, want 0", n)
+	}
+}
+
+func TestPollDeviceToken_Cancel(t *testing.T) {
+	setDeviceIntervalUnit(t, 10*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pending := make([]string, 100)
+	for i := range pending {
+		pending[i] = "authorization_pending"
+	}
+	srv := &deviceServer{responses: pending, onRequest: func(n int) {
+		if n == 2 {
+			cancel()
+		}
+	}}
+	u := newTestUploader(t, AuthFlowDevice, srv)
+	u.ctx = ctx
+
+	start := time.Now()
+	err := pollDevice(u, 1)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("pollDeviceToken() error = %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("pollDeviceToken() took %v after cancel", elapsed)
+	}
+	if n := len(srv.requests()); n != 2 {
+		t.Errorf("token requests = %d, want 2", n)
+	}
+	if u.device != nil {
+		t.Error("device code was not cleared")
+	}
+}
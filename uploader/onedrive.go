@@ -4,10 +4,12 @@ import (
 	"auto-backup/db"
 	"auto-backup/log"
 	"auto-backup/model"
+	"auto-backup/utils"
 	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"hash"
 	"io"
 	"net/http"
 	"net/url"
@@ -15,15 +17,19 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 const ( // 替换为你要上传的文件路径
-	uploadURLTemplate = "https://graph.microsoft.com/v1.0/me/drive/root:/%s/%s:/createUploadSession" // 替换为目标路径
-	chunkSize         = 8 * 1024 * 1024                                                              // 每块大小设置为 8MB
-	maxRetries        = 3
-	retryDelay        = 5 * time.Second
-	tokenURL          = "https://login.microsoftonline.com/common/oauth2/v2.0/token"
+	uploadURLTemplate   = "https://graph.microsoft.com/v1.0/me/drive/root:/%s/%s:/createUploadSession" // 替换为目标路径
+	downloadURLTemplate = "https://graph.microsoft.com/v1.0/me/drive/root:/%s/%s:/content"
+	itemURLTemplate     = "https://graph.microsoft.com/v1.0/me/drive/items/%s"
+	fileURLTemplate     = "https://graph.microsoft.com/v1.0/me/drive/root:/%s/%s"
+	chunkSize           = 8 * 1024 * 1024 // 每块大小设置为 8MB
+	maxRetries          = 3
+	retryDelay          = 5 * time.Second
+	tokenURL            = "https://login.microsoftonline.com/common/oauth2/v2.0/token"
 )
 
 // OneDriveConfig OneDrive配置
@@ -32,6 +38,7 @@ type OneDriveConfig struct {
 	ClientSecret string
 	RedirectURI  string
 	Scope        string
+	AuthFlow     string // 认证方式: AuthFlowCode 或 AuthFlowDevice
 	AccessToken  string
 	RefreshToken string
 	ExpireTime   time.Time
@@ -41,6 +48,26 @@ type UploadSession struct {
 	UploadURL string `json:"uploadUrl"`
 }
 
+// DriveItem 上传完成后返回的文件信息
+type DriveItem struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	File *struct {
+		Hashes struct {
+			QuickXorHash string `json:"quickXorHash"`
+		} `json:"hashes"`
+	} `json:"file"`
+}
+
+// QuickXorHash 返回远端计算的quickXorHash，不存在时返回空字符串
+func (d *DriveItem) QuickXorHash() string {
+	if d.File == nil {
+		return ""
+	}
+	return d.File.Hashes.QuickXorHash
+}
+
 // OneDriveUploader OneDrive上传实现
 type OneDriveUploader struct {
 	config *OneDriveConfig
@@ -48,6 +75,9 @@ type OneDriveUploader struct {
 	action chan model.TokenAction // 用于用于toke操作通知
 	done   chan bool              //用于通知主进程完成认证，可以继续
 	ctx    context.Context
+
+	mu     sync.Mutex
+	device *model.DeviceAuth // 正在等待用户输入的设备代码
 }
 
 func NewOneDriveUploader(config *OneDriveConfig, action chan model.TokenAction, done chan bool, ctx context.Context) (*OneDriveUploader, error) {
@@ -70,14 +100,29 @@ func NewOneDriveUploader(config *OneDriveConfig, action chan model.TokenAction,
 	return onedriveUploader, nil
 }
 
-func (u *OneDriveUploader) GetAuthUrl() string {
-	return fmt.Sprintf("https://login.live.com/oauth20_authorize.srf?client_id=%s&scope=%s&response_type=code&redirect_uri=%s",
-		u.config.ClientID,
-		u.config.Scope,
-		u.config.RedirectURI)
+// GetAuthUrl 生成授权地址，每次调用生成新的state和PKCE校验码并保存到数据库，回调时校验
+func (u *OneDriveUploader) GetAuthUrl() (string, error) {
+	attempt, err := newAuthAttempt()
+	if err != nil {
+		log.Error("%v", err)
+		return "", err
+	}
+
+	query := url.Values{
+		"client_id":             {u.config.ClientID},
+		"scope":                 {u.config.Scope},
+		"response_type":         {"code"},
+		"redirect_uri":          {u.config.RedirectURI},
+		"state":                 {attempt.State},
+		"code_challenge":        {pkceChallenge(attempt.Verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	return authorizeURL + "?" + query.Encode(), nil
 }
 
-func (u *OneDriveUploader) DoAuthInit() {
+// DoAuthInit 加载保存的认证信息，无效时等待用户完成认证。
+// 使用授权回调但没有接收回调的HTTP服务时(例如命令行子命令)返回错误，不再等待
+func (u *OneDriveUploader) DoAuthInit() error {
 	// 加载认证信息
 	authInfo, err := db.LoadAuthInfo()
 	needAuth := false
@@ -86,22 +131,45 @@ func (u *OneDriveUploader) DoAuthInit() {
 		log.Error("加载认证信息失败: %v\n", err)
 		needAuth = true
 	} else if authInfo.ExpiresIn < time.Now().Unix() {
+		// 访问令牌过期时先用刷新令牌获取新的令牌
+		u.SetAuthInfo(authInfo)
+		if authInfo.RefreshToken != "" && u.RefreshAccessToken() == nil {
+			return nil
+		}
 		log.Info("认证信息已过期, 请重新认证")
 		needAuth = true
 	}
 
-	if needAuth {
-		log.Info("请先进行认证, 将下面的URL复制到浏览器中进行认证:")
-		fmt.Println(u.GetAuthUrl())
+	if needAuth && u.config.AuthFlow == AuthFlowDevice {
+		if err := u.waitDeviceAuth(); err != nil {
+			log.Error("设备代码认证失败: %v", err)
+			return fmt.Errorf("设备代码认证失败: %v", err)
+		}
+		if authInfo, err = db.LoadAuthInfo(); err != nil {
+			log.Error("重新加载认证信息失败: %v", err)
+			return fmt.Errorf("重新加载认证信息失败: %v", err)
+		}
+	} else if needAuth {
+		if u.action == nil {
+			return fmt.Errorf("没有接收授权回调的HTTP服务，请先在后台程序中完成认证")
+		}
+		authURL, err := u.GetAuthUrl()
+		if err != nil {
+			log.Error("生成授权地址失败: %v", err)
+			return fmt.Errorf("生成授权地址失败: %v", err)
+		}
+		log.Info("请先进行认证, 将下面的URL复制到浏览器中进行认证, 也可以在管理页面中点击认证:")
+		fmt.Println(authURL)
 		<-u.done
 		// 重新加载认证信息
 		if authInfo, err = db.LoadAuthInfo(); err != nil {
 			log.Error("重新加载认证信息失败: %v", err)
-			return
+			return fmt.Errorf("重新加载认证信息失败: %v", err)
 		}
 	}
 
 	u.SetAuthInfo(authInfo)
+	return nil
 }
 
 // 启动定时器刷新token
@@ -132,13 +200,20 @@ func (u *OneDriveUploader) startTokenHandler() {
 			select {
 			case act := <-u.action:
 				if act.Action == "getToken" {
-					err := u.GetAccessTokenByCode(act.Code)
+					err := u.exchangeCode(act.Code, act.State)
+					if act.Result != nil {
+						act.Result <- err
+					}
 					if err != nil {
 						log.Error("获取访问令牌失败: %v", err)
 						continue
 					}
 					log.Info("认证成功, 可以进行备份")
-					u.done <- true
+					// 只有启动时的认证在等待通知，之后通过管理页面重新认证时没有接收方
+					select {
+					case u.done <- true:
+					default:
+					}
 				} else if act.Action == "refreshToken" {
 					err := u.RefreshAccessToken()
 					if err != nil {
@@ -162,59 +237,43 @@ func (u *OneDriveUploader) SetAuthInfo(authInfo *db.AuthInfo) {
 	u.config.ExpireTime = time.Unix(authInfo.ExpiresIn, 0)
 }
 
-func (u *OneDriveUploader) GetAccessTokenByCode(code string) error {
+// 校验回调中的state，使用对应授权请求的PKCE校验码换取令牌
+func (u *OneDriveUploader) exchangeCode(code, state string) error {
+	attempt, err := db.TakeAuthAttempt(state, time.Now().Add(-authAttemptTTL))
+	if err != nil {
+		return fmt.Errorf("加载授权请求失败: %v", err)
+	}
+	if attempt == nil {
+		return fmt.Errorf("授权请求不存在或已过期，请重新发起认证")
+	}
+	return u.GetAccessTokenByCode(code, attempt.Verifier)
+}
+
+// GetAccessTokenByCode 使用授权码和PKCE校验码换取令牌
+func (u *OneDriveUploader) GetAccessTokenByCode(code, verifier string) error {
 	// 构建请求参数
 	formData := url.Values{
 		"client_id":     {u.config.ClientID},
 		"redirect_uri":  {u.config.RedirectURI},
 		"client_secret": {u.config.ClientSecret},
 		"code":          {code},
+		"code_verifier": {verifier},
 		"grant_type":    {"authorization_code"},
 	}
 
-	req, err := http.NewRequest("POST", tokenURL, bytes.NewBufferString(formData.Encode()))
-	if err != nil {
-		log.Error("创建请求失败: %v", err)
-		return err
-	}
-
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	resp, err := u.client.Do(req)
-	if err != nil {
-		log.Error("发送请求失败: %v", err)
-		return err
-	}
-
-	defer resp.Body.Close()
-
-	// 读取响应内容
-	body, err := io.ReadAll(resp.Body)
+	tokenResp, status, err := u.postTokenForm(u.ctx, formData)
 	if err != nil {
-		log.Error("读取响应内容失败: %v", err)
+		log.Error("%v", err)
 		return err
 	}
-
-	// 解析响应JSON
-	var tokenResp model.TokenResponse
-	if err := json.Unmarshal(body, &tokenResp); err != nil {
-		log.Error("解析响应JSON失败: %v", err)
-		return err
+	if status != http.StatusOK || tokenResp.AccessToken == "" {
+		log.Error("获取token失败，状态码: %d, 错误: %s %s", status, tokenResp.Error, tokenResp.ErrorDescription)
+		return fmt.Errorf("获取token失败(%d): %s %s", status, tokenResp.Error, tokenResp.ErrorDescription)
 	}
 
-	u.config.AccessToken = tokenResp.AccessToken
-	u.config.RefreshToken = tokenResp.RefreshToken
-	u.config.ExpireTime = time.Now().Add(time.Duration(tokenResp.ExpiresIn) * time.Second)
-
-	// 保存认证信息
-	db.SaveAuthInfo(&db.AuthInfo{
-		AccessToken:  u.config.AccessToken,
-		RefreshToken: u.config.RefreshToken,
-		ExpiresIn:    u.config.ExpireTime.Unix(),
-		UserID:       tokenResp.UserID,
-	})
+	u.saveToken(tokenResp)
 
-	log.Info("认证成功: code: %s, 过期时间: %s", code, u.config.ExpireTime.Format(time.RFC3339))
+	log.Info("认证成功, 过期时间: %s", u.config.ExpireTime.Format(time.RFC3339))
 
 	return nil
 }
@@ -229,6 +288,10 @@ func (u *OneDriveUploader) RefreshAccessToken() error {
 		"refresh_token": {u.config.RefreshToken},
 		"grant_type":    {"refresh_token"},
 	}
+	if u.publicClient() {
+		formData.Del("client_secret")
+		formData.Del("redirect_uri")
+	}
 
 	req, err := http.NewRequest("POST", tokenURL, bytes.NewBufferString(formData.Encode()))
 	if err != nil {
@@ -281,7 +344,7 @@ func (u *OneDriveUploader) RefreshAccessToken() error {
 }
 
 // 创建上传会话
-func (u *OneDriveUploader) createUploadSession(uploadURL string) (*UploadSession, error) {
+func (u *OneDriveUploader) createUploadSession(ctx context.Context, uploadURL string) (*UploadSession, error) {
 	payload := map[string]interface{}{
 		"item": map[string]string{
 			"@microsoft.graph.conflictBehavior": "rename", // 如果文件已存在，重命名
@@ -289,7 +352,7 @@ func (u *OneDriveUploader) createUploadSession(uploadURL string) (*UploadSession
 	}
 
 	payloadBytes, _ := json.Marshal(payload)
-	req, err := http.NewRequest("POST", uploadURL, bytes.NewReader(payloadBytes))
+	req, err := http.NewRequestWithContext(ctx, "POST", uploadURL, bytes.NewReader(payloadBytes))
 	if err != nil {
 		log.Error("创建请求失败: %v", err)
 		return nil, err
@@ -321,28 +384,17 @@ func (u *OneDriveUploader) createUploadSession(uploadURL string) (*UploadSession
 	return &session, nil
 }
 
-// 分块上传文件
-func (u *OneDriveUploader) uploadFileChunks(session *UploadSession, localFilePath string) error {
-	file, err := os.Open(localFilePath)
-	if err != nil {
-		log.Error("无法打开文件: %v", err)
-		return fmt.Errorf("无法打开文件: %w", err)
-	}
-	defer file.Close()
-
-	fileInfo, err := file.Stat()
-	if err != nil {
-		log.Error("无法获取文件信息: %v", err)
-		return fmt.Errorf("无法获取文件信息: %w", err)
-	}
-	fileSize := fileInfo.Size()
-
-	client := &http.Client{
-		Timeout: 30 * time.Second, // 添加超时设置
-	}
+// 分块上传数据，同时按顺序把已发送的数据写入hasher，返回上传完成后的driveItem
+func (u *OneDriveUploader) uploadFileChunks(ctx context.Context, session *UploadSession, file io.ReaderAt, fileSize int64, hasher hash.Hash) (*DriveItem, error) {
+	// 已写入hasher的字节数，重试时同一块数据只计算一次
+	var hashed int64
 
 	start := int64(0)
 	for {
+		// 暂停时在上传下一块之前等待
+		if err := utils.WaitIfPaused(ctx); err != nil {
+			return nil, err
+		}
 		end := start + chunkSize - 1
 		if end >= fileSize {
 			end = fileSize - 1
@@ -355,28 +407,43 @@ func (u *OneDriveUploader) uploadFileChunks(session *UploadSession, localFilePat
 			_, err := file.ReadAt(chunk, start)
 			if err != nil && err != io.EOF {
 				log.Error("读取文件块失败: %v", err)
-				return fmt.Errorf("读取文件块失败: %w", err)
+				return nil, fmt.Errorf("读取文件块失败: %w", err)
 			}
 
-			req, err := http.NewRequest("PUT", session.UploadURL, bytes.NewReader(chunk))
+			// 服务端跳过的数据直接从文件补算，保证哈希按顺序覆盖整个文件
+			if start > hashed {
+				if _, err := io.Copy(hasher, io.NewSectionReader(file, hashed, start-hashed)); err != nil {
+					return nil, fmt.Errorf("计算文件哈希失败: %w", err)
+				}
+				hashed = start
+			}
+			if end+1 > hashed {
+				hasher.Write(chunk[hashed-start:])
+				hashed = end + 1
+			}
+
+			req, err := http.NewRequestWithContext(ctx, "PUT", session.UploadURL, bytes.NewReader(chunk))
 			if err != nil {
 				log.Error("创建请求失败: %v", err)
-				return fmt.Errorf("创建请求失败: %w", err)
+				return nil, fmt.Errorf("创建请求失败: %w", err)
 			}
 
 			contentRange := fmt.Sprintf("bytes %d-%d/%d", start, end, fileSize)
 			req.Header.Set("Content-Range", contentRange)
 			req.Header.Set("Content-Length", fmt.Sprintf("%d", len(chunk)))
 
-			resp, err := client.Do(req)
+			resp, err := u.client.Do(req)
 			if err != nil {
+				// 取消后不再重试
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
 				retryCount++
-				if retryCount < maxRetries {
-					time.Sleep(retryDelay)
+				if retryCount < maxRetries && sleepContext(ctx, retryDelay) == nil {
 					continue
 				}
 				log.Error("上传块失败: %v", err)
-				return fmt.Errorf("上传块失败: %w", err)
+				return nil, fmt.Errorf("上传块失败: %w", err)
 			}
 
 			body, _ := io.ReadAll(resp.Body)
@@ -385,11 +452,15 @@ func (u *OneDriveUploader) uploadFileChunks(session *UploadSession, localFilePat
 			// 处理响应
 			if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated {
 				log.Info("文件上传完成: %d/%d 字节", end+1, fileSize)
-				return nil
+				var item DriveItem
+				if err := json.Unmarshal(body, &item); err != nil {
+					return nil, fmt.Errorf("解析响应失败: %w", err)
+				}
+				return &item, nil
 			} else if resp.StatusCode == http.StatusAccepted {
 				var serverResponse map[string]interface{}
 				if err := json.Unmarshal(body, &serverResponse); err != nil {
-					return fmt.Errorf("解析响应失败: %w", err)
+					return nil, fmt.Errorf("解析响应失败: %w", err)
 				}
 
 				// 更新上传进度
@@ -404,12 +475,11 @@ func (u *OneDriveUploader) uploadFileChunks(session *UploadSession, localFilePat
 				}
 			} else {
 				retryCount++
-				if retryCount < maxRetries {
-					time.Sleep(retryDelay)
+				if retryCount < maxRetries && sleepContext(ctx, retryDelay) == nil {
 					continue
 				}
 				log.Error("上传块失败，状态码: %d，响应: %s", resp.StatusCode, string(body))
-				return fmt.Errorf("上传块失败，状态码: %d，响应: %s", resp.StatusCode, string(body))
+				return nil, fmt.Errorf("上传块失败，状态码: %d，响应: %s", resp.StatusCode, string(body))
 			}
 		}
 
@@ -418,21 +488,38 @@ func (u *OneDriveUploader) uploadFileChunks(session *UploadSession, localFilePat
 		}
 	}
 
-	return nil
+	return nil, fmt.Errorf("上传结束但未收到完成响应")
 }
 
-func (u *OneDriveUploader) UploadBigFile(folderPath, localFilePath string) error {
+func (u *OneDriveUploader) UploadBigFile(ctx context.Context, folderPath, localFilePath string) error {
 
 	log.Info("开始上传文件: %s", localFilePath)
 
+	file, err := os.Open(localFilePath)
+	if err != nil {
+		log.Error("无法打开文件: %v", err)
+		return fmt.Errorf("无法打开文件: %w", err)
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		log.Error("无法获取文件信息: %v", err)
+		return fmt.Errorf("无法获取文件信息: %w", err)
+	}
+
 	// 从文件路径中获取文件名
-	fileName := filepath.Base(localFilePath)
+	return u.UploadReader(ctx, folderPath, filepath.Base(localFilePath), file, fileInfo.Size())
+}
+
+// UploadReader 通过上传会话上传数据，完成后校验远端哈希
+func (u *OneDriveUploader) UploadReader(ctx context.Context, folderPath, fileName string, r io.ReaderAt, size int64) error {
 	uploadURL := fmt.Sprintf(uploadURLTemplate, folderPath, fileName)
 
 	log.Info("上传URL: %s", uploadURL)
 
 	// Step 1: 获取上传会话
-	uploadSession, err := u.createUploadSession(uploadURL)
+	uploadSession, err := u.createUploadSession(ctx, uploadURL)
 	if err != nil {
 		log.Error("创建上传会话失败: %v", err)
 		return err
@@ -441,9 +528,19 @@ func (u *OneDriveUploader) UploadBigFile(folderPath, localFilePath string) error
 	log.Info("上传会话: %v", uploadSession)
 
 	// Step 2: 分块上传文件
-	err = u.uploadFileChunks(uploadSession, localFilePath)
+	hasher := utils.NewQuickXorHash()
+	item, err := u.uploadFileChunks(ctx, uploadSession, r, size, hasher)
 	if err != nil {
 		log.Error("分块上传文件失败: %v", err)
+		// 取消未完成的上传会话，释放远端已接收的数据
+		u.cancelUploadSession(uploadSession)
+		return err
+	}
+
+	// Step 3: 校验远端文件哈希
+	err = u.verifyUploadedItem(ctx, item, utils.QuickXorHashString(hasher))
+	if err != nil {
+		log.Error("校验远端文件失败: %v", err)
 		return err
 	}
 
@@ -451,3 +548,200 @@ func (u *OneDriveUploader) UploadBigFile(folderPath, localFilePath string) error
 
 	return nil
 }
+
+// 取消上传会话请求的超时时间
+const cancelSessionTimeout = 10 * time.Second
+
+// 删除上传会话，ctx已经取消时仍然需要发送请求
+func (u *OneDriveUploader) cancelUploadSession(session *UploadSession) {
+	ctx, cancel := context.WithTimeout(context.Background(), cancelSessionTimeout)
+	defer cancel()
+
+	// 上传会话的URL自带授权，不需要Authorization头
+	req, err := http.NewRequestWithContext(ctx, "DELETE", session.UploadURL, nil)
+	if err != nil {
+		log.Warn("创建请求失败: %v", err)
+		return
+	}
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		log.Warn("取消上传会话失败: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		log.Warn("取消上传会话失败，状态码: %d，响应: %s", resp.StatusCode, string(body))
+		return
+	}
+	log.Info("已取消上传会话")
+}
+
+// 等待d，ctx取消时提前返回错误
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// 比较本地计算的quickXorHash和远端driveItem中的哈希，不一致时删除远端文件
+func (u *OneDriveUploader) verifyUploadedItem(ctx context.Context, item *DriveItem, localHash string) error {
+	remoteHash := item.QuickXorHash()
+
+	// 上传完成的响应中可能还没有哈希，稍后重新获取
+	for retry := 0; remoteHash == "" && retry < maxRetries; retry++ {
+		if retry > 0 {
+			if err := sleepContext(ctx, retryDelay); err != nil {
+				return err
+			}
+		}
+		latest, err := u.getItem(ctx, item.ID)
+		if err != nil {
+			return err
+		}
+		remoteHash = latest.QuickXorHash()
+	}
+
+	if remoteHash == "" {
+		return fmt.Errorf("无法获取远端文件哈希: %s", item.Name)
+	}
+
+	if remoteHash != localHash {
+		log.Error("远端文件哈希不一致: %s, 本地: %s, 远端: %s", item.Name, localHash, remoteHash)
+		if err := u.deleteItem(ctx, item.ID); err != nil {
+			log.Warn("删除远端文件失败: %v", err)
+		}
+		return fmt.Errorf("%w: %s", utils.ErrHashMismatch, item.Name)
+	}
+
+	log.Info("远端文件哈希校验通过: %s, %s", item.Name, remoteHash)
+
+	return nil
+}
+
+// 获取driveItem信息
+func (u *OneDriveUploader) getItem(ctx context.Context, itemID string) (*DriveItem, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf(itemURLTemplate, itemID), nil)
+	if err != nil {
+		log.Error("创建请求失败: %v", err)
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+u.config.AccessToken)
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		log.Error("发送请求失败: %v", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("获取文件信息失败，状态码: %d，响应: %s", resp.StatusCode, string(body))
+	}
+
+	var item DriveItem
+	if err := json.NewDecoder(resp.Body).Decode(&item); err != nil {
+		log.Error("解析响应JSON失败: %v", err)
+		return nil, err
+	}
+
+	return &item, nil
+}
+
+// 删除driveItem
+func (u *OneDriveUploader) deleteItem(ctx context.Context, itemID string) error {
+	return u.deleteURL(ctx, fmt.Sprintf(itemURLTemplate, itemID))
+}
+
+// DeleteFile 删除OneDrive上的文件，远端文件不存在时返回utils.ErrNotFound
+func (u *OneDriveUploader) DeleteFile(ctx context.Context, folderPath, fileName string) error {
+	return u.deleteURL(ctx, fmt.Sprintf(fileURLTemplate, folderPath, fileName))
+}
+
+func (u *OneDriveUploader) deleteURL(ctx context.Context, itemURL string) error {
+	req, err := http.NewRequestWithContext(ctx, "DELETE", itemURL, nil)
+	if err != nil {
+		log.Error("创建请求失败: %v", err)
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+u.config.AccessToken)
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		log.Error("发送请求失败: %v", err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: %s", utils.ErrNotFound, itemURL)
+	}
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("删除文件失败，状态码: %d，响应: %s", resp.StatusCode, string(body))
+	}
+
+	return nil
+}
+
+// DownloadFile 下载OneDrive上的文件到本地
+func (u *OneDriveUploader) DownloadFile(ctx context.Context, folderPath, fileName, localFilePath string) error {
+	downloadURL := fmt.Sprintf(downloadURLTemplate, folderPath, fileName)
+
+	log.Info("开始下载文件: %s", downloadURL)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", downloadURL, nil)
+	if err != nil {
+		log.Error("创建请求失败: %v", err)
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+u.config.AccessToken)
+
+	// 大文件下载耗时较长，使用同一个客户端但不设置整体超时，由ctx取消
+	client := *u.client
+	client.Timeout = 0
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Error("发送请求失败: %v", err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: %s", utils.ErrNotFound, fileName)
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		log.Error("下载文件失败，状态码: %d，响应: %s", resp.StatusCode, string(body))
+		return fmt.Errorf("下载文件失败，状态码: %d", resp.StatusCode)
+	}
+
+	file, err := os.Create(localFilePath)
+	if err != nil {
+		log.Error("创建本地文件失败: %v", err)
+		return fmt.Errorf("创建本地文件失败: %w", err)
+	}
+	defer file.Close()
+
+	n, err := io.Copy(file, resp.Body)
+	if err != nil {
+		os.Remove(localFilePath)
+		log.Error("写入本地文件失败: %v", err)
+		return fmt.Errorf("写入本地文件失败: %w", err)
+	}
+
+	log.Info("文件下载完成: %s, %d 字节", localFilePath, n)
+
+	return nil
+}
@@ -0,0 +1,177 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"auto-backup/utils"
+)
+
+// 模拟Graph接口的上传会话、文件信息、删除和下载
+type graphServer struct {
+	mu        sync.Mutex
+	files     map[string][]byte // key: 远端路径
+	items     map[string]string // 文件ID -> 远端路径
+	badHashes int               // 前几次上传完成时返回错误的哈希
+	noHash    bool              // 上传完成的响应中不带哈希，需要重新获取
+	deleted   []string
+	uploads   int
+}
+
+func newGraphServer() *graphServer {
+	return &graphServer{files: make(map[string][]byte), items: make(map[string]string)}
+}
+
+func quickXorHash(data []byte) string {
+	h := utils.NewQuickXorHash()
+	h.Write(data)
+	return utils.QuickXorHashString(h)
+}
+
+func (g *graphServer) item(id string) map[string]any {
+	data := g.files[g.items[id]]
+	return map[string]any{
+		"id":   id,
+		"name": filepath.Base(g.items[id]),
+		"size": len(data),
+		"file": map[string]any{"hashes": map[string]string{"quickXorHash": quickXorHash(data)}},
+	}
+}
+
+func (g *graphServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	p := r.URL.Path
+	const root, items = "/v1.0/me/drive/root:/", "/v1.0/me/drive/items/"
+
+	switch {
+	case r.Method == "POST" && strings.HasSuffix(p, ":/createUploadSession"):
+		remote := strings.TrimSuffix(strings.TrimPrefix(p, root), ":/createUploadSession")
+		json.NewEncoder(w).Encode(UploadSession{UploadURL: "https://upload.example.com/session/" + remote})
+
+	case r.Method == "PUT" && strings.HasPrefix(p, "/session/"):
+		remote := strings.TrimPrefix(p, "/session/")
+		data, _ := io.ReadAll(r.Body)
+		g.uploads++
+		id := fmt.Sprintf("item%d", g.uploads)
+		g.files[remote] = data
+		g.items[id] = remote
+		item := g.item(id)
+		if g.badHashes > 0 {
+			g.badHashes--
+			item["file"] = map[string]any{"hashes": map[string]string{"quickXorHash": quickXorHash([]byte("other"))}}
+		} else if g.noHash {
+			delete(item, "file")
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(item)
+
+	case r.Method == "GET" && strings.HasPrefix(p, items):
+		json.NewEncoder(w).Encode(g.item(strings.TrimPrefix(p, items)))
+
+	case r.Method == "DELETE" && strings.HasPrefix(p, items):
+		id := strings.TrimPrefix(p, items)
+		g.deleted = append(g.deleted, id)
+		delete(g.files, g.items[id])
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == "GET" && strings.HasSuffix(p, ":/content"):
+		data, ok := g.files[strings.TrimSuffix(strings.TrimPrefix(p, root), ":/content")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func TestUploadReader_HashMismatch(t *testing.T) {
+	g := newGraphServer()
+	g.badHashes = 1
+	u := newTestUploader(t, AuthFlowCode, g)
+	data := []byte("part data")
+
+	// 远端哈希不一致时删除上传的文件并返回ErrHashMismatch，由调用方重新上传
+	err := u.UploadReader(context.Background(), "backup", "p.zip", bytes.NewReader(data), int64(len(data)))
+	if !errors.Is(err, utils.ErrHashMismatch) {
+		t.Fatalf("UploadReader() error = %v, want ErrHashMismatch", err)
+	}
+	if strings.Join(g.deleted, ",") != "item1" {
+		t.Errorf("deleted = %v, want [item1]", g.deleted)
+	}
+	if _, ok := g.files["backup/p.zip"]; ok {
+		t.Error("mismatched upload was not removed")
+	}
+
+	if err := u.UploadReader(context.Background(), "backup", "p.zip", bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("second UploadReader() error = %v", err)
+	}
+	if !bytes.Equal(g.files["backup/p.zip"], data) || len(g.deleted) != 1 {
+		t.Errorf("remote = %q, deleted = %v", g.files["backup/p.zip"], g.deleted)
+	}
+}
+
+func TestUploadReader_FetchesMissingHash(t *testing.T) {
+	g := newGraphServer()
+	g.noHash = true
+	u := newTestUploader(t, AuthFlowCode, g)
+	data := []byte("part data")
+
+	if err := u.UploadReader(context.Background(), "backup", "p.zip", bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("UploadReader() error = %v", err)
+	}
+	if len(g.deleted) != 0 {
+		t.Errorf("deleted = %v, want none", g.deleted)
+	}
+}
+
+func TestDownloadFile(t *testing.T) {
+	g := newGraphServer()
+	g.files["backup/p.zip"] = []byte("remote data")
+	u := newTestUploader(t, AuthFlowCode, g)
+	dir := t.TempDir()
+
+	local := filepath.Join(dir, "p.zip")
+	if err := u.DownloadFile(context.Background(), "backup", "p.zip", local); err != nil {
+		t.Fatalf("DownloadFile() error = %v", err)
+	}
+	if data, _ := os.ReadFile(local); string(data) != "remote data" {
+		t.Errorf("downloaded = %q", data)
+	}
+
+	err := u.DownloadFile(context.Background(), "backup", "missing.zip", filepath.Join(dir, "missing.zip"))
+	if !errors.Is(err, utils.ErrNotFound) {
+		t.Errorf("DownloadFile() error = %v, want ErrNotFound", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := u.DownloadFile(ctx, "backup", "p.zip", filepath.Join(dir, "cancelled.zip")); !errors.Is(err, context.Canceled) {
+		t.Errorf("DownloadFile() with cancelled ctx error = %v, want context.Canceled", err)
+	}
+}
+
+func TestDeleteFile(t *testing.T) {
+	g := newGraphServer()
+	u := newTestUploader(t, AuthFlowCode, g)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := u.DeleteFile(ctx, "backup", "p.zip"); !errors.Is(err, context.Canceled) {
+		t.Errorf("DeleteFile() with cancelled ctx error = %v, want context.Canceled", err)
+	}
+}
@@ -1,7 +1,18 @@
 package uploader
 
+import (
+	"context"
+	"io"
+)
+
 // Uploader 定义了文件上传器的接口
 type Uploader interface {
-	// UploadBigFile 上传大文件
-	UploadBigFile(folderPath, localFilePath string) error
+	// UploadBigFile 上传大文件，ctx取消时中止上传并取消上传会话
+	UploadBigFile(ctx context.Context, folderPath, localFilePath string) error
+	// UploadReader 上传r中size字节的数据作为远端文件fileName，不需要本地文件
+	UploadReader(ctx context.Context, folderPath, fileName string, r io.ReaderAt, size int64) error
+	// DownloadFile 下载远端文件到本地路径，远端文件不存在时返回utils.ErrNotFound，ctx取消时中止下载
+	DownloadFile(ctx context.Context, folderPath, fileName, localFilePath string) error
+	// DeleteFile 删除远端文件，远端文件不存在时返回utils.ErrNotFound
+	DeleteFile(ctx context.Context, folderPath, fileName string) error
 }
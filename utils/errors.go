@@ -9,4 +9,7 @@ var (
 	ErrDeleteFailed   = errors.New("delete failed")
 	ErrListFailed     = errors.New("list failed")
 	ErrNotImplemented = errors.New("not implemented")
+	ErrHashMismatch   = errors.New("hash mismatch")
+	ErrNotFound       = errors.New("not found")
+	ErrLocked         = errors.New("locked")
 )
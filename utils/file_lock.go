@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// FileLock 进程间的文件锁(Unix上使用flock，Windows上使用LockFileEx)，进程退出时由系统自动释放
+type FileLock struct {
+	f *os.File
+}
+
+// TryLockFile 以非阻塞方式对path加排他锁，文件不存在时创建，并写入当前进程的PID。
+// 锁已被其他进程持有时返回包含ErrLocked的错误
+func TryLockFile(path string) (*FileLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("打开锁文件失败: %v", err)
+	}
+
+	if err := lockFile(f); err != nil {
+		defer f.Close()
+		if errors.Is(err, ErrLocked) {
+			if pid := lockOwner(f); pid > 0 {
+				return nil, fmt.Errorf("%w: 被进程%d持有", ErrLocked, pid)
+			}
+			return nil, ErrLocked
+		}
+		return nil, fmt.Errorf("加锁失败: %v", err)
+	}
+
+	// 记录持有者便于排查，写入失败不影响加锁结果
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return &FileLock{f: f}, nil
+}
+
+// 读取锁文件中记录的持有者PID，无法读取时返回0
+func lockOwner(f *os.File) int {
+	buf := make([]byte, 32)
+	n, _ := f.ReadAt(buf, 0)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(buf[:n])))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
+
+// Unlock 释放锁，锁文件保留供下次使用
+func (l *FileLock) Unlock() error {
+	// 先清空PID再解锁，关闭文件时锁会一起释放
+	l.f.Truncate(0)
+	return l.f.Close()
+}
@@ -0,0 +1,10 @@
+//go:build !unix && !windows
+
+package utils
+
+import "os"
+
+// 不支持文件锁的平台上不加锁，同一任务的多个进程需要自行避免同时运行
+func lockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,30 @@
+package utils
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestTryLockFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "job.lock")
+
+	lock, err := TryLockFile(path)
+	if err != nil {
+		t.Fatalf("TryLockFile() error = %v", err)
+	}
+
+	// flock按打开的文件加锁，同一进程再次打开也会冲突
+	if _, err := TryLockFile(path); !errors.Is(err, ErrLocked) {
+		t.Fatalf("TryLockFile() error = %v, 期望ErrLocked", err)
+	}
+
+	if err := lock.Unlock(); err != nil {
+		t.Fatalf("Unlock() error = %v", err)
+	}
+	lock, err = TryLockFile(path)
+	if err != nil {
+		t.Fatalf("解锁后TryLockFile() error = %v", err)
+	}
+	lock.Unlock()
+}
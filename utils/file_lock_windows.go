@@ -0,0 +1,22 @@
+//go:build windows
+
+package utils
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// 以非阻塞方式加排他锁，锁已被其他进程持有时返回ErrLocked。
+// 锁定文件末尾之后的一个字节，其他进程仍然可以读取文件中记录的PID
+func lockFile(f *os.File) error {
+	ol := &windows.Overlapped{Offset: 0, OffsetHigh: 1}
+	err := windows.LockFileEx(windows.Handle(f.Fd()),
+		windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, ol)
+	if errors.Is(err, windows.ERROR_LOCK_VIOLATION) {
+		return ErrLocked
+	}
+	return err
+}
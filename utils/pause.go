@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"context"
+	"sync"
+)
+
+// PauseGate 暂停开关，暂停期间Wait会一直阻塞到恢复或ctx取消
+type PauseGate struct {
+	mu      sync.Mutex
+	resumed chan struct{} // 暂停时为未关闭的通道，恢复时关闭
+}
+
+// NewPauseGate 创建未暂停的开关
+func NewPauseGate() *PauseGate {
+	return &PauseGate{}
+}
+
+// Pause 暂停，已经暂停时不做处理
+func (g *PauseGate) Pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resumed == nil {
+		g.resumed = make(chan struct{})
+	}
+}
+
+// Resume 恢复，唤醒所有等待的调用方
+func (g *PauseGate) Resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resumed != nil {
+		close(g.resumed)
+		g.resumed = nil
+	}
+}
+
+// Paused 是否处于暂停状态
+func (g *PauseGate) Paused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.resumed != nil
+}
+
+// Wait 暂停时等待恢复，ctx取消时返回ctx的错误
+func (g *PauseGate) Wait(ctx context.Context) error {
+	g.mu.Lock()
+	resumed := g.resumed
+	g.mu.Unlock()
+
+	if resumed != nil {
+		select {
+		case <-resumed:
+		case <-ctx.Done():
+		}
+	}
+	return ctx.Err()
+}
+
+type pauseGateKey struct{}
+
+// WithPauseGate 返回携带暂停开关的ctx，读取和上传在每一块数据之前通过WaitIfPaused检查
+func WithPauseGate(ctx context.Context, g *PauseGate) context.Context {
+	return context.WithValue(ctx, pauseGateKey{}, g)
+}
+
+// WaitIfPaused ctx中的暂停开关处于暂停状态时等待恢复，返回ctx的错误
+func WaitIfPaused(ctx context.Context) error {
+	if g, ok := ctx.Value(pauseGateKey{}).(*PauseGate); ok {
+		return g.Wait(ctx)
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPauseGate(t *testing.T) {
+	gate := NewPauseGate()
+	ctx := WithPauseGate(context.Background(), gate)
+
+	if err := WaitIfPaused(ctx); err != nil {
+		t.Fatalf("未暂停时WaitIfPaused() error = %v", err)
+	}
+
+	gate.Pause()
+	done := make(chan error, 1)
+	go func() { done <- WaitIfPaused(ctx) }()
+
+	select {
+	case <-done:
+		t.Fatal("暂停时WaitIfPaused()不应返回")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	gate.Resume()
+	if err := <-done; err != nil {
+		t.Fatalf("恢复后WaitIfPaused() error = %v", err)
+	}
+
+	// 暂停期间取消时返回ctx的错误
+	gate.Pause()
+	cctx, cancel := context.WithCancel(ctx)
+	go func() { done <- WaitIfPaused(cctx) }()
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("取消后WaitIfPaused() error = %v, 期望context.Canceled", err)
+	}
+}
@@ -0,0 +1,77 @@
+package utils
+
+import (
+	"encoding/base64"
+	"hash"
+)
+
+// quickXorHash 是OneDrive使用的文件哈希算法
+// 参考: https://learn.microsoft.com/onedrive/developer/code-snippets/quickxorhash
+//
+// 每个输入字节按位置循环左移 11*i 位后异或到160位的结果中，
+// 由于位移以 160*11 字节为周期，可以先按周期异或累加，求和时再统一位移
+const (
+	quickXorSize     = 20
+	quickXorShift    = 11
+	quickXorWidth    = 8 * quickXorSize
+	quickXorDataSize = quickXorShift * quickXorWidth
+)
+
+type quickXorHash struct {
+	data [quickXorDataSize]byte
+	size uint64
+}
+
+// NewQuickXorHash 创建OneDrive quickXorHash计算器
+func NewQuickXorHash() hash.Hash {
+	return &quickXorHash{}
+}
+
+// QuickXorHashString 返回与OneDrive接口一致的base64编码结果
+func QuickXorHashString(h hash.Hash) string {
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func (q *quickXorHash) Write(p []byte) (int, error) {
+	offset := int(q.size % quickXorDataSize)
+	for _, b := range p {
+		q.data[offset] ^= b
+		offset++
+		if offset == quickXorDataSize {
+			offset = 0
+		}
+	}
+	q.size += uint64(len(p))
+	return len(p), nil
+}
+
+func (q *quickXorHash) Sum(b []byte) []byte {
+	var h [quickXorSize + 1]byte
+	for i := 0; i < quickXorDataSize; i++ {
+		shift := (i * quickXorShift) % quickXorWidth
+		shifted := int(q.data[i]) << (shift % 8)
+		h[shift/8] ^= byte(shifted)
+		h[shift/8+1] ^= byte(shifted >> 8)
+	}
+	// 超出160位的部分回绕到开头
+	h[0] ^= h[quickXorSize]
+
+	// 将数据长度以小端序异或到最后8个字节
+	for i := 0; i < 8; i++ {
+		h[quickXorSize-8+i] ^= byte(q.size >> (8 * i))
+	}
+
+	return append(b, h[:quickXorSize]...)
+}
+
+func (q *quickXorHash) Reset() {
+	*q = quickXorHash{}
+}
+
+func (q *quickXorHash) Size() int {
+	return quickXorSize
+}
+
+func (q *quickXorHash) BlockSize() int {
+	return 64
+}
@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"encoding/base64"
+	"math/rand"
+	"testing"
+)
+
+// 按算法定义逐位计算的参考实现
+func referenceQuickXorHash(data []byte) []byte {
+	var bits [160]byte
+	for i, b := range data {
+		shift := (i * 11) % 160
+		for j := 0; j < 8; j++ {
+			bits[(shift+j)%160] ^= (b >> j) & 1
+		}
+	}
+
+	out := make([]byte, 20)
+	for i, bit := range bits {
+		out[i/8] |= bit << (i % 8)
+	}
+	length := uint64(len(data))
+	for i := 0; i < 8; i++ {
+		out[12+i] ^= byte(length >> (8 * i))
+	}
+	return out
+}
+
+func TestQuickXorHash_KnownValues(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"", "AAAAAAAAAAAAAAAAAAAAAAAAAAA="},
+		{"J", "SgAAAAAAAAAAAAAAAQAAAAAAAAA="},
+	}
+
+	for _, tt := range tests {
+		h := NewQuickXorHash()
+		h.Write([]byte(tt.input))
+		if got := QuickXorHashString(h); got != tt.want {
+			t.Errorf("QuickXorHash(%q) = %s, want %s", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestQuickXorHash_MatchesReference(t *testing.T) {
+	data := make([]byte, 3*quickXorDataSize+123)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	// 分多次写入，结果应与一次性计算一致
+	h := NewQuickXorHash()
+	for start := 0; start < len(data); start += 1000 {
+		end := min(start+1000, len(data))
+		h.Write(data[start:end])
+	}
+
+	want := base64.StdEncoding.EncodeToString(referenceQuickXorHash(data))
+	if got := QuickXorHashString(h); got != want {
+		t.Fatalf("QuickXorHash = %s, want %s", got, want)
+	}
+}